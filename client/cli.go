@@ -0,0 +1,151 @@
+package main
+
+import (
+	packet "EternalPacket"
+	"encoding/json"
+	"errors"
+	"eternalStorageClient/logger"
+	"eternalStorageClient/tcp"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// errHelp - "-h" was asked for, usage is already printed
+var errHelp = flag.ErrHelp
+
+// usageError - bad flags or arguments
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+// cli - flags every command has and the connection they share
+type cli struct {
+	addr    string
+	cert    string
+	user    string
+	ns      string
+	codec   string
+	json    bool
+	verbose bool
+
+	stdout io.Writer
+	stderr io.Writer
+	dialer *tcp.DialerTCP
+}
+
+// flagSet returns the flags of a command with the common ones registered
+func (c *cli) flagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(c.stderr, "usage: eternal %s [flags] %s\n\nflags:\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&c.addr, "addr", envOr("ETERNAL_ADDR", "localhost:8080"), "service address (ETERNAL_ADDR)")
+	fs.StringVar(&c.cert, "cert", envOr("ETERNAL_CERT", "server.crt"), "trusted server certificate (ETERNAL_CERT)")
+	fs.StringVar(&c.user, "user", os.Getenv("ETERNAL_USER"), "user name (ETERNAL_USER)")
+	fs.StringVar(&c.ns, "ns", "", "namespace of another user, shared with you")
+	fs.StringVar(&c.codec, "codec", "gzip", "gzip/zlib/snappy/none")
+	fs.BoolVar(&c.json, "json", false, "machine-readable output, -v logs as JSON too")
+	fs.BoolVar(&c.verbose, "v", false, "log transfers to stderr")
+	return fs
+}
+
+// parse parses flags and checks the number of positional arguments,
+// max < 0 - no limit
+func (c *cli) parse(fs *flag.FlagSet, args []string, min, max int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil, errHelp
+		}
+		return nil, &usageError{msg: err.Error()}
+	}
+
+	rest := fs.Args()
+	if len(rest) < min || (max >= 0 && len(rest) > max) {
+		fs.Usage()
+		return nil, &usageError{msg: fmt.Sprintf("%s: wrong number of arguments", fs.Name())}
+	}
+
+	packet.SetLogger(nil)
+	if c.verbose {
+		l := logger.New(logger.Options{Output: c.stderr, Level: slog.LevelDebug, JSON: c.json})
+		packet.SetLogger(l.Logger)
+	}
+	return rest, nil
+}
+
+// connect dials the server once per run
+func (c *cli) connect() (*tcp.DialerTCP, error) {
+	if c.dialer != nil {
+		return c.dialer, nil
+	}
+	if c.user == "" {
+		return nil, &usageError{msg: "user is not set, use -user or ETERNAL_USER"}
+	}
+
+	tlsConfig, err := packet.LoadClientTLS(c.cert)
+	if err != nil {
+		return nil, err
+	}
+	dialer, err := tcp.NewDialerTLS(c.addr, tlsConfig, c.user, os.Getenv("ETERNAL_SECRET"))
+	if err != nil {
+		return nil, err
+	}
+	dialer.Namespace = c.ns
+	c.dialer = dialer
+	return dialer, nil
+}
+
+func (c *cli) close() {
+	if c.dialer != nil {
+		_ = c.dialer.Close()
+	}
+}
+
+// print writes v as JSON with -json, otherwise calls text
+func (c *cli) print(v any, text func(w io.Writer)) error {
+	if !c.json {
+		text(c.stdout)
+		return nil
+	}
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// fail reports err, as a JSON object on stdout with -json
+func (c *cli) fail(err error) {
+	if !c.json {
+		fmt.Fprintln(c.stderr, "eternal:", err)
+		return
+	}
+
+	out := struct {
+		Error string `json:"error"`
+		// Reason - packet.ErrorCode of the error, e.g. "quota_exceeded"
+		Reason string `json:"reason,omitempty"`
+		Status int    `json:"status,omitempty"`
+		Code   int    `json:"exit_code"`
+	}{Error: err.Error(), Reason: packet.ErrorCode(err), Code: exitCode(err)}
+	var respErr *packet.ResponseError
+	if errors.As(err, &respErr) {
+		out.Status = respErr.Status
+	}
+	_ = json.NewEncoder(c.stdout).Encode(out)
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
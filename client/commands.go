@@ -0,0 +1,500 @@
+package main
+
+import (
+	packet "EternalPacket"
+	"context"
+	"encoding/json"
+	"eternalStorageClient/dirsync"
+	"eternalStorageClient/tcp"
+	"eternalStorageClient/watch"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+var codecs = map[string]bool{"gzip": true, "zlib": true, "snappy": true, "none": true}
+
+func runPut(c *cli, args []string) error {
+	fs := c.flagSet("put", "<file>...")
+	as := fs.String("as", "", "stored path, only with one file (default: file name)")
+	ttl := fs.Duration("ttl", 0, "remove the file from the server after this time, e.g. 336h")
+	delta := fs.Bool("delta", true, "send only changed blocks of files the server already has")
+	files, err := c.parse(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+	if *as != "" && len(files) > 1 {
+		return &usageError{msg: "put: -as needs exactly one file"}
+	}
+	if !codecs[c.codec] {
+		return &usageError{msg: fmt.Sprintf("put: unknown codec %q", c.codec)}
+	}
+
+	d, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	stored := make([]packet.FileInfo, 0, len(files))
+	for _, file := range files {
+		info, stats, err := c.put(d, file, *as, int64(ttl.Seconds()), *delta)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		stored = append(stored, *info)
+		if c.json {
+			continue
+		}
+		fmt.Fprintf(c.stdout, "%s -> %s (%d bytes, version %d", file, info.Path, info.Size, info.Version)
+		if stats != nil {
+			fmt.Fprintf(c.stdout, ", delta: %d bytes sent", stats.Literal)
+		}
+		fmt.Fprintln(c.stdout, ")")
+	}
+	if c.json {
+		return c.print(stored, nil)
+	}
+	return nil
+}
+
+func (c *cli) put(d *tcp.DialerTCP, file, remote string, ttl int64, delta bool) (*packet.FileInfo, *packet.DeltaStats, error) {
+	if delta {
+		return d.PutDelta(file, remote, c.codec, ttl)
+	}
+	pack, err := packet.NewTCPPacket(file, c.codec)
+	if err != nil {
+		return nil, nil, err
+	}
+	pack.MetaData.TTL = ttl
+	info, err := d.Put(pack, remote)
+	return info, nil, err
+}
+
+// download - result of get
+type download struct {
+	Remote string `json:"remote"`
+	Local  string `json:"local"`
+	Hash   string `json:"hash"`
+	Size   int64  `json:"size"`
+	// Skipped - local file existed and -conflict skip kept it
+	Skipped bool `json:"skipped,omitempty"`
+	// Resumed - bytes of an interrupted -resume download that were reused
+	Resumed int64 `json:"resumed,omitempty"`
+}
+
+func runGet(c *cli, args []string) error {
+	fs := c.flagSet("get", "<path | hash>")
+	out := fs.String("o", "", "output file (default: base name of the stored path)")
+	version := fs.Int("version", 0, "version to download, 0 - current (see stat -versions)")
+	byHash := fs.Bool("hash", false, "argument is a sha256 of the content, not a path")
+	conflict := fs.String("conflict", "overwrite", "if the output file exists: overwrite, rename, skip or fail")
+	resume := fs.Bool("resume", false, "download in verified ranges, continue an interrupted one (<output>.part)")
+	rest, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	remote := rest[0]
+
+	if !codecs[c.codec] {
+		return &usageError{msg: fmt.Sprintf("get: unknown codec %q", c.codec)}
+	}
+	policy, err := packet.ParseConflictPolicy(*conflict)
+	if err != nil {
+		return &usageError{msg: "get: " + err.Error()}
+	}
+	if *resume && policy != packet.ConflictOverwrite {
+		return &usageError{msg: "get: -resume only writes with -conflict overwrite"}
+	}
+
+	local := *out
+	if local == "" {
+		// stored names can be fine on the server and not here ("..", "CON")
+		local = path.Base(remote)
+		if err := packet.CheckFileName(local); err != nil {
+			return &usageError{msg: fmt.Sprintf("get: %v, choose a name with -o", err)}
+		}
+	}
+
+	d, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	req := &packet.Request{Path: remote, Version: *version, CompressType: c.codec}
+	if *byHash {
+		req.Path, req.Hash = "", remote
+	}
+	if *resume {
+		info, resumed, err := d.Download(req, local)
+		if err != nil {
+			return err
+		}
+		result := download{Remote: remote, Local: local, Hash: info.Hash, Size: info.Size, Resumed: resumed}
+		return c.print(result, func(w io.Writer) {
+			fmt.Fprintf(w, "%s -> %s (%d bytes, %d resumed)\n", remote, filepath.Clean(local), result.Size, resumed)
+		})
+	}
+	pack, written, err := d.GetTo(req, local, policy)
+	if err != nil {
+		return err
+	}
+	if written == "" {
+		result := download{Remote: remote, Local: local, Skipped: true}
+		return c.print(result, func(w io.Writer) {
+			fmt.Fprintf(w, "%s exists, skipped\n", filepath.Clean(local))
+		})
+	}
+	local = written
+
+	result := download{Remote: remote, Local: local, Hash: pack.MetaData.FileHash, Size: pack.MetaData.Size}
+	return c.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "%s -> %s (%d bytes)\n", remote, filepath.Clean(local), result.Size)
+	})
+}
+
+func runList(c *cli, args []string) error {
+	fs := c.flagSet("ls", "[dir]")
+	rest, err := c.parse(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+	dir := ""
+	if len(rest) == 1 {
+		dir = rest[0]
+	}
+
+	d, err := c.connect()
+	if err != nil {
+		return err
+	}
+	files, err := d.List(dir)
+	if err != nil {
+		return err
+	}
+
+	return c.print(files, func(w io.Writer) {
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, file := range files {
+			name := path.Base(file.Path)
+			if file.IsDir {
+				name += "/"
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", file.Mode, file.Size, file.Modified.Local().Format(time.DateTime), name)
+		}
+		_ = tw.Flush()
+	})
+}
+
+func runRemove(c *cli, args []string) error {
+	fs := c.flagSet("rm", "<path>...")
+	paths, err := c.parse(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	d, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	removed := make([]string, 0, len(paths))
+	for _, remote := range paths {
+		if err := d.Delete(remote); err != nil {
+			return err
+		}
+		removed = append(removed, remote)
+		if !c.json {
+			fmt.Fprintln(c.stdout, "removed", remote)
+		}
+	}
+	if c.json {
+		return c.print(struct {
+			Removed []string `json:"removed"`
+		}{removed}, nil)
+	}
+	return nil
+}
+
+func runStat(c *cli, args []string) error {
+	fs := c.flagSet("stat", "<path>")
+	versions := fs.Bool("versions", false, "list all stored versions, newest first")
+	rest, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	d, err := c.connect()
+	if err != nil {
+		return err
+	}
+
+	if *versions {
+		history, err := d.Versions(rest[0])
+		if err != nil {
+			return err
+		}
+		return c.print(history, func(w io.Writer) {
+			tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+			for _, version := range history {
+				current := ""
+				if version.Current {
+					current = "current"
+				}
+				fmt.Fprintf(tw, "%d\t%d\t%s\t%s\t%s\n", version.Version, version.Size,
+					version.Modified.Local().Format(time.DateTime), version.Hash, current)
+			}
+			_ = tw.Flush()
+		})
+	}
+
+	file, err := d.Stat(rest[0])
+	if err != nil {
+		return err
+	}
+	return c.print(file, func(w io.Writer) {
+		fmt.Fprintf(w, "path:     %s\n", file.Path)
+		fmt.Fprintf(w, "size:     %d\n", file.Size)
+		fmt.Fprintf(w, "mode:     %s\n", file.Mode)
+		fmt.Fprintf(w, "modified: %s\n", file.Modified.Local().Format(time.RFC3339))
+		fmt.Fprintf(w, "version:  %d\n", file.Version)
+		fmt.Fprintf(w, "sha256:   %s\n", file.Hash)
+		if file.Expires != nil {
+			fmt.Fprintf(w, "expires:  %s\n", file.Expires.Local().Format(time.RFC3339))
+		}
+	})
+}
+
+func runRestore(c *cli, args []string) error {
+	fs := c.flagSet("restore", "<path>")
+	version := fs.Int("version", 0, "version to make current (see stat -versions)")
+	rest, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if *version <= 0 {
+		return &usageError{msg: "restore: -version is required"}
+	}
+
+	d, err := c.connect()
+	if err != nil {
+		return err
+	}
+	file, err := d.Restore(rest[0], *version)
+	if err != nil {
+		return err
+	}
+	return c.print(file, func(w io.Writer) {
+		fmt.Fprintf(w, "restored %s version %d (%d bytes)\n", file.Path, *version, file.Size)
+	})
+}
+
+// share - a grant the share command made
+type share struct {
+	Path string `json:"path"`
+	User string `json:"user"`
+	Perm string `json:"perm"`
+}
+
+func runShare(c *cli, args []string) error {
+	fs := c.flagSet("share", "<path> <user>")
+	perm := fs.String("perm", "r", `permissions to grant: r(ead), w(rite), d(elete), s(hare), "-" revokes`)
+	rest, err := c.parse(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+	if *perm == "" || *perm != "-" && strings.Trim(*perm, "rwds") != "" {
+		return &usageError{msg: fmt.Sprintf("share: bad -perm %q, use letters of rwds or -", *perm)}
+	}
+
+	d, err := c.connect()
+	if err != nil {
+		return err
+	}
+	if err := d.Share(rest[0], rest[1], *perm); err != nil {
+		return err
+	}
+	result := share{Path: rest[0], User: rest[1], Perm: *perm}
+	return c.print(result, func(w io.Writer) {
+		if result.Perm == "-" {
+			fmt.Fprintf(w, "revoked %s on %s\n", result.User, result.Path)
+			return
+		}
+		fmt.Fprintf(w, "shared %s with %s: %s\n", result.Path, result.User, result.Perm)
+	})
+}
+
+func runWatch(c *cli, args []string) error {
+	fs := c.flagSet("watch", "<dir>")
+	to := fs.String("to", "", "stored directory (default: name of dir)")
+	state := fs.String("state", "", "state DB file (default: "+watch.StateFile+" in dir)")
+	debounce := fs.Duration("debounce", watch.DefaultDebounce, "upload after a file didn't change for this long")
+	ttl := fs.Duration("ttl", 0, "remove the files from the server after this time, e.g. 336h")
+	metrics := fs.String("metrics", "", "serve Prometheus metrics on this address under /metrics")
+	rest, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if !codecs[c.codec] {
+		return &usageError{msg: fmt.Sprintf("watch: unknown codec %q", c.codec)}
+	}
+
+	dir, err := filepath.Abs(rest[0])
+	if err != nil {
+		return err
+	}
+	remote := *to
+	if remote == "" {
+		remote = filepath.Base(dir)
+	}
+
+	enc := json.NewEncoder(c.stdout)
+	opts := watch.Options{
+		Remote:   remote,
+		State:    *state,
+		Codec:    c.codec,
+		TTL:      int64(ttl.Seconds()),
+		Debounce: *debounce,
+		OnEvent: func(e watch.Event) {
+			switch {
+			case c.json:
+				_ = enc.Encode(e)
+			case e.Op == "put":
+				fmt.Fprintf(c.stdout, "put %s -> %s (version %d, %d of %d bytes sent)\n", e.Path, e.Remote, e.Version, e.Sent, e.Size)
+			case e.Op == "delete":
+				fmt.Fprintf(c.stdout, "deleted %s\n", e.Remote)
+			default:
+				fmt.Fprintf(c.stderr, "eternal: %s: %s\n", e.Path, e.Error)
+			}
+		},
+	}
+	// a new connection after the old one failed
+	connect := func() (watch.Client, error) {
+		c.close()
+		c.dialer = nil
+		return c.connect()
+	}
+
+	w, err := watch.New(dir, opts, connect)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	metricsErr := make(chan error, 1)
+	if *metrics != "" {
+		go func() {
+			metricsErr <- fmt.Errorf("metrics: %w", packet.ServeMetrics(*metrics, newRegistry()))
+			stop()
+		}()
+	}
+	if err := w.Run(ctx); err != nil {
+		return err
+	}
+	select {
+	case err := <-metricsErr:
+		return err
+	default:
+		return nil
+	}
+}
+
+// newRegistry - metrics of a watching client: transfers, connections
+// and the Go runtime of the process
+func newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(packet.Collectors()...)
+	reg.MustRegister(tcp.Collectors()...)
+	reg.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return reg
+}
+
+func runSync(c *cli, args []string) error {
+	fs := c.flagSet("sync", "<dir>")
+	to := fs.String("to", "", "stored directory (default: name of dir)")
+	state := fs.String("state", "", "state DB file (default: "+dirsync.StateFile+" in dir)")
+	dryRun := fs.Bool("n", false, "only show what would be done")
+	rest, err := c.parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+	if !codecs[c.codec] {
+		return &usageError{msg: fmt.Sprintf("sync: unknown codec %q", c.codec)}
+	}
+
+	dir, err := filepath.Abs(rest[0])
+	if err != nil {
+		return err
+	}
+	remote := *to
+	if remote == "" {
+		remote = filepath.Base(dir)
+	}
+
+	enc := json.NewEncoder(c.stdout)
+	opts := dirsync.Options{
+		Remote: remote,
+		State:  *state,
+		Codec:  c.codec,
+		DryRun: *dryRun,
+		OnEvent: func(e dirsync.Event) {
+			switch {
+			case c.json:
+				_ = enc.Encode(e)
+			case e.Op == dirsync.OpConflict:
+				fmt.Fprintf(c.stdout, "conflict %s, local copy kept as %s\n", e.Path, e.Conflict)
+			case e.Op == dirsync.OpError:
+				fmt.Fprintf(c.stderr, "eternal: %s: %s\n", e.Path, e.Error)
+			default:
+				fmt.Fprintf(c.stdout, "%s %s\n", e.Op, e.Path)
+			}
+		},
+	}
+
+	client, err := c.connect()
+	if err != nil {
+		return err
+	}
+	result, err := dirsync.Sync(dir, client, opts)
+	printErr := c.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "%d uploaded, %d downloaded, %d deleted, %d conflicts, %d failed\n",
+			result.Uploaded, result.Downloaded, result.Deleted, result.Conflicts, result.Failed)
+	})
+	if err != nil {
+		return err
+	}
+	return printErr
+}
+
+// s3Key - credentials of the S3 endpoint of the server
+type s3Key struct {
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+}
+
+func runS3Key(c *cli, args []string) error {
+	fs := c.flagSet("s3-key", "")
+	if _, err := c.parse(fs, args, 0, 0); err != nil {
+		return err
+	}
+	if c.user == "" {
+		return &usageError{msg: "user is not set, use -user or ETERNAL_USER"}
+	}
+	// derived here from the secret, the server never sends it
+	key, err := packet.DeriveAuthKey(c.user, os.Getenv("ETERNAL_SECRET"))
+	if err != nil {
+		return &usageError{msg: "s3-key: " + err.Error() + ", set ETERNAL_SECRET"}
+	}
+	result := s3Key{AccessKey: c.user, SecretKey: packet.S3SecretKey(key)}
+	return c.print(result, func(w io.Writer) {
+		fmt.Fprintf(w, "access key: %s\nsecret key: %s\n", result.AccessKey, result.SecretKey)
+	})
+}
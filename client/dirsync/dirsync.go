@@ -0,0 +1,495 @@
+// Package dirsync keeps a local directory and a stored directory in sync
+// in both directions.
+//
+// Every file is compared in three versions by hash: local, stored and
+// the one both sides had after the last sync (the state DB). A side that
+// differs from the last sync has changed and its change is copied to the
+// other side. When both changed, the stored file keeps its name locally
+// and the local one is kept next to it with a conflict suffix.
+package dirsync
+
+import (
+	packet "EternalPacket"
+	"errors"
+	"eternalStorageClient/watch"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StateFile - default name of the last-synced state, kept in the directory
+const StateFile = ".eternal-sync.json"
+
+// files named .eternal-* (state DBs, unfinished downloads) are never synced
+const reservedPrefix = ".eternal-"
+
+// reserved - names of the syncer's own files, also the temporary files
+// packet writes a download through before it lands under its tmp name
+func reserved(name string) bool {
+	return strings.HasPrefix(name, reservedPrefix) || strings.HasPrefix(name, "."+reservedPrefix)
+}
+
+// Client - what sync needs from a connection, *tcp.DialerTCP
+type Client interface {
+	List(dir string) ([]packet.FileInfo, error)
+	Get(remotePath string, version int, localPath, compressType string) (*packet.TCPPacket, error)
+	PutDeltaIf(localPath, remotePath, compressType string, ttl int64, ifMatch string) (*packet.FileInfo, *packet.DeltaStats, error)
+	DeleteIf(remotePath, ifMatch string) error
+}
+
+type Options struct {
+	// Remote - stored directory, "" - the namespace root
+	Remote string
+	// State - state DB path, default StateFile in the directory
+	State string
+	// Codec - compression of full uploads and downloads
+	Codec string
+	// Host is put into names of conflict copies, default os.Hostname
+	Host string
+	// DryRun only reports what would be done
+	DryRun bool
+	// OnEvent is called for every change and failure
+	OnEvent func(Event)
+}
+
+// Event ops
+const (
+	OpUpload       = "upload"
+	OpDownload     = "download"
+	OpDeleteLocal  = "delete-local"
+	OpDeleteRemote = "delete-remote"
+	OpConflict     = "conflict"
+	OpError        = "error"
+)
+
+// Event - one change sync made (or would make with DryRun)
+type Event struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Conflict - name the local copy got, for OpConflict
+	Conflict string `json:"conflict,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Result - number of changes in each direction and failures
+type Result struct {
+	Uploaded   int `json:"uploaded"`
+	Downloaded int `json:"downloaded"`
+	Deleted    int `json:"deleted"`
+	Conflicts  int `json:"conflicts"`
+	Failed     int `json:"failed"`
+}
+
+type localFile struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+type syncer struct {
+	dir    string
+	opts   Options
+	client Client
+	state  *watch.State
+	local  map[string]localFile
+	remote map[string]packet.FileInfo
+	result Result
+	failed []error
+}
+
+// Sync runs one synchronization of dir, the returned error joins
+// failures of single files, the rest is synced anyway
+func Sync(dir string, client Client, opts Options) (Result, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return Result{}, err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return Result{}, err
+	}
+	if opts.State == "" {
+		opts.State = filepath.Join(dir, StateFile)
+	}
+	if opts.Host == "" {
+		opts.Host, _ = os.Hostname()
+	}
+	if opts.OnEvent == nil {
+		opts.OnEvent = func(Event) {}
+	}
+	opts.Remote = strings.Trim(path.Clean("/"+opts.Remote), "/")
+
+	state, err := watch.LoadState(opts.State, opts.Remote)
+	if err != nil {
+		return Result{}, err
+	}
+	s := &syncer{dir: dir, opts: opts, client: client, state: state}
+
+	if err := s.scanLocal(); err != nil {
+		return Result{}, err
+	}
+	if err := s.scanRemote(); err != nil {
+		return Result{}, err
+	}
+
+	for _, rel := range s.paths() {
+		if err := s.syncFile(rel); err != nil {
+			s.fail(rel, err)
+		}
+	}
+
+	if !opts.DryRun {
+		if err := state.Save(); err != nil {
+			s.failed = append(s.failed, err)
+		}
+	}
+	return s.result, errors.Join(s.failed...)
+}
+
+func (s *syncer) fail(rel string, err error) {
+	s.result.Failed++
+	s.opts.OnEvent(Event{Op: OpError, Path: rel, Error: err.Error()})
+	s.failed = append(s.failed, fmt.Errorf("%s: %w", rel, err))
+}
+
+// checkRel - rel is a relative slash path of names that are safe to
+// create on any system, so it stays inside the directory, see
+// packet.CheckFileName. Listed names and the state DB come from outside.
+func checkRel(rel string) error {
+	for _, name := range strings.Split(rel, "/") {
+		if err := packet.CheckFileName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncFile decides what happened to rel since the last sync
+func (s *syncer) syncFile(rel string) error {
+	local, hasLocal := s.local[rel]
+	remote, hasRemote := s.remote[rel]
+	base, hasBase := s.state.Files[rel]
+
+	localHash, remoteHash, baseHash := "", "", ""
+	if hasLocal {
+		localHash = local.hash
+	}
+	if hasRemote {
+		remoteHash = remote.Hash
+	}
+	if hasBase {
+		baseHash = base.Hash
+	}
+
+	switch {
+	case localHash == remoteHash:
+		// same on both sides (or gone from both)
+		if hasLocal {
+			s.remember(rel, local, remote.Version)
+		} else {
+			delete(s.state.Files, rel)
+		}
+		return nil
+	case remoteHash == baseHash:
+		// only the local copy changed
+		if !hasLocal {
+			return s.deleteRemote(rel, remote)
+		}
+		return s.upload(rel, local, remoteHash)
+	case localHash == baseHash:
+		// only the stored copy changed
+		if !hasRemote {
+			return s.deleteLocal(rel, local)
+		}
+		return s.download(rel, remote, hasLocal, local)
+	case !hasLocal:
+		// deleted here, changed there - the change wins
+		return s.download(rel, remote, false, local)
+	case !hasRemote:
+		return s.upload(rel, local, "")
+	default:
+		return s.conflict(rel, local, remote)
+	}
+}
+
+// upload stores the local file target, remoteHash - what the server
+// must still have, "" - nothing
+func (s *syncer) upload(target string, local localFile, remoteHash string) error {
+	s.opts.OnEvent(Event{Op: OpUpload, Path: target})
+	s.result.Uploaded++
+	if s.opts.DryRun {
+		return nil
+	}
+
+	ifMatch := remoteHash
+	if ifMatch == "" {
+		ifMatch = packet.MatchNone
+	}
+	file, _, err := s.client.PutDeltaIf(s.localPath(target), s.remotePath(target), s.opts.Codec, 0, ifMatch)
+	if err != nil {
+		return conflictErr(err)
+	}
+	if file.Hash != local.hash {
+		// changed while it was uploaded, next sync sends it again
+		return fmt.Errorf("%s changed during upload", target)
+	}
+	s.remember(target, local, file.Version)
+	return nil
+}
+
+// download replaces the local file, which must still be the one
+// scanned (or missing), by the stored one
+func (s *syncer) download(rel string, remote packet.FileInfo, hasLocal bool, local localFile) error {
+	s.opts.OnEvent(Event{Op: OpDownload, Path: rel})
+	s.result.Downloaded++
+	if s.opts.DryRun {
+		return nil
+	}
+
+	target := s.localPath(rel)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), reservedPrefix+"download-*")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	pack, err := s.client.Get(s.remotePath(rel), remote.Version, tmp.Name(), s.opts.Codec)
+	if err != nil {
+		return err
+	}
+	if err := s.unchanged(rel, hasLocal, local); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	s.remember(rel, localFile{size: info.Size(), modTime: info.ModTime(), hash: pack.MetaData.FileHash}, remote.Version)
+	return nil
+}
+
+func (s *syncer) deleteLocal(rel string, local localFile) error {
+	s.opts.OnEvent(Event{Op: OpDeleteLocal, Path: rel})
+	s.result.Deleted++
+	if s.opts.DryRun {
+		return nil
+	}
+
+	if err := s.unchanged(rel, true, local); err != nil {
+		return err
+	}
+	if err := os.Remove(s.localPath(rel)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	delete(s.state.Files, rel)
+	return nil
+}
+
+func (s *syncer) deleteRemote(rel string, remote packet.FileInfo) error {
+	s.opts.OnEvent(Event{Op: OpDeleteRemote, Path: rel})
+	s.result.Deleted++
+	if s.opts.DryRun {
+		return nil
+	}
+
+	if err := s.client.DeleteIf(s.remotePath(rel), remote.Hash); err != nil {
+		return conflictErr(err)
+	}
+	delete(s.state.Files, rel)
+	return nil
+}
+
+// conflict keeps both: the local file is renamed and uploaded
+// under the new name, the stored one is downloaded under the old one
+func (s *syncer) conflict(rel string, local localFile, remote packet.FileInfo) error {
+	name := conflictName(rel, s.opts.Host, time.Now())
+	s.opts.OnEvent(Event{Op: OpConflict, Path: rel, Conflict: name})
+	s.result.Conflicts++
+	if s.opts.DryRun {
+		return nil
+	}
+
+	if err := s.unchanged(rel, true, local); err != nil {
+		return err
+	}
+	if err := os.Rename(s.localPath(rel), s.localPath(name)); err != nil {
+		return err
+	}
+	if info, err := os.Stat(s.localPath(name)); err == nil {
+		local.modTime = info.ModTime()
+	}
+	if err := s.upload(name, local, ""); err != nil {
+		return err
+	}
+	return s.download(rel, remote, false, localFile{})
+}
+
+// unchanged makes sure the local file wasn't changed since the scan,
+// such a change is only overwritten after the next sync saw it
+func (s *syncer) unchanged(rel string, hasLocal bool, local localFile) error {
+	info, err := os.Lstat(s.localPath(rel))
+	switch {
+	case errors.Is(err, os.ErrNotExist) && !hasLocal:
+		return nil
+	case err != nil && !errors.Is(err, os.ErrNotExist):
+		return err
+	case err == nil && hasLocal && info.Size() == local.size && info.ModTime().Equal(local.modTime):
+		return nil
+	}
+	return fmt.Errorf("%s changed during sync", rel)
+}
+
+func (s *syncer) remember(rel string, local localFile, version int) {
+	s.state.Files[rel] = watch.Entry{Size: local.size, ModTime: local.modTime, Hash: local.hash, Version: version}
+}
+
+func (s *syncer) scanLocal() error {
+	s.local = make(map[string]localFile)
+	return filepath.WalkDir(s.dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && file != s.dir {
+				return nil
+			}
+			return err
+		}
+		if reserved(d.Name()) || file == s.opts.State {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.dir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		local := localFile{size: info.Size(), modTime: info.ModTime()}
+		if base, ok := s.state.Files[rel]; ok && base.Size == local.size && base.ModTime.Equal(local.modTime) {
+			local.hash = base.Hash
+		} else {
+			meta, err := packet.NewDeltaMetaData(file)
+			if err != nil {
+				return err
+			}
+			local.hash = meta.FileHash
+		}
+		s.local[rel] = local
+		return nil
+	})
+}
+
+// scanRemote lists the stored directory recursively
+func (s *syncer) scanRemote() error {
+	s.remote = make(map[string]packet.FileInfo)
+	dirs := []string{s.opts.Remote}
+	for len(dirs) > 0 {
+		dir := dirs[len(dirs)-1]
+		dirs = dirs[:len(dirs)-1]
+
+		files, err := s.client.List(dir)
+		if errors.Is(err, packet.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			rel, ok := strings.CutPrefix(file.Path, s.opts.Remote+"/")
+			if s.opts.Remote == "" {
+				rel, ok = file.Path, true
+			}
+			if !ok || rel == "" {
+				s.fail(file.Path, fmt.Errorf("%w: listed outside %q", packet.ErrProtocol, s.opts.Remote))
+				continue
+			}
+			if file.IsDir {
+				dirs = append(dirs, file.Path)
+				continue
+			}
+			if reserved(path.Base(rel)) {
+				continue
+			}
+			s.remote[rel] = file
+		}
+	}
+	return nil
+}
+
+// paths - every path known locally, remotely or from the last sync, a
+// path unsafe as a local name is reported and never synced either way
+func (s *syncer) paths() []string {
+	seen := make(map[string]bool)
+	for rel := range s.local {
+		seen[rel] = true
+	}
+	for rel := range s.remote {
+		seen[rel] = true
+	}
+	for rel := range s.state.Files {
+		seen[rel] = true
+	}
+	paths := make([]string, 0, len(seen))
+	for rel := range seen {
+		if err := checkRel(rel); err != nil {
+			delete(s.state.Files, rel)
+			s.fail(rel, err)
+			continue
+		}
+		paths = append(paths, rel)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// localPath - rel is checked by paths, see checkRel
+func (s *syncer) localPath(rel string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(rel))
+}
+
+func (s *syncer) remotePath(rel string) string {
+	return path.Join(s.opts.Remote, rel)
+}
+
+// conflictName - dir/name.conflict-host-20060102-150405.ext
+func conflictName(rel, host string, now time.Time) string {
+	dir, name := path.Split(rel)
+	ext := path.Ext(name)
+	if ext == name {
+		// .bashrc has no extension
+		ext = ""
+	}
+	suffix := ".conflict-" + now.Format("20060102-150405")
+	if host != "" {
+		suffix = ".conflict-" + host + "-" + now.Format("20060102-150405")
+	}
+	return dir + strings.TrimSuffix(name, ext) + suffix + ext
+}
+
+// conflictErr explains a conditional change the server refused
+func conflictErr(err error) error {
+	if errors.Is(err, packet.ErrConflict) {
+		return fmt.Errorf("changed on the server during sync, run sync again: %w", err)
+	}
+	return err
+}
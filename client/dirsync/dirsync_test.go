@@ -0,0 +1,254 @@
+package dirsync
+
+import (
+	packet "EternalPacket"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memServer - сховище в пам'яті з умовними змінами як на сервері
+type memServer struct {
+	files    map[string]string
+	versions map[string]int
+}
+
+func newMemServer() *memServer {
+	return &memServer{files: make(map[string]string), versions: make(map[string]int)}
+}
+
+func sum(data string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(data)))
+}
+
+func (m *memServer) info(p string) packet.FileInfo {
+	return packet.FileInfo{Path: p, Hash: sum(m.files[p]), Size: int64(len(m.files[p])), Version: m.versions[p]}
+}
+
+func (m *memServer) match(p, ifMatch string) error {
+	data, ok := m.files[p]
+	if ifMatch == "" || (ifMatch == packet.MatchNone && !ok) || (ok && sum(data) == ifMatch) {
+		return nil
+	}
+	return &packet.ResponseError{Status: packet.StatusConflict, Message: "changed"}
+}
+
+func (m *memServer) List(dir string) ([]packet.FileInfo, error) {
+	var out []packet.FileInfo
+	dirs := make(map[string]bool)
+	for p := range m.files {
+		rest, ok := strings.CutPrefix(p, dir+"/")
+		if dir == "" {
+			rest, ok = p, true
+		}
+		if !ok {
+			continue
+		}
+		if name, _, nested := strings.Cut(rest, "/"); nested {
+			dirs[path.Join(dir, name)] = true
+			continue
+		}
+		out = append(out, m.info(p))
+	}
+	for d := range dirs {
+		out = append(out, packet.FileInfo{Path: d, IsDir: true})
+	}
+	if len(out) == 0 {
+		return nil, &packet.ResponseError{Status: packet.StatusNotFound}
+	}
+	return out, nil
+}
+
+func (m *memServer) Get(remotePath string, _ int, localPath, _ string) (*packet.TCPPacket, error) {
+	data, ok := m.files[remotePath]
+	if !ok {
+		return nil, &packet.ResponseError{Status: packet.StatusNotFound}
+	}
+	if err := os.WriteFile(localPath, []byte(data), 0o644); err != nil {
+		return nil, err
+	}
+	return &packet.TCPPacket{MetaData: &packet.TCPPacketMetaData{FileHash: sum(data), Size: int64(len(data))}}, nil
+}
+
+func (m *memServer) PutDeltaIf(localPath, remotePath, _ string, _ int64, ifMatch string) (*packet.FileInfo, *packet.DeltaStats, error) {
+	if err := m.match(remotePath, ifMatch); err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	m.files[remotePath] = string(data)
+	m.versions[remotePath]++
+	info := m.info(remotePath)
+	return &info, nil, nil
+}
+
+func (m *memServer) DeleteIf(remotePath, ifMatch string) error {
+	if err := m.match(remotePath, ifMatch); err != nil {
+		return err
+	}
+	delete(m.files, remotePath)
+	return nil
+}
+
+func write(t *testing.T, dir, rel, data string) {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(rel))
+	require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+	require.NoError(t, os.WriteFile(p, []byte(data), 0o644))
+	// різний час зміни, навіть якщо розмір той самий
+	later := time.Now().Add(time.Duration(len(data)) * time.Second)
+	require.NoError(t, os.Chtimes(p, later, later))
+}
+
+func readDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	require.NoError(t, filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		require.NoError(t, err)
+		if d.IsDir() || strings.HasPrefix(d.Name(), reservedPrefix) {
+			return nil
+		}
+		data, err := os.ReadFile(p)
+		require.NoError(t, err)
+		rel, _ := filepath.Rel(dir, p)
+		files[filepath.ToSlash(rel)] = string(data)
+		return nil
+	}))
+	return files
+}
+
+func TestSyncBothWays(t *testing.T) {
+	server := newMemServer()
+	laptop, desktop := t.TempDir(), t.TempDir()
+	syncDir := func(dir, host string) Result {
+		t.Helper()
+		result, err := Sync(dir, server, Options{Remote: "team", Host: host})
+		require.NoError(t, err)
+		return result
+	}
+
+	write(t, laptop, "a.txt", "a1")
+	write(t, laptop, "docs/b.txt", "b1")
+	assert.Equal(t, Result{Uploaded: 2}, syncDir(laptop, "laptop"))
+	assert.Equal(t, Result{Downloaded: 2}, syncDir(desktop, "desktop"))
+	assert.Equal(t, readDir(t, laptop), readDir(t, desktop))
+
+	// нічого не змінилось - нічого не робиться
+	assert.Equal(t, Result{}, syncDir(laptop, "laptop"))
+
+	// зміни з обох боків, без конфліктів
+	write(t, laptop, "a.txt", "a2 laptop")
+	require.NoError(t, os.Remove(filepath.Join(laptop, "docs", "b.txt")))
+	write(t, desktop, "c.txt", "c1")
+	assert.Equal(t, Result{Uploaded: 1, Deleted: 1}, syncDir(laptop, "laptop"))
+	assert.Equal(t, Result{Uploaded: 1, Downloaded: 1, Deleted: 1}, syncDir(desktop, "desktop"))
+	assert.Equal(t, Result{Downloaded: 1}, syncDir(laptop, "laptop"))
+	assert.Equal(t, map[string]string{"a.txt": "a2 laptop", "c.txt": "c1"}, readDir(t, laptop))
+	assert.Equal(t, readDir(t, laptop), readDir(t, desktop))
+
+	// обидва змінили один файл - зберігаються обидві копії
+	write(t, laptop, "c.txt", "c2 laptop")
+	write(t, desktop, "c.txt", "c2 desktop!")
+	syncDir(laptop, "laptop")
+	result := syncDir(desktop, "desktop")
+	assert.Equal(t, 1, result.Conflicts)
+	syncDir(laptop, "laptop")
+
+	files := readDir(t, desktop)
+	assert.Equal(t, "c2 laptop", files["c.txt"])
+	var conflict string
+	for name, data := range files {
+		if strings.HasPrefix(name, "c.conflict-desktop-") && strings.HasSuffix(name, ".txt") {
+			conflict = name
+			assert.Equal(t, "c2 desktop!", data)
+		}
+	}
+	require.NotEmpty(t, conflict)
+	assert.Equal(t, files, readDir(t, laptop))
+	assert.Equal(t, "c2 desktop!", server.files["team/"+conflict])
+}
+
+// Сервер змінився між переглядом і вивантаженням - файл не перезаписується
+func TestSyncDoesNotOverwriteConcurrentChange(t *testing.T) {
+	server := newMemServer()
+	dir := t.TempDir()
+	write(t, dir, "a.txt", "v1")
+	_, err := Sync(dir, server, Options{Host: "h"})
+	require.NoError(t, err)
+	write(t, dir, "a.txt", "mine")
+
+	racing := &racingServer{memServer: server}
+	result, err := Sync(dir, racing, Options{Host: "h"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "run sync again")
+	assert.Equal(t, 1, result.Failed)
+	assert.Equal(t, "changed underneath", server.files["a.txt"])
+}
+
+// racingServer змінює файл одразу після того, як sync отримав список
+type racingServer struct {
+	*memServer
+}
+
+func (r *racingServer) List(dir string) ([]packet.FileInfo, error) {
+	files, err := r.memServer.List(dir)
+	r.files["a.txt"] = "changed underneath"
+	return files, err
+}
+
+func TestConflictName(t *testing.T) {
+	now := time.Date(2026, 10, 19, 1, 2, 3, 0, time.UTC)
+	assert.Equal(t, "docs/report.conflict-pc-20261019-010203.txt", conflictName("docs/report.txt", "pc", now))
+	assert.Equal(t, ".bashrc.conflict-pc-20261019-010203", conflictName(".bashrc", "pc", now))
+	assert.Equal(t, "Makefile.conflict-20261019-010203", conflictName("Makefile", "", now))
+}
+
+// evilServer віддає шляхи поза каталогом синхронізації
+type evilServer struct {
+	*memServer
+}
+
+func (e *evilServer) List(dir string) ([]packet.FileInfo, error) {
+	files, err := e.memServer.List(dir)
+	return append(files,
+		packet.FileInfo{Path: "other/x.txt", Hash: sum("x")},
+		packet.FileInfo{Path: "team/../escape.txt", Hash: sum("x")},
+		packet.FileInfo{Path: "team/a/../../b.txt", Hash: sum("x")},
+	), err
+}
+
+// Шляхи від сервера і зі стану не виходять за межі каталогу
+func TestSyncRejectsUnsafePaths(t *testing.T) {
+	server := newMemServer()
+	server.files["team/ok.txt"] = "ok"
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "sync")
+	state := filepath.Join(parent, "state.json")
+	require.NoError(t, os.WriteFile(state, []byte(`{"version":1,"remote":"team","files":{"../state-escape.txt":{"hash":"x"}}}`), 0o644))
+
+	var rejected []string
+	result, err := Sync(dir, &evilServer{memServer: server}, Options{Remote: "team", State: state, Host: "h",
+		OnEvent: func(e Event) {
+			if e.Op == OpError {
+				rejected = append(rejected, e.Path)
+			}
+		}})
+	require.Error(t, err)
+	assert.ElementsMatch(t, []string{"other/x.txt", "../escape.txt", "a/../../b.txt", "../state-escape.txt"}, rejected)
+	assert.Equal(t, 4, result.Failed)
+	assert.Equal(t, 1, result.Downloaded)
+	assert.Equal(t, map[string]string{"ok.txt": "ok"}, readDir(t, dir))
+	entries, err := os.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
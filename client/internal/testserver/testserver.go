@@ -0,0 +1,85 @@
+// Package testserver runs the storage server on 127.0.0.1 for tests
+// of the client, with its own certificate and an empty store.
+package testserver
+
+import (
+	packet "EternalPacket"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"eternalStorageServer/storage"
+	"eternalStorageServer/tcp"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type Server struct {
+	Addr string
+	// CertFile - PEM of the server certificate, for packet.LoadClientTLS
+	CertFile string
+	Store    *storage.Store
+}
+
+// Start serves a new store until the test ends, users - name -> secret
+func Start(t testing.TB, users map[string]string) *Server {
+	t.Helper()
+	creds := packet.Credentials{}
+	for user, secret := range users {
+		if err := creds.Add(user, secret); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := storage.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tcp.NewListenerTCP("", store, creds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, certFile := certificate(t)
+	listener.SetCertificate(cert)
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = inner.Close() })
+	go func() { _ = listener.ServeListener(inner) }()
+
+	return &Server{Addr: inner.Addr().String(), CertFile: certFile, Store: store}
+}
+
+// certificate - self-signed certificate for 127.0.0.1 and its PEM file
+func certificate(t testing.TB) (tls.Certificate, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"EternalStorage"}},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "server.crt")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
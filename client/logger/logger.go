@@ -1,30 +1,51 @@
 package logger
 
 import (
-	"log"
+	"io"
+	"log/slog"
 	"os"
 )
 
+// Options of a logger
+type Options struct {
+	// Output - os.Stderr if nil
+	Output io.Writer
+	Level  slog.Level
+	// JSON - one JSON object per record instead of key=value text
+	JSON bool
+}
+
+// EtrnlLogger - slog.Logger with the helpers the client uses,
+// packet.SetLogger takes its Logger
 type EtrnlLogger struct {
-	Info func(msg string)
-	Err  func(err error, msg string) error
-	Msg  func(msg, remote string)
+	*slog.Logger
 }
 
-func NewEtrnlLogger() *EtrnlLogger {
-	return &EtrnlLogger{
-		Info: func(msg string) {
-			l := log.New(os.Stdout, "[INFO]:", log.Ldate|log.Ltime|log.Lshortfile)
-			l.Println(msg)
-		},
-		Err: func(err error, msg string) error {
-			l := log.New(os.Stdout, "[ERROR]:", log.Ldate|log.Ltime|log.Lshortfile)
-			l.Println(msg, err.Error())
-			return err
-		},
-		Msg: func(msg, remote string) {
-			l := log.New(os.Stdout, "[MSG]: ", log.Ldate)
-			l.Println(msg + remote)
-		},
+func New(opts Options) *EtrnlLogger {
+	out := opts.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+	var handler slog.Handler = slog.NewTextHandler(out, handlerOpts)
+	if opts.JSON {
+		handler = slog.NewJSONHandler(out, handlerOpts)
 	}
+	return &EtrnlLogger{slog.New(handler)}
+}
+
+// Wrap - EtrnlLogger writing to l
+func Wrap(l *slog.Logger) *EtrnlLogger {
+	return &EtrnlLogger{l}
+}
+
+// Err logs err at Error and returns it
+func (l *EtrnlLogger) Err(err error, msg string) error {
+	l.Error(msg, "error", err)
+	return err
+}
+
+// Msg logs a message of the remote side
+func (l *EtrnlLogger) Msg(msg, remote string) {
+	l.Info(msg, "remote", remote)
 }
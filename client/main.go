@@ -2,60 +2,111 @@ package main
 
 import (
 	packet "EternalPacket"
-	"flag"
+	"errors"
 	"fmt"
-	"log"
-	"net"
+	"io"
+	"os"
 )
 
-// dial conn
-// go run main.go -mode dial -addr localhost:8080
+// eternal - storage client, token or password is taken from ETERNAL_SECRET
+//
+//	eternal put -user alice -codec gzip file.txt
+//	eternal get -user alice -o file.txt docs/file.txt
+//	eternal ls -user alice -json docs
 
-func main() {
+const usage = `usage: eternal <command> [flags] [args]
 
-	addr := flag.String("addr", "localhost:8080", "service address")
+commands:
+  put   <file>...        upload files
+  get   <path | hash>    download a stored file
+  ls    [dir]            list a directory
+  rm    <path>...        delete files
+  stat  <path>           show a stored file
+  restore <path>         make an old version current again
+  share <path> <user>    grant a user access to a path or revoke it
+  watch <dir>            upload files of dir whenever they change
+  sync  <dir>            sync dir with the server both ways
+  s3-key                 show the key pair of the S3 endpoint
 
-	conn, err := net.Dial("tcp", *addr)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("Client connected")
+run "eternal <command> -h" for the flags of a command
 
-	err = packet.ReceiveCert(conn)
-	if err != nil {
-		log.Fatal(err)
-	}
+exit codes:
+  0  success
+  1  error
+  2  bad usage
+  3  file not found
+  4  authentication failed or permission denied
+  5  quota exceeded
+`
+
+// exit codes
+const (
+	exitOK = iota
+	exitError
+	exitUsage
+	exitNotFound
+	exitDenied
+	exitNoSpace
+)
 
-	/*mode := flag.String("mode", "dial", "client|server mode, conn/dial")
-	path := flag.String("path", "", "file path")
-	compType := flag.String("compType", "gzip", "gzip/zlib/snappy")
-	flag.Parse()
+var commands = map[string]func(c *cli, args []string) error{
+	"put":     runPut,
+	"get":     runGet,
+	"ls":      runList,
+	"rm":      runRemove,
+	"stat":    runStat,
+	"restore": runRestore,
+	"share":   runShare,
+	"watch":   runWatch,
+	"sync":    runSync,
+	"s3-key":  runS3Key,
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
 
-	if *mode != "dial" && *mode != "send" {
-		fmt.Println("mode: dial/conn")
-		os.Exit(1)
+// run executes the command in args and returns the exit code
+func run(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" || args[0] == "help" {
+		fmt.Fprint(stderr, usage)
+		if len(args) == 0 {
+			return exitUsage
+		}
+		return exitOK
 	}
 
-	dialer, e := tcp.NewDialerTCP(*addr)
-	if e != nil {
-		fmt.Println(e)
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %q\n\n%s", args[0], usage)
+		return exitUsage
 	}
 
-	switch *mode {
-	case "dial":
-		err := dialer.Dial()
-		if err != nil {
-			log.Fatal(err)
-		}
-	case "send":
-		pack, err := packet.NewTCPPacket(*path, *compType)
-		if err != nil {
-			fmt.Println(err)
-		}
+	c := &cli{stdout: stdout, stderr: stderr}
+	defer c.close()
 
-		e = dialer.SendFile(pack)
-		if e != nil {
-			fmt.Println(e)
-		}
-	}*/
+	err := cmd(c, args[1:])
+	if err == nil {
+		return exitOK
+	}
+	if errors.Is(err, errHelp) {
+		return exitOK
+	}
+	c.fail(err)
+	return exitCode(err)
+}
+
+func exitCode(err error) int {
+	var usageErr *usageError
+	switch {
+	case errors.As(err, &usageErr):
+		return exitUsage
+	case errors.Is(err, packet.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, packet.ErrAuthFailed), errors.Is(err, packet.ErrForbidden):
+		return exitDenied
+	case errors.Is(err, packet.ErrQuotaExceeded):
+		return exitNoSpace
+	}
+	return exitError
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	packet "EternalPacket"
+	"bytes"
+	"encoding/json"
+	"eternalStorageClient/internal/testserver"
+	"eternalStorageServer/storage"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eternal з аргументами, повертає код виходу, stdout і stderr
+func runCLI(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// failure - вивід помилки з -json
+type failure struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+	Status int    `json:"status"`
+	Code   int    `json:"exit_code"`
+}
+
+func startServer(t *testing.T) *testserver.Server {
+	t.Helper()
+	srv := testserver.Start(t, map[string]string{"alice": "pw"})
+	t.Setenv("ETERNAL_ADDR", srv.Addr)
+	t.Setenv("ETERNAL_CERT", srv.CertFile)
+	t.Setenv("ETERNAL_USER", "alice")
+	t.Setenv("ETERNAL_SECRET", "pw")
+	return srv
+}
+
+func TestRunUsage(t *testing.T) {
+	code, _, stderr := runCLI(t)
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, "usage: eternal")
+
+	code, _, _ = runCLI(t, "help")
+	assert.Equal(t, exitOK, code)
+	code, _, stderr = runCLI(t, "copy")
+	assert.Equal(t, exitUsage, code)
+	assert.Contains(t, stderr, `unknown command "copy"`)
+
+	// аргументи перевіряються до підключення
+	code, _, _ = runCLI(t, "put")
+	assert.Equal(t, exitUsage, code)
+	code, _, _ = runCLI(t, "get", "-codec", "bz2", "a.txt")
+	assert.Equal(t, exitUsage, code)
+	code, _, _ = runCLI(t, "get", "-conflict", "merge", "a.txt")
+	assert.Equal(t, exitUsage, code)
+	code, _, _ = runCLI(t, "get", "-resume", "-conflict", "skip", "a.txt")
+	assert.Equal(t, exitUsage, code)
+	code, _, _ = runCLI(t, "ls", "-h")
+	assert.Equal(t, exitOK, code)
+
+	t.Setenv("ETERNAL_USER", "")
+	code, stdout, _ := runCLI(t, "ls", "-json")
+	assert.Equal(t, exitUsage, code)
+	var out failure
+	require.NoError(t, json.Unmarshal([]byte(stdout), &out))
+	assert.Equal(t, exitUsage, out.Code)
+}
+
+// Команди через справжній сервер, текстом і в JSON
+func TestRunLoopback(t *testing.T) {
+	startServer(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	require.NoError(t, os.WriteFile(file, []byte("hello cli"), 0o644))
+
+	code, stdout, stderr := runCLI(t, "put", file)
+	require.Equal(t, exitOK, code, stderr)
+	assert.Equal(t, file+" -> a.txt (9 bytes, version 1)\n", stdout)
+
+	code, stdout, _ = runCLI(t, "put", "-json", "-as", "docs/b.txt", file)
+	require.Equal(t, exitOK, code)
+	var stored []packet.FileInfo
+	require.NoError(t, json.Unmarshal([]byte(stdout), &stored))
+	require.Len(t, stored, 1)
+	assert.Equal(t, "docs/b.txt", stored[0].Path)
+
+	local := filepath.Join(dir, "got.txt")
+	code, stdout, _ = runCLI(t, "get", "-json", "-o", local, "docs/b.txt")
+	require.Equal(t, exitOK, code)
+	var got download
+	require.NoError(t, json.Unmarshal([]byte(stdout), &got))
+	assert.Equal(t, download{Remote: "docs/b.txt", Local: local, Hash: stored[0].Hash, Size: 9}, got)
+	data, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.Equal(t, "hello cli", string(data))
+
+	code, stdout, _ = runCLI(t, "get", "-json", "-conflict", "skip", "-o", local, "docs/b.txt")
+	require.Equal(t, exitOK, code)
+	require.NoError(t, json.Unmarshal([]byte(stdout), &got))
+	assert.True(t, got.Skipped)
+	code, stdout, _ = runCLI(t, "get", "-conflict", "rename", "-o", local, "-hash", stored[0].Hash)
+	require.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "got (1).txt (9 bytes)")
+	code, stdout, _ = runCLI(t, "get", "-resume", "-json", "-o", local, "docs/b.txt")
+	require.Equal(t, exitOK, code)
+	var resumed download
+	require.NoError(t, json.Unmarshal([]byte(stdout), &resumed))
+	assert.Equal(t, download{Remote: "docs/b.txt", Local: local, Hash: stored[0].Hash, Size: 9}, resumed)
+
+	code, stdout, _ = runCLI(t, "ls", "-json")
+	require.Equal(t, exitOK, code)
+	var files []packet.FileInfo
+	require.NoError(t, json.Unmarshal([]byte(stdout), &files))
+	require.Len(t, files, 2)
+	assert.Equal(t, "a.txt", files[0].Path)
+	assert.True(t, files[1].IsDir)
+
+	code, stdout, _ = runCLI(t, "stat", "docs/b.txt")
+	require.Equal(t, exitOK, code)
+	assert.Contains(t, stdout, "sha256:   "+stored[0].Hash)
+	code, stdout, _ = runCLI(t, "stat", "-versions", "-json", "a.txt")
+	require.Equal(t, exitOK, code)
+	var versions []packet.FileInfo
+	require.NoError(t, json.Unmarshal([]byte(stdout), &versions))
+	require.Len(t, versions, 1)
+	assert.True(t, versions[0].Current)
+
+	// стара версія знову поточна
+	require.NoError(t, os.WriteFile(file, []byte("hello again"), 0o644))
+	code, _, _ = runCLI(t, "put", file)
+	require.Equal(t, exitOK, code)
+	code, _, _ = runCLI(t, "restore", "a.txt")
+	assert.Equal(t, exitUsage, code)
+	code, stdout, _ = runCLI(t, "restore", "-version", "1", "a.txt")
+	require.Equal(t, exitOK, code)
+	assert.Equal(t, "restored a.txt version 1 (9 bytes)\n", stdout)
+	restored := filepath.Join(dir, "restored.txt")
+	code, _, _ = runCLI(t, "get", "-o", restored, "a.txt")
+	require.Equal(t, exitOK, code)
+	data, err = os.ReadFile(restored)
+	require.NoError(t, err)
+	assert.Equal(t, "hello cli", string(data))
+
+	code, stdout, _ = runCLI(t, "rm", "docs/b.txt")
+	require.Equal(t, exitOK, code)
+	assert.Equal(t, "removed docs/b.txt\n", stdout)
+
+	// відсутній файл: код 3, причина і статус у JSON
+	code, stdout, _ = runCLI(t, "get", "-json", "-o", filepath.Join(dir, "x.txt"), "docs/b.txt")
+	assert.Equal(t, exitNotFound, code)
+	var out failure
+	require.NoError(t, json.Unmarshal([]byte(stdout), &out))
+	assert.Equal(t, failure{Error: out.Error, Reason: "not_found", Status: packet.StatusNotFound, Code: exitNotFound}, out)
+	assert.NoFileExists(t, filepath.Join(dir, "x.txt"))
+	code, _, stderr = runCLI(t, "stat", "docs/b.txt")
+	assert.Equal(t, exitNotFound, code)
+	assert.Contains(t, stderr, "eternal: ")
+}
+
+func TestRunExitCodes(t *testing.T) {
+	srv := startServer(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "big.bin")
+	require.NoError(t, os.WriteFile(file, make([]byte, 4000), 0o644))
+
+	srv.Store.SetQuotas(storage.Quotas{Default: storage.Quota{Bytes: 1000}})
+	code, stdout, _ := runCLI(t, "put", "-json", file)
+	assert.Equal(t, exitNoSpace, code)
+	var out failure
+	require.NoError(t, json.Unmarshal([]byte(stdout), &out))
+	assert.Equal(t, "quota_exceeded", out.Reason)
+	assert.Equal(t, packet.StatusInsufficientStorage, out.Status)
+
+	_, err := srv.Store.Put("bob", "bob", "private.txt", bytes.NewReader([]byte("bob's")), storage.PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+	code, _, _ = runCLI(t, "stat", "-ns", "bob", "private.txt")
+	assert.Equal(t, exitDenied, code)
+
+	t.Setenv("ETERNAL_SECRET", "wrong")
+	code, stdout, _ = runCLI(t, "ls", "-json")
+	assert.Equal(t, exitDenied, code)
+	require.NoError(t, json.Unmarshal([]byte(stdout), &out))
+	assert.Equal(t, "auth_failed", out.Reason)
+
+	t.Setenv("ETERNAL_CERT", filepath.Join(dir, "missing.crt"))
+	code, _, _ = runCLI(t, "ls")
+	assert.Equal(t, exitError, code)
+}
+
+// Ключ S3 виводиться з секрету так само, як на сервері, без підключення
+func TestRunS3Key(t *testing.T) {
+	t.Setenv("ETERNAL_USER", "alice")
+	t.Setenv("ETERNAL_SECRET", "pw")
+	code, stdout, _ := runCLI(t, "s3-key", "-json")
+	require.Equal(t, exitOK, code)
+	var got s3Key
+	require.NoError(t, json.Unmarshal([]byte(stdout), &got))
+	creds := packet.Credentials{}
+	require.NoError(t, creds.Add("alice", "pw"))
+	assert.Equal(t, s3Key{AccessKey: "alice", SecretKey: packet.S3SecretKey(creds["alice"])}, got)
+
+	t.Setenv("ETERNAL_SECRET", "")
+	code, _, _ = runCLI(t, "s3-key")
+	assert.Equal(t, exitUsage, code)
+}
+
+// Надання і відкликання доступу з командного рядка
+func TestRunShare(t *testing.T) {
+	srv := startServer(t)
+	file := filepath.Join(t.TempDir(), "a.txt")
+	require.NoError(t, os.WriteFile(file, []byte("shared"), 0o644))
+	code, _, _ := runCLI(t, "put", "-as", "docs/a.txt", file)
+	require.Equal(t, exitOK, code)
+
+	code, _, _ = runCLI(t, "share", "-perm", "rx", "docs", "bob")
+	assert.Equal(t, exitUsage, code)
+	code, _, _ = runCLI(t, "share", "docs")
+	assert.Equal(t, exitUsage, code)
+
+	code, stdout, _ := runCLI(t, "share", "-perm", "rw", "docs", "bob")
+	require.Equal(t, exitOK, code)
+	assert.Equal(t, "shared docs with bob: rw\n", stdout)
+	acl, err := srv.Store.ACL("alice", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, storage.PermRead|storage.PermWrite, acl["docs"]["bob"])
+
+	code, stdout, _ = runCLI(t, "share", "-json", "-perm", "-", "docs", "bob")
+	require.Equal(t, exitOK, code)
+	var got share
+	require.NoError(t, json.Unmarshal([]byte(stdout), &got))
+	assert.Equal(t, share{Path: "docs", User: "bob", Perm: "-"}, got)
+	acl, err = srv.Store.ACL("alice", "alice")
+	require.NoError(t, err)
+	assert.NotContains(t, acl, "docs")
+}
@@ -0,0 +1,262 @@
+package tcp
+
+import (
+	packet "EternalPacket"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// roundTrip sends req and reads its response, commands
+// carrying a packet (PUT, GET) have their own flow
+func (d *DialerTCP) roundTrip(req *packet.Request) (*packet.Response, error) {
+	d.prepare(req)
+	if err := req.Send(d.conn); err != nil {
+		return nil, err
+	}
+	return packet.ReadResponse(d.conn, req)
+}
+
+func (d *DialerTCP) prepare(req *packet.Request) {
+	d.nextID++
+	req.ID = d.nextID
+	if req.Namespace == "" {
+		req.Namespace = d.Namespace
+	}
+}
+
+// Put uploads the packet as remotePath, empty - the packet's file name
+func (d *DialerTCP) Put(pack *packet.TCPPacket, remotePath string) (*packet.FileInfo, error) {
+	return d.PutIf(pack, remotePath, "")
+}
+
+// PutIf - Put only if the stored file has hash ifMatch (packet.MatchNone -
+// there is no file), else the server answers with StatusConflict
+func (d *DialerTCP) PutIf(pack *packet.TCPPacket, remotePath, ifMatch string) (*packet.FileInfo, error) {
+	req := &packet.Request{Op: packet.OpPut, Path: remotePath, IfMatch: ifMatch}
+	d.prepare(req)
+	if err := req.Send(d.conn); err != nil {
+		return nil, err
+	}
+
+	err := pack.SendOverTCP(d.conn)
+	var reject *packet.RejectError
+	if err != nil && !errors.As(err, &reject) {
+		return nil, err
+	}
+	// a rejected packet is followed by the response with the same reason
+	resp, err := packet.ReadResponse(d.conn, req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.File, nil
+}
+
+// PutDelta uploads a local file that changed since its last upload, only
+// the changed parts are sent. Falls back to Put with compressType when the
+// server has no copy to compare with. Stats are nil after a full upload.
+func (d *DialerTCP) PutDelta(localPath, remotePath, compressType string, ttl int64) (*packet.FileInfo, *packet.DeltaStats, error) {
+	return d.PutDeltaIf(localPath, remotePath, compressType, ttl, "")
+}
+
+// PutDeltaIf - PutDelta with the condition of PutIf
+func (d *DialerTCP) PutDeltaIf(localPath, remotePath, compressType string, ttl int64, ifMatch string) (*packet.FileInfo, *packet.DeltaStats, error) {
+	if remotePath == "" {
+		remotePath = filepath.Base(localPath)
+	}
+
+	req := &packet.Request{Op: packet.OpDelta, Path: remotePath, IfMatch: ifMatch}
+	_, err := d.roundTrip(req)
+	var respErr *packet.ResponseError
+	if errors.As(err, &respErr) && deltaFallback(respErr.Status) {
+		pack, err := packet.NewTCPPacket(localPath, compressType)
+		if err != nil {
+			return nil, nil, err
+		}
+		pack.MetaData.TTL = ttl
+		info, err := d.PutIf(pack, remotePath, ifMatch)
+		return info, nil, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sig, err := packet.ReadSignature(d.conn)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta, err := packet.NewDeltaMetaData(localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	meta.TTL = ttl
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	stats, err := packet.SendDeltaOverTCP(d.conn, meta, file, sig)
+	var reject *packet.RejectError
+	if err != nil && !errors.As(err, &reject) {
+		return nil, nil, err
+	}
+	resp, err := packet.ReadResponse(d.conn, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.File, &stats, nil
+}
+
+// deltaFallback - statuses of DELTA after which a full upload may still work
+func deltaFallback(status int) bool {
+	switch status {
+	case packet.StatusNotFound, packet.StatusForbidden, packet.StatusNotImplemented:
+		return true
+	}
+	return false
+}
+
+// Get downloads version (0 - current) of remotePath into localPath,
+// compressType is how the server should pack the data, empty - its default
+func (d *DialerTCP) Get(remotePath string, version int, localPath, compressType string) (*packet.TCPPacket, error) {
+	pack, _, err := d.GetTo(&packet.Request{Op: packet.OpGet, Path: remotePath, Version: version, CompressType: compressType}, localPath, packet.ConflictOverwrite)
+	return pack, err
+}
+
+// GetHash downloads a file by its content hash (FileHash of the upload)
+func (d *DialerTCP) GetHash(hash, localPath, compressType string) (*packet.TCPPacket, error) {
+	pack, _, err := d.GetTo(&packet.Request{Op: packet.OpGet, Hash: hash, CompressType: compressType}, localPath, packet.ConflictOverwrite)
+	return pack, err
+}
+
+// GetTo runs the GET req into localPath, an existing file there is
+// handled by policy. Returns the path the file was written to, empty if
+// it was skipped. A packet that doesn't carry the hash the server stored
+// is refused before its data, so it never replaces anything.
+func (d *DialerTCP) GetTo(req *packet.Request, localPath string, policy packet.ConflictPolicy) (*packet.TCPPacket, string, error) {
+	req.Op = packet.OpGet
+	resp, err := d.roundTrip(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	check := func(meta *packet.TCPPacketMetaData) error {
+		// the receiver checks the data against FileHash, so it has to be there
+		if meta.FileHash == "" || resp.File != nil && meta.FileHash != resp.File.Hash {
+			want := ""
+			if resp.File != nil {
+				want = resp.File.Hash
+			}
+			return &packet.MismatchError{Err: packet.ErrHashMismatch, Got: meta.FileHash, Want: want}
+		}
+		return nil
+	}
+	pack, path, err := packet.ReceiveOverTCPTo(d.conn, localPath, packet.ReceiveOptions{Check: check, Conflict: policy})
+	var mismatch *packet.MismatchError
+	if errors.As(err, &mismatch) {
+		return nil, "", fmt.Errorf("download of %s is corrupted: %w", req.Path+req.Hash, err)
+	}
+	return pack, path, err
+}
+
+// GetRange reads up to length bytes (0 - packet.MaxRangeLength) of version
+// (0 - current) of remotePath from offset, a multiple of
+// packet.MerkleLeafSize. Every leaf is checked against root, empty - the
+// root the server reports. With a root the server only answers while the
+// content still has it, a file changed meanwhile fails with ErrConflict
+// instead of mixing two contents. Download resumes with it.
+func (d *DialerTCP) GetRange(remotePath string, version int, offset, length int64, root string) ([]byte, *packet.FileInfo, error) {
+	rng, info, err := d.getRange(&packet.Request{Path: remotePath, Version: version, Offset: offset, Length: length}, root)
+	if err != nil {
+		return nil, info, err
+	}
+	return rng.Data, info, nil
+}
+
+// getRange runs the RANGE req (Path or Hash, Version, Offset and Length)
+func (d *DialerTCP) getRange(req *packet.Request, root string) (*packet.Range, *packet.FileInfo, error) {
+	req.Op, req.Root = packet.OpRange, root
+	resp, err := d.roundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.File == nil || resp.Range == nil || resp.Range.Offset != req.Offset {
+		return nil, nil, fmt.Errorf("%w: RANGE of %s answered without the range", packet.ErrProtocol, req.Path+req.Hash)
+	}
+	if root == "" {
+		root = resp.File.MerkleRoot
+	}
+	if resp.File.MerkleRoot != root {
+		return nil, resp.File, &packet.MismatchError{Err: packet.ErrMerkleMismatch, Got: resp.File.MerkleRoot, Want: root}
+	}
+	if err := packet.VerifyRange(root, resp.Range); err != nil {
+		return nil, resp.File, fmt.Errorf("range of %s is corrupted: %w", req.Path+req.Hash, err)
+	}
+	return resp.Range, resp.File, nil
+}
+
+// List returns entries directly under dir, directories have IsDir set
+func (d *DialerTCP) List(dir string) ([]packet.FileInfo, error) {
+	return d.pages(&packet.Request{Op: packet.OpList, Path: dir})
+}
+
+// pages runs a LIST or VERSIONS req page by page and joins the pages,
+// servers without pages answer everything at once
+func (d *DialerTCP) pages(req *packet.Request) ([]packet.FileInfo, error) {
+	req.Limit = packet.MaxPage
+	var files []packet.FileInfo
+	for {
+		resp, err := d.roundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, resp.Files...)
+		if resp.Next == "" {
+			return files, nil
+		}
+		if len(resp.Files) == 0 || resp.Next == req.Cursor {
+			return nil, fmt.Errorf("%w: %s of %s doesn't advance past %q", packet.ErrProtocol, req.Op, req.Path, resp.Next)
+		}
+		req.Cursor = resp.Next
+	}
+}
+
+func (d *DialerTCP) Stat(remotePath string) (*packet.FileInfo, error) {
+	resp, err := d.roundTrip(&packet.Request{Op: packet.OpStat, Path: remotePath})
+	if err != nil {
+		return nil, err
+	}
+	return resp.File, nil
+}
+
+func (d *DialerTCP) Delete(remotePath string) error {
+	return d.DeleteIf(remotePath, "")
+}
+
+// DeleteIf - Delete only if the stored file has hash ifMatch
+func (d *DialerTCP) DeleteIf(remotePath, ifMatch string) error {
+	_, err := d.roundTrip(&packet.Request{Op: packet.OpDelete, Path: remotePath, IfMatch: ifMatch})
+	return err
+}
+
+// Versions - history of remotePath, newest first
+func (d *DialerTCP) Versions(remotePath string) ([]packet.FileInfo, error) {
+	return d.pages(&packet.Request{Op: packet.OpVersions, Path: remotePath})
+}
+
+// Restore makes an old version current again
+func (d *DialerTCP) Restore(remotePath string, version int) (*packet.FileInfo, error) {
+	resp, err := d.roundTrip(&packet.Request{Op: packet.OpRestore, Path: remotePath, Version: version})
+	if err != nil {
+		return nil, err
+	}
+	return resp.File, nil
+}
+
+// Share grants user perm ("rwds", "-" revokes) on remotePath of own namespace
+func (d *DialerTCP) Share(remotePath, user, perm string) error {
+	_, err := d.roundTrip(&packet.Request{Op: packet.OpShare, Path: remotePath, User: user, Perm: perm})
+	return err
+}
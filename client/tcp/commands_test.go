@@ -0,0 +1,351 @@
+package tcp
+
+import (
+	packet "EternalPacket"
+	"crypto/rand"
+	"eternalStorageClient/internal/testserver"
+	"eternalStorageServer/storage"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var users = map[string]string{"alice": "alice-secret", "bob": "bob-secret"}
+
+func dial(t *testing.T, srv *testserver.Server, user string) *DialerTCP {
+	t.Helper()
+	config, err := packet.LoadClientTLS(srv.CertFile)
+	require.NoError(t, err)
+	d, err := NewDialerTLS(srv.Addr, config, user, users[user])
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = d.Close() })
+	return d
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, data, 0o644))
+	return path
+}
+
+func putFile(t *testing.T, d *DialerTCP, path, remote string) *packet.FileInfo {
+	t.Helper()
+	pack, err := packet.NewTCPPacket(path, "gzip")
+	require.NoError(t, err)
+	info, err := d.Put(pack, remote)
+	require.NoError(t, err)
+	return info
+}
+
+// відповідь сервера з кодом помилки і статусом
+func requireResponseError(t *testing.T, err error, status int, code string) {
+	t.Helper()
+	var respErr *packet.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	assert.Equal(t, status, respErr.Status)
+	assert.Equal(t, code, respErr.Code)
+}
+
+// Усі команди протоколу через справжній сервер на 127.0.0.1
+func TestCommandsLoopback(t *testing.T) {
+	srv := testserver.Start(t, users)
+	d := dial(t, srv, "alice")
+	dir := t.TempDir()
+
+	v1 := putFile(t, d, writeFile(t, dir, "a.txt", []byte("version one")), "")
+	assert.Equal(t, "a.txt", v1.Path)
+	assert.Equal(t, int64(len("version one")), v1.Size)
+	assert.Equal(t, 1, v1.Version)
+	putFile(t, d, writeFile(t, dir, "b.txt", []byte("nested")), "docs/b.txt")
+
+	local := filepath.Join(dir, "got.txt")
+	pack, err := d.Get("a.txt", 0, local, "snappy")
+	require.NoError(t, err)
+	assert.Equal(t, v1.Hash, pack.MetaData.FileHash)
+	data, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.Equal(t, "version one", string(data))
+
+	files, err := d.List("")
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	assert.Equal(t, "a.txt", files[0].Path)
+	assert.Equal(t, "docs", files[1].Path)
+	assert.True(t, files[1].IsDir)
+
+	stat, err := d.Stat("docs/b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("nested")), stat.Size)
+
+	// нова версія, історія і відновлення старої
+	v2 := putFile(t, d, writeFile(t, dir, "a.txt", []byte("version two")), "")
+	assert.Equal(t, 2, v2.Version)
+	versions, err := d.Versions("a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 2)
+	assert.Equal(t, v2.Hash, versions[0].Hash)
+	assert.True(t, versions[0].Current)
+	assert.Equal(t, v1.Hash, versions[1].Hash)
+
+	restored, err := d.Restore("a.txt", versions[1].Version)
+	require.NoError(t, err)
+	assert.Equal(t, v1.Hash, restored.Hash)
+	_, err = d.GetHash(v2.Hash, local, "")
+	require.NoError(t, err)
+	data, err = os.ReadFile(local)
+	require.NoError(t, err)
+	assert.Equal(t, "version two", string(data))
+
+	// умовні запити з чужим хешем
+	pack, err = packet.NewTCPPacket(writeFile(t, dir, "a.txt", []byte("lost update")), "gzip")
+	require.NoError(t, err)
+	_, err = d.PutIf(pack, "", v2.Hash)
+	assert.ErrorIs(t, err, packet.ErrConflict)
+	requireResponseError(t, err, packet.StatusConflict, "conflict")
+	err = d.DeleteIf("a.txt", v2.Hash)
+	assert.ErrorIs(t, err, packet.ErrConflict)
+	_, err = d.PutIf(pack, "new.txt", packet.MatchNone)
+	require.NoError(t, err)
+	_, err = d.PutIf(pack, "new.txt", packet.MatchNone)
+	assert.ErrorIs(t, err, packet.ErrConflict)
+
+	require.NoError(t, d.Delete("docs/b.txt"))
+	_, err = d.Stat("docs/b.txt")
+	assert.ErrorIs(t, err, packet.ErrNotFound)
+	requireResponseError(t, err, packet.StatusNotFound, "not_found")
+	_, err = d.Get("docs/b.txt", 0, filepath.Join(dir, "missing.txt"), "")
+	assert.ErrorIs(t, err, packet.ErrNotFound)
+	assert.NoFileExists(t, filepath.Join(dir, "missing.txt"))
+}
+
+// Спільний доступ: bob читає простір alice і не може в нього писати
+func TestShareLoopback(t *testing.T) {
+	srv := testserver.Start(t, users)
+	alice := dial(t, srv, "alice")
+	bob := dial(t, srv, "bob")
+	bob.Namespace = "alice"
+	dir := t.TempDir()
+
+	putFile(t, alice, writeFile(t, dir, "shared.txt", []byte("for bob")), "")
+	_, err := bob.Stat("shared.txt")
+	assert.ErrorIs(t, err, packet.ErrForbidden)
+	requireResponseError(t, err, packet.StatusForbidden, "forbidden")
+
+	require.NoError(t, alice.Share("shared.txt", "bob", "r"))
+	local := filepath.Join(dir, "bob.txt")
+	_, err = bob.Get("shared.txt", 0, local, "")
+	require.NoError(t, err)
+	data, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.Equal(t, "for bob", string(data))
+
+	// відмова приходить після метаданих, дані не надсилаються,
+	// а з'єднання лишається робочим
+	pack, err := packet.NewTCPPacket(local, "gzip")
+	require.NoError(t, err)
+	_, err = bob.Put(pack, "shared.txt")
+	assert.ErrorIs(t, err, packet.ErrForbidden)
+	requireResponseError(t, err, packet.StatusForbidden, "forbidden")
+	_, err = bob.Stat("shared.txt")
+	require.NoError(t, err)
+
+	err = bob.Share("shared.txt", "bob", "rw")
+	assert.ErrorIs(t, err, packet.ErrForbidden)
+}
+
+// Завантаження понад квоту відхиляється до даних
+func TestQuotaRejectedLoopback(t *testing.T) {
+	srv := testserver.Start(t, users)
+	srv.Store.SetQuotas(storage.Quotas{Default: storage.Quota{Bytes: 1000}})
+	d := dial(t, srv, "alice")
+	dir := t.TempDir()
+
+	pack, err := packet.NewTCPPacket(writeFile(t, dir, "big.bin", make([]byte, 4000)), "gzip")
+	require.NoError(t, err)
+	_, err = d.Put(pack, "")
+	assert.ErrorIs(t, err, packet.ErrQuotaExceeded)
+	requireResponseError(t, err, packet.StatusInsufficientStorage, "quota_exceeded")
+
+	putFile(t, d, writeFile(t, dir, "small.txt", []byte("fits")), "")
+	_, err = d.Stat("big.bin")
+	assert.ErrorIs(t, err, packet.ErrNotFound)
+}
+
+// Змінений файл надсилається дельтою, перше завантаження - повністю
+func TestDeltaLoopback(t *testing.T) {
+	srv := testserver.Start(t, users)
+	d := dial(t, srv, "alice")
+	dir := t.TempDir()
+
+	data := make([]byte, 1<<20)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	path := writeFile(t, dir, "data.bin", data)
+
+	info, stats, err := d.PutDelta(path, "", "gzip", 0)
+	require.NoError(t, err)
+	assert.Nil(t, stats)
+	assert.Equal(t, 1, info.Version)
+
+	copy(data[500_000:], "changed in the middle")
+	writeFile(t, dir, "data.bin", data)
+	info, stats, err = d.PutDelta(path, "", "gzip", 0)
+	require.NoError(t, err)
+	require.NotNil(t, stats)
+	assert.Equal(t, 2, info.Version)
+	assert.Less(t, stats.Literal, int64(len(data)/10))
+	assert.Equal(t, int64(len(data)), stats.Literal+stats.Copied)
+
+	local := filepath.Join(dir, "back.bin")
+	_, err = d.Get("data.bin", 0, local, "none")
+	require.NoError(t, err)
+	got, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// дельта до застарілої версії не приймається
+	_, _, err = d.PutDeltaIf(path, "", "gzip", 0, "stale")
+	assert.ErrorIs(t, err, packet.ErrConflict)
+}
+
+// Завантаження діапазонами продовжується з будь-якого листа, а заміна
+// файлу посеред завантаження помічається за коренем
+func TestRangeLoopback(t *testing.T) {
+	srv := testserver.Start(t, users)
+	d := dial(t, srv, "alice")
+	dir := t.TempDir()
+
+	data := make([]byte, 2*packet.MaxRangeLength+1000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	putFile(t, d, writeFile(t, dir, "big.bin", data), "")
+
+	got, info, err := d.GetRange("big.bin", 0, 0, packet.MaxRangeLength, "")
+	require.NoError(t, err)
+	assert.Equal(t, data[:packet.MaxRangeLength], got)
+	assert.Equal(t, int64(len(data)), info.Size)
+	root := info.MerkleRoot
+	require.NotEmpty(t, root)
+
+	// нове з'єднання продовжує з того, що вже отримано
+	d = dial(t, srv, "alice")
+	for int64(len(got)) < info.Size {
+		more, _, err := d.GetRange("big.bin", 0, int64(len(got)), 0, root)
+		require.NoError(t, err)
+		got = append(got, more...)
+	}
+	assert.Equal(t, data, got)
+
+	data[0] ^= 1
+	putFile(t, d, writeFile(t, dir, "big.bin", data), "")
+	// сервер не змішує вміст: корінь уже інший
+	_, _, err = d.GetRange("big.bin", 0, packet.MaxRangeLength, 0, root)
+	assert.ErrorIs(t, err, packet.ErrConflict)
+	// попередня версія лишилася тією самою
+	_, _, err = d.GetRange("big.bin", 1, packet.MaxRangeLength, 0, root)
+	assert.NoError(t, err)
+}
+
+// Перерване завантаження продовжується з перевірених листків
+func TestDownloadResumeLoopback(t *testing.T) {
+	srv := testserver.Start(t, users)
+	d := dial(t, srv, "alice")
+	dir := t.TempDir()
+
+	data := make([]byte, 3*packet.MaxRangeLength+1000)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	putFile(t, d, writeFile(t, dir, "big.bin", data), "")
+
+	local := filepath.Join(dir, "out.bin")
+	info, resumed, err := d.Download(&packet.Request{Path: "big.bin"}, local)
+	require.NoError(t, err)
+	assert.Zero(t, resumed)
+	assert.Equal(t, int64(len(data)), info.Size)
+	got, err := os.ReadFile(local)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.NoFileExists(t, local+".part")
+	assert.NoFileExists(t, local+".part.json")
+
+	// перервано після двох діапазонів
+	interrupt := func(t *testing.T, root string) {
+		t.Helper()
+		part := data[:2*packet.MaxRangeLength]
+		state := &partial{Root: root, Hash: info.Hash, Size: info.Size}
+		for off := 0; off < len(part); off += packet.MerkleLeafSize {
+			state.Leaves = append(state.Leaves, packet.MerkleLeafHash(part[off:off+packet.MerkleLeafSize]))
+		}
+		require.NoError(t, os.WriteFile(local+".part", part, 0o644))
+		require.NoError(t, state.save(local+".part.json"))
+	}
+
+	t.Run("resume", func(t *testing.T) {
+		interrupt(t, info.MerkleRoot)
+		_, resumed, err := d.Download(&packet.Request{Path: "big.bin"}, local)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2*packet.MaxRangeLength), resumed)
+		got, err := os.ReadFile(local)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("corrupted local leaf", func(t *testing.T) {
+		interrupt(t, info.MerkleRoot)
+		f, err := os.OpenFile(local+".part", os.O_RDWR, 0)
+		require.NoError(t, err)
+		_, err = f.WriteAt([]byte{data[5*packet.MerkleLeafSize] ^ 1}, 5*packet.MerkleLeafSize)
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+
+		// продовжує лише з листків до зіпсованого
+		_, resumed, err := d.Download(&packet.Request{Path: "big.bin"}, local)
+		require.NoError(t, err)
+		assert.Equal(t, int64(5*packet.MerkleLeafSize), resumed)
+		got, err := os.ReadFile(local)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+	})
+
+	t.Run("changed remote file", func(t *testing.T) {
+		interrupt(t, info.MerkleRoot)
+		changed := append([]byte(nil), data...)
+		changed[0] ^= 1
+		putFile(t, d, writeFile(t, dir, "big.bin", changed), "")
+
+		// старі листки не підходять новому кореню, завантаження з початку
+		_, resumed, err := d.Download(&packet.Request{Path: "big.bin"}, local)
+		require.NoError(t, err)
+		assert.Zero(t, resumed)
+		got, err := os.ReadFile(local)
+		require.NoError(t, err)
+		assert.Equal(t, changed, got)
+	})
+}
+
+// Список, більший за кадр, приходить сторінками
+func TestListLargeLoopback(t *testing.T) {
+	srv := testserver.Start(t, users)
+	d := dial(t, srv, "alice")
+
+	// довгі шляхи: разом більше 1 МіБ JSON
+	long := strings.TrimSuffix(strings.Repeat(strings.Repeat("d", 250)+"/", 16), "/")
+	const count = 300
+	for i := range count {
+		_, err := srv.Store.Put("alice", "alice", fmt.Sprintf("big/%s/%05d.txt", long, i), strings.NewReader("x"), storage.PutOptions{Mode: 0o644})
+		require.NoError(t, err)
+	}
+
+	files, err := d.List("big/" + long)
+	require.NoError(t, err)
+	require.Len(t, files, count)
+	for i, file := range files {
+		assert.Equal(t, fmt.Sprintf("big/%s/%05d.txt", long, i), file.Path)
+	}
+}
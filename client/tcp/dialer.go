@@ -2,21 +2,31 @@ package tcp
 
 import (
 	packet "EternalPacket"
-	"bufio"
+	"crypto/tls"
 	"eternalStorageClient/logger"
-	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
 	"net"
-	"os"
 )
 
+// tlsHandshakeFailures - certificate or protocol errors, the same metric
+// the server has
+var tlsHandshakeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "eternal_tls_handshake_failures_total",
+	Help: "TLS handshakes that failed.",
+})
+
+// Collectors - connection metrics of the dialer
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{tlsHandshakeFailures}
+}
+
 type DialerTCP struct {
 	RemoteAddr string
-	conn       net.Conn
-	logger     *logger.EtrnlLogger
-
-	inMsgChan  chan string
-	outMsgChan chan string
-	errChan    chan error
+	// Namespace - whose files the commands work on, empty - own
+	Namespace string
+	conn      net.Conn
+	logger    *logger.EtrnlLogger
+	nextID    uint64
 }
 
 func NewDialerTCP(remoteAddr string) (*DialerTCP, error) {
@@ -28,74 +38,56 @@ func NewDialerTCP(remoteAddr string) (*DialerTCP, error) {
 
 	return &DialerTCP{
 		RemoteAddr: remoteAddr,
-		logger:     logger.NewEtrnlLogger(),
+		logger:     logger.Wrap(packet.Logger()),
 		conn:       conn,
-		inMsgChan:  make(chan string),
-		outMsgChan: make(chan string),
-		errChan:    make(chan error),
 	}, nil
 }
 
-func (d *DialerTCP) SendFile(pack *packet.TCPPacket) error {
-	defer d.conn.Close()
-
-	err := pack.SendOverTCP(d.conn)
+// NewDialerTLS - connection over TLS, authenticated with user token or password
+// before anything else is sent
+func NewDialerTLS(remoteAddr string, config *tls.Config, user, secret string) (*DialerTCP, error) {
+	raw, err := net.Dial("tcp", remoteAddr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Println("send successfully")
-	return nil
-}
-
-func (d *DialerTCP) ReceiveFile(path string) (*packet.TCPPacket, error) {
-	defer d.conn.Close()
-	return packet.ReceiveOverTCP(d.conn, path)
-}
-
-func (d *DialerTCP) Dial() error {
-	var err error
-	d.conn, err = net.Dial("tcp", d.RemoteAddr)
-	if err != nil {
-		return d.logger.Err(err, "connection error")
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(remoteAddr)
+	}
+	conn := tls.Client(raw, config)
+	if err := conn.Handshake(); err != nil {
+		tlsHandshakeFailures.Inc()
+		_ = raw.Close()
+		return nil, err
 	}
-	d.logger.Info("connected to: " + d.conn.RemoteAddr().String())
-
-	go d.handleIncoming()
-	go d.handleOutgoing()
 
-	for {
-		select {
-		case msg := <-d.inMsgChan:
-			fmt.Printf("$-> %s", string(msg))
-		case <-d.outMsgChan:
-		case e := <-d.errChan:
-			return d.logger.Err(e, "error in communication")
-		}
+	if err := packet.ClientAuth(conn, user, secret); err != nil {
+		_ = conn.Close()
+		return nil, err
 	}
+
+	return &DialerTCP{
+		RemoteAddr: remoteAddr,
+		logger:     logger.Wrap(packet.Logger()),
+		conn:       conn,
+	}, nil
 }
 
-func (d *DialerTCP) handleIncoming() {
-	for {
-		reader, err := bufio.NewReader(d.conn).ReadString('\n')
-		if err != nil {
-			d.errChan <- err
-		}
-		d.inMsgChan <- reader
+// SendFile stores the packet under its file name
+func (d *DialerTCP) SendFile(pack *packet.TCPPacket) error {
+	if _, err := d.Put(pack, ""); err != nil {
+		return err
 	}
+	d.logger.Info("file sent", "file", pack.MetaData.FileName, "remote", d.RemoteAddr)
+	return nil
 }
 
-func (d *DialerTCP) handleOutgoing() {
-	for {
-		reader, err := bufio.NewReader(os.Stdin).ReadString('\n')
-		if err != nil {
-			d.errChan <- err
-		}
-
-		_, err = d.conn.Write([]byte(reader + "\n"))
-		if err != nil {
-			d.errChan <- err
-		}
+// ReceiveFile downloads the current version of remotePath to path,
+// the data is verified against the hash stored on the server
+func (d *DialerTCP) ReceiveFile(remotePath, path string) (*packet.TCPPacket, error) {
+	return d.Get(remotePath, 0, path, "")
+}
 
-		d.outMsgChan <- reader
-	}
+func (d *DialerTCP) Close() error {
+	return d.conn.Close()
 }
@@ -0,0 +1,154 @@
+package tcp
+
+import (
+	packet "EternalPacket"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// partial - what a download in ranges verified so far, kept next to the
+// data in <local>.part.json
+type partial struct {
+	// Root - merkle root every leaf was verified against
+	Root string `json:"root"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	// Leaves - hashes of the verified leaves at the start of the data
+	Leaves []string `json:"leaves"`
+}
+
+// Download fetches the file of req (Path and Version, or Hash) into
+// localPath in verified ranges. An interrupted download leaves
+// localPath+".part" and its proof ".part.json", the next Download proves
+// the data it has against the leaf hashes it verified before and asks the
+// server to continue from the first leaf it can't prove, as long as the
+// content still has the same root. Otherwise it starts over. Returns the
+// stored file and how many bytes were reused.
+func (d *DialerTCP) Download(req *packet.Request, localPath string) (*packet.FileInfo, int64, error) {
+	dataPath, statePath := localPath+".part", localPath+".part.json"
+	state, data, err := resumePartial(dataPath, statePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer data.Close()
+	resumed := int64(len(state.Leaves)) * packet.MerkleLeafSize
+
+	offset := resumed
+	var info *packet.FileInfo
+	for restarted := false; ; {
+		if info != nil && offset >= info.Size {
+			break
+		}
+		rng, got, err := d.getRange(&packet.Request{Path: req.Path, Hash: req.Hash, Version: req.Version, Offset: offset}, state.Root)
+		if errors.Is(err, packet.ErrConflict) && !restarted {
+			// the content changed since the partial download, start over
+			restarted, offset, resumed = true, 0, 0
+			state = &partial{}
+			if err := data.Truncate(0); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, resumed, err
+		}
+		info = got
+		if state.Root == "" {
+			state.Root, state.Hash, state.Size = info.MerkleRoot, info.Hash, info.Size
+		}
+		if _, err := data.WriteAt(rng.Data, offset); err != nil {
+			return nil, resumed, err
+		}
+		for i := 0; i < max(1, (len(rng.Data)+packet.MerkleLeafSize-1)/packet.MerkleLeafSize); i++ {
+			leaf := rng.Data[i*packet.MerkleLeafSize : min((i+1)*packet.MerkleLeafSize, len(rng.Data))]
+			state.Leaves = append(state.Leaves, packet.MerkleLeafHash(leaf))
+		}
+		// the data first, a proof never covers data that isn't written
+		if err := data.Sync(); err != nil {
+			return nil, resumed, err
+		}
+		if err := state.save(statePath); err != nil {
+			return nil, resumed, err
+		}
+		offset += int64(len(rng.Data))
+	}
+
+	if err := checkHash(data, info.Hash); err != nil {
+		_ = os.Remove(statePath)
+		return nil, resumed, fmt.Errorf("download of %s is corrupted: %w", req.Path+req.Hash, err)
+	}
+	if err := data.Close(); err != nil {
+		return nil, resumed, err
+	}
+	if err := os.Rename(dataPath, localPath); err != nil {
+		return nil, resumed, err
+	}
+	_ = os.Remove(statePath)
+	return info, resumed, nil
+}
+
+// resumePartial opens the partial data, keeping only the leaves that
+// still match the hashes verified before. Without a usable proof the
+// download starts from nothing.
+func resumePartial(dataPath, statePath string) (*partial, *os.File, error) {
+	data, err := os.OpenFile(dataPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	state := &partial{}
+	raw, err := os.ReadFile(statePath)
+	if err == nil && json.Unmarshal(raw, state) != nil {
+		state = &partial{}
+	}
+
+	buf := make([]byte, packet.MerkleLeafSize)
+	proven := 0
+	for ; proven < len(state.Leaves); proven++ {
+		n, err := io.ReadFull(data, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+			data.Close()
+			return nil, nil, err
+		}
+		if n == 0 || packet.MerkleLeafHash(buf[:n]) != state.Leaves[proven] {
+			break
+		}
+	}
+	if proven > 0 && int64(proven)*packet.MerkleLeafSize >= state.Size {
+		// the last leaf is fetched again, its range brings the file info
+		proven--
+	}
+	if proven == 0 {
+		state = &partial{}
+	}
+	state.Leaves = state.Leaves[:proven]
+	if err := data.Truncate(int64(proven) * packet.MerkleLeafSize); err != nil {
+		data.Close()
+		return nil, nil, err
+	}
+	return state, data, nil
+}
+
+func (p *partial) save(path string) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// checkHash - sha256 of the whole file is want
+func checkHash(f *os.File, want string) error {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+		return &packet.MismatchError{Err: packet.ErrHashMismatch, Got: got, Want: want}
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+//go:build linux
+
+package watch
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// inotify watches every directory under the root, directories
+// created later get their own watch
+type inotify struct {
+	file   *os.File
+	fd     int
+	root   string
+	ignore func(path string) bool
+	events chan string
+	errors chan error
+	done   chan struct{}
+
+	mu   sync.Mutex
+	dirs map[int32]string
+}
+
+func newNotifier(root string, ignore func(path string) bool) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotify{
+		// non blocking fd goes to the runtime poller, so Close wakes up Read
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		root:   root,
+		ignore: ignore,
+		events: make(chan string, 256),
+		errors: make(chan error, 1),
+		done:   make(chan struct{}),
+		dirs:   make(map[int32]string),
+	}
+	if err := n.addTree(root); err != nil {
+		_ = n.file.Close()
+		return nil, err
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotify) Events() <-chan string { return n.events }
+func (n *inotify) Errors() <-chan error  { return n.errors }
+
+func (n *inotify) Close() error {
+	close(n.done)
+	return n.file.Close()
+}
+
+func (n *inotify) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			// removed in the meantime
+			if errors.Is(err, os.ErrNotExist) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if n.ignore(path) {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(n.fd, path, inotifyMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		n.mu.Lock()
+		n.dirs[int32(wd)] = path
+		n.mu.Unlock()
+		return nil
+	})
+}
+
+func (n *inotify) read() {
+	defer close(n.events)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+
+	for {
+		count, err := n.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				n.fail(err)
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= count; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			n.handle(event, cString(nameBytes))
+		}
+	}
+}
+
+func (n *inotify) handle(event *syscall.InotifyEvent, name string) {
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		// events were lost, the whole tree has to be checked
+		n.send(n.root)
+		return
+	}
+
+	n.mu.Lock()
+	dir, ok := n.dirs[event.Wd]
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		delete(n.dirs, event.Wd)
+	}
+	n.mu.Unlock()
+	if !ok || event.Mask&syscall.IN_IGNORED != 0 {
+		return
+	}
+
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+	if n.ignore(path) {
+		return
+	}
+
+	isDir := event.Mask&syscall.IN_ISDIR != 0
+	if isDir && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		if err := n.addTree(path); err != nil {
+			n.fail(err)
+		}
+	}
+	n.send(path)
+}
+
+func (n *inotify) send(path string) {
+	select {
+	case n.events <- path:
+	case <-n.done:
+	}
+}
+
+func (n *inotify) fail(err error) {
+	select {
+	case n.errors <- err:
+	default:
+	}
+}
+
+func cString(b []byte) string {
+	for i, c := range b {
+		if c == 0 {
+			return string(b[:i])
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,121 @@
+//go:build !linux
+
+package watch
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// pollInterval - how often the tree is scanned where inotify isn't available
+const pollInterval = 2 * time.Second
+
+// poller compares sizes and modification times of the tree every pollInterval
+type poller struct {
+	root   string
+	ignore func(path string) bool
+	events chan string
+	errors chan error
+	done   chan struct{}
+}
+
+func newNotifier(root string, ignore func(path string) bool) (notifier, error) {
+	p := &poller{
+		root:   root,
+		ignore: ignore,
+		events: make(chan string, 256),
+		errors: make(chan error, 1),
+		done:   make(chan struct{}),
+	}
+	seen, err := p.scan()
+	if err != nil {
+		return nil, err
+	}
+	go p.run(seen)
+	return p, nil
+}
+
+func (p *poller) Events() <-chan string { return p.events }
+func (p *poller) Errors() <-chan error  { return p.errors }
+
+func (p *poller) Close() error {
+	close(p.done)
+	return nil
+}
+
+type polled struct {
+	size    int64
+	modTime time.Time
+}
+
+func (p *poller) run(seen map[string]polled) {
+	defer close(p.events)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		current, err := p.scan()
+		if err != nil {
+			select {
+			case p.errors <- err:
+			default:
+			}
+			continue
+		}
+		for path, file := range current {
+			if old, ok := seen[path]; !ok || old != file {
+				p.send(path)
+			}
+		}
+		for path := range seen {
+			if _, ok := current[path]; !ok {
+				p.send(path)
+			}
+		}
+		seen = current
+	}
+}
+
+func (p *poller) send(path string) {
+	select {
+	case p.events <- path:
+	case <-p.done:
+	}
+}
+
+func (p *poller) scan() (map[string]polled, error) {
+	files := make(map[string]polled)
+	err := filepath.WalkDir(p.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && path != p.root {
+				return nil
+			}
+			return err
+		}
+		if p.ignore(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[path] = polled{size: info.Size(), modTime: info.ModTime()}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,69 @@
+package watch
+
+import (
+	packet "EternalPacket"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// StateFile - default name of the state DB, kept in the watched directory
+const StateFile = ".eternal-state.json"
+
+const stateVersion = 1
+
+// Entry - what was uploaded for a local file
+type Entry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Hash    string    `json:"hash"`
+	Version int       `json:"version,omitempty"`
+}
+
+// State - local files already on the server, so a restart only
+// uploads what changed while the watcher wasn't running
+type State struct {
+	Version int `json:"version"`
+	// Remote - directory the files were uploaded to, state of
+	// another directory is not used
+	Remote string `json:"remote"`
+	// Files - slash separated path relative to the watched directory -> entry
+	Files map[string]Entry `json:"files"`
+
+	path string
+}
+
+// LoadState reads the state DB, missing file or state of another
+// remote directory gives an empty state
+func LoadState(path, remote string) (*State, error) {
+	state := &State{Version: stateVersion, Remote: remote, Files: make(map[string]Entry), path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var saved State
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("error parsing watch state %s: %w", path, err)
+	}
+	if saved.Version != stateVersion || saved.Remote != remote || saved.Files == nil {
+		return state, nil
+	}
+	saved.path = path
+	return &saved, nil
+}
+
+func (s *State) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return packet.WriteFileAtomic(s.path, data, 0o600)
+}
@@ -0,0 +1,385 @@
+// Package watch uploads files of a local directory whenever they change
+package watch
+
+import (
+	packet "EternalPacket"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Client - what the watcher needs from a connection, *tcp.DialerTCP
+type Client interface {
+	PutDelta(localPath, remotePath, compressType string, ttl int64) (*packet.FileInfo, *packet.DeltaStats, error)
+	Delete(remotePath string) error
+}
+
+// notifier reports paths under the watched directory that may have changed
+type notifier interface {
+	Events() <-chan string
+	Errors() <-chan error
+	Close() error
+}
+
+const (
+	DefaultDebounce = 2 * time.Second
+
+	// a file written all the time is still uploaded this often
+	maxWaitFactor = 10
+)
+
+type Options struct {
+	// Remote - directory on the server the files go to
+	Remote string
+	// State - state DB path, default StateFile in the watched directory
+	State string
+	// Codec - compression of full uploads
+	Codec string
+	// TTL - seconds the server keeps uploads, 0 - no limit
+	TTL int64
+	// Debounce - how long a file has to stay unchanged before upload
+	Debounce time.Duration
+	// OnEvent is called after every upload, delete or failure
+	OnEvent func(Event)
+}
+
+// Event - what the watcher did
+type Event struct {
+	Op      string `json:"op"` // put, delete, error
+	Path    string `json:"path"`
+	Remote  string `json:"remote,omitempty"`
+	Version int    `json:"version,omitempty"`
+	// Sent - bytes of file data sent, less than Size for deltas
+	Sent  int64  `json:"sent,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type Watcher struct {
+	dir     string
+	opts    Options
+	state   *State
+	connect func() (Client, error)
+	client  Client
+}
+
+// New prepares watching dir, connect is called for the first upload
+// and again after the connection failed
+func New(dir string, opts Options, connect func() (Client, error)) (*Watcher, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+
+	if opts.State == "" {
+		opts.State = filepath.Join(dir, StateFile)
+	}
+	if opts.State, err = filepath.Abs(opts.State); err != nil {
+		return nil, err
+	}
+	if opts.Debounce <= 0 {
+		opts.Debounce = DefaultDebounce
+	}
+	if opts.OnEvent == nil {
+		opts.OnEvent = func(Event) {}
+	}
+
+	state, err := LoadState(opts.State, opts.Remote)
+	if err != nil {
+		return nil, err
+	}
+	return &Watcher{dir: dir, opts: opts, state: state, connect: connect}, nil
+}
+
+// Run uploads what changed since the last run and then every change
+// until ctx is done
+func (w *Watcher) Run(ctx context.Context) error {
+	n, err := newNotifier(w.dir, w.ignored)
+	if err != nil {
+		return err
+	}
+	defer n.Close()
+
+	// changes made while the watcher wasn't running, including deletes
+	pending := map[string]time.Time{w.dir: time.Now()}
+	w.flush(pending)
+
+	timer := time.NewTimer(w.opts.Debounce)
+	timer.Stop()
+	var oldest time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case path, ok := <-n.Events():
+			if !ok {
+				return errors.New("watch stopped")
+			}
+			now := time.Now()
+			if len(pending) == 0 {
+				oldest = now
+			}
+			if _, ok := pending[path]; !ok {
+				pending[path] = now
+			}
+			// bursts of writes are uploaded once they're over, but not later than maxWait
+			if now.Sub(oldest) < maxWaitFactor*w.opts.Debounce {
+				timer.Reset(w.opts.Debounce)
+			}
+		case err := <-n.Errors():
+			w.opts.OnEvent(Event{Op: "error", Path: w.dir, Error: err.Error()})
+		case <-timer.C:
+			w.flush(pending)
+			if len(pending) > 0 {
+				// failed uploads are retried later
+				oldest = time.Now()
+				timer.Reset(maxWaitFactor * w.opts.Debounce)
+			}
+		}
+	}
+}
+
+// flush handles pending paths, the ones that failed stay in pending
+func (w *Watcher) flush(pending map[string]time.Time) {
+	paths := make([]string, 0, len(pending))
+	for path := range pending {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	changed := false
+	for _, path := range paths {
+		done, err := w.sync(path)
+		changed = changed || done
+		if err != nil {
+			w.opts.OnEvent(Event{Op: "error", Path: path, Error: err.Error()})
+			continue
+		}
+		delete(pending, path)
+	}
+	if changed {
+		if err := w.state.Save(); err != nil {
+			w.opts.OnEvent(Event{Op: "error", Path: w.opts.State, Error: err.Error()})
+		}
+	}
+}
+
+// sync brings the server copy of path (file or directory) up to date,
+// reports if the state changed
+func (w *Watcher) sync(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return w.removedUnder(path)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return false, nil
+		}
+		return w.changed(path, info)
+	}
+
+	// files of a new, moved in or overflowed directory, and the ones under it that are gone
+	changed, err := w.removedUnder(path)
+	if err != nil {
+		return changed, err
+	}
+	var failed []error
+	err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if w.ignored(file) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		done, err := w.changed(file, info)
+		changed = changed || done
+		if err != nil {
+			failed = append(failed, fmt.Errorf("%s: %w", file, err))
+		}
+		return nil
+	})
+	if err == nil {
+		err = errors.Join(failed...)
+	}
+	return changed, err
+}
+
+func (w *Watcher) changed(path string, info fs.FileInfo) (bool, error) {
+	rel, err := w.rel(path)
+	if err != nil {
+		return false, err
+	}
+	entry, known := w.state.Files[rel]
+	if known && entry.Size == info.Size() && entry.ModTime.Equal(info.ModTime()) {
+		return false, nil
+	}
+
+	hash, err := fileHash(path)
+	if err != nil {
+		return false, err
+	}
+	if known && entry.Hash == hash {
+		// touched, content is the same
+		entry.ModTime = info.ModTime()
+		w.state.Files[rel] = entry
+		return true, nil
+	}
+
+	client, err := w.dial()
+	if err != nil {
+		return false, err
+	}
+	remote := w.remote(rel)
+	file, stats, err := client.PutDelta(path, remote, w.opts.Codec, w.opts.TTL)
+	if err != nil {
+		w.dropClient(err)
+		return false, err
+	}
+
+	sent := file.Size
+	if stats != nil {
+		sent = stats.Literal
+	}
+	w.state.Files[rel] = Entry{Size: info.Size(), ModTime: info.ModTime(), Hash: file.Hash, Version: file.Version}
+	w.opts.OnEvent(Event{Op: "put", Path: path, Remote: remote, Version: file.Version, Sent: sent, Size: file.Size})
+	return true, nil
+}
+
+// removedUnder deletes on the server the files of the state under path
+// (or path itself) that don't exist locally anymore
+func (w *Watcher) removedUnder(path string) (bool, error) {
+	rel, err := w.rel(path)
+	if err != nil {
+		return false, err
+	}
+
+	var gone []string
+	for file := range w.state.Files {
+		if rel != "." && file != rel && !strings.HasPrefix(file, rel+"/") {
+			continue
+		}
+		if _, err := os.Lstat(filepath.Join(w.dir, filepath.FromSlash(file))); errors.Is(err, os.ErrNotExist) {
+			gone = append(gone, file)
+		}
+	}
+	if len(gone) == 0 {
+		return false, nil
+	}
+	sort.Strings(gone)
+
+	client, err := w.dial()
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for _, file := range gone {
+		remote := w.remote(file)
+		err := client.Delete(remote)
+		if errors.Is(err, packet.ErrNotFound) {
+			err = nil
+		}
+		if err != nil {
+			w.dropClient(err)
+			return changed, err
+		}
+		delete(w.state.Files, file)
+		changed = true
+		w.opts.OnEvent(Event{Op: "delete", Path: filepath.Join(w.dir, filepath.FromSlash(file)), Remote: remote})
+	}
+	return changed, nil
+}
+
+func (w *Watcher) dial() (Client, error) {
+	if w.client != nil {
+		return w.client, nil
+	}
+	client, err := w.connect()
+	if err != nil {
+		return nil, err
+	}
+	w.client = client
+	return client, nil
+}
+
+// dropClient forgets a connection that failed, errors reported
+// by the server leave it usable
+func (w *Watcher) dropClient(err error) {
+	var respErr *packet.ResponseError
+	if errors.As(err, &respErr) || w.client == nil {
+		return
+	}
+	if closer, ok := w.client.(io.Closer); ok {
+		_ = closer.Close()
+	}
+	w.client = nil
+}
+
+func (w *Watcher) ignored(path string) bool {
+	name := filepath.Base(path)
+	state := filepath.Base(w.opts.State)
+	return path == w.opts.State || strings.HasPrefix(name, "."+state+".tmp-")
+}
+
+// rel - slash separated path relative to the watched directory
+func (w *Watcher) rel(path string) (string, error) {
+	rel, err := filepath.Rel(w.dir, path)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%s is outside of %s", path, w.dir)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+func (w *Watcher) remote(rel string) string {
+	return path.Join(w.opts.Remote, rel)
+}
+
+func fileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
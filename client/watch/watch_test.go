@@ -0,0 +1,135 @@
+package watch
+
+import (
+	packet "EternalPacket"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClient - сервер у пам'яті: шлях -> вміст
+type fakeClient struct {
+	mu    sync.Mutex
+	files map[string]string
+	puts  int
+}
+
+func (c *fakeClient) PutDelta(localPath, remotePath, _ string, _ int64) (*packet.FileInfo, *packet.DeltaStats, error) {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash, err := fileHash(localPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.files[remotePath] = string(data)
+	c.puts++
+	return &packet.FileInfo{Path: remotePath, Hash: hash, Size: int64(len(data)), Version: c.puts}, nil, nil
+}
+
+func (c *fakeClient) Delete(remotePath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.files[remotePath]; !ok {
+		return &packet.ResponseError{Status: packet.StatusNotFound}
+	}
+	delete(c.files, remotePath)
+	return nil
+}
+
+func (c *fakeClient) snapshot() (map[string]string, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files := make(map[string]string, len(c.files))
+	for k, v := range c.files {
+		files[k] = v
+	}
+	return files, c.puts
+}
+
+func runWatcher(t *testing.T, dir string, client *fakeClient) context.CancelFunc {
+	t.Helper()
+	w, err := New(dir, Options{Remote: "backup", Debounce: 50 * time.Millisecond},
+		func() (Client, error) { return client, nil })
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, w.Run(ctx))
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func TestWatchUploadsChanges(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a1"), 0o644))
+	client := &fakeClient{files: make(map[string]string)}
+
+	stop := runWatcher(t, dir, client)
+	// файли, що вже були в каталозі, вивантажуються одразу
+	assert.Eventually(t, func() bool {
+		files, _ := client.snapshot()
+		return files["backup/a.txt"] == "a1"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	// нові, змінені та видалені файли, у тому числі в нових підкаталогах
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub", "deep"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "deep", "b.txt"), []byte("b"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a2"), 0o644))
+	assert.Eventually(t, func() bool {
+		files, _ := client.snapshot()
+		return files["backup/a.txt"] == "a2" && files["backup/sub/deep/b.txt"] == "b"
+	}, 5*time.Second, 20*time.Millisecond)
+
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "sub")))
+	assert.Eventually(t, func() bool {
+		files, _ := client.snapshot()
+		_, ok := files["backup/sub/deep/b.txt"]
+		return !ok
+	}, 5*time.Second, 20*time.Millisecond)
+	stop()
+
+	// після перезапуску незмінені файли не вивантажуються повторно,
+	// а видалені без вотчера - видаляються на сервері
+	_, puts := client.snapshot()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "c.txt"), []byte("c"), 0o644))
+	require.NoError(t, os.Remove(filepath.Join(dir, "a.txt")))
+
+	stop = runWatcher(t, dir, client)
+	assert.Eventually(t, func() bool {
+		files, _ := client.snapshot()
+		_, hasA := files["backup/a.txt"]
+		return files["backup/c.txt"] == "c" && !hasA
+	}, 5*time.Second, 20*time.Millisecond)
+	stop()
+
+	files, after := client.snapshot()
+	assert.Equal(t, puts+1, after)
+	assert.Equal(t, map[string]string{"backup/c.txt": "c"}, files)
+
+	state, err := LoadState(filepath.Join(dir, StateFile), "backup")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c.txt"}, keys(state.Files))
+}
+
+func keys(m map[string]Entry) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	return out
+}
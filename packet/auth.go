@@ -0,0 +1,237 @@
+package packet
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Authentication runs right after the TLS handshake:
+//
+//	server -> client: challenge {version, server nonce}
+//	client -> server: response  {user, client nonce, HMAC(key, client label | nonces | user)}
+//	server -> client: result    {ok, error, HMAC(key, server label | nonces | user)}
+//
+// key is derived from the user's token or password, so the secret itself
+// never crosses the wire and the client also checks that the server knows it.
+const (
+	authVersion   = 1
+	authNonceSize = 32
+	authKeySize   = 32
+)
+
+var ErrAuthFailed = errors.New("authentication failed")
+
+// CredentialStore - server side lookup of user auth keys
+type CredentialStore interface {
+	AuthKey(user string) ([]byte, bool)
+}
+
+// Credentials - user -> key from DeriveAuthKey. Only derived keys are kept,
+// never tokens or passwords themselves.
+type Credentials map[string][]byte
+
+func (c Credentials) AuthKey(user string) ([]byte, bool) {
+	key, ok := c[user]
+	return key, ok
+}
+
+// Add derives and stores the key for user, replacing the old one
+func (c Credentials) Add(user, secret string) error {
+	key, err := DeriveAuthKey(user, secret)
+	if err != nil {
+		return err
+	}
+	c[user] = key
+	return nil
+}
+
+func (c Credentials) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, data, 0o600)
+}
+
+func LoadCredentials(path string) (Credentials, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	creds := make(Credentials)
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("error parsing credentials %s: %w", path, err)
+	}
+	return creds, nil
+}
+
+// DeriveAuthKey turns an API token or password into the HMAC key,
+// salted with the user name so equal passwords give different keys
+func DeriveAuthKey(user, secret string) ([]byte, error) {
+	if user == "" || secret == "" {
+		return nil, errors.New("user or secret is empty")
+	}
+	return scrypt.Key([]byte(secret), []byte("EternalStorage auth:"+user), scryptN, scryptR, scryptP, authKeySize)
+}
+
+// S3SecretKey - secret key of the S3 endpoint, derived from the auth key
+// with its own label, so an S3 secret known to a tool doesn't let anyone
+// log in over TCP
+func S3SecretKey(authKey []byte) string {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write([]byte("EternalStorage s3"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type authChallenge struct {
+	Version int    `json:"version"`
+	Nonce   []byte `json:"nonce"`
+}
+
+type authResponse struct {
+	User  string `json:"user"`
+	Nonce []byte `json:"nonce"`
+	MAC   []byte `json:"mac"`
+}
+
+type authResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	MAC   []byte `json:"mac,omitempty"`
+}
+
+// ClientAuth - client side of the handshake with a token or password
+func ClientAuth(conn io.ReadWriter, user, secret string) error {
+	key, err := DeriveAuthKey(user, secret)
+	if err != nil {
+		return err
+	}
+	return ClientAuthKey(conn, user, key)
+}
+
+// ClientAuthKey - ClientAuth with an already derived key
+func ClientAuthKey(conn io.ReadWriter, user string, key []byte) error {
+	var challenge authChallenge
+	if err := readFrame(conn, &challenge); err != nil {
+		return fmt.Errorf("error reading auth challenge: %w", err)
+	}
+	if challenge.Version != authVersion {
+		return fmt.Errorf("%w: auth version %d", ErrProtocolVersion, challenge.Version)
+	}
+	if len(challenge.Nonce) != authNonceSize {
+		return fmt.Errorf("%w: bad auth challenge nonce size: %d", ErrProtocol, len(challenge.Nonce))
+	}
+
+	nonce, err := authNonce()
+	if err != nil {
+		return err
+	}
+	err = writeFrame(conn, authResponse{
+		User:  user,
+		Nonce: nonce,
+		MAC:   authMAC(key, "client", challenge.Nonce, nonce, user),
+	})
+	if err != nil {
+		return err
+	}
+
+	var result authResult
+	if err := readFrame(conn, &result); err != nil {
+		return fmt.Errorf("error reading auth result: %w", err)
+	}
+	if !result.OK {
+		return fmt.Errorf("%w: %s", ErrAuthFailed, result.Error)
+	}
+	if !hmac.Equal(result.MAC, authMAC(key, "server", challenge.Nonce, nonce, user)) {
+		return fmt.Errorf("%w: server doesn't know the user key", ErrAuthFailed)
+	}
+	return nil
+}
+
+// ServerAuth - server side of the handshake, returns the authenticated user.
+// Anything other than a valid response (e.g. a client that starts sending
+// a packet right away) is rejected.
+func ServerAuth(conn io.ReadWriter, store CredentialStore) (string, error) {
+	nonce, err := authNonce()
+	if err != nil {
+		return "", err
+	}
+	if err := writeFrame(conn, authChallenge{Version: authVersion, Nonce: nonce}); err != nil {
+		return "", err
+	}
+
+	var resp authResponse
+	if err := readFrame(conn, &resp); err != nil {
+		_ = writeFrame(conn, authResult{Error: "authentication required"})
+		return "", fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	if resp.User == "" || len(resp.Nonce) != authNonceSize {
+		_ = writeFrame(conn, authResult{Error: "authentication required"})
+		return "", fmt.Errorf("%w: malformed auth response", ErrAuthFailed)
+	}
+
+	key, known := store.AuthKey(resp.User)
+	if !known {
+		// compare against a random key anyway, unknown and wrong
+		// credentials must look the same to the client
+		key = make([]byte, authKeySize)
+		_, _ = io.ReadFull(rand.Reader, key)
+	}
+	if !hmac.Equal(resp.MAC, authMAC(key, "client", nonce, resp.Nonce, resp.User)) || !known {
+		_ = writeFrame(conn, authResult{Error: "invalid user or secret"})
+		return "", fmt.Errorf("%w: user %q", ErrAuthFailed, resp.User)
+	}
+
+	err = writeFrame(conn, authResult{
+		OK:  true,
+		MAC: authMAC(key, "server", nonce, resp.Nonce, resp.User),
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.User, nil
+}
+
+// CheckSecret - authentication where the client sends the secret itself
+// (HTTP Basic auth over TLS), its derived key must be the stored one.
+// Unknown users fail before the (slow on purpose) key derivation.
+func CheckSecret(store CredentialStore, user, secret string) error {
+	key, known := store.AuthKey(user)
+	if !known {
+		return fmt.Errorf("%w: user %q", ErrAuthFailed, user)
+	}
+	derived, err := DeriveAuthKey(user, secret)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrAuthFailed, err)
+	}
+	if !hmac.Equal(derived, key) {
+		return fmt.Errorf("%w: user %q", ErrAuthFailed, user)
+	}
+	return nil
+}
+
+func authMAC(key []byte, label string, serverNonce, clientNonce []byte, user string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("EternalStorage auth " + label))
+	mac.Write(serverNonce)
+	mac.Write(clientNonce)
+	mac.Write([]byte(user))
+	return mac.Sum(nil)
+}
+
+func authNonce() ([]byte, error) {
+	nonce := make([]byte, authNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
@@ -0,0 +1,108 @@
+package packet
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tcpPair - з'єднання через loopback, на відміну від net.Pipe має буфери
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	client, err = net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	server, err = listener.Accept()
+	require.NoError(t, err)
+	return client, server
+}
+
+func serverAuthAsync(conn net.Conn, store CredentialStore) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		_, err := ServerAuth(conn, store)
+		done <- err
+	}()
+	return done
+}
+
+func TestAuthHandshake(t *testing.T) {
+	creds := Credentials{}
+	require.NoError(t, creds.Add("alice", "token-1"))
+
+	// правильний токен
+	client, server := tcpPair(t)
+	done := serverAuthAsync(server, creds)
+	assert.NoError(t, ClientAuth(client, "alice", "token-1"))
+	assert.NoError(t, <-done)
+	client.Close()
+
+	// неправильний токен та невідомий користувач
+	for _, user := range []string{"alice", "bob"} {
+		client, server = tcpPair(t)
+		done = serverAuthAsync(server, creds)
+		assert.ErrorIs(t, ClientAuth(client, user, "token-2"), ErrAuthFailed)
+		assert.ErrorIs(t, <-done, ErrAuthFailed)
+		client.Close()
+	}
+}
+
+// Клієнт, що одразу надсилає пакет без автентифікації, має бути відхилений
+func TestAuthRejectsRawPacket(t *testing.T) {
+	client, server := tcpPair(t)
+	done := serverAuthAsync(server, Credentials{})
+
+	var challenge authChallenge
+	require.NoError(t, readFrame(client, &challenge))
+
+	packet := &TCPPacket{
+		MetaData: &TCPPacketMetaData{FileName: "x.txt", Size: 1},
+		Bytes:    []byte("x"),
+	}
+	go func() { _ = packet.SendOverTCP(client) }()
+
+	assert.ErrorIs(t, <-done, ErrAuthFailed)
+	client.Close()
+}
+
+func TestCredentialsSaveLoad(t *testing.T) {
+	path := t.TempDir() + "/users.json"
+	creds := Credentials{}
+	require.NoError(t, creds.Add("alice", "password"))
+	require.NoError(t, creds.Save(path))
+
+	loaded, err := LoadCredentials(path)
+	require.NoError(t, err)
+	assert.Equal(t, creds, loaded)
+}
+
+// Пароль, надісланий напряму (HTTP Basic), перевіряється за збереженим ключем
+func TestCheckSecret(t *testing.T) {
+	creds := Credentials{}
+	require.NoError(t, creds.Add("alice", "password"))
+
+	assert.NoError(t, CheckSecret(creds, "alice", "password"))
+	assert.ErrorIs(t, CheckSecret(creds, "alice", "wrong"), ErrAuthFailed)
+	assert.ErrorIs(t, CheckSecret(creds, "bob", "password"), ErrAuthFailed)
+	assert.ErrorIs(t, CheckSecret(creds, "alice", ""), ErrAuthFailed)
+}
+
+// Секрет S3 виводиться з ключа, але не збігається з ним
+func TestS3SecretKey(t *testing.T) {
+	key, err := DeriveAuthKey("alice", "password")
+	require.NoError(t, err)
+	secret := S3SecretKey(key)
+	assert.Len(t, secret, 64)
+	assert.Equal(t, secret, S3SecretKey(key))
+	assert.NotEqual(t, hex.EncodeToString(key), secret)
+
+	other, err := DeriveAuthKey("bob", "password")
+	require.NoError(t, err)
+	assert.NotEqual(t, secret, S3SecretKey(other))
+}
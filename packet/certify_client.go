@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"os"
 )
 
 // ReceiveCert - client side
@@ -17,7 +18,7 @@ func ReceiveCert(conn net.Conn) (*tls.Config, error) {
 		return nil, fmt.Errorf("failed to read certificate: %w", err)
 	}
 
-	fmt.Println("Received cert length:", n)
+	Logger().Debug("certificate received", "bytes", n, "remote", conn.RemoteAddr().String())
 
 	pemBlock, _ := pem.Decode(cert[:n])
 	if pemBlock == nil || pemBlock.Type != "CERTIFICATE" {
@@ -36,7 +37,23 @@ func ReceiveCert(conn net.Conn) (*tls.Config, error) {
 		RootCAs: certPool,
 	}
 
-	fmt.Println("TLS configuration ready with trusted certificate")
-
 	return tlsConfig, nil
 }
+
+// LoadClientTLS - client side, trusts the server certificate stored on disk
+// (server.crt copied from the server) instead of receiving it over the wire
+func LoadClientTLS(certFile string) (*tls.Config, error) {
+	cert, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read certificate: %w", err)
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(cert) {
+		return nil, errors.New("failed to decode PEM block")
+	}
+
+	return &tls.Config{
+		RootCAs: certPool,
+	}, nil
+}
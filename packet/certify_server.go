@@ -9,6 +9,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"math/big"
 	"net"
 	"os"
@@ -17,12 +18,6 @@ import (
 
 // Server side
 func EstablishServerTLS(addr string) (net.Conn, error) {
-	// Генеруємо RSA ключі
-	privateKey, publicKey, err := GenerateKeys()
-	if err != nil {
-		return nil, err
-	}
-
 	// Слухаємо на порту
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -40,15 +35,9 @@ func EstablishServerTLS(addr string) (net.Conn, error) {
 	// Завантажуємо або генеруємо TLS-сертифікат
 	tlsCert := LoadTLSCert()
 
-	// Шифруємо сертифікат
-	encryptedCert, err := Encrypt(tlsCert.Certificate, publicKey)
-	if err != nil {
-		_ = conn.Close()
-		return nil, err
-	}
-
-	// Передаємо зашифрований сертифікат клієнту
-	err = SendCert(conn, encryptedCert)
+	// Передаємо сертифікат клієнту. Він публічний, тому шифрувати його
+	// нема сенсу: клієнт все одно не має ключа, щоб його розшифрувати
+	err = SendCert(conn)
 	if err != nil {
 		_ = conn.Close()
 		return nil, err
@@ -83,7 +72,7 @@ func EstablishServerTLS(addr string) (net.Conn, error) {
 			_ = tlsConn.Close()
 			return nil, fmt.Errorf("TLS handshake failed: %w", err)
 		}
-		fmt.Println("Secure TLS connection established")
+		Logger().Info("TLS connection established", "remote", remoteAddr.String())
 		return tlsConnection, nil
 	}
 
@@ -103,9 +92,9 @@ func SendCert(conn net.Conn) error {
 	}
 
 	if n != len(cert) {
-		return errors.New("short write")
+		return io.ErrShortWrite
 	}
-	fmt.Println("cert send over network with bytes: ", n)
+	Logger().Debug("certificate sent", "bytes", n, "remote", conn.RemoteAddr().String())
 	return nil
 }
 
@@ -116,7 +105,7 @@ func LoadTLSCert() tls.Certificate {
 	)
 	cert, err = tls.LoadX509KeyPair("server.crt", "server.key")
 	if err != nil {
-		fmt.Println("cert files not found, generate new one")
+		Logger().Warn("certificate files not found, generating new ones", "error", err)
 		cert, err = generateCert()
 		if err != nil {
 			panic(err)
@@ -140,6 +129,10 @@ func generateCert() (tls.Certificate, error) {
 		NotBefore: time.Now(),
 		NotAfter:  time.Now().Add(365 * 24 * time.Hour),
 
+		// без SAN клієнт не пройде перевірку імені хоста
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 		BasicConstraintsValid: true,
@@ -159,7 +152,7 @@ func generateCert() (tls.Certificate, error) {
 	if err != nil {
 		return tls.Certificate{}, err
 	}
-	fmt.Println("server cert written to: ", certOut.Name())
+	Logger().Info("server certificate written", "file", certOut.Name())
 
 	keyOut, err := os.Create("server.key")
 	if err != nil {
@@ -170,7 +163,7 @@ func generateCert() (tls.Certificate, error) {
 	if err != nil {
 		return tls.Certificate{}, err
 	}
-	fmt.Println("server key written to: ", keyOut.Name())
+	Logger().Info("server key written", "file", keyOut.Name())
 
 	return tls.LoadX509KeyPair("server.crt", "server.key")
 }
@@ -0,0 +1,265 @@
+package packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+)
+
+// Checked chunks: the sender offers them in metadata (ChunkCRC), the receiver
+// accepts in its Reply. Every chunk is then sent as int32 size, uint32 CRC32C
+// of the data and the data, the empty chunk ends the round. The receiver
+// answers each round with a chunkReport listing corrupted chunks, only those
+// are sent again, in the asked order, until the report is empty.
+// The leaf hashes of the data as sent (DataRoot in metadata, accepted with
+// Reply.DataLeaves) go before the first chunk, and every chunk is checked
+// against its leaf, compressed or not. Peers without DataRoot do this
+// only for uncompressed packets, with the leaves of MerkleRoot.
+
+const (
+	// chunkSize - 32 KB для ефективної передачі великих файлів
+	chunkSize = 32 * 1024
+
+	// maxResends - rounds of retransmission before the transfer fails
+	maxResends = 3
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// chunkReport - receiver's answer after every round of checked chunks
+type chunkReport struct {
+	Resend []int  `json:"resend,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ChunkError - chunk that was still corrupted after maxResends retransmissions
+type ChunkError struct {
+	Index int
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d is corrupted after %d retransmissions", e.Index, maxResends)
+}
+
+func chunkCount(size int) int {
+	return (size + chunkSize - 1) / chunkSize
+}
+
+func chunkAt(data []byte, index int) []byte {
+	end := min((index+1)*chunkSize, len(data))
+	return data[index*chunkSize : end]
+}
+
+func writeChunk(w io.Writer, data []byte) error {
+	var head [8]byte
+	binary.LittleEndian.PutUint32(head[:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(head[4:], crc32.Checksum(data, castagnoli))
+	if _, err := w.Write(head[:]); err != nil {
+		return fmt.Errorf("error writing chunk header: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("error sending chunk: %w", err)
+	}
+	return nil
+}
+
+// readChunk returns nil data at the end of a round, ok is false
+// when the data doesn't match its checksum
+func readChunk(r io.Reader, maxSize int) (data []byte, ok bool, err error) {
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:4]); err != nil {
+		return nil, false, fmt.Errorf("error reading chunk size: %w", err)
+	}
+	size := int32(binary.LittleEndian.Uint32(head[:4]))
+	if size == 0 {
+		return nil, true, nil
+	}
+	if size < 0 || size > chunkSize {
+		return nil, false, fmt.Errorf("%w: invalid chunk size %d", ErrProtocol, size)
+	}
+	if int(size) > maxSize {
+		return nil, false, &LimitError{Limit: "chunk size", Size: int64(size), Max: int64(maxSize)}
+	}
+	if _, err := io.ReadFull(r, head[4:]); err != nil {
+		return nil, false, fmt.Errorf("error reading chunk checksum: %w", err)
+	}
+	data = make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, false, fmt.Errorf("error reading chunk: %w", err)
+	}
+	return data, crc32.Checksum(data, castagnoli) == binary.LittleEndian.Uint32(head[4:]), nil
+}
+
+func writeEndOfChunks(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, int32(0)); err != nil {
+		return fmt.Errorf("error writing end of data: %w", err)
+	}
+	return nil
+}
+
+// merkleChunks - chunks of the packet are the leaves of its file's Merkle tree
+func merkleChunks(meta *TCPPacketMetaData) bool {
+	return meta.MerkleRoot != "" && (meta.CompressType == "" || meta.CompressType == "none")
+}
+
+// sendChunks sends data as checked chunks and resends the ones
+// the receiver reports as corrupted, tree - leaves sent first, or nil
+func sendChunks(conn io.ReadWriter, data []byte, tree *MerkleTree, log *slog.Logger) error {
+	if tree != nil {
+		if err := writeMerkleLeaves(conn, tree); err != nil {
+			return err
+		}
+	}
+	count := chunkCount(len(data))
+	indexes := make([]int, count)
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	for round := 0; ; round++ {
+		for _, i := range indexes {
+			if i < 0 || i >= count {
+				return fmt.Errorf("%w: receiver asked for chunk %d of %d", ErrProtocol, i, count)
+			}
+			chunk := chunkAt(data, i)
+			if err := writeChunk(conn, chunk); err != nil {
+				return err
+			}
+			log.Debug("chunk sent", "index", i, "bytes", len(chunk))
+		}
+		if err := writeEndOfChunks(conn); err != nil {
+			return err
+		}
+
+		var report chunkReport
+		if err := readFrame(conn, &report); err != nil {
+			return fmt.Errorf("error reading chunk report: %w", err)
+		}
+		if report.Error != "" {
+			return fmt.Errorf("receiver failed: %s", report.Error)
+		}
+		if len(report.Resend) == 0 {
+			return nil
+		}
+		if round >= maxResends {
+			return fmt.Errorf("%w: receiver asked for retransmission %d times", ErrProtocol, round+1)
+		}
+		log.Warn("resending corrupted chunks", "chunks", report.Resend, "round", round+1)
+		indexes = report.Resend
+	}
+}
+
+// receiveChunks reads checked chunks, asking again for the corrupted ones,
+// dataLeaves - the leaves of meta.DataRoot come first
+func receiveChunks(conn io.ReadWriter, meta *TCPPacketMetaData, dataLeaves bool, opts ReceiveOptions, log *slog.Logger) ([]byte, error) {
+	verify := func(int, []byte) bool { return true }
+	var tree *MerkleTree
+	var err error
+	switch {
+	case dataLeaves:
+		tree, err = readMerkleLeaves(conn, max(1, chunkCount(int(meta.CompressedSize))), meta.DataRoot)
+	case merkleChunks(meta):
+		tree, err = readMerkleLeaves(conn, max(1, chunkCount(int(meta.Size))), meta.MerkleRoot)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tree != nil {
+		verify = tree.Verify
+	}
+
+	var chunks [][]byte
+	var bad []int
+	var total int64
+	// grow - total size after a chunk of n bytes replaced one of old bytes
+	grow := func(n, old int) error {
+		total += int64(n - old)
+		if total > opts.MaxFileSize {
+			return &LimitError{Limit: "file size", Size: total, Max: opts.MaxFileSize}
+		}
+		return nil
+	}
+	for {
+		chunk, ok, err := readChunk(conn, opts.MaxChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if chunk == nil {
+			break
+		}
+		if err := grow(len(chunk), 0); err != nil {
+			return nil, err
+		}
+		if !checkChunk(ok, verify, len(chunks), chunk) {
+			bad = append(bad, len(chunks))
+		}
+		log.Debug("chunk received", "index", len(chunks), "bytes", len(chunk))
+		chunks = append(chunks, chunk)
+	}
+
+	for round := 1; len(bad) > 0; round++ {
+		if round > maxResends {
+			err := &ChunkError{Index: bad[0]}
+			_ = writeFrame(conn, chunkReport{Error: err.Error()})
+			return nil, err
+		}
+		log.Warn("corrupted chunks, asking to resend", "chunks", bad, "round", round)
+		if err := writeFrame(conn, chunkReport{Resend: bad}); err != nil {
+			return nil, err
+		}
+
+		var still []int
+		for _, i := range bad {
+			chunk, ok, err := readChunk(conn, opts.MaxChunkSize)
+			if err != nil {
+				return nil, err
+			}
+			if chunk == nil {
+				return nil, fmt.Errorf("%w: chunk %d wasn't resent", ErrProtocol, i)
+			}
+			if err := grow(len(chunk), len(chunks[i])); err != nil {
+				return nil, err
+			}
+			if !checkChunk(ok, verify, i, chunk) {
+				still = append(still, i)
+			}
+			chunks[i] = chunk
+		}
+		end, _, err := readChunk(conn, opts.MaxChunkSize)
+		if err != nil {
+			return nil, err
+		}
+		if end != nil {
+			return nil, fmt.Errorf("%w: more chunks resent than asked for", ErrProtocol)
+		}
+		bad = still
+	}
+
+	if err := writeFrame(conn, chunkReport{}); err != nil {
+		return nil, err
+	}
+	size := 0
+	for _, chunk := range chunks {
+		size += len(chunk)
+	}
+	data := make([]byte, 0, size)
+	for _, chunk := range chunks {
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// checkChunk - chunk index passed its CRC (ok) and verify, failures are counted
+func checkChunk(ok bool, verify func(int, []byte) bool, index int, chunk []byte) bool {
+	switch {
+	case !ok:
+		hashMismatches.WithLabelValues("crc32c").Inc()
+	case !verify(index, chunk):
+		hashMismatches.WithLabelValues("merkle").Inc()
+	default:
+		return true
+	}
+	return false
+}
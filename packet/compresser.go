@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"compress/zlib"
+	"crypto/sha256"
 	"fmt"
 	"github.com/golang/snappy"
 	"io"
@@ -11,43 +12,80 @@ import (
 	"path/filepath"
 )
 
+// decompressToFile writes the packet data to dstFile through a temporary
+// file, dstFile is replaced only once the data is on disk and matches the
+// size, Merkle root and FileHash of the metadata
 func (tp *TCPPacket) decompressToFile(dstFile string) error {
+	_, err := tp.decompressTo(dstFile, ConflictOverwrite)
+	return err
+}
+
+// decompressTo - decompressToFile where policy decides about a file at
+// dstFile, returns the path the data is at, empty if it was skipped
+func (tp *TCPPacket) decompressTo(dstFile string, policy ConflictPolicy) (string, error) {
 	var (
 		err    error
 		reader io.Reader
 	)
-	outFile, er := os.OpenFile(dstFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, tp.MetaData.FileMode)
+	// only permission bits of the sender's mode, no setuid or file type
+	perm := tp.MetaData.FileMode.Perm()
+	if perm == 0 {
+		perm = 0o644
+	}
+	outFile, er := createAtomic(dstFile, perm)
 	if er != nil {
-		return er
+		return "", er
 	}
-	defer outFile.Close()
+	defer outFile.Abort()
+	outFile.policy = policy
 
 	switch tp.MetaData.CompressType {
 	case "gzip":
 		reader, err = gzip.NewReader(bytes.NewReader(tp.Bytes))
 		if err != nil {
-			return err
+			return "", err
 		}
 	case "zlib":
 		reader, err = zlib.NewReader(bytes.NewReader(tp.Bytes))
 		if err != nil {
-			return err
+			return "", err
 		}
 	case "snappy":
 		reader = snappy.NewReader(bytes.NewReader(tp.Bytes))
+	case "", "none":
+		reader = bytes.NewReader(tp.Bytes)
+	default:
+		return "", fmt.Errorf("%w: %q", ErrUnknownCodec, tp.MetaData.CompressType)
 	}
 
-	n, e := io.Copy(outFile, reader)
+	// a packet decompressing to more than its metadata says is stopped
+	// right after Size, not after filling the disk
+	var tree merkleBuilder
+	hash := sha256.New()
+	out := &limitWriter{w: io.MultiWriter(outFile, &tree, hash), limit: "decompressed size", max: tp.MetaData.Size}
+	n, e := io.Copy(out, reader)
 	if e != nil {
-		return e
+		return "", e
 	}
 
 	if n != tp.MetaData.Size {
-		return fmt.Errorf("file size mismatch: %d vs %d", n, tp.MetaData.Size)
+		return "", sizeMismatch(n, tp.MetaData.Size)
+	}
+	if root := tree.Tree().Root(); tp.MetaData.MerkleRoot != "" && root != tp.MetaData.MerkleRoot {
+		hashMismatches.WithLabelValues("merkle").Inc()
+		return "", &MismatchError{Err: ErrMerkleMismatch, Got: root, Want: tp.MetaData.MerkleRoot}
+	}
+	if tp.MetaData.FileHash != "" {
+		if err := tp.compareHashSUm(fmt.Sprintf("%x", hash.Sum(nil))); err != nil {
+			return "", err
+		}
+	}
+	if err := outFile.Commit(); err != nil {
+		return "", err
 	}
 
-	fmt.Printf("Successfully decompessed to file: %s - %d bytes: ", outFile.Name(), n)
-	return nil
+	Logger().Debug("packet decompressed", "file", outFile.path, "size", n)
+	return outFile.path, nil
 }
 
 func NewTCPPacketSNAPPY(path string) (*TCPPacket, error) {
@@ -69,7 +107,7 @@ func NewTCPPacketSNAPPY(path string) (*TCPPacket, error) {
 		return nil, err
 	}
 
-	sum, er := hashSum(file)
+	sum, root, er := fileSums(file)
 	if er != nil {
 		return nil, er
 	}
@@ -82,7 +120,7 @@ func NewTCPPacketSNAPPY(path string) (*TCPPacket, error) {
 	}
 
 	if n != info.Size() {
-		return nil, fmt.Errorf("file size mismatch: %d vs %d", n, info.Size())
+		return nil, sizeMismatch(n, info.Size())
 	}
 	if err := snppy.Close(); err != nil {
 		return nil, err
@@ -93,6 +131,7 @@ func NewTCPPacketSNAPPY(path string) (*TCPPacket, error) {
 			FileName:       info.Name(),
 			FileType:       filepath.Ext(info.Name()),
 			FileHash:       sum,
+			MerkleRoot:     root,
 			FileMode:       info.Mode(),
 			Size:           info.Size(),
 			CompressedSize: int64(buff.Len()),
@@ -100,7 +139,7 @@ func NewTCPPacketSNAPPY(path string) (*TCPPacket, error) {
 		},
 		Bytes: buff.Bytes(),
 	}
-	tp.print()
+	tp.logMetaData(Logger())
 
 	return tp, nil
 }
@@ -124,7 +163,7 @@ func NewTCPPacketZLIB(path string) (*TCPPacket, error) {
 		return nil, err
 	}
 
-	sum, er := hashSum(file)
+	sum, root, er := fileSums(file)
 	if er != nil {
 		return nil, er
 	}
@@ -137,7 +176,7 @@ func NewTCPPacketZLIB(path string) (*TCPPacket, error) {
 	}
 
 	if n != info.Size() {
-		return nil, fmt.Errorf("file size mismatch: %d vs %d", n, info.Size())
+		return nil, sizeMismatch(n, info.Size())
 	}
 	if err := zl.Close(); err != nil {
 		return nil, err
@@ -148,6 +187,7 @@ func NewTCPPacketZLIB(path string) (*TCPPacket, error) {
 			FileName:       info.Name(),
 			FileType:       filepath.Ext(info.Name()),
 			FileHash:       sum,
+			MerkleRoot:     root,
 			FileMode:       info.Mode(),
 			Size:           info.Size(),
 			CompressedSize: int64(buff.Len()),
@@ -155,7 +195,7 @@ func NewTCPPacketZLIB(path string) (*TCPPacket, error) {
 		},
 		Bytes: buff.Bytes(),
 	}
-	tp.print()
+	tp.logMetaData(Logger())
 
 	return tp, nil
 }
@@ -179,7 +219,7 @@ func NewTCPPacketGZIP(path string) (*TCPPacket, error) {
 		return nil, err
 	}
 
-	sum, er := hashSum(file)
+	sum, root, er := fileSums(file)
 	if er != nil {
 		return nil, er
 	}
@@ -191,7 +231,7 @@ func NewTCPPacketGZIP(path string) (*TCPPacket, error) {
 		return nil, e
 	}
 	if n != info.Size() {
-		return nil, fmt.Errorf("file size mismatch %d vs %d", n, info.Size())
+		return nil, sizeMismatch(n, info.Size())
 	}
 
 	if errr := gz.Close(); errr != nil {
@@ -203,6 +243,7 @@ func NewTCPPacketGZIP(path string) (*TCPPacket, error) {
 			FileName:       info.Name(),
 			FileType:       filepath.Ext(info.Name()),
 			FileHash:       sum,
+			MerkleRoot:     root,
 			FileMode:       info.Mode(),
 			Size:           info.Size(),
 			CompressedSize: int64(buff.Len()),
@@ -210,7 +251,85 @@ func NewTCPPacketGZIP(path string) (*TCPPacket, error) {
 		},
 		Bytes: buff.Bytes(),
 	}
-	tp.print()
+	tp.logMetaData(Logger())
+
+	return tp, nil
+}
+
+// NewTCPPacketFromReader - packet from data that isn't a local file
+// (e.g. a stored blob), hash is computed while compressing
+func NewTCPPacketFromReader(r io.Reader, name string, mode os.FileMode, compressType string) (*TCPPacket, error) {
+	var buff bytes.Buffer
+
+	if compressType == "" {
+		compressType = "snappy"
+	}
+	cw, err := newCompressWriter(&buff, compressType)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	var tree merkleBuilder
+	n, err := io.Copy(cw, io.TeeReader(r, io.MultiWriter(hash, &tree)))
+	if err != nil {
+		return nil, err
+	}
+	if err := cw.Close(); err != nil {
+		return nil, err
+	}
+
+	tp := &TCPPacket{
+		MetaData: &TCPPacketMetaData{
+			FileName:       filepath.Base(name),
+			FileType:       filepath.Ext(name),
+			FileHash:       fmt.Sprintf("%x", hash.Sum(nil)),
+			MerkleRoot:     tree.Tree().Root(),
+			FileMode:       mode,
+			Size:           n,
+			CompressedSize: int64(buff.Len()),
+			CompressType:   compressType,
+		},
+		Bytes: buff.Bytes(),
+	}
+	tp.logMetaData(Logger())
 
 	return tp, nil
 }
+
+// newTCPPacketRaw - packet with uncompressed data, for files that are
+// already compressed (archives, media)
+func newTCPPacketRaw(path string) (*TCPPacket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return NewTCPPacketFromReader(file, path, info.Mode(), "none")
+}
+
+func newCompressWriter(w io.Writer, compressType string) (io.WriteCloser, error) {
+	switch compressType {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zlib":
+		return zlib.NewWriter(w), nil
+	case "snappy":
+		return snappy.NewBufferedWriter(w), nil
+	case "none":
+		return nopWriteCloser{w}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, compressType)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
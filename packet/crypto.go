@@ -1,11 +1,22 @@
 package packet
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 )
 
+// Encrypt - raw RSA-OAEP, usable only for payloads shorter than the key size
+// minus padding (~446 bytes for 4096 bit keys). Use Seal for anything else.
 func Encrypt(data []byte, pub *rsa.PublicKey) ([]byte, error) {
 	encrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, data, nil)
 	if err != nil {
@@ -23,8 +34,281 @@ func Decrypt(data []byte, priv *rsa.PrivateKey) ([]byte, error) {
 }
 
 func GenerateKeys() (private *rsa.PrivateKey, public *rsa.PublicKey, err error) {
-	private, _ = rsa.GenerateKey(rand.Reader, 4096)
+	private, err = rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return nil, nil, err
+	}
 	public = &private.PublicKey
 
 	return private, public, nil
 }
+
+// GenerateX25519Keys - key pair for Seal/Open, much cheaper than RSA
+func GenerateX25519Keys() (*ecdh.PrivateKey, *ecdh.PublicKey, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, private.PublicKey(), nil
+}
+
+// envelope layout:
+//
+//	magic[4] | version | wrap algo | wrapped key len (uint16) | wrapped key | nonce prefix[7]
+//	segments: len (uint32, high bit marks the last one) | AES-256-GCM ciphertext
+//
+// every segment is sealed with nonce = prefix | counter (uint32) | last flag,
+// and the header as additional data, so segments can't be reordered,
+// dropped or truncated without Open noticing
+const (
+	sealVersion     = 1
+	sealSegmentSize = 64 * 1024
+	sealPrefixSize  = 7
+	sealLastSegment = 1 << 31
+
+	wrapRSAOAEP byte = 1
+	wrapX25519  byte = 2
+)
+
+var sealMagic = []byte("ESTL")
+
+var ErrSealFormat = errors.New("sealed data is malformed")
+
+// Seal encrypts data of any length for the owner of pub
+// (*rsa.PublicKey or *ecdh.PublicKey for X25519)
+func Seal(data []byte, pub crypto.PublicKey) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := SealStream(&buff, bytes.NewReader(data), pub); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// Open decrypts data produced by Seal or SealStream
+func Open(sealed []byte, priv crypto.PrivateKey) ([]byte, error) {
+	var buff bytes.Buffer
+	if err := OpenStream(&buff, bytes.NewReader(sealed), priv); err != nil {
+		return nil, err
+	}
+	return buff.Bytes(), nil
+}
+
+// SealStream - Seal for io.Reader, src is encrypted segment by segment
+// so memory usage doesn't depend on the stream length
+func SealStream(dst io.Writer, src io.Reader, pub crypto.PublicKey) error {
+	key, algo, wrapped, err := wrapKey(pub)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, len(sealMagic)+4+len(wrapped)+sealPrefixSize)
+	header = append(header, sealMagic...)
+	header = append(header, sealVersion, algo)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+
+	prefix := make([]byte, sealPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	if _, err := dst.Write(header); err != nil {
+		return fmt.Errorf("error writing seal header: %w", err)
+	}
+
+	plain := make([]byte, sealSegmentSize)
+	var counter uint32
+	for {
+		n, err := io.ReadFull(src, plain)
+		last := false
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			last = true
+		case err != nil:
+			return fmt.Errorf("error reading plaintext: %w", err)
+		}
+
+		out := aead.Seal(nil, segmentNonce(prefix, counter, last), plain[:n], header)
+		length := uint32(len(out))
+		if last {
+			length |= sealLastSegment
+		}
+		if err := binary.Write(dst, binary.BigEndian, length); err != nil {
+			return fmt.Errorf("error writing segment length: %w", err)
+		}
+		if _, err := dst.Write(out); err != nil {
+			return fmt.Errorf("error writing segment: %w", err)
+		}
+
+		if last {
+			return nil
+		}
+		counter++
+		if counter == 0 {
+			return errors.New("stream is too long to seal")
+		}
+	}
+}
+
+// OpenStream - reverse of SealStream, returns an error if the stream
+// was modified or cut before the last segment
+func OpenStream(dst io.Writer, src io.Reader, priv crypto.PrivateKey) error {
+	fixed := make([]byte, len(sealMagic)+4)
+	if _, err := io.ReadFull(src, fixed); err != nil {
+		return fmt.Errorf("error reading seal header: %w", err)
+	}
+	if !bytes.Equal(fixed[:len(sealMagic)], sealMagic) {
+		return ErrSealFormat
+	}
+	if fixed[len(sealMagic)] != sealVersion {
+		return fmt.Errorf("%w: unsupported seal version %d", ErrSealFormat, fixed[len(sealMagic)])
+	}
+	algo := fixed[len(sealMagic)+1]
+	wrappedLen := binary.BigEndian.Uint16(fixed[len(sealMagic)+2:])
+
+	rest := make([]byte, int(wrappedLen)+sealPrefixSize)
+	if _, err := io.ReadFull(src, rest); err != nil {
+		return fmt.Errorf("error reading seal header: %w", err)
+	}
+	header := append(fixed, rest...)
+	wrapped, prefix := rest[:wrappedLen], rest[wrappedLen:]
+
+	key, err := unwrapKey(priv, algo, wrapped)
+	if err != nil {
+		return err
+	}
+	aead, err := newSealAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	var counter uint32
+	for {
+		var length uint32
+		if err := binary.Read(src, binary.BigEndian, &length); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("%w: missing last segment", ErrSealFormat)
+			}
+			return fmt.Errorf("error reading segment length: %w", err)
+		}
+		last := length&sealLastSegment != 0
+		length &^= sealLastSegment
+		if length > sealSegmentSize+uint32(aead.Overhead()) {
+			return fmt.Errorf("%w: segment too large", ErrSealFormat)
+		}
+
+		segment := make([]byte, length)
+		if _, err := io.ReadFull(src, segment); err != nil {
+			return fmt.Errorf("error reading segment: %w", err)
+		}
+		plain, err := aead.Open(segment[:0], segmentNonce(prefix, counter, last), segment, header)
+		if err != nil {
+			return fmt.Errorf("error decrypting segment %d: %w", counter, err)
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+		counter++
+	}
+}
+
+// wrapKey creates a fresh data key and the recipient specific blob
+// needed to recover it
+func wrapKey(pub crypto.PublicKey) (key []byte, algo byte, wrapped []byte, err error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		key = make([]byte, 32)
+		if _, err = io.ReadFull(rand.Reader, key); err != nil {
+			return nil, 0, nil, err
+		}
+		wrapped, err = Encrypt(key, pub)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("error wrapping key: %w", err)
+		}
+		return key, wrapRSAOAEP, wrapped, nil
+	case *ecdh.PublicKey:
+		if pub.Curve() != ecdh.X25519() {
+			return nil, 0, nil, errors.New("only X25519 ecdh keys are supported")
+		}
+		ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		shared, err := ephemeral.ECDH(pub)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		wrapped = ephemeral.PublicKey().Bytes()
+		return deriveX25519Key(shared, wrapped, pub.Bytes()), wrapX25519, wrapped, nil
+	default:
+		return nil, 0, nil, fmt.Errorf("unsupported public key type: %T", pub)
+	}
+}
+
+func unwrapKey(priv crypto.PrivateKey, algo byte, wrapped []byte) ([]byte, error) {
+	switch algo {
+	case wrapRSAOAEP:
+		rsaKey, ok := priv.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("data sealed with RSA, got %T", priv)
+		}
+		key, err := Decrypt(wrapped, rsaKey)
+		if err != nil {
+			return nil, fmt.Errorf("error unwrapping key: %w", err)
+		}
+		return key, nil
+	case wrapX25519:
+		ecdhKey, ok := priv.(*ecdh.PrivateKey)
+		if !ok || ecdhKey.Curve() != ecdh.X25519() {
+			return nil, fmt.Errorf("data sealed with X25519, got %T", priv)
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSealFormat, err)
+		}
+		shared, err := ecdhKey.ECDH(ephemeral)
+		if err != nil {
+			return nil, err
+		}
+		return deriveX25519Key(shared, wrapped, ecdhKey.PublicKey().Bytes()), nil
+	default:
+		return nil, fmt.Errorf("unsupported key wrap algorithm: %d", algo)
+	}
+}
+
+func deriveX25519Key(shared, ephemeral, recipient []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("EternalStorage seal X25519"))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	return h.Sum(nil)
+}
+
+func newSealAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, 12)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
@@ -0,0 +1,66 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Seal/Open мають працювати з даними, довшими за ліміт RSA-OAEP
+func TestSealOpenRSA(t *testing.T) {
+	priv, pub, err := GenerateKeys()
+	require.NoError(t, err)
+
+	data := make([]byte, 3*sealSegmentSize+123)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+
+	sealed, err := Seal(data, pub)
+	require.NoError(t, err)
+
+	opened, err := Open(sealed, priv)
+	require.NoError(t, err)
+	assert.Equal(t, data, opened)
+}
+
+func TestSealOpenX25519Stream(t *testing.T) {
+	priv, pub, err := GenerateX25519Keys()
+	require.NoError(t, err)
+
+	// розмір кратний сегменту - останній сегмент буде порожнім
+	for _, size := range []int{0, 10, sealSegmentSize, 2*sealSegmentSize + 1} {
+		data := bytes.Repeat([]byte{'x'}, size)
+
+		var sealed bytes.Buffer
+		require.NoError(t, SealStream(&sealed, bytes.NewReader(data), pub))
+
+		var opened bytes.Buffer
+		require.NoError(t, OpenStream(&opened, bytes.NewReader(sealed.Bytes()), priv))
+		assert.True(t, bytes.Equal(data, opened.Bytes()), "size %d", size)
+	}
+}
+
+// Обрізані або змінені дані не повинні розшифровуватись
+func TestOpenTampered(t *testing.T) {
+	priv, pub, err := GenerateX25519Keys()
+	require.NoError(t, err)
+	otherPriv, _, err := GenerateX25519Keys()
+	require.NoError(t, err)
+
+	sealed, err := Seal(bytes.Repeat([]byte{'y'}, 2*sealSegmentSize), pub)
+	require.NoError(t, err)
+
+	_, err = Open(sealed[:len(sealed)-100], priv)
+	assert.Error(t, err)
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)/2] ^= 1
+	_, err = Open(flipped, priv)
+	assert.Error(t, err)
+
+	_, err = Open(sealed, otherPriv)
+	assert.Error(t, err)
+}
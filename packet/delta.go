@@ -0,0 +1,530 @@
+package packet
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Delta transfer (rsync algorithm) for files the receiver already has
+// an older copy of:
+//
+//	receiver -> sender: signature of its copy, weak rolling + strong hash per block
+//	sender -> receiver: metadata frame (CompressType "delta"), then Reply
+//	sender -> receiver: ops - copy blocks of the old copy or literal data
+//
+// The receiver rebuilds the new file from its copy and the literals
+// and checks the result against FileHash from metadata.
+const (
+	CompressDelta = "delta"
+
+	deltaMinBlock = 2 << 10
+	deltaMaxBlock = 128 << 10
+
+	// signature is sent in batches of blocks, empty batch ends it
+	sigBatch     = 1024
+	sigStrongLen = 16
+	sigMaxBlocks = 1 << 26
+
+	maxLiteral = 64 << 10
+
+	opCopy    = 'C'
+	opLiteral = 'L'
+	opEnd     = 'E'
+)
+
+// BlockSignature - hashes of one block of the receiver's copy
+type BlockSignature struct {
+	Weak   uint32
+	Strong [sigStrongLen]byte
+}
+
+type Signature struct {
+	BlockSize int
+	Blocks    []BlockSignature
+	// LastLen - length of the last block, the only one that may be short
+	LastLen int
+	// weak hash -> blocks with it
+	index map[uint32][]int
+}
+
+// DeltaStats - how much of the file was sent and how much reused
+type DeltaStats struct {
+	Literal int64 `json:"literal"`
+	Copied  int64 `json:"copied"`
+}
+
+// DeltaBlockSize - block size for a copy of size bytes, about sqrt(size)
+// so the signature and the per block overhead both stay small
+func DeltaBlockSize(size int64) int {
+	block := int(math.Sqrt(float64(size)))
+	block = (block + 1023) &^ 1023
+	return min(max(block, deltaMinBlock), deltaMaxBlock)
+}
+
+// WriteSignature reads base and sends the signature of its blocks
+func WriteSignature(w io.Writer, base io.Reader, blockSize int) error {
+	if blockSize < 1 || blockSize > deltaMaxBlock {
+		return fmt.Errorf("bad delta block size: %d", blockSize)
+	}
+	bw := bufio.NewWriter(w)
+	if err := binary.Write(bw, binary.LittleEndian, uint32(blockSize)); err != nil {
+		return err
+	}
+
+	block := make([]byte, blockSize)
+	batch := make([]BlockSignature, 0, sigBatch)
+	lastLen := 0
+	for {
+		n, err := io.ReadFull(base, block)
+		if n > 0 {
+			batch = append(batch, blockSignature(block[:n]))
+			lastLen = n
+		}
+		last := errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+		if err != nil && !last {
+			return err
+		}
+		if len(batch) == sigBatch || (last && len(batch) > 0) {
+			if err := binary.Write(bw, binary.LittleEndian, int32(len(batch))); err != nil {
+				return err
+			}
+			if err := binary.Write(bw, binary.LittleEndian, batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if last {
+			break
+		}
+	}
+
+	// empty batch and the length of the last block end the signature
+	if err := binary.Write(bw, binary.LittleEndian, [2]int32{0, int32(lastLen)}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func ReadSignature(r io.Reader) (*Signature, error) {
+	var blockSize uint32
+	if err := binary.Read(r, binary.LittleEndian, &blockSize); err != nil {
+		return nil, fmt.Errorf("error reading signature: %w", err)
+	}
+	if blockSize < 1 || blockSize > deltaMaxBlock {
+		return nil, fmt.Errorf("%w: bad delta block size: %d", ErrProtocol, blockSize)
+	}
+
+	sig := &Signature{BlockSize: int(blockSize), index: make(map[uint32][]int)}
+	for {
+		var count int32
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return nil, fmt.Errorf("error reading signature: %w", err)
+		}
+		if count == 0 {
+			var lastLen int32
+			if err := binary.Read(r, binary.LittleEndian, &lastLen); err != nil {
+				return nil, fmt.Errorf("error reading signature: %w", err)
+			}
+			if lastLen < 0 || int(lastLen) > sig.BlockSize || (lastLen == 0) != (len(sig.Blocks) == 0) {
+				return nil, fmt.Errorf("%w: bad signature last block: %d bytes", ErrProtocol, lastLen)
+			}
+			sig.LastLen = int(lastLen)
+			return sig, nil
+		}
+		if count < 0 || count > sigBatch || len(sig.Blocks)+int(count) > sigMaxBlocks {
+			return nil, fmt.Errorf("%w: bad signature batch: %d blocks", ErrProtocol, count)
+		}
+		batch := make([]BlockSignature, count)
+		if err := binary.Read(r, binary.LittleEndian, batch); err != nil {
+			return nil, fmt.Errorf("error reading signature: %w", err)
+		}
+		for _, block := range batch {
+			sig.index[block.Weak] = append(sig.index[block.Weak], len(sig.Blocks))
+			sig.Blocks = append(sig.Blocks, block)
+		}
+	}
+}
+
+// find returns the block equal to data, -1 if there is none
+func (sig *Signature) find(weak uint32, data []byte) int {
+	candidates := sig.index[weak]
+	if len(candidates) == 0 {
+		return -1
+	}
+	strong := strongSum(data)
+	for _, i := range candidates {
+		if sig.Blocks[i].Strong == strong && sig.blockLen(i) == len(data) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (sig *Signature) blockLen(i int) int {
+	if i < len(sig.Blocks)-1 {
+		return sig.BlockSize
+	}
+	return sig.LastLen
+}
+
+// WriteDelta compares src with the signature and sends ops that turn
+// the receiver's copy into src
+func WriteDelta(w io.Writer, sig *Signature, src io.Reader) (DeltaStats, error) {
+	dw := &deltaWriter{w: bufio.NewWriterSize(w, maxLiteral+16), copyFrom: -1}
+	br := bufio.NewReaderSize(src, 4*sig.BlockSize)
+	bs := sig.BlockSize
+
+	// window over src, literal bytes are taken from its front
+	data := make([]byte, 0, 4*bs)
+	fill := func() error {
+		for len(data) < bs {
+			b, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			data = append(data, b)
+		}
+		return nil
+	}
+
+	err := fill()
+	if err != nil && !errors.Is(err, io.EOF) {
+		return dw.stats, err
+	}
+	var weak rolling
+	weak.init(data)
+
+	for len(data) == bs {
+		if i := sig.find(weak.sum(), data); i >= 0 {
+			if err := dw.copyBlock(i, len(data)); err != nil {
+				return dw.stats, err
+			}
+			data = data[:0]
+			if err := fill(); err != nil && !errors.Is(err, io.EOF) {
+				return dw.stats, err
+			}
+			weak.init(data)
+			continue
+		}
+
+		// no match, the first byte is literal, window moves by one
+		b, err := br.ReadByte()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return dw.stats, err
+		}
+		if err := dw.literal(data[0]); err != nil {
+			return dw.stats, err
+		}
+		weak.roll(data[0], b)
+		data = append(data[1:], b)
+	}
+
+	// tail shorter than a block can still be the short last block
+	if len(data) > 0 {
+		weak.init(data)
+		if i := sig.find(weak.sum(), data); i >= 0 {
+			if err := dw.copyBlock(i, len(data)); err != nil {
+				return dw.stats, err
+			}
+		} else {
+			for _, b := range data {
+				if err := dw.literal(b); err != nil {
+					return dw.stats, err
+				}
+			}
+		}
+	}
+	return dw.stats, dw.end()
+}
+
+// deltaWriter merges consecutive blocks into one copy op and bytes
+// into literal ops of up to maxLiteral
+type deltaWriter struct {
+	w         *bufio.Writer
+	stats     DeltaStats
+	lit       []byte
+	copyFrom  int
+	copyCount int
+}
+
+func (dw *deltaWriter) literal(b byte) error {
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.lit = append(dw.lit, b)
+	if len(dw.lit) == maxLiteral {
+		return dw.flushLiteral()
+	}
+	return nil
+}
+
+func (dw *deltaWriter) copyBlock(i, n int) error {
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+	dw.stats.Copied += int64(n)
+	if dw.copyFrom >= 0 && dw.copyFrom+dw.copyCount == i {
+		dw.copyCount++
+		return nil
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	dw.copyFrom, dw.copyCount = i, 1
+	return nil
+}
+
+func (dw *deltaWriter) flushLiteral() error {
+	if len(dw.lit) == 0 {
+		return nil
+	}
+	if err := dw.w.WriteByte(opLiteral); err != nil {
+		return err
+	}
+	if err := binary.Write(dw.w, binary.LittleEndian, uint32(len(dw.lit))); err != nil {
+		return err
+	}
+	if _, err := dw.w.Write(dw.lit); err != nil {
+		return err
+	}
+	dw.stats.Literal += int64(len(dw.lit))
+	dw.lit = dw.lit[:0]
+	return nil
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.copyFrom < 0 {
+		return nil
+	}
+	if err := dw.w.WriteByte(opCopy); err != nil {
+		return err
+	}
+	if err := binary.Write(dw.w, binary.LittleEndian, [2]uint32{uint32(dw.copyFrom), uint32(dw.copyCount)}); err != nil {
+		return err
+	}
+	dw.copyFrom, dw.copyCount = -1, 0
+	return nil
+}
+
+func (dw *deltaWriter) end() error {
+	if err := dw.flushLiteral(); err != nil {
+		return err
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	if err := dw.w.WriteByte(opEnd); err != nil {
+		return err
+	}
+	return dw.w.Flush()
+}
+
+// ApplyDelta writes the file described by ops from r, blocks are
+// copied from base, the copy of baseSize bytes the signature was made of
+func ApplyDelta(w io.Writer, base io.ReaderAt, baseSize int64, blockSize int, r io.Reader) (DeltaStats, error) {
+	var stats DeltaStats
+	if blockSize < 1 {
+		return stats, fmt.Errorf("bad delta block size: %d", blockSize)
+	}
+	blocks := (baseSize + int64(blockSize) - 1) / int64(blockSize)
+	br := bufio.NewReader(r)
+
+	for {
+		op, err := br.ReadByte()
+		if err != nil {
+			return stats, fmt.Errorf("error reading delta: %w", err)
+		}
+		switch op {
+		case opCopy:
+			var ref [2]uint32
+			if err := binary.Read(br, binary.LittleEndian, &ref); err != nil {
+				return stats, fmt.Errorf("error reading delta: %w", err)
+			}
+			from, count := int64(ref[0]), int64(ref[1])
+			if count == 0 || from+count > blocks {
+				return stats, fmt.Errorf("%w: delta refers to blocks %d-%d of %d", ErrProtocol, from, from+count, blocks)
+			}
+			section := io.NewSectionReader(base, from*int64(blockSize), count*int64(blockSize))
+			n, err := io.Copy(w, section)
+			stats.Copied += n
+			if err != nil {
+				return stats, err
+			}
+		case opLiteral:
+			var n uint32
+			if err := binary.Read(br, binary.LittleEndian, &n); err != nil {
+				return stats, fmt.Errorf("error reading delta: %w", err)
+			}
+			if n == 0 || n > maxLiteral {
+				return stats, fmt.Errorf("%w: bad delta literal size: %d", ErrProtocol, n)
+			}
+			copied, err := io.CopyN(w, br, int64(n))
+			stats.Literal += copied
+			if err != nil {
+				return stats, fmt.Errorf("error reading delta: %w", err)
+			}
+		case opEnd:
+			return stats, nil
+		default:
+			return stats, fmt.Errorf("%w: unknown delta op %q", ErrProtocol, op)
+		}
+	}
+}
+
+// NewDeltaMetaData - metadata of a local file sent by SendDeltaOverTCP,
+// the file is read once to get its hash
+func NewDeltaMetaData(path string) (*TCPPacketMetaData, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	sum, root, err := fileSums(file)
+	if err != nil {
+		return nil, err
+	}
+	return &TCPPacketMetaData{
+		FileName:     filepath.Base(path),
+		FileType:     filepath.Ext(path),
+		FileHash:     sum,
+		MerkleRoot:   root,
+		FileMode:     info.Mode(),
+		Size:         info.Size(),
+		CompressType: CompressDelta,
+	}, nil
+}
+
+// SendDeltaOverTCP sends meta and the delta of src against sig,
+// src must be the content meta was made of
+func SendDeltaOverTCP(conn net.Conn, meta *TCPPacketMetaData, src io.Reader, sig *Signature) (DeltaStats, error) {
+	start := time.Now()
+	meta.CompressType = CompressDelta
+	if err := writeFrame(conn, meta); err != nil {
+		return DeltaStats{}, err
+	}
+	var reply Reply
+	if err := readFrame(conn, &reply); err != nil {
+		return DeltaStats{}, fmt.Errorf("error reading receiver reply: %w", err)
+	}
+	if err := reply.err(); err != nil {
+		return DeltaStats{}, err
+	}
+
+	stats, err := WriteDelta(conn, sig, src)
+	if err != nil {
+		return stats, err
+	}
+	transferLogger(conn, meta).Info("delta sent", "literal", stats.Literal, "reused", stats.Copied, "duration", time.Since(start))
+	observeTransfer("send", meta, int(stats.Literal), start)
+	return stats, nil
+}
+
+// ReceiveDeltaOverTCP - receiver side of SendDeltaOverTCP, the file is
+// rebuilt from base and verified against FileHash, path is replaced only
+// by a verified file. Of opts the sizes and Check apply, a delta is never
+// sent in chunks.
+func ReceiveDeltaOverTCP(conn net.Conn, path string, base io.ReaderAt, baseSize int64, blockSize int, opts ReceiveOptions) (*TCPPacketMetaData, error) {
+	start := time.Now()
+	opts = opts.withDefaults()
+	var meta TCPPacketMetaData
+	if err := readFrameMax(conn, &meta, opts.MaxMetaDataSize); err != nil {
+		return nil, fmt.Errorf("error reading metadata: %w", err)
+	}
+
+	var checkErr error
+	if meta.CompressType != CompressDelta {
+		checkErr = &RejectError{Status: StatusBadRequest, Message: "expected delta metadata"}
+	} else if checkErr = opts.checkMetaData(&meta); checkErr == nil && opts.Check != nil {
+		checkErr = opts.Check(&meta)
+	}
+	if err := writeFrame(conn, replyFor(checkErr)); err != nil {
+		return nil, err
+	}
+	if checkErr != nil {
+		return nil, checkErr
+	}
+
+	out, err := createAtomic(path, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Abort()
+
+	hash := sha256.New()
+	// every delta op writes, so the output limit bounds what is read too
+	bw := bufio.NewWriter(&limitWriter{w: io.MultiWriter(out, hash), limit: "decompressed size", max: meta.Size})
+	stats, err := ApplyDelta(bw, base, baseSize, blockSize, conn)
+	if err != nil {
+		return nil, err
+	}
+	if err := bw.Flush(); err != nil {
+		return nil, err
+	}
+	transferLogger(conn, &meta).Info("delta received", "literal", stats.Literal, "reused", stats.Copied, "duration", time.Since(start))
+
+	if size := stats.Literal + stats.Copied; size != meta.Size {
+		return nil, sizeMismatch(size, meta.Size)
+	}
+	if sum := fmt.Sprintf("%x", hash.Sum(nil)); sum != meta.FileHash {
+		hashMismatches.WithLabelValues("sha256").Inc()
+		return nil, &MismatchError{Err: ErrHashMismatch, Got: sum, Want: meta.FileHash}
+	}
+	if err := out.Commit(); err != nil {
+		return nil, err
+	}
+	observeTransfer("receive", &meta, int(stats.Literal), start)
+	return &meta, nil
+}
+
+func blockSignature(block []byte) BlockSignature {
+	var weak rolling
+	weak.init(block)
+	return BlockSignature{Weak: weak.sum(), Strong: strongSum(block)}
+}
+
+func strongSum(data []byte) [sigStrongLen]byte {
+	var strong [sigStrongLen]byte
+	sum := sha256.Sum256(data)
+	copy(strong[:], sum[:])
+	return strong
+}
+
+// rolling - rsync weak checksum, moves over the data byte by byte in O(1)
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rolling) init(data []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(data))
+	for i, c := range data {
+		r.a += uint32(c)
+		r.b += uint32(len(data)-i) * uint32(c)
+	}
+}
+
+func (r *rolling) roll(out, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
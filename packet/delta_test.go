@@ -0,0 +1,106 @@
+package packet
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func deltaRoundTrip(t *testing.T, base, changed []byte, blockSize int) DeltaStats {
+	t.Helper()
+	var sigBuf bytes.Buffer
+	require.NoError(t, WriteSignature(&sigBuf, bytes.NewReader(base), blockSize))
+	sig, err := ReadSignature(&sigBuf)
+	require.NoError(t, err)
+
+	var delta bytes.Buffer
+	sent, err := WriteDelta(&delta, sig, bytes.NewReader(changed))
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	applied, err := ApplyDelta(&out, bytes.NewReader(base), int64(len(base)), blockSize, &delta)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(changed, out.Bytes()), "rebuilt file differs")
+	assert.Equal(t, sent, applied)
+	return sent
+}
+
+// Змінений рядок посередині - передається тільки він, решта береться з копії отримувача
+func TestDeltaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	base := make([]byte, 200_000)
+	rng.Read(base)
+
+	edited := append([]byte{}, base[:100_000]...)
+	edited = append(edited, []byte("one changed line\n")...)
+	edited = append(edited, base[100_010:]...)
+
+	stats := deltaRoundTrip(t, base, edited, 2048)
+	assert.Less(t, stats.Literal, int64(2*2048+20))
+	assert.Greater(t, stats.Copied, int64(190_000))
+
+	// без змін - нічого не передається
+	stats = deltaRoundTrip(t, base, base, 2048)
+	assert.Zero(t, stats.Literal)
+
+	// дописано в кінець, обрізано, порожні файли
+	deltaRoundTrip(t, base, append(append([]byte{}, base...), "tail"...), 2048)
+	deltaRoundTrip(t, base, base[:150_001], 2048)
+	deltaRoundTrip(t, base, nil, 2048)
+	deltaRoundTrip(t, nil, base[:5000], 2048)
+	deltaRoundTrip(t, base[:10], base[:10], 2048)
+}
+
+func TestApplyDeltaRejectsBadBlocks(t *testing.T) {
+	// копія блоку, якого в отримувача немає
+	delta := []byte{opCopy, 5, 0, 0, 0, 1, 0, 0, 0, opEnd}
+	_, err := ApplyDelta(&bytes.Buffer{}, bytes.NewReader(make([]byte, 4096)), 4096, 2048, bytes.NewReader(delta))
+	assert.Error(t, err)
+}
+
+// Дельта через з'єднання, файл перевіряється за хешем
+func TestSendDeltaOverTCP(t *testing.T) {
+	dir := t.TempDir()
+	rng := rand.New(rand.NewSource(2))
+	base := make([]byte, 50_000)
+	rng.Read(base)
+	changed := append(append([]byte{}, base[:30_000]...), base[31_000:]...)
+	src := filepath.Join(dir, "new.bin")
+	require.NoError(t, os.WriteFile(src, changed, 0o644))
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	dst := filepath.Join(dir, "rebuilt.bin")
+	blockSize := DeltaBlockSize(int64(len(base)))
+	done := make(chan error, 1)
+	go func() {
+		if err := WriteSignature(server, bytes.NewReader(base), blockSize); err != nil {
+			done <- err
+			return
+		}
+		_, err := ReceiveDeltaOverTCP(server, dst, bytes.NewReader(base), int64(len(base)), blockSize, ReceiveOptions{})
+		done <- err
+	}()
+
+	sig, err := ReadSignature(client)
+	require.NoError(t, err)
+	meta, err := NewDeltaMetaData(src)
+	require.NoError(t, err)
+	file, err := os.Open(src)
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = SendDeltaOverTCP(client, meta, file, sig)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+
+	rebuilt, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(changed, rebuilt))
+}
@@ -0,0 +1,110 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors of the package, all of them work with errors.Is. The ones with a
+// code in errorCodes are sent in Response.Code and Reply.Code, so the other
+// side gets the same error back from *ResponseError or *RejectError.
+var (
+	ErrHashMismatch   = errors.New("file hash mismatch")
+	ErrSizeMismatch   = errors.New("file size mismatch")
+	ErrMerkleMismatch = errors.New("merkle root mismatch")
+	ErrUnknownCodec   = errors.New("unknown compress type")
+	// ErrProtocolVersion - the other side speaks a version this one doesn't
+	ErrProtocolVersion = errors.New("unsupported protocol version")
+	// ErrProtocol - malformed frame, chunk or reply
+	ErrProtocol = errors.New("protocol error")
+
+	ErrNotFound      = errors.New("file not found")
+	ErrForbidden     = errors.New("permission denied")
+	ErrBadPath       = errors.New("invalid path")
+	ErrConflict      = errors.New("file was changed")
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrTooLarge - over a limit of ReceiveOptions, see LimitError
+	ErrTooLarge      = errors.New("too large")
+	ErrNotReplicated = errors.New("not enough replicas confirmed")
+	// ErrUnsafeName - received file name that could write outside of the
+	// target directory or to a device, see SafePath
+	ErrUnsafeName = errors.New("unsafe file name")
+	// ErrFileExists - received file is already there, see ConflictPolicy
+	ErrFileExists = errors.New("file already exists")
+)
+
+// errorCodes - codes of the errors sent across the wire
+var errorCodes = []struct {
+	code string
+	err  error
+}{
+	{"hash_mismatch", ErrHashMismatch},
+	{"size_mismatch", ErrSizeMismatch},
+	{"merkle_mismatch", ErrMerkleMismatch},
+	{"unknown_codec", ErrUnknownCodec},
+	{"protocol_version", ErrProtocolVersion},
+	{"protocol", ErrProtocol},
+	{"auth_failed", ErrAuthFailed},
+	{"not_found", ErrNotFound},
+	{"forbidden", ErrForbidden},
+	{"bad_path", ErrBadPath},
+	{"conflict", ErrConflict},
+	{"quota_exceeded", ErrQuotaExceeded},
+	{"too_large", ErrTooLarge},
+	{"not_replicated", ErrNotReplicated},
+	{"unsafe_name", ErrUnsafeName},
+	{"file_exists", ErrFileExists},
+}
+
+// ErrorCode - code err is sent with, empty if it isn't one of the errors
+// of the package
+func ErrorCode(err error) string {
+	for _, c := range errorCodes {
+		if errors.Is(err, c.err) {
+			return c.code
+		}
+	}
+	return ""
+}
+
+// errorFor - error of a code, or of a status for peers that send no code
+func errorFor(code string, status int) error {
+	for _, c := range errorCodes {
+		if c.code == code {
+			return c.err
+		}
+	}
+	switch status {
+	case StatusUnauthorized:
+		return ErrAuthFailed
+	case StatusForbidden:
+		return ErrForbidden
+	case StatusNotFound:
+		return ErrNotFound
+	case StatusConflict:
+		return ErrConflict
+	case StatusInsufficientStorage:
+		return ErrQuotaExceeded
+	case StatusTooLarge:
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// MismatchError - received data differs from what its metadata says,
+// Err is ErrHashMismatch, ErrSizeMismatch or ErrMerkleMismatch
+type MismatchError struct {
+	Err  error
+	Got  string
+	Want string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("%v: got %s, want %s", e.Err, e.Got, e.Want)
+}
+
+func (e *MismatchError) Unwrap() error { return e.Err }
+
+func sizeMismatch(got, want int64) error {
+	return &MismatchError{Err: ErrSizeMismatch, Got: fmt.Sprint(got), Want: fmt.Sprint(want)}
+}
@@ -0,0 +1,59 @@
+package packet
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Причина відмови доходить до відправника як та сама помилка
+func TestErrorCodeOverWire(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		_, err := ReceiveOverTCPChecked(server, filepath.Join(t.TempDir(), "x"), func(meta *TCPPacketMetaData) error {
+			return fmt.Errorf("%w: %s", ErrUnknownCodec, meta.CompressType)
+		})
+		done <- err
+	}()
+
+	packet := &TCPPacket{
+		MetaData: &TCPPacketMetaData{FileName: "x.txt", CompressType: "lz4", Size: 1},
+		Bytes:    []byte("x"),
+	}
+	err := packet.SendOverTCP(client)
+	assert.ErrorIs(t, err, ErrUnknownCodec)
+	var reject *RejectError
+	require.ErrorAs(t, err, &reject)
+	assert.Equal(t, "unknown_codec", reject.Code)
+	assert.ErrorIs(t, <-done, ErrUnknownCodec)
+}
+
+func TestResponseErrorCode(t *testing.T) {
+	req := &Request{ID: 7, Op: OpPut, Path: "a.txt"}
+	read := func(resp Response) error {
+		var buf bytes.Buffer
+		require.NoError(t, resp.Send(&buf))
+		_, err := ReadResponse(&buf, req)
+		return err
+	}
+
+	err := read(Response{ID: 7, Status: StatusBadRequest, Code: ErrorCode(&MismatchError{Err: ErrHashMismatch}), Error: "hash"})
+	assert.ErrorIs(t, err, ErrHashMismatch)
+	assert.NotErrorIs(t, err, ErrSizeMismatch)
+
+	// старий сервер без коду - за статусом
+	assert.ErrorIs(t, read(Response{ID: 7, Status: StatusNotFound, Error: "file not found"}), ErrNotFound)
+	err = read(Response{ID: 7, Status: StatusInternalError, Code: "something_new"})
+	assert.Error(t, err)
+	assert.Empty(t, ErrorCode(err))
+
+	assert.ErrorIs(t, read(Response{ID: 8, Status: StatusOK}), ErrProtocol)
+}
@@ -2,9 +2,15 @@ package packet
 
 import (
 	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
 )
 
 func hashSum(file *os.File) (string, error) {
@@ -23,3 +29,175 @@ func hashSum(file *os.File) (string, error) {
 
 	return sum, nil
 }
+
+// fileSums - SHA-256 and Merkle root of the file in one read,
+// the file pointer is back at the start
+func fileSums(file *os.File) (sum, root string, err error) {
+	hash := sha256.New()
+	var tree merkleBuilder
+	if _, err := io.Copy(io.MultiWriter(hash, &tree), file); err != nil {
+		return "", "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), tree.Tree().Root(), nil
+}
+
+// WriteFileAtomic - data lands under name only after it was fully
+// written, the file and the directory are flushed to disk, so after it
+// returns a crash leaves either the old or the new content
+func WriteFileAtomic(name string, data []byte, perm os.FileMode) error {
+	file, err := createAtomic(name, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Abort()
+
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	return file.Commit()
+}
+
+// atomicFile - file written under a temporary name next to path, so a
+// crash or a failed check never leaves a partial file at path. With a
+// policy other than ConflictOverwrite nothing at path is ever replaced.
+type atomicFile struct {
+	*os.File
+	path      string
+	policy    ConflictPolicy
+	committed bool
+}
+
+func createAtomic(path string, perm os.FileMode) (*atomicFile, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	return &atomicFile{File: tmp, path: path}, nil
+}
+
+// Commit flushes the data to disk, moves the file to its path and
+// flushes the directory, so the move survives a crash too. Path is where
+// the file is after it, empty if ConflictSkip found a file there.
+func (f *atomicFile) Commit() error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	var err error
+	if f.policy == ConflictOverwrite {
+		err = os.Rename(f.Name(), f.path)
+	} else {
+		err = f.link()
+	}
+	if err != nil {
+		return err
+	}
+	f.committed = true
+	if f.path == "" {
+		return nil
+	}
+	return syncDir(filepath.Dir(f.path))
+}
+
+// link puts the file at path only if nothing is there, a hard link fails
+// instead of replacing like a rename does. ConflictRename takes the next
+// free name when another file got there first.
+func (f *atomicFile) link() error {
+	original := f.path
+	for {
+		err := os.Link(f.Name(), f.path)
+		if err == nil {
+			return os.Remove(f.Name())
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		switch f.policy {
+		case ConflictSkip:
+			f.path = ""
+			return os.Remove(f.Name())
+		case ConflictRename:
+			// ResolveConflict gives up after maxRenames taken names
+			if f.path, err = ResolveConflict(original, ConflictRename); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: %s", ErrFileExists, f.path)
+		}
+	}
+}
+
+// Abort removes the temporary file, does nothing after Commit
+func (f *atomicFile) Abort() {
+	if f.committed {
+		return
+	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// directories can't be synced on windows, renames there are durable
+	// once they return
+	if err := d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
+	return nil
+}
+
+// maxFrameSize - limit for control frames (auth, replies), packet data
+// goes through chunks
+const maxFrameSize = 1 << 20
+
+// writeFrame sends v as length prefixed JSON, same layout as packet metadata
+func writeFrame(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error marshaling frame: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return fmt.Errorf("error writing frame length: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("error writing frame: %w", err)
+	}
+	return nil
+}
+
+func readFrame(r io.Reader, v any) error {
+	return readFrameMax(r, v, maxFrameSize)
+}
+
+// readFrameMax - readFrame of frames up to max bytes
+func readFrameMax(r io.Reader, v any, max int) error {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return fmt.Errorf("error reading frame length: %w", err)
+	}
+	if int64(length) > int64(max) {
+		return &LimitError{Limit: "frame size", Size: int64(length), Max: int64(max)}
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("error reading frame: %w", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error unmarshalling frame: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+package packet
+
+import (
+	"crypto"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KeyRSA    = "RSA"
+	KeyX25519 = "X25519"
+
+	plainKeyBlock     = "PRIVATE KEY"
+	encryptedKeyBlock = "ETERNAL ENCRYPTED PRIVATE KEY"
+
+	keyFileExt     = ".pem"
+	keyVersionTime = "20060102T150405Z"
+
+	// scrypt cost, ~100ms on a laptop, also the most a key file may ask
+	// for, so a crafted header can't make Load take minutes or gigabytes
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrKeyExists      = errors.New("key already exists")
+	ErrBadPassphrase  = errors.New("wrong passphrase or corrupted key")
+	errBadKeyName     = errors.New("key name may contain only letters, digits, '-' and '_'")
+	keyNamePattern    = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	keyVersionPattern = regexp.MustCompile(`^([A-Za-z0-9_-]+)\.(\d{8}T\d{6}Z)$`)
+)
+
+// Keystore - directory of PEM encoded private keys, one file per identity.
+// Rotated keys stay next to the current one as <name>.<time>.pem, so data
+// sealed for an old key can still be opened.
+type Keystore struct {
+	dir string
+}
+
+// Identity describes a named key and its retired versions (newest first)
+type Identity struct {
+	Name      string    `json:"name"`
+	Algorithm string    `json:"algorithm"`
+	Encrypted bool      `json:"encrypted"`
+	Created   time.Time `json:"created"`
+	Retired   []string  `json:"retired,omitempty"`
+}
+
+func NewKeystore(dir string) (*Keystore, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("keystore dir is empty")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Keystore{dir: dir}, nil
+}
+
+// Generate creates a new key (KeyRSA or KeyX25519) and saves it under name.
+// Empty passphrase stores the key unencrypted.
+func (ks *Keystore) Generate(name, algorithm string, passphrase []byte) (crypto.PrivateKey, error) {
+	if _, err := os.Stat(ks.path(name)); err == nil {
+		return nil, fmt.Errorf("%w: %s", ErrKeyExists, name)
+	}
+	key, err := generateKey(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if err := ks.Save(name, key, passphrase); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// LoadOrGenerate returns the key stored under name, creating it on first use
+func (ks *Keystore) LoadOrGenerate(name, algorithm string, passphrase []byte) (crypto.PrivateKey, error) {
+	key, err := ks.Load(name, passphrase)
+	if errors.Is(err, ErrKeyNotFound) {
+		return ks.Generate(name, algorithm, passphrase)
+	}
+	return key, err
+}
+
+// Save writes key under name, replacing the current one
+func (ks *Keystore) Save(name string, key crypto.PrivateKey, passphrase []byte) error {
+	if !keyNamePattern.MatchString(name) {
+		return errBadKeyName
+	}
+	block, err := encodeKey(key, passphrase)
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(ks.path(name), pem.EncodeToMemory(block), 0o600)
+}
+
+func (ks *Keystore) Load(name string, passphrase []byte) (crypto.PrivateKey, error) {
+	if !keyNamePattern.MatchString(name) {
+		return nil, errBadKeyName
+	}
+	return ks.load(ks.path(name), passphrase)
+}
+
+// LoadRetired loads one of the versions listed in Identity.Retired
+func (ks *Keystore) LoadRetired(name, version string, passphrase []byte) (crypto.PrivateKey, error) {
+	if !keyNamePattern.MatchString(name) {
+		return nil, errBadKeyName
+	}
+	if _, err := time.Parse(keyVersionTime, version); err != nil {
+		return nil, fmt.Errorf("bad key version %q", version)
+	}
+	return ks.load(filepath.Join(ks.dir, name+"."+version+keyFileExt), passphrase)
+}
+
+// Rotate retires the current key and generates a new one with the same
+// algorithm and passphrase
+func (ks *Keystore) Rotate(name string, passphrase []byte) (crypto.PrivateKey, error) {
+	old, err := ks.Load(name, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	key, err := generateKey(keyAlgorithm(old))
+	if err != nil {
+		return nil, err
+	}
+
+	version := time.Now().UTC().Format(keyVersionTime)
+	retired := filepath.Join(ks.dir, name+"."+version+keyFileExt)
+	if _, err := os.Stat(retired); err == nil {
+		return nil, fmt.Errorf("%w: %s.%s", ErrKeyExists, name, version)
+	}
+	if err := os.Rename(ks.path(name), retired); err != nil {
+		return nil, err
+	}
+	if err := ks.Save(name, key, passphrase); err != nil {
+		// put the old key back so the identity doesn't disappear
+		_ = os.Rename(retired, ks.path(name))
+		return nil, err
+	}
+	return key, nil
+}
+
+// List returns all identities sorted by name
+func (ks *Keystore) List() ([]Identity, error) {
+	entries, err := os.ReadDir(ks.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*Identity)
+	retired := make(map[string][]string)
+	for _, entry := range entries {
+		base, ok := strings.CutSuffix(entry.Name(), keyFileExt)
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if m := keyVersionPattern.FindStringSubmatch(base); m != nil {
+			retired[m[1]] = append(retired[m[1]], m[2])
+			continue
+		}
+		if !keyNamePattern.MatchString(base) {
+			continue
+		}
+
+		id, err := ks.identity(base)
+		if err != nil {
+			return nil, err
+		}
+		byName[base] = id
+	}
+
+	list := make([]Identity, 0, len(byName))
+	for name, id := range byName {
+		versions := retired[name]
+		sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+		id.Retired = versions
+		list = append(list, *id)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list, nil
+}
+
+// identity reads key info from PEM headers, without the passphrase
+func (ks *Keystore) identity(name string) (*Identity, error) {
+	data, err := os.ReadFile(ks.path(name))
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s: failed to decode PEM block", name)
+	}
+	created, _ := time.Parse(time.RFC3339, block.Headers["Created"])
+	return &Identity{
+		Name:      name,
+		Algorithm: block.Headers["Algorithm"],
+		Encrypted: block.Type == encryptedKeyBlock,
+		Created:   created,
+	}, nil
+}
+
+func (ks *Keystore) load(path string, passphrase []byte) (crypto.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrKeyNotFound, filepath.Base(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block in %s", path)
+	}
+	return decodeKey(block, passphrase)
+}
+
+func (ks *Keystore) path(name string) string {
+	return filepath.Join(ks.dir, name+keyFileExt)
+}
+
+func generateKey(algorithm string) (crypto.PrivateKey, error) {
+	switch algorithm {
+	case KeyRSA:
+		private, _, err := GenerateKeys()
+		return private, err
+	case KeyX25519:
+		private, _, err := GenerateX25519Keys()
+		return private, err
+	default:
+		return nil, fmt.Errorf("unsupported key algorithm: %q", algorithm)
+	}
+}
+
+func keyAlgorithm(key crypto.PrivateKey) string {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return KeyRSA
+	case *ecdh.PrivateKey:
+		if key.Curve() == ecdh.X25519() {
+			return KeyX25519
+		}
+	}
+	return ""
+}
+
+// encodeKey - PKCS#8 in a PEM block, sealed with scrypt + AES-GCM
+// when passphrase isn't empty
+func encodeKey(key crypto.PrivateKey, passphrase []byte) (*pem.Block, error) {
+	algorithm := keyAlgorithm(key)
+	if algorithm == "" {
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := map[string]string{
+		"Algorithm": algorithm,
+		"Created":   time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(passphrase) == 0 {
+		return &pem.Block{Type: plainKeyBlock, Headers: headers, Bytes: der}, nil
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := passphraseAEAD(passphrase, salt, scryptN, scryptR, scryptP)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	headers["KDF"] = fmt.Sprintf("scrypt,%d,%d,%d", scryptN, scryptR, scryptP)
+	headers["Salt"] = hex.EncodeToString(salt)
+	headers["Nonce"] = hex.EncodeToString(nonce)
+
+	return &pem.Block{
+		Type:    encryptedKeyBlock,
+		Headers: headers,
+		Bytes:   aead.Seal(nil, nonce, der, []byte(algorithm)),
+	}, nil
+}
+
+func decodeKey(block *pem.Block, passphrase []byte) (crypto.PrivateKey, error) {
+	der := block.Bytes
+
+	switch block.Type {
+	case plainKeyBlock:
+	case encryptedKeyBlock:
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("%w: key is encrypted, passphrase required", ErrBadPassphrase)
+		}
+		n, r, p, err := parseScryptParams(block.Headers["KDF"])
+		if err != nil {
+			return nil, err
+		}
+		salt, err := hex.DecodeString(block.Headers["Salt"])
+		if err != nil {
+			return nil, fmt.Errorf("bad key salt: %w", err)
+		}
+		nonce, err := hex.DecodeString(block.Headers["Nonce"])
+		if err != nil {
+			return nil, fmt.Errorf("bad key nonce: %w", err)
+		}
+		aead, err := passphraseAEAD(passphrase, salt, n, r, p)
+		if err != nil {
+			return nil, err
+		}
+		if len(nonce) != aead.NonceSize() {
+			return nil, fmt.Errorf("bad key nonce size: %d", len(nonce))
+		}
+		der, err = aead.Open(nil, nonce, block.Bytes, []byte(block.Headers["Algorithm"]))
+		if err != nil {
+			return nil, ErrBadPassphrase
+		}
+	default:
+		return nil, fmt.Errorf("unexpected PEM block type: %s", block.Type)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	if keyAlgorithm(key) == "" {
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+	return key, nil
+}
+
+func passphraseAEAD(passphrase, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, n, r, p, 32)
+	if err != nil {
+		return nil, err
+	}
+	return newSealAEAD(key)
+}
+
+func parseScryptParams(kdf string) (n, r, p int, err error) {
+	parts := strings.Split(kdf, ",")
+	if len(parts) != 4 || parts[0] != "scrypt" {
+		return 0, 0, 0, fmt.Errorf("unsupported key KDF: %q", kdf)
+	}
+	params := make([]int, 3)
+	for i, part := range parts[1:] {
+		params[i], err = strconv.Atoi(part)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("bad key KDF params %q: %w", kdf, err)
+		}
+	}
+	n, r, p = params[0], params[1], params[2]
+	if n <= 0 || n > scryptN || r <= 0 || r > scryptR || p <= 0 || p > scryptP {
+		return 0, 0, 0, fmt.Errorf("key KDF params %q are out of range, at most scrypt,%d,%d,%d", kdf, scryptN, scryptR, scryptP)
+	}
+	return n, r, p, nil
+}
@@ -0,0 +1,116 @@
+package packet
+
+import (
+	"crypto"
+	"encoding/pem"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Ключ, збережений з паролем, має відкривати дані після перезавантаження
+func TestKeystoreEncryptedRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	ks, err := NewKeystore(dir)
+	require.NoError(t, err)
+
+	key, err := ks.Generate("server", KeyX25519, []byte("secret"))
+	require.NoError(t, err)
+
+	sealed, err := Seal([]byte("hello"), publicKey(t, key))
+	require.NoError(t, err)
+
+	// новий екземпляр - як після рестарту
+	ks, err = NewKeystore(dir)
+	require.NoError(t, err)
+
+	_, err = ks.Load("server", []byte("wrong"))
+	assert.ErrorIs(t, err, ErrBadPassphrase)
+	_, err = ks.Load("server", nil)
+	assert.ErrorIs(t, err, ErrBadPassphrase)
+
+	loaded, err := ks.Load("server", []byte("secret"))
+	require.NoError(t, err)
+	opened, err := Open(sealed, loaded)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), opened)
+
+	_, err = ks.Generate("server", KeyX25519, nil)
+	assert.ErrorIs(t, err, ErrKeyExists)
+	_, err = ks.Load("missing", nil)
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = ks.Load("../server", nil)
+	assert.Error(t, err)
+}
+
+func TestKeystoreRotateAndList(t *testing.T) {
+	ks, err := NewKeystore(t.TempDir())
+	require.NoError(t, err)
+
+	old, err := ks.Generate("backup", KeyX25519, nil)
+	require.NoError(t, err)
+	_, err = ks.LoadOrGenerate("transfer", KeyRSA, []byte("pass"))
+	require.NoError(t, err)
+
+	sealed, err := Seal([]byte("old data"), publicKey(t, old))
+	require.NoError(t, err)
+
+	current, err := ks.Rotate("backup", nil)
+	require.NoError(t, err)
+	assert.NotEqual(t, old, current)
+
+	list, err := ks.List()
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "backup", list[0].Name)
+	assert.Equal(t, KeyX25519, list[0].Algorithm)
+	assert.False(t, list[0].Encrypted)
+	require.Len(t, list[0].Retired, 1)
+	assert.Equal(t, "transfer", list[1].Name)
+	assert.Equal(t, KeyRSA, list[1].Algorithm)
+	assert.True(t, list[1].Encrypted)
+
+	// старий ключ лишається доступним для старих даних
+	retired, err := ks.LoadRetired("backup", list[0].Retired[0], nil)
+	require.NoError(t, err)
+	opened, err := Open(sealed, retired)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old data"), opened)
+}
+
+func publicKey(t *testing.T, key any) any {
+	t.Helper()
+	signer, ok := key.(interface{ Public() crypto.PublicKey })
+	require.True(t, ok)
+	return signer.Public()
+}
+
+// Параметри scrypt із заголовка файлу не можуть перевищувати ті, з якими ключ записується
+func TestKeystoreScryptParamsBounded(t *testing.T) {
+	for _, kdf := range []string{"scrypt,32768,8,1", "scrypt,1024,1,1"} {
+		_, _, _, err := parseScryptParams(kdf)
+		assert.NoError(t, err, kdf)
+	}
+	for _, kdf := range []string{"scrypt,1073741824,8,1", "scrypt,32768,1024,1", "scrypt,32768,8,64", "scrypt,0,8,1", "scrypt,32768,-1,1", "argon2,1,1,1"} {
+		_, _, _, err := parseScryptParams(kdf)
+		assert.Error(t, err, kdf)
+	}
+
+	dir := t.TempDir()
+	ks, err := NewKeystore(dir)
+	require.NoError(t, err)
+	_, err = ks.Generate("server", KeyX25519, []byte("secret"))
+	require.NoError(t, err)
+	path := ks.path("server")
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	block, _ := pem.Decode(data)
+	require.NotNil(t, block)
+	block.Headers["KDF"] = "scrypt,1073741824,8,1"
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+
+	_, err = ks.Load("server", []byte("secret"))
+	assert.ErrorContains(t, err, "out of range")
+}
@@ -0,0 +1,101 @@
+package packet
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// Default limits of ReceiveOptions
+const (
+	DefaultMaxMetaDataSize     = 64 << 10
+	DefaultMaxChunkSize        = chunkSize
+	DefaultMaxFileSize         = 4 << 30
+	DefaultMaxDecompressedSize = 16 << 30
+)
+
+// ReceiveOptions - limits a peer can't make the receiver go over, they are
+// checked before anything is allocated. Zero fields take the defaults,
+// negative ones are unlimited.
+type ReceiveOptions struct {
+	// MaxMetaDataSize - bytes of the metadata JSON
+	MaxMetaDataSize int
+	// MaxChunkSize - bytes of one data chunk
+	MaxChunkSize int
+	// MaxFileSize - bytes of packet data as sent, compressed or a delta
+	MaxFileSize int64
+	// MaxDecompressedSize - bytes of the received file, also stops
+	// data that decompresses to more than its metadata says
+	MaxDecompressedSize int64
+	// Check can refuse the packet after its metadata, see MetaDataCheck
+	Check MetaDataCheck
+	// Conflict - what ReceiveOverTCPInto does with an existing file
+	Conflict ConflictPolicy
+}
+
+// LimitError - peer sent or announced more than a ReceiveOptions limit
+type LimitError struct {
+	// Limit - "metadata size", "frame size", "chunk size", "file size"
+	// or "decompressed size"
+	Limit string
+	Size  int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s %d exceeds the limit of %d bytes", e.Limit, e.Size, e.Max)
+}
+
+func (e *LimitError) Unwrap() error { return ErrTooLarge }
+
+func (o ReceiveOptions) withDefaults() ReceiveOptions {
+	o.MaxMetaDataSize = int(min(limit(int64(o.MaxMetaDataSize), DefaultMaxMetaDataSize), math.MaxInt))
+	o.MaxChunkSize = int(min(limit(int64(o.MaxChunkSize), DefaultMaxChunkSize), math.MaxInt))
+	o.MaxFileSize = limit(o.MaxFileSize, DefaultMaxFileSize)
+	o.MaxDecompressedSize = limit(o.MaxDecompressedSize, DefaultMaxDecompressedSize)
+	return o
+}
+
+func limit(v, def int64) int64 {
+	switch {
+	case v == 0:
+		return def
+	case v < 0:
+		return math.MaxInt64
+	}
+	return v
+}
+
+// checkMetaData - sizes the metadata announces, the packet is refused
+// before its data like by MetaDataCheck
+func (o ReceiveOptions) checkMetaData(meta *TCPPacketMetaData) error {
+	var limit *LimitError
+	switch {
+	case meta.Size < 0 || meta.CompressedSize < 0:
+		return &RejectError{Status: StatusBadRequest, Code: ErrorCode(ErrProtocol), Message: "negative size in metadata"}
+	case meta.CompressedSize > o.MaxFileSize:
+		limit = &LimitError{Limit: "file size", Size: meta.CompressedSize, Max: o.MaxFileSize}
+	case meta.Size > o.MaxDecompressedSize:
+		limit = &LimitError{Limit: "decompressed size", Size: meta.Size, Max: o.MaxDecompressedSize}
+	default:
+		return nil
+	}
+	return &RejectError{Status: StatusTooLarge, Code: ErrorCode(limit), Message: limit.Error()}
+}
+
+// limitWriter fails instead of writing more than max bytes
+type limitWriter struct {
+	w       io.Writer
+	limit   string
+	written int64
+	max     int64
+}
+
+func (lw *limitWriter) Write(p []byte) (int, error) {
+	if lw.written+int64(len(p)) > lw.max {
+		return 0, &LimitError{Limit: lw.limit, Size: lw.written + int64(len(p)), Max: lw.max}
+	}
+	n, err := lw.w.Write(p)
+	lw.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,122 @@
+package packet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// receiveLimited приймає пакет з обмеженнями в окремій горутині
+func receiveLimited(t *testing.T, opts ReceiveOptions) (client net.Conn, path string, done <-chan error) {
+	t.Helper()
+	client, server := tcpPair(t)
+	t.Cleanup(func() { _ = client.Close() })
+	path = filepath.Join(t.TempDir(), "dst")
+	errs := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		_, err := ReceiveOverTCPWith(server, path, opts)
+		errs <- err
+	}()
+	return client, path, errs
+}
+
+// sendMeta - початок пакета від шкідливого відправника, без контрольних сум
+func sendMeta(t *testing.T, conn net.Conn, meta *TCPPacketMetaData) Reply {
+	t.Helper()
+	data, err := json.Marshal(meta)
+	require.NoError(t, err)
+	require.NoError(t, binary.Write(conn, binary.LittleEndian, uint32(len(data))))
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+	var reply Reply
+	require.NoError(t, readFrame(conn, &reply))
+	return reply
+}
+
+func TestReceiveLimitsMetaData(t *testing.T) {
+	// довжина метаданих 4 ГБ - відмова без виділення пам'яті
+	client, _, done := receiveLimited(t, ReceiveOptions{})
+	require.NoError(t, binary.Write(client, binary.LittleEndian, uint32(1<<32-1)))
+	var limit *LimitError
+	require.ErrorAs(t, <-done, &limit)
+	assert.Equal(t, "metadata size", limit.Limit)
+
+	// заявлений розмір більший за дозволений - відправник дізнається чому
+	client, _, done = receiveLimited(t, ReceiveOptions{MaxDecompressedSize: 1000})
+	packet := &TCPPacket{MetaData: &TCPPacketMetaData{FileName: "big.bin", Size: 1001}, Bytes: []byte("x")}
+	err := packet.SendOverTCP(client)
+	assert.ErrorIs(t, err, ErrTooLarge)
+	var reject *RejectError
+	require.ErrorAs(t, err, &reject)
+	assert.Equal(t, StatusTooLarge, reject.Status)
+	assert.ErrorIs(t, <-done, ErrTooLarge)
+
+	client, _, done = receiveLimited(t, ReceiveOptions{})
+	reply := sendMeta(t, client, &TCPPacketMetaData{FileName: "x", Size: -1})
+	assert.Equal(t, StatusBadRequest, reply.Status)
+	assert.Error(t, <-done)
+}
+
+func TestReceiveLimitsChunks(t *testing.T) {
+	chunk := func(conn net.Conn, size int32, data []byte) {
+		require.NoError(t, binary.Write(conn, binary.LittleEndian, size))
+		_, _ = conn.Write(data)
+	}
+
+	client, _, done := receiveLimited(t, ReceiveOptions{})
+	require.Equal(t, StatusOK, sendMeta(t, client, &TCPPacketMetaData{FileName: "x", Size: 1}).Status)
+	chunk(client, -5, nil)
+	assert.ErrorIs(t, <-done, ErrProtocol)
+
+	client, _, done = receiveLimited(t, ReceiveOptions{})
+	require.Equal(t, StatusOK, sendMeta(t, client, &TCPPacketMetaData{FileName: "x", Size: 1}).Status)
+	chunk(client, 1<<30, nil)
+	var limit *LimitError
+	require.ErrorAs(t, <-done, &limit)
+	assert.Equal(t, "chunk size", limit.Limit)
+
+	// метадані занижують розмір, дані не закінчуються
+	client, _, done = receiveLimited(t, ReceiveOptions{MaxFileSize: 100})
+	require.Equal(t, StatusOK, sendMeta(t, client, &TCPPacketMetaData{FileName: "x", Size: 1}).Status)
+	for range 3 {
+		chunk(client, 40, make([]byte, 40))
+	}
+	require.ErrorAs(t, <-done, &limit)
+	assert.Equal(t, "file size", limit.Limit)
+	assert.Equal(t, int64(120), limit.Size)
+}
+
+// Архів, що розпаковується в більше, ніж заявлено, зупиняється на заявленому розмірі
+func TestReceiveLimitsDecompression(t *testing.T) {
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	_, err := zw.Write([]byte(strings.Repeat("0", 10<<20)))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	client, path, done := receiveLimited(t, ReceiveOptions{MaxDecompressedSize: 1 << 20})
+	packet := &TCPPacket{
+		MetaData: &TCPPacketMetaData{FileName: "bomb.txt", CompressType: "gzip", Size: 1000, CompressedSize: int64(bomb.Len())},
+		Bytes:    bomb.Bytes(),
+	}
+	require.NoError(t, packet.SendOverTCP(client))
+	err = <-done
+	var limit *LimitError
+	require.ErrorAs(t, err, &limit)
+	assert.Equal(t, "decompressed size", limit.Limit)
+	// недописаний файл не з'являється під своїм іменем
+	assert.NoFileExists(t, path)
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
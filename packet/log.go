@@ -0,0 +1,50 @@
+package packet
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sync/atomic"
+)
+
+// logger of the package, silent until SetLogger is called
+var logger atomic.Pointer[slog.Logger]
+
+func init() {
+	SetLogger(nil)
+}
+
+// SetLogger routes the logs of the package to l, nil silences them.
+// Transfers log at Info, chunks and retransmissions at Debug and Warn,
+// with the fields file, size and remote.
+func SetLogger(l *slog.Logger) {
+	if l == nil {
+		l = slog.New(discardHandler{})
+	}
+	logger.Store(l)
+}
+
+// Logger - the logger set with SetLogger
+func Logger() *slog.Logger {
+	return logger.Load()
+}
+
+// transferLogger - logger of one packet transfer over conn
+func transferLogger(conn net.Conn, meta *TCPPacketMetaData) *slog.Logger {
+	l := Logger()
+	if conn != nil && conn.RemoteAddr() != nil {
+		l = l.With("remote", conn.RemoteAddr().String())
+	}
+	if meta != nil {
+		l = l.With("file", meta.FileName, "size", meta.Size)
+	}
+	return l
+}
+
+// discardHandler - slog.DiscardHandler of newer Go versions
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
@@ -0,0 +1,46 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Передача пишеться в заданий логер з полями, пересилання - як попередження
+func TestTransferLog(t *testing.T) {
+	var buf bytes.Buffer
+	SetLogger(slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	t.Cleanup(func() { SetLogger(nil) })
+
+	data := []byte(strings.Repeat("log ", chunkSize/2))
+	sendErr, receiveErr, _ := sendCorrupted(t, data, func(chunk int) bool { return chunk == 1 })
+	require.NoError(t, sendErr)
+	require.NoError(t, receiveErr)
+
+	records := map[string]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records[record["msg"].(string)] = record
+	}
+	sent := records["packet sent"]
+	require.NotNil(t, sent)
+	assert.Equal(t, "INFO", sent["level"])
+	assert.Equal(t, "src.bin", sent["file"])
+	assert.Equal(t, float64(len(data)), sent["size"])
+	assert.NotEmpty(t, sent["remote"])
+	require.NotNil(t, records["packet received"])
+	require.NotNil(t, records["corrupted chunks, asking to resend"])
+	assert.Equal(t, "WARN", records["resending corrupted chunks"]["level"])
+
+	// без логера нічого не пишеться
+	SetLogger(nil)
+	buf.Reset()
+	_, _, _ = sendCorrupted(t, data, func(int) bool { return false })
+	assert.Zero(t, buf.Len())
+}
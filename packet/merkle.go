@@ -0,0 +1,275 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Merkle tree over MerkleLeafSize pieces of a file. Leaves and nodes are
+// hashed with different prefixes, so a node can't pass for a leaf, and a
+// node without a pair is moved one level up as it is (RFC 6962 style).
+// The root goes to TCPPacketMetaData.MerkleRoot: every leaf can then be
+// checked on its own, with the leaf hashes or with a MerkleProof.
+// Transfers also build a tree over the data as sent (DataRoot), so every
+// chunk, compressed or not, is checked with the leaf hashes as it arrives
+// (chunks.go). RANGE sends leaves with proofs, so a download in ranges can
+// be resumed at any leaf: the client keeps the hashes of the leaves it
+// verified, proves its data against them and asks the server to continue
+// only while the content still has the same root (Request.Root).
+
+// MerkleLeafSize - same as a transfer chunk, so uncompressed chunks
+// are checked as they arrive
+const MerkleLeafSize = chunkSize
+
+const (
+	merkleLeafPrefix = 0
+	merkleNodePrefix = 1
+)
+
+type MerkleTree struct {
+	// levels[0] - leaves, the last level - root
+	levels [][][sha256.Size]byte
+}
+
+// MerkleProof - hashes that lead from leaf Index to the root
+type MerkleProof struct {
+	Index  int      `json:"index"`
+	Leaves int      `json:"leaves"`
+	Path   []string `json:"path"`
+}
+
+func merkleLeaf(data []byte) [sha256.Size]byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleLeafPrefix})
+	hash.Write(data)
+	var sum [sha256.Size]byte
+	hash.Sum(sum[:0])
+	return sum
+}
+
+func merkleNode(left, right [sha256.Size]byte) [sha256.Size]byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleNodePrefix})
+	hash.Write(left[:])
+	hash.Write(right[:])
+	var sum [sha256.Size]byte
+	hash.Sum(sum[:0])
+	return sum
+}
+
+// MerkleLeafHash - hex hash of one leaf, for keeping what was verified
+func MerkleLeafHash(data []byte) string {
+	sum := merkleLeaf(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// NewMerkleTree builds the tree of leaf hashes, an empty file has one empty leaf
+func NewMerkleTree(leaves [][sha256.Size]byte) *MerkleTree {
+	if len(leaves) == 0 {
+		leaves = [][sha256.Size]byte{merkleLeaf(nil)}
+	}
+	t := &MerkleTree{levels: [][][sha256.Size]byte{leaves}}
+	for level := leaves; len(level) > 1; {
+		next := make([][sha256.Size]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleNode(level[i], level[i+1]))
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+// BuildMerkleTree reads r to the end
+func BuildMerkleTree(r io.Reader) (*MerkleTree, error) {
+	var b merkleBuilder
+	if _, err := io.Copy(&b, r); err != nil {
+		return nil, err
+	}
+	return b.Tree(), nil
+}
+
+func (t *MerkleTree) Root() string {
+	root := t.levels[len(t.levels)-1][0]
+	return hex.EncodeToString(root[:])
+}
+
+func (t *MerkleTree) Leaves() int {
+	return len(t.levels[0])
+}
+
+// Verify checks data of leaf index against the tree
+func (t *MerkleTree) Verify(index int, data []byte) bool {
+	return index >= 0 && index < t.Leaves() && merkleLeaf(data) == t.levels[0][index]
+}
+
+// Proof of leaf index, checked with VerifyMerkleProof knowing only the root
+func (t *MerkleTree) Proof(index int) (MerkleProof, error) {
+	if index < 0 || index >= t.Leaves() {
+		return MerkleProof{}, fmt.Errorf("leaf %d out of range, tree has %d", index, t.Leaves())
+	}
+	proof := MerkleProof{Index: index, Leaves: t.Leaves()}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof.Path = append(proof.Path, hex.EncodeToString(level[sibling][:]))
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof checks data of one leaf (e.g. a range download)
+// against the root from metadata
+func VerifyMerkleProof(root string, data []byte, proof MerkleProof) error {
+	if proof.Index < 0 || proof.Index >= proof.Leaves {
+		return fmt.Errorf("leaf %d out of range, tree has %d", proof.Index, proof.Leaves)
+	}
+	sum := merkleLeaf(data)
+	path := proof.Path
+	for index, width := proof.Index, proof.Leaves; width > 1; index, width = index/2, (width+1)/2 {
+		sibling := index ^ 1
+		if sibling >= width {
+			continue
+		}
+		if len(path) == 0 {
+			return fmt.Errorf("merkle proof is too short")
+		}
+		raw, err := hex.DecodeString(path[0])
+		if err != nil || len(raw) != sha256.Size {
+			return fmt.Errorf("invalid hash in merkle proof: %q", path[0])
+		}
+		path = path[1:]
+		var other [sha256.Size]byte
+		copy(other[:], raw)
+		if sibling < index {
+			sum = merkleNode(other, sum)
+		} else {
+			sum = merkleNode(sum, other)
+		}
+	}
+	if len(path) != 0 {
+		return fmt.Errorf("merkle proof is too long")
+	}
+	if hex.EncodeToString(sum[:]) != root {
+		return ErrMerkleMismatch
+	}
+	return nil
+}
+
+// Range - leaves of data at offset with their proofs, data ends at a
+// leaf boundary or at the end of the file
+func (t *MerkleTree) Range(offset int64, data []byte) (*Range, error) {
+	if offset < 0 || offset%MerkleLeafSize != 0 {
+		return nil, fmt.Errorf("range offset %d is not a multiple of %d", offset, MerkleLeafSize)
+	}
+	rng := &Range{Offset: offset, Data: data}
+	first := int(offset / MerkleLeafSize)
+	for i := 0; i < max(1, chunkCount(len(data))); i++ {
+		proof, err := t.Proof(first + i)
+		if err != nil {
+			return nil, err
+		}
+		rng.Proofs = append(rng.Proofs, proof)
+	}
+	return rng, nil
+}
+
+// VerifyRange checks every leaf of rng against root, a short leaf
+// must be the last one of the file
+func VerifyRange(root string, rng *Range) error {
+	if rng.Offset < 0 || rng.Offset%MerkleLeafSize != 0 {
+		return fmt.Errorf("%w: range offset %d is not a multiple of %d", ErrProtocol, rng.Offset, MerkleLeafSize)
+	}
+	leaves := max(1, chunkCount(len(rng.Data)))
+	if len(rng.Proofs) != leaves {
+		return fmt.Errorf("%w: range of %d leaves has %d proofs", ErrProtocol, leaves, len(rng.Proofs))
+	}
+	first := int(rng.Offset / MerkleLeafSize)
+	for i, proof := range rng.Proofs {
+		leaf := chunkAt(rng.Data, i)
+		if proof.Index != first+i || len(leaf) < MerkleLeafSize && proof.Index != proof.Leaves-1 {
+			return fmt.Errorf("%w: proof of leaf %d doesn't fit the range", ErrProtocol, proof.Index)
+		}
+		if err := VerifyMerkleProof(root, leaf, proof); err != nil {
+			if errors.Is(err, ErrMerkleMismatch) {
+				hashMismatches.WithLabelValues("merkle").Inc()
+			}
+			return fmt.Errorf("leaf %d of the range: %w", proof.Index, err)
+		}
+	}
+	return nil
+}
+
+// merkleBuilder hashes leaves of everything written to it
+type merkleBuilder struct {
+	leaves  [][sha256.Size]byte
+	pending []byte
+}
+
+func (b *merkleBuilder) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		take := min(MerkleLeafSize-len(b.pending), len(p))
+		b.pending = append(b.pending, p[:take]...)
+		p = p[take:]
+		if len(b.pending) == MerkleLeafSize {
+			b.leaves = append(b.leaves, merkleLeaf(b.pending))
+			b.pending = b.pending[:0]
+		}
+	}
+	return n, nil
+}
+
+func (b *merkleBuilder) Tree() *MerkleTree {
+	leaves := b.leaves
+	if len(b.pending) > 0 {
+		leaves = append(leaves, merkleLeaf(b.pending))
+	}
+	return NewMerkleTree(leaves)
+}
+
+// writeMerkleLeaves sends leaf hashes as uint32 count and the hashes
+func writeMerkleLeaves(w io.Writer, t *MerkleTree) error {
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.LittleEndian, uint32(t.Leaves()))
+	for _, leaf := range t.levels[0] {
+		buf.Write(leaf[:])
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("error writing merkle leaves: %w", err)
+	}
+	return nil
+}
+
+// readMerkleLeaves reads the hashes of a tree with the expected number
+// of leaves and checks them against root
+func readMerkleLeaves(r io.Reader, leaves int, root string) (*MerkleTree, error) {
+	var count uint32
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("error reading merkle leaves: %w", err)
+	}
+	if int(count) != leaves {
+		return nil, fmt.Errorf("%w: expected %d merkle leaves, got %d", ErrProtocol, leaves, count)
+	}
+	hashes := make([][sha256.Size]byte, count)
+	for i := range hashes {
+		if _, err := io.ReadFull(r, hashes[i][:]); err != nil {
+			return nil, fmt.Errorf("error reading merkle leaves: %w", err)
+		}
+	}
+	t := NewMerkleTree(hashes)
+	if t.Root() != root {
+		hashMismatches.WithLabelValues("merkle").Inc()
+		return nil, fmt.Errorf("merkle leaves don't match the root: %w", ErrMerkleMismatch)
+	}
+	return t, nil
+}
@@ -0,0 +1,248 @@
+package packet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func leafData(t *testing.T, leaves int) []byte {
+	t.Helper()
+	data := make([]byte, leaves*MerkleLeafSize-MerkleLeafSize/3)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	return data
+}
+
+// Кожен лист перевіряється доказом лише за коренем, для будь-якої кількості листів
+func TestMerkleProofs(t *testing.T) {
+	for leaves := 1; leaves <= 9; leaves++ {
+		data := leafData(t, leaves)
+		tree, err := BuildMerkleTree(bytes.NewReader(data))
+		require.NoError(t, err)
+		require.Equal(t, leaves, tree.Leaves())
+
+		for i := 0; i < leaves; i++ {
+			leaf := data[i*MerkleLeafSize : min((i+1)*MerkleLeafSize, len(data))]
+			proof, err := tree.Proof(i)
+			require.NoError(t, err)
+			assert.NoError(t, VerifyMerkleProof(tree.Root(), leaf, proof), "leaves %d, leaf %d", leaves, i)
+
+			// інші дані або інший лист не проходять
+			bad := append([]byte{1}, leaf[1:]...)
+			bad[0] = leaf[0] ^ 1
+			assert.Error(t, VerifyMerkleProof(tree.Root(), bad, proof))
+			if leaves > 1 {
+				moved := proof
+				moved.Index = (i + 1) % leaves
+				assert.Error(t, VerifyMerkleProof(tree.Root(), leaf, moved))
+			}
+		}
+	}
+
+	_, err := NewMerkleTree(nil).Proof(1)
+	assert.Error(t, err)
+}
+
+// Діапазон перевіряється лише за коренем, підмінений лист або доказ не проходять
+func TestMerkleRange(t *testing.T) {
+	data := leafData(t, 5)
+	tree, err := BuildMerkleTree(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	for _, offset := range []int64{0, MerkleLeafSize, 3 * MerkleLeafSize} {
+		part := data[offset:min(int(offset)+2*MerkleLeafSize, len(data))]
+		rng, err := tree.Range(offset, part)
+		require.NoError(t, err)
+		assert.NoError(t, VerifyRange(tree.Root(), rng), "offset %d", offset)
+	}
+	_, err = tree.Range(10, data[10:100])
+	assert.Error(t, err)
+
+	// останній неповний лист
+	rng, err := tree.Range(4*MerkleLeafSize, data[4*MerkleLeafSize:])
+	require.NoError(t, err)
+	require.NoError(t, VerifyRange(tree.Root(), rng))
+
+	rng, err = tree.Range(MerkleLeafSize, append([]byte(nil), data[MerkleLeafSize:3*MerkleLeafSize]...))
+	require.NoError(t, err)
+	rng.Data[MerkleLeafSize+7] ^= 1
+	assert.ErrorIs(t, VerifyRange(tree.Root(), rng), ErrMerkleMismatch)
+
+	// неповний лист посеред файлу
+	rng, err = tree.Range(MerkleLeafSize, data[MerkleLeafSize:2*MerkleLeafSize-1])
+	require.NoError(t, err)
+	assert.ErrorIs(t, VerifyRange(tree.Root(), rng), ErrProtocol)
+
+	// доказ іншого листа
+	rng, err = tree.Range(0, data[:MerkleLeafSize])
+	require.NoError(t, err)
+	rng.Proofs[0], err = tree.Proof(1)
+	require.NoError(t, err)
+	assert.ErrorIs(t, VerifyRange(tree.Root(), rng), ErrProtocol)
+
+	// порожній файл - один порожній лист
+	empty := NewMerkleTree(nil)
+	rng, err = empty.Range(0, nil)
+	require.NoError(t, err)
+	assert.NoError(t, VerifyRange(empty.Root(), rng))
+}
+
+// Корінь у метаданих однаковий для всіх кодеків і перевіряється при отриманні
+func TestPacketMerkleRoot(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	data := leafData(t, 3)
+	require.NoError(t, os.WriteFile(src, data, 0o644))
+	tree, err := BuildMerkleTree(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	for _, codec := range []string{"gzip", "zlib", "snappy", "none"} {
+		packet, err := NewTCPPacket(src, codec)
+		require.NoError(t, err)
+		assert.Equal(t, tree.Root(), packet.MetaData.MerkleRoot, codec)
+
+		dst := filepath.Join(dir, "dst-"+codec)
+		require.NoError(t, packet.decompressToFile(dst))
+		packet.MetaData.MerkleRoot = NewMerkleTree(nil).Root()
+		assert.ErrorIs(t, packet.decompressToFile(dst), ErrMerkleMismatch, codec)
+	}
+}
+
+// Блок з правильним CRC, але не з тим вмістом, пересилається повторно
+func TestMerkleChunkResent(t *testing.T) {
+	good := leafData(t, 3)
+	tree, err := BuildMerkleTree(bytes.NewReader(good))
+	require.NoError(t, err)
+	bad := append([]byte(nil), good...)
+	bad[MerkleLeafSize+1] ^= 1
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	type result struct {
+		data []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer server.Close()
+		meta := &TCPPacketMetaData{Size: int64(len(good)), CompressType: "none", MerkleRoot: tree.Root()}
+		data, err := receiveChunks(server, meta, false, ReceiveOptions{}.withDefaults(), Logger())
+		done <- result{data, err}
+	}()
+
+	require.NoError(t, writeMerkleLeaves(client, tree))
+	for i := 0; i < 3; i++ {
+		require.NoError(t, writeChunk(client, chunkAt(bad, i)))
+	}
+	require.NoError(t, writeEndOfChunks(client))
+	var report chunkReport
+	require.NoError(t, readFrame(client, &report))
+	assert.Equal(t, []int{1}, report.Resend)
+
+	require.NoError(t, writeChunk(client, chunkAt(good, 1)))
+	require.NoError(t, writeEndOfChunks(client))
+	var final chunkReport
+	require.NoError(t, readFrame(client, &final))
+	assert.Empty(t, final.Resend)
+
+	res := <-done
+	require.NoError(t, res.err)
+	assert.Equal(t, good, res.data)
+}
+
+// Дані пакета не відповідають кореню з метаданих - приймач відмовляється
+func TestMerkleLeavesRejected(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	require.NoError(t, os.WriteFile(src, leafData(t, 3), 0o644))
+	packet, err := NewTCPPacket(src, "none")
+	require.NoError(t, err)
+	packet.Bytes[MerkleLeafSize+1] ^= 1
+
+	client, server := tcpPair(t)
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		_, err := ReceiveOverTCP(server, filepath.Join(dir, "dst.bin"))
+		done <- err
+	}()
+
+	_ = packet.SendOverTCP(client)
+	client.Close()
+	assert.ErrorIs(t, <-done, ErrMerkleMismatch)
+}
+
+// crcForger псує вибраний блок і перераховує його CRC, такий блок
+// помічає лише дерево Меркла
+type crcForger struct {
+	net.Conn
+	head   []byte
+	chunks int
+	forge  func(chunk int) bool
+}
+
+func (c *crcForger) Write(p []byte) (int, error) {
+	if len(p) == 8 && c.head == nil {
+		c.head = append([]byte(nil), p...)
+		return len(p), nil
+	}
+	if head := c.head; head != nil {
+		c.head = nil
+		if int(binary.LittleEndian.Uint32(head[:4])) == len(p) {
+			c.chunks++
+			if c.forge(c.chunks) {
+				p = append([]byte(nil), p...)
+				p[len(p)/2] ^= 0x10
+				binary.LittleEndian.PutUint32(head[4:], crc32.Checksum(p, castagnoli))
+			}
+		}
+		if _, err := c.Conn.Write(head); err != nil {
+			return 0, err
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+// Блок стиснутого пакета з правильним CRC, але іншим вмістом,
+// помічається одразу і пересилається
+func TestMerkleCompressedChunkResent(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	data := leafData(t, 4)
+	require.NoError(t, os.WriteFile(src, data, 0o644))
+
+	for _, codec := range []string{"gzip", "snappy", "none"} {
+		packet, err := NewTCPPacket(src, codec)
+		require.NoError(t, err)
+		require.Greater(t, len(packet.Bytes), 2*MerkleLeafSize, codec)
+
+		client, server := tcpPair(t)
+		dst := filepath.Join(dir, "dst-"+codec)
+		done := make(chan error, 1)
+		go func() {
+			defer server.Close()
+			_, err := ReceiveOverTCP(server, dst)
+			done <- err
+		}()
+
+		before := testutil.ToFloat64(hashMismatches.WithLabelValues("merkle"))
+		err = packet.SendOverTCP(&crcForger{Conn: client, forge: func(chunk int) bool { return chunk == 2 }})
+		client.Close()
+		require.NoError(t, err, codec)
+		require.NoError(t, <-done, codec)
+		assert.Equal(t, before+1, testutil.ToFloat64(hashMismatches.WithLabelValues("merkle")), codec)
+		got, err := os.ReadFile(dst)
+		require.NoError(t, err)
+		assert.Equal(t, data, got, codec)
+	}
+}
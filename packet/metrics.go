@@ -0,0 +1,80 @@
+package packet
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+var (
+	// DurationBuckets - seconds, from a local transfer to a slow upload
+	DurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+	ratioBuckets    = []float64{1, 1.25, 1.5, 2, 3, 5, 10, 20}
+)
+
+// transfer metrics of this package, nothing is registered globally,
+// the binary that exposes them registers Collectors
+var (
+	bytesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "eternal_sent_bytes_total",
+		Help: "Packet data sent, compressed or as a delta.",
+	}, []string{"compress_type"})
+	bytesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "eternal_received_bytes_total",
+		Help: "Packet data received, compressed or as a delta.",
+	}, []string{"compress_type"})
+	transferDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "eternal_transfer_duration_seconds",
+		Help:    "Duration of successful packet transfers.",
+		Buckets: DurationBuckets,
+	}, []string{"direction"})
+	compressionRatio = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "eternal_compression_ratio",
+		Help:    "File size divided by compressed size of transferred packets.",
+		Buckets: ratioBuckets,
+	}, []string{"compress_type"})
+	hashMismatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "eternal_hash_mismatches_total",
+		Help: "Data that didn't match its checksum: crc32c - chunk, merkle - chunk or file, sha256 - file.",
+	}, []string{"check"})
+)
+
+// Collectors - transfer metrics of this package
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{bytesSent, bytesReceived, transferDuration, compressionRatio, hashMismatches}
+}
+
+// ServeMetrics serves the metrics of gatherer on addr under /metrics
+func ServeMetrics(addr string, gatherer prometheus.Gatherer) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	return server.ListenAndServe()
+}
+
+// compressLabel - compress type as a label value, metadata comes from the
+// other side and must not create unlimited series
+func compressLabel(compressType string) string {
+	switch compressType {
+	case "gzip", "snappy", "zlib", "none", "delta":
+		return compressType
+	case "":
+		return "none"
+	}
+	return "other"
+}
+
+// observeTransfer records a successful transfer of meta with n bytes of data
+func observeTransfer(direction string, meta *TCPPacketMetaData, n int, start time.Time) {
+	label := compressLabel(meta.CompressType)
+	if direction == "send" {
+		bytesSent.WithLabelValues(label).Add(float64(n))
+	} else {
+		bytesReceived.WithLabelValues(label).Add(float64(n))
+	}
+	transferDuration.WithLabelValues(direction).Observe(time.Since(start).Seconds())
+	if meta.CompressedSize > 0 {
+		compressionRatio.WithLabelValues(label).Observe(float64(meta.Size) / float64(meta.CompressedSize))
+	}
+}
@@ -0,0 +1,59 @@
+package packet
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// кількість спостережень однієї серії гістограми
+func observations(t *testing.T, h prometheus.Observer) uint64 {
+	t.Helper()
+	var m dto.Metric
+	require.NoError(t, h.(prometheus.Metric).Write(&m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+// Передача з одним зіпсованим блоком рахується в обидва боки
+func TestTransferMetrics(t *testing.T) {
+	sent := testutil.ToFloat64(bytesSent.WithLabelValues("none"))
+	received := testutil.ToFloat64(bytesReceived.WithLabelValues("none"))
+	crc := testutil.ToFloat64(hashMismatches.WithLabelValues("crc32c"))
+	sends := observations(t, transferDuration.WithLabelValues("send"))
+
+	data := []byte(strings.Repeat("metrics ", chunkSize/4))
+	sendErr, receiveErr, _ := sendCorrupted(t, data, func(chunk int) bool { return chunk == 1 })
+	require.NoError(t, sendErr)
+	require.NoError(t, receiveErr)
+
+	assert.Equal(t, float64(len(data)), testutil.ToFloat64(bytesSent.WithLabelValues("none"))-sent)
+	assert.Equal(t, float64(len(data)), testutil.ToFloat64(bytesReceived.WithLabelValues("none"))-received)
+	assert.Equal(t, float64(1), testutil.ToFloat64(hashMismatches.WithLabelValues("crc32c"))-crc)
+	assert.Equal(t, uint64(1), observations(t, transferDuration.WithLabelValues("send"))-sends)
+	assert.Equal(t, "other", compressLabel("bogus\n"))
+}
+
+// Метрики пакета реєструються в реєстрі програми, а не глобально,
+// тому два реєстри в одному процесі не конфліктують
+func TestCollectors(t *testing.T) {
+	for i := 0; i < 2; i++ {
+		reg := prometheus.NewPedanticRegistry()
+		require.NoError(t, reg.Register(prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_other", Help: "Other."})))
+		for _, c := range Collectors() {
+			require.NoError(t, reg.Register(c))
+		}
+		bytesSent.WithLabelValues("gzip").Add(0)
+		families, err := reg.Gather()
+		require.NoError(t, err)
+		var names []string
+		for _, f := range families {
+			names = append(names, f.GetName())
+		}
+		assert.Contains(t, names, "eternal_sent_bytes_total")
+	}
+}
@@ -1,6 +1,7 @@
 package packet
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -40,12 +41,13 @@ func TestSendAndReceiveOverTCP(t *testing.T) {
 	done := make(chan *TCPPacket)
 
 	// Створення сервера
+	dst := filepath.Join(t.TempDir(), "testfile.txt")
 	go func() {
 		conn, err := listener.Accept()
 		require.NoError(t, err)
 		defer conn.Close()
 
-		receivedPacket, err := ReceiveOverTCP(conn)
+		receivedPacket, err := ReceiveOverTCP(conn, dst)
 		require.NoError(t, err)
 		done <- receivedPacket
 	}()
@@ -60,7 +62,7 @@ func TestSendAndReceiveOverTCP(t *testing.T) {
 		MetaData: &TCPPacketMetaData{
 			FileName: "testfile.txt",
 			FileType: "text",
-			FileHash: "dummyhash",
+			FileHash: "a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e",
 			Size:     int64(len("Hello World")),
 		},
 		Bytes: []byte("Hello World"),
@@ -80,7 +82,7 @@ func TestSaveFile(t *testing.T) {
 	packet := &TCPPacket{
 		MetaData: &TCPPacketMetaData{
 			FileName: "saved_file.txt",
-			FileHash: "expectedhash",
+			FileHash: "ca83c6acbe7f1270c63b0b4d0b2b180c347b6d5cab6e95b2fd7be152f345314b",
 			Size:     int64(len("Sample content")),
 		},
 		Bytes: []byte("Sample content"),
@@ -93,9 +95,59 @@ func TestSaveFile(t *testing.T) {
 
 	// Перевірка наявності та відповідності файлу
 	savedFilePath := filepath.Join(tempDir, packet.MetaData.FileName)
-	info, err := os.Stat(savedFilePath)
+	data, err := os.ReadFile(savedFilePath)
 	assert.NoError(t, err)
-	assert.Equal(t, packet.MetaData.Size, info.Size())
+	assert.Equal(t, "Sample content", string(data))
+
+	// Файл з невірним хешем не залишається на диску
+	packet.MetaData.FileName = "bad.txt"
+	packet.MetaData.FileHash = "expectedhash"
+	assert.ErrorIs(t, packet.SaveFile(tempDir), ErrHashMismatch)
+	assert.NoFileExists(t, filepath.Join(tempDir, "bad.txt"))
+}
+
+// Невдале отримання не зачіпає старий файл і не залишає тимчасових
+func TestReceiveKeepsOldFile(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "report.txt")
+	require.NoError(t, os.WriteFile(dst, []byte("old content"), 0o644))
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		_, err := ReceiveOverTCP(server, dst)
+		done <- err
+	}()
+	packet := &TCPPacket{
+		MetaData: &TCPPacketMetaData{FileName: "report.txt", FileHash: "wronghash", Size: 11},
+		Bytes:    []byte("new content"),
+	}
+	require.NoError(t, packet.SendOverTCP(client))
+	assert.ErrorIs(t, <-done, ErrHashMismatch)
+
+	data, err := os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "old content", string(data))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	// з правильним хешем файл замінюється повністю
+	client, server = tcpPair(t)
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		_, err := ReceiveOverTCP(server, dst)
+		done <- err
+	}()
+	packet.MetaData.FileHash = "fe32608c9ef5b6cf7e3f946480253ff76f24f4ec0678f3d0f07f9844cbff9601"
+	require.NoError(t, packet.SendOverTCP(client))
+	require.NoError(t, <-done)
+	data, err = os.ReadFile(dst)
+	require.NoError(t, err)
+	assert.Equal(t, "new content", string(data))
 }
 
 // Тест для порівняння хешів файлів
@@ -111,6 +163,30 @@ func TestCompareHashSum(t *testing.T) {
 	assert.Error(t, packet.compareHashSUm("hash2"))
 }
 
+// Отриманий файл перевіряється за хешем з метаданих
+func TestVerifyFile(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.txt")
+	require.NoError(t, os.WriteFile(src, []byte("verify me"), 0o644))
+
+	packet, err := NewTCPPacket(src, "gzip")
+	require.NoError(t, err)
+
+	dst := filepath.Join(dir, "dst.txt")
+	require.NoError(t, packet.decompressToFile(dst))
+	assert.NoError(t, packet.VerifyFile(dst))
+
+	require.NoError(t, os.WriteFile(dst, []byte("verify mE"), 0o644))
+	err = packet.VerifyFile(dst)
+	assert.ErrorIs(t, err, ErrHashMismatch)
+	var mismatch *MismatchError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, packet.MetaData.FileHash, mismatch.Want)
+
+	require.NoError(t, os.WriteFile(dst, []byte("verify"), 0o644))
+	assert.ErrorIs(t, packet.VerifyFile(dst), ErrSizeMismatch)
+}
+
 // Тест для JSON-серіалізації та десеріалізації
 func TestToJsonFromJson(t *testing.T) {
 	packet := &TCPPacket{
@@ -132,3 +208,107 @@ func TestToJsonFromJson(t *testing.T) {
 	assert.Equal(t, packet.MetaData.FileName, newPacket.MetaData.FileName)
 	assert.Equal(t, packet.Bytes, newPacket.Bytes)
 }
+
+// Приймач може відмовити після метаданих, відправник отримує причину
+func TestReceiveOverTCPRejected(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		_, err := ReceiveOverTCPChecked(server, filepath.Join(t.TempDir(), "x"), func(meta *TCPPacketMetaData) error {
+			return &RejectError{Status: StatusInsufficientStorage, Message: "quota exceeded"}
+		})
+		done <- err
+	}()
+
+	packet := &TCPPacket{
+		MetaData: &TCPPacketMetaData{FileName: "x.txt", Size: 1 << 30},
+		Bytes:    []byte("x"),
+	}
+	err := packet.SendOverTCP(client)
+
+	var reject *RejectError
+	require.ErrorAs(t, err, &reject)
+	assert.Equal(t, StatusInsufficientStorage, reject.Status)
+	assert.Equal(t, "quota exceeded", reject.Message)
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+	assert.Error(t, <-done)
+}
+
+// flipConn псує біт у вибраних блоках даних, що проходять через з'єднання
+type flipConn struct {
+	net.Conn
+	chunks int
+	flip   func(chunk int) bool
+}
+
+func (c *flipConn) Write(p []byte) (int, error) {
+	if len(p) == chunkSize {
+		c.chunks++
+		if c.flip(c.chunks) {
+			p = append([]byte(nil), p...)
+			p[len(p)/2] ^= 0x10
+		}
+	}
+	return c.Conn.Write(p)
+}
+
+func sendCorrupted(t *testing.T, data []byte, flip func(chunk int) bool) (sendErr, receiveErr error, received []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.bin")
+	require.NoError(t, os.WriteFile(src, data, 0o644))
+	packet, err := NewTCPPacket(src, "none")
+	require.NoError(t, err)
+
+	client, server := tcpPair(t)
+	defer client.Close()
+	dst := filepath.Join(dir, "dst.bin")
+	done := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		_, err := ReceiveOverTCP(server, dst)
+		done <- err
+	}()
+
+	sendErr = packet.SendOverTCP(&flipConn{Conn: client, flip: flip})
+	receiveErr = <-done
+	received, _ = os.ReadFile(dst)
+	return sendErr, receiveErr, received
+}
+
+// Зіпсований блок помічається одразу і пересилається тільки він
+func TestChunkCorruptionResent(t *testing.T) {
+	data := make([]byte, 5*chunkSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+
+	var flipped []int
+	sendErr, receiveErr, received := sendCorrupted(t, data, func(chunk int) bool {
+		// другий блок псується двічі, четвертий - один раз
+		if chunk == 2 || chunk == 4 || chunk == 6 {
+			flipped = append(flipped, chunk)
+			return true
+		}
+		return false
+	})
+	require.NoError(t, sendErr)
+	require.NoError(t, receiveErr)
+	assert.Equal(t, data, received)
+	// 5 повних блоків, потім 2 пересилання, потім ще 1
+	assert.Equal(t, []int{2, 4, 6}, flipped)
+}
+
+// Блок, що псується щоразу, зупиняє передачу з обох боків
+func TestChunkCorruptionGivesUp(t *testing.T) {
+	data := make([]byte, 2*chunkSize)
+	sendErr, receiveErr, _ := sendCorrupted(t, data, func(chunk int) bool {
+		return chunk != 1
+	})
+	assert.ErrorContains(t, sendErr, "corrupted after")
+	var chunkErr *ChunkError
+	require.ErrorAs(t, receiveErr, &chunkErr)
+	assert.Equal(t, 1, chunkErr.Index)
+}
@@ -0,0 +1,186 @@
+package packet
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Commands of a session. After authentication the client sends a Request
+// and the server answers with a Response carrying the same ID:
+//
+//	PUT:  Request, packet (SendOverTCP), Response with the stored file
+//	GET:  Request, Response, packet from the server if the status is OK
+//	DELTA: Request, Response with the stored copy and its signature if OK,
+//	       delta (SendDeltaOverTCP), Response with the stored file
+//	REPLICATE: as PUT, from a peer server storing into Namespace as its owner
+//	RANGE: Request, Response with File (and its MerkleRoot) and Range
+//	rest: Request, Response
+const (
+	OpPut      = "PUT"
+	OpDelta    = "DELTA"
+	OpGet      = "GET"
+	OpList     = "LIST"
+	OpStat     = "STAT"
+	OpDelete   = "DELETE"
+	OpVersions = "VERSIONS"
+	OpRestore  = "RESTORE"
+	OpShare    = "SHARE"
+	OpRange    = "RANGE"
+	// OpReplicate - only for users the server accepts replicas from
+	OpReplicate = "REPLICATE"
+)
+
+// MatchNone - Request.IfMatch of a path that must not exist yet
+const MatchNone = "none"
+
+// MaxRangeLength - most bytes one RANGE returns, so the range with its
+// proofs fits into a frame
+const MaxRangeLength = 16 * MerkleLeafSize
+
+// MaxPage - most entries in a page of LIST or VERSIONS, a page is also cut
+// before its entries take PageBytes of JSON, so it always fits in a frame
+const (
+	MaxPage   = 1000
+	PageBytes = maxFrameSize / 2
+)
+
+// Status codes of responses, in addition to the ones in reply.go
+const (
+	StatusUnauthorized   = 401
+	StatusConflict       = 409
+	StatusInternalError  = 500
+	StatusNotImplemented = 501
+	// StatusServiceUnavailable - stored, but not replicated as required
+	StatusServiceUnavailable = 503
+)
+
+type Request struct {
+	ID uint64 `json:"id"`
+	Op string `json:"op"`
+	// Namespace - whose files, empty - the user's own
+	Namespace string `json:"namespace,omitempty"`
+	Path      string `json:"path,omitempty"`
+	// Hash - GET by content (sha256 hex) instead of Path
+	Hash string `json:"hash,omitempty"`
+	// Version for GET and RESTORE, 0 - current
+	Version int `json:"version,omitempty"`
+	// CompressType the client wants GET data in
+	CompressType string `json:"compress_type,omitempty"`
+	// IfMatch for PUT, DELTA and DELETE - hash the current version must
+	// have, MatchNone - the path must not exist, else StatusConflict
+	IfMatch string `json:"if_match,omitempty"`
+	// User and Perm ("rwds", "-" revokes) for SHARE
+	User string `json:"user,omitempty"`
+	Perm string `json:"perm,omitempty"`
+	// Offset and Length of RANGE, Offset is a multiple of MerkleLeafSize,
+	// Length is rounded down to whole leaves (at least one), 0 or above
+	// MaxRangeLength - MaxRangeLength
+	Offset int64 `json:"offset,omitempty"`
+	Length int64 `json:"length,omitempty"`
+	// Root of RANGE - root the client's leaves were verified against, the
+	// range is only sent while the content has it, else StatusConflict,
+	// so a resumed download continues the same content
+	Root string `json:"root,omitempty"`
+	// Cursor and Limit page LIST and VERSIONS: up to Limit (at most
+	// MaxPage) entries after Cursor, the Next of the previous page. Limit 0
+	// - all entries in one response, as older clients expect
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+}
+
+type Response struct {
+	ID     uint64 `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Code - ErrorCode of the error, empty for other errors
+	Code string `json:"code,omitempty"`
+	// File - result of PUT, GET, STAT and RESTORE
+	File *FileInfo `json:"file,omitempty"`
+	// Files - entries of LIST, versions (newest first) of VERSIONS
+	Files []FileInfo `json:"files,omitempty"`
+	// Next - Cursor of the next page of a paged LIST or VERSIONS, empty
+	// on the last page
+	Next string `json:"next,omitempty"`
+	// Range - data of RANGE
+	Range *Range `json:"range,omitempty"`
+}
+
+// Range - leaves of a file from Offset, each with its MerkleProof,
+// checked with VerifyRange against the root of the file
+type Range struct {
+	Offset int64         `json:"offset"`
+	Data   []byte        `json:"data"`
+	Proofs []MerkleProof `json:"proofs"`
+}
+
+// FileInfo - stored file as the server describes it
+type FileInfo struct {
+	Path     string      `json:"path"`
+	Hash     string      `json:"hash,omitempty"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	IsDir    bool        `json:"is_dir,omitempty"`
+	Modified time.Time   `json:"modified"`
+	Version  int         `json:"version,omitempty"`
+	Current  bool        `json:"current,omitempty"`
+	Expires  *time.Time  `json:"expires,omitempty"`
+	// MerkleRoot - root of the Merkle tree of the content, only for RANGE
+	MerkleRoot string `json:"merkle_root,omitempty"`
+}
+
+// ResponseError - request failed on the server, errors.Is matches the
+// error of Code (or of Status if there is no code)
+type ResponseError struct {
+	Op      string
+	Path    string
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("%s %s failed (%d): %s", e.Op, e.Path, e.Status, e.Message)
+}
+
+func (e *ResponseError) Unwrap() error { return errorFor(e.Code, e.Status) }
+
+func (r *Request) Send(w io.Writer) error {
+	return writeFrame(w, r)
+}
+
+func ReadRequest(r io.Reader) (*Request, error) {
+	var req Request
+	if err := readFrame(r, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func (r *Response) Send(w io.Writer) error {
+	return writeFrame(w, r)
+}
+
+// ReadResponse reads the answer to req, status other than OK
+// is returned as *ResponseError together with the response
+func ReadResponse(r io.Reader, req *Request) (*Response, error) {
+	var resp Response
+	if err := readFrame(r, &resp); err != nil {
+		return nil, err
+	}
+	if resp.ID != req.ID {
+		return nil, fmt.Errorf("%w: response id %d doesn't match request id %d", ErrProtocol, resp.ID, req.ID)
+	}
+	if resp.Status != StatusOK {
+		return &resp, &ResponseError{Op: req.Op, Path: req.target(), Status: resp.Status, Code: resp.Code, Message: resp.Error}
+	}
+	return &resp, nil
+}
+
+func (r *Request) target() string {
+	if r.Path == "" && r.Hash != "" {
+		return r.Hash
+	}
+	return r.Path
+}
@@ -0,0 +1,79 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Status codes of receiver replies, same meaning as in HTTP
+const (
+	StatusOK                  = 200
+	StatusBadRequest          = 400
+	StatusForbidden           = 403
+	StatusNotFound            = 404
+	StatusTooLarge            = 413
+	StatusInsufficientStorage = 507
+)
+
+// Reply - receiver's answer to packet metadata, sent before any chunk,
+// so the sender learns why a packet was refused instead of a broken pipe
+type Reply struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+	// Code - ErrorCode of the reason, empty for other errors
+	Code string `json:"code,omitempty"`
+	// ChunkCRC - send the data as checked chunks, only when the sender offered them
+	ChunkCRC bool `json:"chunk_crc,omitempty"`
+	// DataLeaves - send the leaf hashes of DataRoot before the chunks
+	DataLeaves bool `json:"data_leaves,omitempty"`
+}
+
+// RejectError - packet refused by the receiver, errors.Is matches the
+// error of Code (or of Status if there is no code)
+type RejectError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	return fmt.Sprintf("rejected by receiver (%d): %s", e.Status, e.Message)
+}
+
+func (e *RejectError) Unwrap() error { return errorFor(e.Code, e.Status) }
+
+// MetaDataCheck decides if a packet is accepted before its data is read,
+// returning *RejectError sets the status sent to the sender, the code of
+// other errors is sent too
+type MetaDataCheck func(meta *TCPPacketMetaData) error
+
+func replyFor(err error) Reply {
+	if err == nil {
+		return Reply{Status: StatusOK}
+	}
+	var reject *RejectError
+	if errors.As(err, &reject) {
+		code := reject.Code
+		if code == "" {
+			code = ErrorCode(errors.Unwrap(reject))
+		}
+		return Reply{Status: reject.Status, Code: code, Message: reject.Message}
+	}
+	status := StatusForbidden
+	switch {
+	case errors.Is(err, ErrTooLarge):
+		status = StatusTooLarge
+	case errors.Is(err, ErrUnsafeName), errors.Is(err, ErrHashMismatch), errors.Is(err, ErrSizeMismatch):
+		status = StatusBadRequest
+	case errors.Is(err, ErrFileExists):
+		status = StatusConflict
+	}
+	return Reply{Status: status, Code: ErrorCode(err), Message: err.Error()}
+}
+
+func (r Reply) err() error {
+	if r.Status == StatusOK {
+		return nil
+	}
+	return &RejectError{Status: r.Status, Code: r.Code, Message: r.Message}
+}
@@ -0,0 +1,137 @@
+package packet
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ConflictPolicy - what is done when the received file already exists
+type ConflictPolicy int
+
+const (
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictRename writes "name (1).ext", "name (2).ext"...
+	ConflictRename
+	// ConflictSkip keeps the existing file, the packet isn't received
+	ConflictSkip
+	// ConflictFail returns ErrFileExists
+	ConflictFail
+)
+
+// maxRenames - suffixes tried by ConflictRename
+const maxRenames = 1000
+
+var conflictNames = []string{"overwrite", "rename", "skip", "fail"}
+
+func (p ConflictPolicy) String() string {
+	if p < 0 || int(p) >= len(conflictNames) {
+		return fmt.Sprintf("ConflictPolicy(%d)", int(p))
+	}
+	return conflictNames[p]
+}
+
+// ParseConflictPolicy - policy by its name: overwrite, rename, skip or fail
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	for i, name := range conflictNames {
+		if s == name {
+			return ConflictPolicy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q, want overwrite, rename, skip or fail", s)
+}
+
+// windowsDevices - names that open a device on Windows with any extension
+var windowsDevices = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true, "CONIN$": true, "CONOUT$": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// CheckFileName - name is a single path element that is safe to create
+// on any system: no separators, "." or "..", control characters, device
+// names or trailing dots and spaces
+func CheckFileName(name string) error {
+	unsafe := func(why string) error {
+		return fmt.Errorf("%w %q: %s", ErrUnsafeName, name, why)
+	}
+	switch {
+	case name == "":
+		return unsafe("empty")
+	case name == "." || name == "..":
+		return unsafe("refers to a directory")
+	case strings.ContainsAny(name, `/\`):
+		return unsafe("contains a path separator")
+	case filepath.VolumeName(name) != "" || strings.Contains(name, ":"):
+		return unsafe("contains a drive or stream name")
+	case strings.HasSuffix(name, ".") || strings.HasSuffix(name, " "):
+		return unsafe("ends with a dot or a space")
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return unsafe("contains a control character")
+		}
+	}
+	base, _, _ := strings.Cut(name, ".")
+	if windowsDevices[strings.ToUpper(strings.TrimRight(base, " "))] {
+		return unsafe("is a device name")
+	}
+	return nil
+}
+
+// SafePath - name from the other side joined onto dir, the result is
+// always directly inside dir
+func SafePath(dir, name string) (string, error) {
+	if dir == "" {
+		return "", errors.New("target directory is empty")
+	}
+	if err := CheckFileName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// ResolveConflict - path to write to by policy, empty if the file is
+// skipped. Nothing is created, the received file is linked there only
+// once it is complete and never replaces a file that appeared meanwhile,
+// see atomicFile. Existing symlinks and other special files are never
+// replaced.
+func ResolveConflict(path string, policy ConflictPolicy) (string, error) {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%w: %s is not a regular file", ErrUnsafeName, path)
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		return path, nil
+	case ConflictSkip:
+		return "", nil
+	case ConflictFail:
+		return "", fmt.Errorf("%w: %s", ErrFileExists, path)
+	case ConflictRename:
+		ext := filepath.Ext(path)
+		stem := strings.TrimSuffix(path, ext)
+		for i := 1; i <= maxRenames; i++ {
+			renamed := fmt.Sprintf("%s (%d)%s", stem, i, ext)
+			_, err := os.Lstat(renamed)
+			if errors.Is(err, fs.ErrNotExist) {
+				return renamed, nil
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+		return "", fmt.Errorf("%w: %s and %d renamed copies", ErrFileExists, path, maxRenames)
+	}
+	return "", fmt.Errorf("unknown conflict policy %d", policy)
+}
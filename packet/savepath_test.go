@@ -0,0 +1,171 @@
+package packet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFileName(t *testing.T) {
+	for _, name := range []string{"file.txt", "архів.tar.gz", ".hidden", "a..b", "CONSOLE.txt", "com10"} {
+		assert.NoError(t, CheckFileName(name), name)
+	}
+
+	// імена, що виходять за каталог або відкривають пристрій
+	for _, name := range []string{
+		"", ".", "..", "../../etc/cron.d/x", "/etc/passwd", `..\..\boot.ini`, "a/b",
+		"C:evil", `C:\evil`, "file.txt:stream", "bad\x00name", "new\nline",
+		"trailing.", "trailing ", "CON", "nul.txt", "Com1.log", "LPT9",
+	} {
+		assert.ErrorIs(t, CheckFileName(name), ErrUnsafeName, "%q", name)
+	}
+
+	dir := t.TempDir()
+	path, err := SafePath(dir, "ok.txt")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "ok.txt"), path)
+	_, err = SafePath(dir, "../escape.txt")
+	assert.ErrorIs(t, err, ErrUnsafeName)
+}
+
+func TestResolveConflict(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.txt")
+
+	// файлу немає - шлях той самий для будь-якої політики і нічого не створено
+	for _, p := range []ConflictPolicy{ConflictOverwrite, ConflictRename, ConflictSkip, ConflictFail} {
+		got, err := ResolveConflict(path, p)
+		require.NoError(t, err)
+		assert.Equal(t, path, got)
+	}
+	assert.NoFileExists(t, path)
+
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0o644))
+	got, err := ResolveConflict(path, ConflictOverwrite)
+	require.NoError(t, err)
+	assert.Equal(t, path, got)
+
+	got, err = ResolveConflict(path, ConflictSkip)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	_, err = ResolveConflict(path, ConflictFail)
+	assert.ErrorIs(t, err, ErrFileExists)
+
+	got, err = ResolveConflict(path, ConflictRename)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "report (1).txt"), got)
+	require.NoError(t, os.WriteFile(got, []byte("copy"), 0o644))
+	got, err = ResolveConflict(path, ConflictRename)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "report (2).txt"), got)
+
+	// через символьне посилання не пишемо
+	link := filepath.Join(dir, "link")
+	require.NoError(t, os.Symlink(filepath.Join(dir, "outside"), link))
+	_, err = ResolveConflict(link, ConflictOverwrite)
+	assert.ErrorIs(t, err, ErrUnsafeName)
+
+	for _, p := range []ConflictPolicy{ConflictOverwrite, ConflictRename, ConflictSkip, ConflictFail} {
+		parsed, err := ParseConflictPolicy(p.String())
+		require.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err = ParseConflictPolicy("merge")
+	assert.Error(t, err)
+}
+
+// Відправник не може вказати шлях поза каталогом отримувача
+func TestReceiveOverTCPInto(t *testing.T) {
+	receive := func(dir, name string, opts ReceiveOptions) (string, error, error) {
+		client, server := tcpPair(t)
+		defer client.Close()
+		type result struct {
+			path string
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			defer server.Close()
+			_, path, err := ReceiveOverTCPInto(server, dir, opts)
+			done <- result{path, err}
+		}()
+		packet := &TCPPacket{MetaData: &TCPPacketMetaData{FileName: name, Size: 4}, Bytes: []byte("data")}
+		sendErr := packet.SendOverTCP(client)
+		r := <-done
+		return r.path, r.err, sendErr
+	}
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "inbox")
+	require.NoError(t, os.Mkdir(dir, 0o755))
+
+	_, err, sendErr := receive(dir, "../escaped.txt", ReceiveOptions{})
+	assert.ErrorIs(t, err, ErrUnsafeName)
+	var reject *RejectError
+	require.ErrorAs(t, sendErr, &reject)
+	assert.Equal(t, StatusBadRequest, reject.Status)
+	assert.ErrorIs(t, sendErr, ErrUnsafeName)
+	assert.NoFileExists(t, filepath.Join(root, "escaped.txt"))
+
+	path, err, sendErr := receive(dir, "a.txt", ReceiveOptions{})
+	require.NoError(t, err)
+	require.NoError(t, sendErr)
+	assert.Equal(t, filepath.Join(dir, "a.txt"), path)
+
+	path, err, sendErr = receive(dir, "a.txt", ReceiveOptions{Conflict: ConflictRename})
+	require.NoError(t, err)
+	require.NoError(t, sendErr)
+	assert.Equal(t, filepath.Join(dir, "a (1).txt"), path)
+
+	// пропуск - відправник отримує file_exists, отримувач не помилку
+	path, err, sendErr = receive(dir, "a.txt", ReceiveOptions{Conflict: ConflictSkip})
+	require.NoError(t, err)
+	assert.Empty(t, path)
+	assert.ErrorIs(t, sendErr, ErrFileExists)
+
+	_, err, sendErr = receive(dir, "a.txt", ReceiveOptions{Conflict: ConflictFail})
+	assert.ErrorIs(t, err, ErrFileExists)
+	require.ErrorAs(t, sendErr, &reject)
+	assert.Equal(t, StatusConflict, reject.Status)
+	assert.Equal(t, "file_exists", reject.Code)
+}
+
+// Файл, що з'явився під час отримання, не перезаписується, і недописаний
+// файл ніколи не видно під кінцевим іменем
+func TestDecompressConflictAtCommit(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	packet := &TCPPacket{MetaData: &TCPPacketMetaData{FileName: "a.txt", Size: 3}, Bytes: []byte("new")}
+
+	got, err := packet.decompressTo(path, ConflictFail)
+	require.NoError(t, err)
+	assert.Equal(t, path, got)
+
+	// хтось інший уже записав файл
+	_, err = packet.decompressTo(path, ConflictFail)
+	assert.ErrorIs(t, err, ErrFileExists)
+
+	got, err = packet.decompressTo(path, ConflictRename)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "a (1).txt"), got)
+
+	require.NoError(t, os.WriteFile(path, []byte("old"), 0o644))
+	got, err = packet.decompressTo(path, ConflictSkip)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+
+	// помилка даних - нічого під кінцевим іменем і жодних тимчасових файлів
+	packet.MetaData.Size = 4
+	_, err = packet.decompressTo(filepath.Join(dir, "b.txt"), ConflictRename)
+	assert.ErrorIs(t, err, ErrSizeMismatch)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -6,9 +6,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"os"
-	"path/filepath"
+	"time"
 )
 
 // check if struct == interface
@@ -22,6 +23,14 @@ type TCPPacketMetaData struct {
 	CompressedSize int64       `json:"compressed_size"`
 	Size           int64       `json:"size"`
 	CompressType   string      `json:"compress_type"`
+	TTL            int64       `json:"ttl,omitempty"` // seconds the receiver keeps the file, 0 - no limit
+	// MerkleRoot - root of the Merkle tree of the file, see merkle.go
+	MerkleRoot string `json:"merkle_root,omitempty"`
+	// DataRoot - root of the Merkle tree of the data as sent (compressed),
+	// set by SendOverTCP so every chunk can be checked as it arrives
+	DataRoot string `json:"data_root,omitempty"`
+	// ChunkCRC - sender can send chunks with checksums, see chunks.go
+	ChunkCRC bool `json:"chunk_crc,omitempty"`
 }
 
 type TCPPacket struct {
@@ -41,35 +50,67 @@ func NewTCPPacket(path, compressType string) (*TCPPacket, error) {
 		return NewTCPPacketSNAPPY(path)
 	case "zlib":
 		return NewTCPPacketZLIB(path)
+	case "none":
+		return newTCPPacketRaw(path)
 	default:
 		return NewTCPPacketSNAPPY(path)
 	}
 }
 
 func (tp *TCPPacket) SendOverTCP(conn net.Conn) error {
-	// Серіалізація метаданих
-	meta, err := json.Marshal(tp.MetaData)
+	start := time.Now()
+	// Серіалізація метаданих, пропонуємо блоки з контрольними сумами
+	offer := *tp.MetaData
+	offer.ChunkCRC = true
+	tree, err := BuildMerkleTree(bytes.NewReader(tp.Bytes))
 	if err != nil {
-		return fmt.Errorf("error marshaling metadata: %v", err)
+		return err
+	}
+	offer.DataRoot = tree.Root()
+	meta, err := json.Marshal(&offer)
+	if err != nil {
+		return fmt.Errorf("error marshaling metadata: %w", err)
 	}
 
 	// Логування початку передачі
-	fmt.Printf("Starting to send packet: %s, size: %d bytes\n", tp.MetaData.FileName, len(tp.Bytes))
+	log := transferLogger(conn, tp.MetaData)
+	log.Info("sending packet", "compress_type", tp.MetaData.CompressType, "bytes", len(tp.Bytes))
 
 	// Надсилаємо довжину метаданих
 	if err := binary.Write(conn, binary.LittleEndian, uint32(len(meta))); err != nil {
-		return fmt.Errorf("error writing metadata length: %v", err)
+		return fmt.Errorf("error writing metadata length: %w", err)
 	}
-	fmt.Printf("Sent metadata length: %d bytes\n", len(meta))
 
 	// Надсилаємо метадані
-	if n, err := conn.Write(meta); err != nil || n != len(meta) {
-		return fmt.Errorf("error sending metadata: wrote %d bytes, expected %d bytes, error: %v", n, len(meta), err)
+	if _, err := conn.Write(meta); err != nil {
+		return fmt.Errorf("error sending metadata: %w", err)
+	}
+	log.Debug("metadata sent", "bytes", len(meta))
+
+	// Чекаємо, чи приймач погодився прийняти пакет
+	var reply Reply
+	if err := readFrame(conn, &reply); err != nil {
+		return fmt.Errorf("error reading receiver reply: %w", err)
+	}
+	if err := reply.err(); err != nil {
+		return err
+	}
+
+	if reply.ChunkCRC {
+		// receivers that don't know DataRoot only take the leaves of
+		// uncompressed data, where both trees are the same
+		if !reply.DataLeaves && !merkleChunks(tp.MetaData) {
+			tree = nil
+		}
+		if err := sendChunks(conn, tp.Bytes, tree, log); err != nil {
+			return err
+		}
+		log.Info("packet sent", "duration", time.Since(start))
+		observeTransfer("send", tp.MetaData, len(tp.Bytes), start)
+		return nil
 	}
-	fmt.Println("Metadata sent successfully.")
 
-	// Ініціалізуємо константу для розміру блоку
-	const chunkSize = 32 * 1024 // 32 KB для ефективної передачі великих файлів
+	// Приймач без контрольних сум - блоки як раніше
 	reader := bytes.NewReader(tp.Bytes)
 
 	// Передаємо дані великими блоками
@@ -79,129 +120,253 @@ func (tp *TCPPacket) SendOverTCP(conn net.Conn) error {
 		if bytesRead > 0 {
 			// Спершу надсилаємо розмір блоку
 			if err := binary.Write(conn, binary.LittleEndian, int32(bytesRead)); err != nil {
-				return fmt.Errorf("error writing chunk size: %v", err)
+				return fmt.Errorf("error writing chunk size: %w", err)
 			}
 			// Надсилаємо самі дані
 			if _, err := conn.Write(chunk[:bytesRead]); err != nil {
-				return fmt.Errorf("error sending chunk: %v", err)
+				return fmt.Errorf("error sending chunk: %w", err)
 			}
-			fmt.Printf("Sent chunk: %d bytes\n", bytesRead)
+			log.Debug("chunk sent", "bytes", bytesRead)
 		}
 		// Перевірка на закінчення даних
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return fmt.Errorf("error reading chunk: %v", err)
+			return fmt.Errorf("error reading chunk: %w", err)
 		}
 	}
-	fmt.Println("Data sent successfully.")
+
+	// Порожній блок - кінець даних, з'єднання лишається відкритим для наступних команд
+	if err := writeEndOfChunks(conn); err != nil {
+		return err
+	}
+	log.Info("packet sent", "duration", time.Since(start))
+	observeTransfer("send", tp.MetaData, len(tp.Bytes), start)
 	return nil
 }
 
 func ReceiveOverTCP(conn net.Conn, path string) (*TCPPacket, error) {
+	return ReceiveOverTCPWith(conn, path, ReceiveOptions{})
+}
+
+// ReceiveOverTCPChecked - ReceiveOverTCP that lets check refuse the packet
+// (quota, permissions...) right after metadata, before any data is read.
+// The reason is sent back to the sender.
+func ReceiveOverTCPChecked(conn net.Conn, path string, check MetaDataCheck) (*TCPPacket, error) {
+	return ReceiveOverTCPWith(conn, path, ReceiveOptions{Check: check})
+}
+
+// ReceiveOverTCPWith - ReceiveOverTCP within the limits of opts, a packet
+// announcing more than them is refused with StatusTooLarge, one sending
+// more fails with *LimitError. A file at path is always replaced,
+// opts.Conflict is for ReceiveOverTCPTo.
+func ReceiveOverTCPWith(conn net.Conn, path string, opts ReceiveOptions) (*TCPPacket, error) {
+	opts.Conflict = ConflictOverwrite
+	tp, _, err := receiveOverTCP(conn, opts, func(*TCPPacketMetaData) (string, error) { return path, nil })
+	return tp, err
+}
+
+// ReceiveOverTCPTo - ReceiveOverTCPWith where an existing file at path is
+// handled by opts.Conflict, returns the path the file was written to.
+// Skipped and failed conflicts are refused with StatusConflict before the
+// data, a skip returns the packet without Bytes and an empty path.
+func ReceiveOverTCPTo(conn net.Conn, path string, opts ReceiveOptions) (*TCPPacket, string, error) {
+	return receiveOverTCP(conn, opts, func(*TCPPacketMetaData) (string, error) {
+		return ResolveConflict(path, opts.Conflict)
+	})
+}
+
+// ReceiveOverTCPInto - ReceiveOverTCPTo that saves the file under the name
+// from its metadata in dir. Names that could leave dir are refused with
+// StatusBadRequest.
+func ReceiveOverTCPInto(conn net.Conn, dir string, opts ReceiveOptions) (*TCPPacket, string, error) {
+	return receiveOverTCP(conn, opts, func(meta *TCPPacketMetaData) (string, error) {
+		path, err := SafePath(dir, meta.FileName)
+		if err != nil {
+			return "", err
+		}
+		return ResolveConflict(path, opts.Conflict)
+	})
+}
+
+// receiveOverTCP - target gives the path for the metadata, an error refuses
+// the packet, an empty path skips it
+func receiveOverTCP(conn net.Conn, opts ReceiveOptions, target func(*TCPPacketMetaData) (string, error)) (*TCPPacket, string, error) {
+	start := time.Now()
+	opts = opts.withDefaults()
 	var metaLength uint32
 
 	// get meta data length
 	if err := binary.Read(conn, binary.LittleEndian, &metaLength); err != nil {
-		return nil, fmt.Errorf("error reading metadata length: %v", err)
+		return nil, "", fmt.Errorf("error reading metadata length: %w", err)
+	}
+	if int64(metaLength) > int64(opts.MaxMetaDataSize) {
+		return nil, "", &LimitError{Limit: "metadata size", Size: int64(metaLength), Max: int64(opts.MaxMetaDataSize)}
 	}
-	fmt.Printf("Metadata length received: %d bytes\n", metaLength)
 
 	// get meta data
 	meta := make([]byte, metaLength)
-	if n, err := io.ReadFull(conn, meta); err != nil || uint32(n) != metaLength {
-		return nil, fmt.Errorf("error reading metadata: read %d bytes, expected %d, error: %v", n, metaLength, err)
+	if _, err := io.ReadFull(conn, meta); err != nil {
+		return nil, "", fmt.Errorf("error reading metadata: %w", err)
 	}
 
 	//write meta data to struct
 	var metaData *TCPPacketMetaData
-	if err := json.Unmarshal(meta, &metaData); err != nil {
-		return nil, fmt.Errorf("error unmarshalling metadata: %v", err)
+	if err := json.Unmarshal(meta, &metaData); err != nil || metaData == nil {
+		return nil, "", fmt.Errorf("%w: error unmarshalling metadata: %v", ErrProtocol, err)
 	}
-	fmt.Printf("Received metadata: %v\n", metaData)
+	log := transferLogger(conn, metaData)
+	log.Debug("metadata received", "bytes", metaLength)
 
+	// answer before the data, so a refused sender doesn't push the whole file
+	checkErr := opts.checkMetaData(metaData)
+	if checkErr == nil && opts.Check != nil {
+		checkErr = opts.Check(metaData)
+	}
+	var path string
+	if checkErr == nil {
+		path, checkErr = target(metaData)
+	}
+	skipped := checkErr == nil && path == ""
+	if skipped {
+		checkErr = &RejectError{Status: StatusConflict, Code: ErrorCode(ErrFileExists), Message: "file exists, skipped"}
+	}
+	reply := replyFor(checkErr)
+	reply.ChunkCRC = checkErr == nil && metaData.ChunkCRC
+	reply.DataLeaves = reply.ChunkCRC && metaData.DataRoot != ""
+	if err := writeFrame(conn, reply); err != nil {
+		return nil, "", err
+	}
+	if skipped {
+		log.Info("packet skipped, file exists")
+		return &TCPPacket{MetaData: metaData}, "", nil
+	}
+	if checkErr != nil {
+		return nil, "", checkErr
+	}
+	metaData.ChunkCRC = false
+
+	var data []byte
+	var err error
+	if reply.ChunkCRC {
+		data, err = receiveChunks(conn, metaData, reply.DataLeaves, opts, log)
+	} else {
+		data, err = receivePlainChunks(conn, opts, log)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	tp := &TCPPacket{
+		MetaData: metaData,
+		Bytes:    data,
+	}
+	tp.logMetaData(log)
+
+	// a file that appeared at path during the transfer is still handled
+	// by the policy
+	path, err = tp.decompressTo(path, opts.Conflict)
+	if err != nil {
+		return nil, "", fmt.Errorf("error decompressing file: %w", err)
+	}
+	log.Info("packet received", "bytes", len(data), "duration", time.Since(start))
+	observeTransfer("receive", metaData, len(data), start)
+
+	return tp, path, nil
+}
+
+// receivePlainChunks reads chunks of senders without checksums
+func receivePlainChunks(conn io.ReadWriter, opts ReceiveOptions, log *slog.Logger) ([]byte, error) {
 	// data buffer
 	var packetBuffer bytes.Buffer
 
 	for {
-		var chunkSize int32
+		var size int32
 		// get len of chunk
-		if err := binary.Read(conn, binary.LittleEndian, &chunkSize); err != nil {
+		if err := binary.Read(conn, binary.LittleEndian, &size); err != nil {
+			// old senders just close the connection after the last chunk
 			if err == io.EOF {
 				break
 			}
-			return nil, fmt.Errorf("error reading chunk size: %v", err)
+			return nil, fmt.Errorf("error reading chunk size: %w", err)
+		}
+		if size == 0 {
+			break
+		}
+		if size < 0 {
+			return nil, fmt.Errorf("%w: invalid chunk size %d", ErrProtocol, size)
+		}
+		if int(size) > opts.MaxChunkSize {
+			return nil, &LimitError{Limit: "chunk size", Size: int64(size), Max: int64(opts.MaxChunkSize)}
+		}
+		if total := int64(packetBuffer.Len()) + int64(size); total > opts.MaxFileSize {
+			return nil, &LimitError{Limit: "file size", Size: total, Max: opts.MaxFileSize}
 		}
 
 		// get chunk
-		chunk := make([]byte, chunkSize)
-		if n, err := io.ReadFull(conn, chunk); err != nil || int32(n) != chunkSize {
-			return nil, fmt.Errorf("error reading chunk: read %d bytes, expected %d, error: %v", n, chunkSize, err)
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(conn, chunk); err != nil {
+			return nil, fmt.Errorf("error reading chunk: %w", err)
 		}
 		packetBuffer.Write(chunk)
-		fmt.Printf("Received chunk: %d bytes\n", chunkSize)
+		log.Debug("chunk received", "bytes", size)
 	}
+	return packetBuffer.Bytes(), nil
+}
 
-	fmt.Println("Data received successfully.")
-	tp := &TCPPacket{
-		MetaData: metaData,
-		Bytes:    packetBuffer.Bytes(),
-	}
-	tp.print()
+// SaveFile writes the packet as FileName in dir, overwriting an existing
+// file, and checks it against the metadata
+func (tp *TCPPacket) SaveFile(dir string) error {
+	_, err := tp.SaveFileWith(dir, ConflictOverwrite)
+	return err
+}
 
-	err := tp.decompressToFile(path)
+// SaveFileWith - SaveFile with policy for an existing file, returns the
+// path written to, empty if the file was skipped. FileName must pass
+// CheckFileName, a file that fails the check never replaces the old one.
+func (tp *TCPPacket) SaveFileWith(dir string, policy ConflictPolicy) (string, error) {
+	path, err := SafePath(dir, tp.MetaData.FileName)
 	if err != nil {
-		return nil, fmt.Errorf("error decompressing file: %v", err)
+		return "", err
 	}
-
-	return tp, nil
+	path, err = ResolveConflict(path, policy)
+	if err != nil || path == "" {
+		return "", err
+	}
+	return tp.decompressTo(path, policy)
 }
 
-func (tp *TCPPacket) SaveFile(path string) error {
-	//create file
-	if path == "" {
-		return fmt.Errorf("file path is empty")
+func (tp *TCPPacket) compareHashSUm(newHash string) error {
+	if tp.MetaData.FileHash == newHash {
+		return nil
 	}
-	filePath := filepath.Join(path, tp.MetaData.FileName)
-	file, err := os.Create(filePath)
+	hashMismatches.WithLabelValues("sha256").Inc()
+	return &MismatchError{Err: ErrHashMismatch, Got: newHash, Want: tp.MetaData.FileHash}
+}
+
+// VerifyFile checks that the file at path (e.g. written by ReceiveOverTCP)
+// has the size and FileHash from metadata
+func (tp *TCPPacket) VerifyFile(path string) error {
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	//buffer for file
-	var buff = bytes.NewBuffer(make([]byte, tp.MetaData.Size))
-	b, e := io.Copy(file, buff)
-	if e != nil {
-		return e
+	info, err := file.Stat()
+	if err != nil {
+		return err
 	}
-
-	//compare bytes
-	if b != tp.MetaData.Size {
-		return fmt.Errorf("file size mismatch: %d vs %d", b, tp.MetaData.Size)
+	if info.Size() != tp.MetaData.Size {
+		return sizeMismatch(info.Size(), tp.MetaData.Size)
 	}
 
-	//get check sum
-	sum, er := hashSum(file)
-	if er != nil {
-		return er
-	}
-
-	// compare check sums
-	err = tp.compareHashSUm(sum)
+	sum, err := hashSum(file)
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func (tp *TCPPacket) compareHashSUm(newHash string) error {
-	if tp.MetaData.FileHash == newHash {
-		return nil
-	}
-	return fmt.Errorf("file hash mismatch: %s vs %s", tp.MetaData.FileHash, newHash)
+	return tp.compareHashSUm(sum)
 }
 
 func (tp *TCPPacket) ToJson() ([]byte, error) {
@@ -218,13 +383,15 @@ func (tp *TCPPacket) FromJson() (*TCPPacket, error) {
 	return packet, nil
 }
 
-func (tp *TCPPacket) print() {
-	fmt.Println("TCPPacket: ")
-	fmt.Printf("FileName: %s\n", tp.MetaData.FileName)
-	fmt.Printf("FileType: %s\n", tp.MetaData.FileType)
-	fmt.Printf("Compress type: %s\n", tp.MetaData.CompressType)
-	fmt.Printf("Size: %d\n", tp.MetaData.Size)
-	fmt.Printf("Compress size: %d\n", tp.MetaData.CompressedSize)
-	fmt.Printf("HashSum: %s\n", tp.MetaData.FileHash)
-	fmt.Printf("FileMode: %s\n", tp.MetaData.FileMode.String())
+// logMetaData logs all metadata of the packet at Debug
+func (tp *TCPPacket) logMetaData(log *slog.Logger) {
+	log.Debug("packet",
+		"file", tp.MetaData.FileName,
+		"file_type", tp.MetaData.FileType,
+		"compress_type", tp.MetaData.CompressType,
+		"size", tp.MetaData.Size,
+		"compressed_size", tp.MetaData.CompressedSize,
+		"hash", tp.MetaData.FileHash,
+		"merkle_root", tp.MetaData.MerkleRoot,
+		"mode", tp.MetaData.FileMode.String())
 }
@@ -0,0 +1,404 @@
+// Package gateway serves the storage over HTTP for tools that can't
+// speak the packet protocol:
+//
+//	GET    /files/<namespace>/<path>   file, Range and conditional requests
+//	HEAD   /files/<namespace>/<path>   headers only
+//	GET    /files/<namespace>/<dir>/   directory listing (JSON)
+//	PUT    /files/<namespace>/<path>   upload the request body
+//	DELETE /files/<namespace>/<path>   delete
+//
+// ETag is the stored file hash, the same FileHash packets carry. Users
+// authenticate with HTTP Basic auth and the credentials of the TCP server,
+// so the gateway must only be served over TLS.
+package gateway
+
+import (
+	packet "EternalPacket"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"eternalStorageServer/replica"
+	"eternalStorageServer/storage"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Prefix of file URLs
+	Prefix = "/files/"
+
+	// authCacheTTL - how long a checked password isn't derived again,
+	// key derivation is slow on purpose
+	authCacheTTL = 5 * time.Minute
+	// maxAuthFailures - failed logins of one user or one address within
+	// authFailureWindow, after that they are refused without a check
+	maxAuthFailures   = 10
+	authFailureWindow = time.Minute
+	// maxTrackedFailures - users and addresses with failures kept before
+	// expired ones are dropped
+	maxTrackedFailures = 4096
+)
+
+var (
+	errAuthRequired    = errors.New("authentication required")
+	errTooManyFailures = errors.New("too many failed logins, try again later")
+)
+
+type Gateway struct {
+	store    *storage.Store
+	creds    packet.CredentialStore
+	replicas *replica.Replicator
+	logger   *log.Logger
+	// maxSize - largest upload body
+	maxSize int64
+	// derivations - slots of concurrent key derivations, each one
+	// takes a lot of memory and CPU
+	derivations chan struct{}
+
+	mu        sync.Mutex
+	authCache map[string]authEntry
+	// failures - "user:" or "addr:" + name -> failed logins
+	failures map[string]authFailures
+}
+
+type authEntry struct {
+	digest  [sha256.Size]byte
+	expires time.Time
+}
+
+type authFailures struct {
+	count int
+	since time.Time
+}
+
+// New - gateway to store, uploads are replicated with replicas if not nil
+func New(store *storage.Store, creds packet.CredentialStore, replicas *replica.Replicator, logger *log.Logger) *Gateway {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	return &Gateway{
+		store:       store,
+		creds:       creds,
+		replicas:    replicas,
+		logger:      logger,
+		maxSize:     maxUploadSize(packet.ReceiveOptions{}),
+		derivations: make(chan struct{}, runtime.NumCPU()),
+		authCache:   make(map[string]authEntry),
+		failures:    make(map[string]authFailures),
+	}
+}
+
+// SetReceiveLimits - uploads get the limit of the TCP server, the body
+// can't be larger than MaxDecompressedSize
+func (g *Gateway) SetReceiveLimits(opts packet.ReceiveOptions) {
+	g.maxSize = maxUploadSize(opts)
+}
+
+// maxUploadSize - MaxDecompressedSize with the meaning of zero and
+// negative values of packet.ReceiveOptions
+func maxUploadSize(opts packet.ReceiveOptions) int64 {
+	switch {
+	case opts.MaxDecompressedSize == 0:
+		return packet.DefaultMaxDecompressedSize
+	case opts.MaxDecompressedSize < 0:
+		return math.MaxInt64
+	}
+	return opts.MaxDecompressedSize
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, err := g.authenticate(r)
+	if errors.Is(err, errTooManyFailures) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(authFailureWindow.Seconds())))
+		httpError(w, http.StatusTooManyRequests, err.Error())
+		return
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="eternal", charset="UTF-8"`)
+		httpError(w, http.StatusUnauthorized, errAuthRequired.Error())
+		return
+	}
+
+	rest, ok := strings.CutPrefix(r.URL.Path, Prefix)
+	if !ok {
+		httpError(w, http.StatusNotFound, "not found")
+		return
+	}
+	ns, filePath, _ := strings.Cut(rest, "/")
+	if ns == "" {
+		ns = user
+	}
+
+	switch {
+	case (r.Method == http.MethodGet || r.Method == http.MethodHead) && (filePath == "" || strings.HasSuffix(filePath, "/")):
+		g.list(w, r, user, ns, filePath)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		g.get(w, r, user, ns, filePath)
+	case r.Method == http.MethodPut:
+		g.put(w, r, user, ns, filePath)
+	case r.Method == http.MethodDelete:
+		g.delete(w, r, user, ns, filePath)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+		httpError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	g.logger.Println(r.RemoteAddr, user, r.Method, ns, filePath)
+}
+
+// authenticate checks Basic auth. A password that was checked recently is
+// taken from the cache, otherwise the key is derived in one of the
+// derivations slots, unless the user or the address failed too often.
+func (g *Gateway) authenticate(r *http.Request) (string, error) {
+	user, secret, ok := r.BasicAuth()
+	if !ok || user == "" {
+		return "", errAuthRequired
+	}
+	digest := sha256.Sum256([]byte(user + "\x00" + secret))
+
+	g.mu.Lock()
+	cached, found := g.authCache[user]
+	g.mu.Unlock()
+	if found && time.Now().Before(cached.expires) && subtle.ConstantTimeCompare(cached.digest[:], digest[:]) == 1 {
+		return user, nil
+	}
+
+	keys := []string{"user:" + user, "addr:" + remoteHost(r)}
+	if g.blocked(time.Now(), keys) {
+		return "", errTooManyFailures
+	}
+	select {
+	case g.derivations <- struct{}{}:
+	case <-r.Context().Done():
+		return "", r.Context().Err()
+	}
+	err := packet.CheckSecret(g.creds, user, secret)
+	<-g.derivations
+	if err != nil {
+		g.failed(time.Now(), keys)
+		return "", err
+	}
+
+	g.mu.Lock()
+	g.authCache[user] = authEntry{digest: digest, expires: time.Now().Add(authCacheTTL)}
+	delete(g.failures, keys[0])
+	g.mu.Unlock()
+	return user, nil
+}
+
+// blocked - one of keys has maxAuthFailures in the current window
+func (g *Gateway) blocked(now time.Time, keys []string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys {
+		f, ok := g.failures[key]
+		if ok && f.count >= maxAuthFailures && now.Sub(f.since) < authFailureWindow {
+			return true
+		}
+	}
+	return false
+}
+
+// failed counts a failed login of every key, a window starts
+// with the first failure after the previous one ended
+func (g *Gateway) failed(now time.Time, keys []string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(g.failures) >= maxTrackedFailures {
+		for key, f := range g.failures {
+			if now.Sub(f.since) >= authFailureWindow {
+				delete(g.failures, key)
+			}
+		}
+	}
+	for _, key := range keys {
+		f := g.failures[key]
+		if now.Sub(f.since) >= authFailureWindow {
+			f = authFailures{since: now}
+		}
+		f.count++
+		g.failures[key] = f
+	}
+}
+
+// remoteHost - address of the client without the port
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (g *Gateway) get(w http.ResponseWriter, r *http.Request, user, ns, filePath string) {
+	version := 0
+	if v := r.URL.Query().Get("version"); v != "" {
+		var err error
+		if version, err = strconv.Atoi(v); err != nil {
+			httpError(w, http.StatusBadRequest, "invalid version "+v)
+			return
+		}
+	}
+
+	file, data, err := g.store.OpenVersion(user, ns, filePath, version)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	defer data.Close()
+	content, ok := data.(io.ReaderAt)
+	if !ok {
+		httpError(w, http.StatusNotImplemented, "storage can't seek")
+		return
+	}
+
+	setFileHeaders(w, file)
+	// Range, If-Range, If-None-Match, If-Modified-Since and HEAD
+	http.ServeContent(w, r, file.Path, file.Modified, io.NewSectionReader(content, 0, file.Size))
+}
+
+func (g *Gateway) list(w http.ResponseWriter, r *http.Request, user, ns, dir string) {
+	files, err := g.store.List(user, ns, strings.TrimSuffix(dir, "/"))
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	writeJSON(w, r, http.StatusOK, files)
+}
+
+func (g *Gateway) put(w http.ResponseWriter, r *http.Request, user, ns, filePath string) {
+	opts := storage.PutOptions{Mode: 0o644}
+	if ttl := r.URL.Query().Get("ttl"); ttl != "" {
+		seconds, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil || seconds < 0 {
+			httpError(w, http.StatusBadRequest, "invalid ttl "+ttl)
+			return
+		}
+		opts.TTL = time.Duration(seconds) * time.Second
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		opts.IfMatch = strings.Trim(match, `"`)
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		opts.IfMatch = storage.MatchNone
+	}
+
+	// refuse before the body is read, like a rejected packet
+	if r.ContentLength > g.maxSize {
+		httpError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("upload of %d bytes exceeds the limit of %d", r.ContentLength, g.maxSize))
+		return
+	}
+	if r.ContentLength >= 0 {
+		if err := g.store.CheckPut(user, ns, filePath, r.ContentLength); err != nil {
+			storageError(w, err)
+			return
+		}
+	}
+	// a body without Content-Length (chunked) is cut at the limit
+	r.Body = http.MaxBytesReader(w, r.Body, g.maxSize)
+
+	_, statErr := g.store.Stat(user, ns, filePath)
+	file, err := g.store.Put(user, ns, filePath, r.Body, opts)
+	if err != nil {
+		storageError(w, err)
+		return
+	}
+	if g.replicas != nil {
+		if err := g.replicas.Replicate(ns, file); err != nil {
+			storageError(w, err)
+			return
+		}
+	}
+
+	status := http.StatusOK
+	if errors.Is(statErr, storage.ErrNotFound) {
+		status = http.StatusCreated
+	}
+	setFileHeaders(w, file)
+	writeJSON(w, r, status, file)
+}
+
+func (g *Gateway) delete(w http.ResponseWriter, r *http.Request, user, ns, filePath string) {
+	ifMatch := strings.Trim(r.Header.Get("If-Match"), `"`)
+	if err := g.store.DeleteIf(user, ns, filePath, ifMatch); err != nil {
+		storageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setFileHeaders(w http.ResponseWriter, file *storage.File) {
+	w.Header().Set("ETag", `"`+file.Hash+`"`)
+	w.Header().Set("X-Eternal-Version", strconv.Itoa(file.Version))
+	if !file.Expires.IsZero() {
+		w.Header().Set("Expires", file.Expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		_ = json.NewEncoder(w).Encode(v)
+	}
+}
+
+func httpError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func storageError(w http.ResponseWriter, err error) {
+	httpError(w, statusFor(err), err.Error())
+}
+
+func statusFor(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, storage.ErrForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrBadPath):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrConflict):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, replica.ErrNotReplicated):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ListenAndServeTLS serves handler (Gateway or S3) on addr with the
+// certificate of the TCP server
+func ListenAndServeTLS(addr string, handler http.Handler, logger *log.Logger) error {
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{packet.LoadTLSCert()}}
+	logger.Println("listening on", addr)
+	if err := server.ListenAndServeTLS("", ""); err != nil {
+		return fmt.Errorf("http gateway: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package gateway
+
+import (
+	packet "EternalPacket"
+	"encoding/json"
+	"eternalStorageServer/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	creds := packet.Credentials{}
+	require.NoError(t, creds.Add("alice", "pw"))
+	server := httptest.NewServer(New(store, creds, nil, nil))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func do(t *testing.T, method, url, body string, header map[string]string) *http.Response {
+	t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	require.NoError(t, err)
+	req.SetBasicAuth("alice", "pw")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func body(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// Без пароля або з неправильним - 401
+func TestGatewayAuth(t *testing.T) {
+	server := newServer(t)
+
+	resp, err := http.Get(server.URL + "/files/alice/a.txt")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("WWW-Authenticate"))
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/files/alice/a.txt", nil)
+	require.NoError(t, err)
+	req.SetBasicAuth("alice", "wrong")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+// Завантаження, читання частинами, умовні запити і видалення
+func TestGatewayFiles(t *testing.T) {
+	server := newServer(t)
+	url := server.URL + "/files/alice/docs/a.txt"
+
+	resp := do(t, http.MethodPut, url, "hello gateway", nil)
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	var file storage.File
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&file))
+	etag := `"` + file.Hash + `"`
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp = do(t, http.MethodGet, url, "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello gateway", body(t, resp))
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp = do(t, http.MethodGet, url, "", map[string]string{"Range": "bytes=6-"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "gateway", body(t, resp))
+
+	resp = do(t, http.MethodGet, url, "", map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp = do(t, http.MethodHead, url, "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len("hello gateway")), resp.ContentLength)
+	assert.Empty(t, body(t, resp))
+
+	// простір імен за замовчуванням - свій
+	resp = do(t, http.MethodGet, server.URL+"/files//docs/", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var files []storage.File
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&files))
+	require.Len(t, files, 1)
+	assert.Equal(t, "docs/a.txt", files[0].Path)
+
+	resp = do(t, http.MethodPut, url, "changed", map[string]string{"If-Match": `"stale"`})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = do(t, http.MethodPut, url, "changed", map[string]string{"If-None-Match": "*"})
+	assert.Equal(t, http.StatusPreconditionFailed, resp.StatusCode)
+	resp = do(t, http.MethodPut, url, "changed", map[string]string{"If-Match": etag})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("X-Eternal-Version"))
+
+	resp = do(t, http.MethodGet, url+"?version=1", "", nil)
+	assert.Equal(t, "hello gateway", body(t, resp))
+
+	resp = do(t, http.MethodDelete, url, "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = do(t, http.MethodGet, url, "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(t, http.MethodPost, url, "x", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+// Після maxAuthFailures невдалих входів користувач і адреса отримують
+// 429 без перевірки пароля, до кінця вікна
+func TestGatewayAuthFailures(t *testing.T) {
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	creds := packet.Credentials{}
+	require.NoError(t, creds.Add("alice", "pw"))
+	g := New(store, creds, nil, nil)
+
+	login := func(user, secret string) *http.Response {
+		req := httptest.NewRequest(http.MethodGet, "/files/alice/", nil)
+		req.SetBasicAuth(user, secret)
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	assert.Equal(t, http.StatusOK, login("alice", "pw").StatusCode)
+	for i := 0; i < maxAuthFailures; i++ {
+		assert.Equal(t, http.StatusUnauthorized, login("alice", "wrong").StatusCode)
+	}
+	// пароль з кешу не потребує виведення ключа і приймається
+	assert.Equal(t, http.StatusOK, login("alice", "pw").StatusCode)
+	resp := login("alice", "guess")
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "60", resp.Header.Get("Retry-After"))
+	// невідомий користувач з тієї ж адреси
+	assert.Equal(t, http.StatusTooManyRequests, login("mallory", "x").StatusCode)
+
+	// вікно минуло
+	g.mu.Lock()
+	for key, f := range g.failures {
+		f.since = f.since.Add(-authFailureWindow)
+		g.failures[key] = f
+	}
+	g.authCache = make(map[string]authEntry)
+	g.mu.Unlock()
+	assert.Equal(t, http.StatusOK, login("alice", "pw").StatusCode)
+}
+
+// Тіло більше за ліміт відхиляється, і з Content-Length, і без нього
+func TestGatewayUploadLimit(t *testing.T) {
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	creds := packet.Credentials{}
+	require.NoError(t, creds.Add("alice", "pw"))
+	g := New(store, creds, nil, nil)
+	g.SetReceiveLimits(packet.ReceiveOptions{MaxDecompressedSize: 10})
+	server := httptest.NewServer(g)
+	t.Cleanup(server.Close)
+	url := server.URL + "/files/alice/big.txt"
+
+	resp := do(t, http.MethodPut, url, "more than ten bytes", nil)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+
+	// без Content-Length тіло надсилається частинами
+	req, err := http.NewRequest(http.MethodPut, url, io.MultiReader(strings.NewReader("more than "), strings.NewReader("ten bytes")))
+	require.NoError(t, err)
+	req.ContentLength = -1
+	req.SetBasicAuth("alice", "pw")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	resp = do(t, http.MethodGet, url, "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(t, http.MethodPut, url, "ten bytes!", nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+}
@@ -0,0 +1,389 @@
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"eternalStorageServer/storage"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxParts = 10000
+	// maxPartSize - the largest part S3 accepts, 5 GiB
+	maxPartSize = 5 << 30
+	// maxUploadAge - multipart uploads nobody completed or aborted
+	// are removed after this time
+	maxUploadAge = 7 * 24 * time.Hour
+	uploadFile   = "upload.json"
+)
+
+// uploads - multipart uploads in progress, <dir>/<upload id>/ holds
+// upload.json and a file per part named <number>-<sha256>
+type uploads struct {
+	dir string
+	mu  sync.Mutex
+}
+
+type upload struct {
+	User      string    `json:"user"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Initiated time.Time `json:"initiated"`
+}
+
+type part struct {
+	number int
+	hash   string
+	path   string
+	size   int64
+}
+
+func newUploads(tmp string) (*uploads, error) {
+	u := &uploads{dir: filepath.Join(tmp, "s3-uploads")}
+	if err := os.MkdirAll(u.dir, 0o750); err != nil {
+		return nil, err
+	}
+	if _, err := u.clean(time.Now()); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// clean removes the uploads untouched for maxUploadAge, a part upload
+// or a completion renews the upload. Returns how many were removed.
+func (u *uploads) clean(now time.Time) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || now.Sub(info.ModTime()) <= maxUploadAge {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(u.dir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// pending - bytes of the parts uploaded to bucket and not completed yet,
+// they count against the quota of the namespace until they are stored.
+// Must be called with mu locked.
+func (u *uploads) pending(bucket string) (int64, error) {
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, entry := range entries {
+		dir := filepath.Join(u.dir, entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, uploadFile))
+		if err != nil {
+			continue
+		}
+		var up upload
+		if err := json.Unmarshal(data, &up); err != nil || up.Bucket != bucket {
+			continue
+		}
+		parts, err := u.parts(dir)
+		if err != nil {
+			continue
+		}
+		for _, p := range parts {
+			total += p.size
+		}
+	}
+	return total, nil
+}
+
+// RunCleanup removes abandoned multipart uploads every interval until
+// ctx is done. A non-positive interval disables it, it returns at once.
+func (s *S3) RunCleanup(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		removed, err := s.uploads.clean(time.Now())
+		if err != nil {
+			s.logger.Println("upload cleanup failed:", err)
+		}
+		if removed > 0 {
+			s.logger.Printf("removed %d abandoned multipart uploads", removed)
+		}
+	}
+}
+
+// load - upload id of req, only its initiator may use it
+func (u *uploads) load(req *s3Request, id string) (string, error) {
+	errNoUpload := s3Err(http.StatusNotFound, "NoSuchUpload", "no such upload "+id)
+	if _, err := hex.DecodeString(id); err != nil || len(id) != 32 {
+		return "", errNoUpload
+	}
+	dir := filepath.Join(u.dir, id)
+	data, err := os.ReadFile(filepath.Join(dir, uploadFile))
+	if err != nil {
+		return "", errNoUpload
+	}
+	var up upload
+	if err := json.Unmarshal(data, &up); err != nil || up.User != req.user || up.Bucket != req.bucket || up.Key != req.key {
+		return "", errNoUpload
+	}
+	return dir, nil
+}
+
+// parts - the latest upload of every part number
+func (u *uploads) parts(dir string) (map[int]part, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	parts := make(map[int]part)
+	for _, entry := range entries {
+		number, hash, ok := strings.Cut(entry.Name(), "-")
+		n, err := strconv.Atoi(number)
+		info, infoErr := entry.Info()
+		if !ok || err != nil || infoErr != nil || !entry.Type().IsRegular() {
+			continue
+		}
+		parts[n] = part{number: n, hash: hash, path: filepath.Join(dir, entry.Name()), size: info.Size()}
+	}
+	return parts, nil
+}
+
+func (s *S3) createUpload(w http.ResponseWriter, req *s3Request) error {
+	if err := s.store.CheckPut(req.user, req.bucket, req.key, 0); err != nil {
+		return storageErr(err, "NoSuchBucket")
+	}
+	random := make([]byte, 16)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(random)
+	dir := filepath.Join(s.uploads.dir, id)
+	if err := os.Mkdir(dir, 0o750); err != nil {
+		return err
+	}
+	data, err := json.Marshal(upload{User: req.user, Bucket: req.bucket, Key: req.key, Initiated: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, uploadFile), data, 0o640); err != nil {
+		return err
+	}
+
+	return writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: req.bucket, Key: req.key, UploadId: id})
+}
+
+func (s *S3) uploadPart(w http.ResponseWriter, req *s3Request, id, number string) error {
+	n, err := strconv.Atoi(number)
+	if err != nil || n < 1 || n > maxParts {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("partNumber must be 1 to %d", maxParts))
+	}
+	dir, err := s.uploads.load(req, id)
+	if err != nil {
+		return err
+	}
+	limit := min(s.maxSize, maxPartSize)
+	if req.size > limit {
+		return errTooLarge(limit)
+	}
+	// a part without a length is checked once it's read
+	s.uploads.mu.Lock()
+	_, err = s.checkPart(req, dir, n, max(req.size, 0))
+	s.uploads.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".part-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), &limitedBody{r: req.body, limit: limit})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	s.uploads.mu.Lock()
+	defer s.uploads.mu.Unlock()
+	// again with the parts stored meanwhile by other requests
+	parts, err := s.checkPart(req, dir, n, size)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, fmt.Sprintf("%05d-%s", n, sum))); err != nil {
+		return err
+	}
+	// a part uploaded again replaces the previous one
+	if old, ok := parts[n]; ok && old.hash != sum {
+		_ = os.Remove(old.path)
+	}
+	w.Header().Set("ETag", etag(sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// checkPart - quota for size bytes as part n of the upload in dir, the
+// parts of all uploads to the bucket count as well. Returns the parts of
+// the upload. Must be called with uploads.mu locked.
+func (s *S3) checkPart(req *s3Request, dir string, n int, size int64) (map[int]part, error) {
+	parts, err := s.uploads.parts(dir)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := s.uploads.pending(req.bucket)
+	if err != nil {
+		return nil, err
+	}
+	// a part uploaded again replaces the previous one
+	pending -= parts[n].size
+	if err := s.store.CheckPut(req.user, req.bucket, req.key, pending+size); err != nil {
+		return nil, storageErr(err, "NoSuchBucket")
+	}
+	return parts, nil
+}
+
+func (s *S3) completeUpload(w http.ResponseWriter, req *s3Request, id string) error {
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := readXML(req.body, &request); err != nil {
+		return err
+	}
+	if len(request.Parts) == 0 {
+		return s3Err(http.StatusBadRequest, "MalformedXML", "no parts to complete")
+	}
+
+	// the upload is taken out of reach of other requests while it is stored
+	s.uploads.mu.Lock()
+	dir, err := s.uploads.load(req, id)
+	completing := dir + ".complete"
+	if err == nil {
+		err = os.Rename(dir, completing)
+	}
+	if err == nil {
+		// keeps clean from removing an old upload while it's stored
+		now := time.Now()
+		_ = os.Chtimes(completing, now, now)
+	}
+	s.uploads.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	stored := false
+	defer func() {
+		if stored {
+			_ = os.RemoveAll(completing)
+		} else {
+			_ = os.Rename(completing, dir)
+		}
+	}()
+
+	available, err := s.uploads.parts(completing)
+	if err != nil {
+		return err
+	}
+	var (
+		readers []io.Reader
+		size    int64
+	)
+	for i, p := range request.Parts {
+		if i > 0 && p.PartNumber <= request.Parts[i-1].PartNumber {
+			return s3Err(http.StatusBadRequest, "InvalidPartOrder", "parts must be listed in ascending order")
+		}
+		uploaded, ok := available[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != uploaded.hash {
+			return s3Err(http.StatusBadRequest, "InvalidPart", fmt.Sprintf("part %d was not uploaded or its ETag doesn't match", p.PartNumber))
+		}
+		file, err := os.Open(uploaded.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		readers = append(readers, file)
+		size += uploaded.size
+	}
+	if size > s.maxSize {
+		return errTooLarge(s.maxSize)
+	}
+
+	if err := s.store.CheckPut(req.user, req.bucket, req.key, size); err != nil {
+		return storageErr(err, "NoSuchBucket")
+	}
+	file, err := s.put(req, req.key, io.MultiReader(readers...), storage.PutOptions{Mode: 0o644})
+	var sErr *s3ErrorResponse
+	if errors.As(err, &sErr) && sErr.Code == "ServiceUnavailable" {
+		// stored, only not replicated yet
+		stored = true
+	}
+	if err != nil {
+		return err
+	}
+	stored = true
+
+	w.Header().Set("X-Amz-Version-Id", strconv.Itoa(file.Version))
+	return writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{Xmlns: s3Namespace, Location: "/" + req.bucket + "/" + req.key, Bucket: req.bucket, Key: req.key, ETag: etag(file.Hash)})
+}
+
+func (s *S3) abortUpload(w http.ResponseWriter, req *s3Request, id string) error {
+	s.uploads.mu.Lock()
+	defer s.uploads.mu.Unlock()
+	dir, err := s.uploads.load(req, id)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
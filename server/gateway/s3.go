@@ -0,0 +1,607 @@
+package gateway
+
+import (
+	packet "EternalPacket"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"eternalStorageServer/replica"
+	"eternalStorageServer/storage"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 serves a subset of the Amazon S3 REST API for existing S3 tools
+// (aws-cli, rclone...): path style requests, bucket = namespace, key =
+// path. Supported are ListBuckets, HeadBucket, CreateBucket (only the own
+// namespace), ListObjects (v1 and v2), PutObject, CopyObject, GetObject,
+// HeadObject, DeleteObject, DeleteObjects and multipart uploads.
+//
+// Requests are authenticated with Signature Version 4. The access key is
+// the user name and the secret key is packet.S3SecretKey of the key the
+// server keeps for the user, the user gets it with "eternal s3-key".
+type S3 struct {
+	store    *storage.Store
+	creds    packet.CredentialStore
+	replicas *replica.Replicator
+	logger   *log.Logger
+	uploads  *uploads
+	maxSize  int64
+}
+
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// maxKeys - the most keys a listing returns
+const maxKeys = 1000
+
+// NewS3 - S3 endpoint of store, uploads are replicated with replicas if not nil
+func NewS3(store *storage.Store, creds packet.CredentialStore, replicas *replica.Replicator, logger *log.Logger) (*S3, error) {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	u, err := newUploads(store.TempDir())
+	if err != nil {
+		return nil, err
+	}
+	return &S3{store: store, creds: creds, replicas: replicas, logger: logger, uploads: u,
+		maxSize: maxUploadSize(packet.ReceiveOptions{})}, nil
+}
+
+// SetReceiveLimits - objects get the limit of the TCP server, no object
+// can be larger than MaxDecompressedSize, no part larger than 5 GiB
+func (s *S3) SetReceiveLimits(opts packet.ReceiveOptions) {
+	s.maxSize = maxUploadSize(opts)
+}
+
+func (s *S3) secretKey(accessKey string) (string, bool) {
+	key, ok := s.creds.AuthKey(accessKey)
+	if !ok {
+		return "", false
+	}
+	return packet.S3SecretKey(key), true
+}
+
+func (s *S3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sig, err := verifySigV4(r, s.secretKey, time.Now())
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+	body, size, err := payloadReader(r, sig)
+	if err != nil {
+		s3Error(w, r, err)
+		return
+	}
+	user := sig.accessKey
+	req := &s3Request{user: user, body: body, size: size}
+	req.bucket, req.key, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	query := r.URL.Query()
+
+	switch {
+	case req.bucket == "" && r.Method == http.MethodGet:
+		err = s.listBuckets(w, req)
+	case req.bucket == "":
+		err = errMethod
+	case req.key == "":
+		err = s.serveBucket(w, r, req, query)
+	case !validKey(req.key):
+		err = s3Err(http.StatusBadRequest, "InvalidArgument", "key can't be stored, it must be a clean slash separated path")
+	default:
+		err = s.serveObject(w, r, req, query)
+	}
+	if err != nil {
+		s3Error(w, r, err)
+	}
+	s.logger.Println(r.RemoteAddr, user, r.Method, req.bucket, req.key, errorCode(err))
+}
+
+type s3Request struct {
+	user        string
+	bucket, key string
+	// body - verified payload, size - its length or -1
+	body io.Reader
+	size int64
+}
+
+func (s *S3) serveBucket(w http.ResponseWriter, r *http.Request, req *s3Request, query url.Values) error {
+	switch {
+	case r.Method == http.MethodGet && query.Has("location"):
+		return writeXML(w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3Namespace})
+	case r.Method == http.MethodGet && hasSubresource(query):
+		return errNotImplemented
+	case r.Method == http.MethodGet:
+		return s.listObjects(w, req, query)
+	case r.Method == http.MethodHead:
+		return s.headBucket(req)
+	case r.Method == http.MethodPut:
+		return s.createBucket(w, req)
+	case r.Method == http.MethodPost && query.Has("delete"):
+		return s.deleteObjects(w, req)
+	case r.Method == http.MethodDelete:
+		return s3Err(http.StatusConflict, "BucketNotEmpty", "namespaces can't be deleted")
+	}
+	return errMethod
+}
+
+func (s *S3) serveObject(w http.ResponseWriter, r *http.Request, req *s3Request, query url.Values) error {
+	uploadID := query.Get("uploadId")
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		return s.createUpload(w, req)
+	case r.Method == http.MethodPut && uploadID != "":
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return errNotImplemented
+		}
+		return s.uploadPart(w, req, uploadID, query.Get("partNumber"))
+	case r.Method == http.MethodPost && uploadID != "":
+		return s.completeUpload(w, req, uploadID)
+	case r.Method == http.MethodDelete && uploadID != "":
+		return s.abortUpload(w, req, uploadID)
+	case hasSubresource(query):
+		return errNotImplemented
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		return s.getObject(w, r, req, query.Get("versionId"))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		return s.copyObject(w, r, req)
+	case r.Method == http.MethodPut:
+		return s.putObject(w, r, req)
+	case r.Method == http.MethodDelete:
+		return s.deleteObject(w, req)
+	}
+	return errMethod
+}
+
+func (s *S3) listBuckets(w http.ResponseWriter, req *s3Request) error {
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	result := struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace}
+	result.Owner.ID, result.Owner.DisplayName = req.user, req.user
+	for _, ns := range s.store.Namespaces(req.user) {
+		result.Buckets = append(result.Buckets, bucket{Name: ns, CreationDate: s3Time(time.Unix(0, 0))})
+	}
+	return writeXML(w, http.StatusOK, result)
+}
+
+func (s *S3) headBucket(req *s3Request) error {
+	if !contains(s.store.Namespaces(req.user), req.bucket) {
+		return s3Err(http.StatusNotFound, "NoSuchBucket", "no such bucket "+req.bucket)
+	}
+	return nil
+}
+
+// createBucket - namespaces exist with their users, creating the own one
+// succeeds like it does for S3 buckets in us-east-1
+func (s *S3) createBucket(w http.ResponseWriter, req *s3Request) error {
+	if req.bucket != req.user {
+		return s3Err(http.StatusForbidden, "AccessDenied", "only the namespace of "+req.user+" can be created")
+	}
+	w.Header().Set("Location", "/"+req.bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+// listObjects - ListObjectsV2 with list-type=2, ListObjects otherwise
+func (s *S3) listObjects(w http.ResponseWriter, req *s3Request, query url.Values) error {
+	v2 := query.Get("list-type") == "2"
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	limit := maxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+		}
+		limit = min(n, maxKeys)
+	}
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = func(s string) string { return strings.ReplaceAll(url.QueryEscape(s), "%2F", "/") }
+	}
+
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid continuation-token")
+			}
+			after = string(decoded)
+		}
+	}
+
+	files, err := s.store.Walk(req.user, req.bucket, prefix)
+	if err != nil {
+		return storageErr(err, "NoSuchBucket")
+	}
+
+	type commonPrefix struct{ Prefix string }
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Xmlns                 string   `xml:"xmlns,attr"`
+		Name                  string
+		Prefix                string
+		Marker                *string `xml:",omitempty"`
+		NextMarker            string  `xml:",omitempty"`
+		StartAfter            string  `xml:",omitempty"`
+		ContinuationToken     string  `xml:",omitempty"`
+		NextContinuationToken string  `xml:",omitempty"`
+		KeyCount              *int    `xml:",omitempty"`
+		MaxKeys               int
+		Delimiter             string `xml:",omitempty"`
+		EncodingType          string `xml:",omitempty"`
+		IsTruncated           bool
+		Contents              []s3Object
+		CommonPrefixes        []commonPrefix
+	}{
+		Xmlns:        s3Namespace,
+		Name:         req.bucket,
+		Prefix:       encode(prefix),
+		MaxKeys:      limit,
+		Delimiter:    encode(delimiter),
+		EncodingType: query.Get("encoding-type"),
+	}
+
+	// last - key or common prefix listed last, the next page starts after it
+	count, last := 0, ""
+	for _, file := range files {
+		if file.Path <= after || delimiter != "" && strings.HasSuffix(after, delimiter) && strings.HasPrefix(file.Path, after) {
+			continue
+		}
+		entry, isPrefix := file.Path, false
+		if delimiter != "" {
+			if i := strings.Index(file.Path[len(prefix):], delimiter); i >= 0 {
+				entry, isPrefix = file.Path[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if isPrefix && entry == last {
+			continue
+		}
+		if count == limit {
+			result.IsTruncated = true
+			break
+		}
+		count, last = count+1, entry
+		if isPrefix {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{encode(entry)})
+		} else {
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(file.Path),
+				LastModified: s3Time(file.Modified),
+				ETag:         etag(file.Hash),
+				Size:         file.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+	}
+
+	if v2 {
+		result.KeyCount = &count
+		result.StartAfter = encode(query.Get("start-after"))
+		result.ContinuationToken = query.Get("continuation-token")
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := encode(after)
+		result.Marker = &marker
+		if result.IsTruncated {
+			result.NextMarker = encode(last)
+		}
+	}
+	return writeXML(w, http.StatusOK, result)
+}
+
+func (s *S3) getObject(w http.ResponseWriter, r *http.Request, req *s3Request, versionID string) error {
+	version := 0
+	if versionID != "" && versionID != "null" {
+		var err error
+		if version, err = strconv.Atoi(versionID); err != nil {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid versionId")
+		}
+	}
+	file, data, err := s.store.OpenVersion(req.user, req.bucket, req.key, version)
+	if err != nil {
+		return storageErr(err, "NoSuchKey")
+	}
+	defer data.Close()
+	content, ok := data.(io.ReaderAt)
+	if !ok {
+		return errNotImplemented
+	}
+
+	setObjectHeaders(w, file)
+	http.ServeContent(w, r, file.Path, file.Modified, io.NewSectionReader(content, 0, file.Size))
+	return nil
+}
+
+func (s *S3) putObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	opts := storage.PutOptions{Mode: 0o644}
+	if match := r.Header.Get("If-Match"); match != "" {
+		opts.IfMatch = strings.Trim(match, `"`)
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		opts.IfMatch = storage.MatchNone
+	}
+	if req.size > s.maxSize {
+		return errTooLarge(s.maxSize)
+	}
+	if req.size >= 0 {
+		if err := s.store.CheckPut(req.user, req.bucket, req.key, req.size); err != nil {
+			return storageErr(err, "NoSuchBucket")
+		}
+	}
+	file, err := s.put(req, req.key, &limitedBody{r: req.body, limit: s.maxSize}, opts)
+	if err != nil {
+		return err
+	}
+	setObjectHeaders(w, file)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// put stores and replicates the object, the body is verified
+// before anything is committed
+func (s *S3) put(req *s3Request, key string, body io.Reader, opts storage.PutOptions) (*storage.File, error) {
+	file, err := s.store.Put(req.user, req.bucket, key, body, opts)
+	var sErr *s3ErrorResponse
+	if errors.As(err, &sErr) {
+		return nil, sErr
+	}
+	if err != nil {
+		return nil, storageErr(err, "NoSuchBucket")
+	}
+	if s.replicas != nil {
+		if err := s.replicas.Replicate(req.bucket, file); err != nil {
+			return nil, storageErr(err, "NoSuchKey")
+		}
+	}
+	return file, nil
+}
+
+func (s *S3) copyObject(w http.ResponseWriter, r *http.Request, req *s3Request) error {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil {
+		return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid x-amz-copy-source")
+	}
+	source, versionID, _ := strings.Cut(source, "?versionId=")
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	version := 0
+	if versionID != "" && versionID != "null" {
+		if version, err = strconv.Atoi(versionID); err != nil {
+			return s3Err(http.StatusBadRequest, "InvalidArgument", "invalid versionId")
+		}
+	}
+
+	file, data, err := s.store.OpenVersion(req.user, bucket, key, version)
+	if err != nil {
+		return storageErr(err, "NoSuchKey")
+	}
+	defer data.Close()
+	if err := s.store.CheckPut(req.user, req.bucket, req.key, file.Size); err != nil {
+		return storageErr(err, "NoSuchBucket")
+	}
+	copied, err := s.put(req, req.key, data, storage.PutOptions{Mode: file.Mode})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("X-Amz-Version-Id", strconv.Itoa(copied.Version))
+	return writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		LastModified string
+		ETag         string
+	}{LastModified: s3Time(copied.Modified), ETag: etag(copied.Hash)})
+}
+
+func (s *S3) deleteObject(w http.ResponseWriter, req *s3Request) error {
+	// deleting a missing key succeeds in S3
+	if err := s.store.Delete(req.user, req.bucket, req.key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return storageErr(err, "NoSuchKey")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *S3) deleteObjects(w http.ResponseWriter, req *s3Request) error {
+	var request struct {
+		Quiet   bool
+		Objects []struct{ Key string } `xml:"Object"`
+	}
+	if err := readXML(req.body, &request); err != nil {
+		return err
+	}
+	if len(request.Objects) > maxKeys {
+		return s3Err(http.StatusBadRequest, "MalformedXML", fmt.Sprintf("at most %d keys can be deleted at once", maxKeys))
+	}
+
+	type deleted struct{ Key string }
+	type failed struct{ Key, Code, Message string }
+	result := struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Deleted []deleted
+		Error   []failed
+	}{Xmlns: s3Namespace}
+	for _, object := range request.Objects {
+		err := s.store.Delete(req.user, req.bucket, object.Key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			sErr := storageErr(err, "NoSuchKey")
+			result.Error = append(result.Error, failed{object.Key, sErr.Code, sErr.Message})
+		} else if !request.Quiet {
+			result.Deleted = append(result.Deleted, deleted{object.Key})
+		}
+	}
+	return writeXML(w, http.StatusOK, result)
+}
+
+func setObjectHeaders(w http.ResponseWriter, file *storage.File) {
+	w.Header().Set("ETag", etag(file.Hash))
+	w.Header().Set("X-Amz-Version-Id", strconv.Itoa(file.Version))
+	if !file.Expires.IsZero() {
+		w.Header().Set("Expires", file.Expires.UTC().Format(http.TimeFormat))
+	}
+}
+
+func etag(hash string) string {
+	return `"` + hash + `"`
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// validKey - keys are stored as clean paths, "a//b" or "dir/" would
+// silently become other keys
+func validKey(key string) bool {
+	return !strings.ContainsAny(key, "\\\x00") && path.Clean("/"+key) == "/"+key
+}
+
+// hasSubresource - ?acl, ?tagging... of requests this subset doesn't implement
+func hasSubresource(query url.Values) bool {
+	for name := range query {
+		switch name {
+		case "acl", "tagging", "versioning", "versions", "policy", "lifecycle", "cors", "uploads",
+			"website", "logging", "notification", "replication", "encryption", "object-lock",
+			"retention", "legal-hold", "torrent", "attributes", "restore", "select":
+			return true
+		}
+	}
+	return false
+}
+
+// s3ErrorResponse - error as S3 clients expect it
+type s3ErrorResponse struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e *s3ErrorResponse) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func s3Err(status int, code, message string) *s3ErrorResponse {
+	return &s3ErrorResponse{status: status, Code: code, Message: message}
+}
+
+func errTooLarge(limit int64) *s3ErrorResponse {
+	return s3Err(http.StatusBadRequest, "EntityTooLarge", fmt.Sprintf("upload exceeds the limit of %d bytes", limit))
+}
+
+// limitedBody fails with EntityTooLarge once more than limit bytes are
+// read, bodies without a length are bounded by it
+type limitedBody struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if left := l.limit - l.read; left < int64(len(p)) {
+		p = p[:left+1]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return 0, errTooLarge(l.limit)
+	}
+	return n, err
+}
+
+var (
+	errMethod         = s3Err(http.StatusMethodNotAllowed, "MethodNotAllowed", "the method is not allowed against this resource")
+	errNotImplemented = s3Err(http.StatusNotImplemented, "NotImplemented", "not supported by this server")
+)
+
+// storageErr maps storage errors, notFound - code of a missing file
+func storageErr(err error, notFound string) *s3ErrorResponse {
+	code := "InternalError"
+	switch {
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		code = "QuotaExceeded"
+	case errors.Is(err, storage.ErrForbidden):
+		code = "AccessDenied"
+	case errors.Is(err, storage.ErrNotFound):
+		code = notFound
+	case errors.Is(err, storage.ErrBadPath):
+		code = "InvalidArgument"
+	case errors.Is(err, storage.ErrConflict):
+		code = "PreconditionFailed"
+	case errors.Is(err, replica.ErrNotReplicated):
+		code = "ServiceUnavailable"
+	}
+	return s3Err(statusFor(err), code, err.Error())
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var sErr *s3ErrorResponse
+	if !errors.As(err, &sErr) {
+		sErr = storageErr(err, "NoSuchKey")
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(sErr.status)
+		return
+	}
+	_ = writeXML(w, sErr.status, struct {
+		XMLName  xml.Name `xml:"Error"`
+		Code     string
+		Message  string
+		Resource string
+	}{Code: sErr.Code, Message: sErr.Message, Resource: r.URL.Path})
+}
+
+func errorCode(err error) string {
+	var sErr *s3ErrorResponse
+	if errors.As(err, &sErr) {
+		return sErr.Code
+	}
+	return ""
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = io.WriteString(w, xml.Header)
+	_ = xml.NewEncoder(w).Encode(v)
+	return nil
+}
+
+// readXML decodes a request document of at most 1MiB
+func readXML(body io.Reader, v any) error {
+	data, err := io.ReadAll(io.LimitReader(body, 1<<20+1))
+	var sErr *s3ErrorResponse
+	if errors.As(err, &sErr) {
+		return sErr
+	}
+	if err != nil || len(data) > 1<<20 {
+		return s3Err(http.StatusBadRequest, "MalformedXML", "request body is too large or incomplete")
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return s3Err(http.StatusBadRequest, "MalformedXML", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,304 @@
+package gateway
+
+import (
+	packet "EternalPacket"
+	"context"
+	"encoding/hex"
+	"encoding/xml"
+	"eternalStorageServer/storage"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type s3Client struct {
+	t      *testing.T
+	url    string
+	user   string
+	secret string
+	store  *storage.Store
+	s3     *S3
+}
+
+func newS3Server(t *testing.T) *s3Client {
+	t.Helper()
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	creds := packet.Credentials{}
+	require.NoError(t, creds.Add("alice", "pw"))
+	s3, err := NewS3(store, creds, nil, nil)
+	require.NoError(t, err)
+	server := httptest.NewServer(s3)
+	t.Cleanup(server.Close)
+	return &s3Client{t: t, url: server.URL, user: "alice", secret: packet.S3SecretKey(creds["alice"]), store: store, s3: s3}
+}
+
+// do signs the request the way S3 SDKs do, with the payload hash,
+// an UNSIGNED-PAYLOAD body is sent without Content-Length
+func (c *s3Client) do(method, target, body string, header map[string]string) *http.Response {
+	c.t.Helper()
+	req, err := http.NewRequest(method, c.url+target, strings.NewReader(body))
+	require.NoError(c.t, err)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	payload := sha256Hex([]byte(body))
+	if header["X-Amz-Content-Sha256"] == unsignedPayload {
+		payload = unsignedPayload
+		req.Body = io.NopCloser(strings.NewReader(body))
+		req.ContentLength = -1
+	}
+	now := time.Now().UTC()
+	sig := &signature{
+		amzDate: now.Format(amzDateFormat),
+		scope:   now.Format("20060102") + "/us-east-1/s3/aws4_request",
+		key:     signingKey(c.secret, now.Format("20060102"), "us-east-1"),
+	}
+	req.Header.Set("X-Amz-Date", sig.amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	value := sig.sign(sigAlgorithm, sha256Hex([]byte(canonicalRequest(req, headers, payload, false))))
+	req.Header.Set("Authorization", sigAlgorithm+" Credential="+c.user+"/"+sig.scope+
+		",SignedHeaders="+strings.Join(headers, ";")+",Signature="+value)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(c.t, err)
+	c.t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func decodeXML(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+	require.NoError(t, xml.NewDecoder(resp.Body).Decode(v))
+}
+
+type listResult struct {
+	KeyCount              int
+	IsTruncated           bool
+	NextContinuationToken string
+	Contents              []struct{ Key, ETag string }
+	CommonPrefixes        []struct{ Prefix string }
+}
+
+func TestS3Objects(t *testing.T) {
+	c := newS3Server(t)
+
+	resp := c.do(http.MethodPut, "/alice/docs/a.txt", "hello s3", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	etag := resp.Header.Get("ETag")
+	assert.Equal(t, `"`+sha256Hex([]byte("hello s3"))+`"`, etag)
+
+	resp = c.do(http.MethodGet, "/alice/docs/a.txt", "", map[string]string{"Range": "bytes=6-"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "s3", body(t, resp))
+
+	resp = c.do(http.MethodHead, "/alice/docs/a.txt", "", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+
+	resp = c.do(http.MethodPut, "/alice/docs/b.txt", "", map[string]string{"X-Amz-Copy-Source": "/alice/docs/a.txt"})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = c.do(http.MethodPut, "/alice/top.txt", "top", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// по одному ключу на сторінку, docs/ - спільний префікс
+	var list listResult
+	resp = c.do(http.MethodGet, "/alice?list-type=2&delimiter=/&max-keys=1", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	decodeXML(t, resp, &list)
+	require.Len(t, list.CommonPrefixes, 1)
+	assert.Equal(t, "docs/", list.CommonPrefixes[0].Prefix)
+	assert.True(t, list.IsTruncated)
+	token := list.NextContinuationToken
+	list = listResult{}
+	resp = c.do(http.MethodGet, "/alice?list-type=2&delimiter=/&max-keys=1&continuation-token="+token, "", nil)
+	decodeXML(t, resp, &list)
+	require.Len(t, list.Contents, 1)
+	assert.Equal(t, "top.txt", list.Contents[0].Key)
+	assert.False(t, list.IsTruncated)
+
+	list = listResult{}
+	resp = c.do(http.MethodGet, "/alice?list-type=2&prefix=docs/", "", nil)
+	decodeXML(t, resp, &list)
+	require.Len(t, list.Contents, 2)
+	assert.Equal(t, "docs/a.txt", list.Contents[0].Key)
+	assert.Equal(t, etag, list.Contents[1].ETag)
+
+	resp = c.do(http.MethodPost, "/alice?delete", "<Delete><Object><Key>docs/a.txt</Key></Object><Object><Key>missing</Key></Object></Delete>", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = c.do(http.MethodGet, "/alice/docs/a.txt", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	var s3err struct{ Code string }
+	decodeXML(t, resp, &s3err)
+	assert.Equal(t, "NoSuchKey", s3err.Code)
+
+	resp = c.do(http.MethodDelete, "/alice/top.txt", "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = c.do(http.MethodPut, "/bob/x.txt", "x", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp = c.do(http.MethodPut, "/alice/a//b", "x", nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// неправильний секрет
+	c.secret = "wrong"
+	resp = c.do(http.MethodGet, "/alice/docs/b.txt", "", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	decodeXML(t, resp, &s3err)
+	assert.Equal(t, "SignatureDoesNotMatch", s3err.Code)
+	// ключ TCP автентифікації не є секретом S3
+	key, _ := c.s3.creds.AuthKey("alice")
+	c.secret = hex.EncodeToString(key)
+	resp = c.do(http.MethodGet, "/alice/docs/b.txt", "", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// responseCode - Code of the S3 error in resp
+func responseCode(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	var s3err struct{ Code string }
+	decodeXML(t, resp, &s3err)
+	return s3err.Code
+}
+
+func (c *s3Client) initiate(key string) string {
+	c.t.Helper()
+	var initiated struct{ UploadId string }
+	resp := c.do(http.MethodPost, "/alice/"+key+"?uploads", "", nil)
+	require.Equal(c.t, http.StatusOK, resp.StatusCode)
+	decodeXML(c.t, resp, &initiated)
+	return "/alice/" + key + "?uploadId=" + initiated.UploadId
+}
+
+func TestS3Multipart(t *testing.T) {
+	c := newS3Server(t)
+
+	var initiated struct{ UploadId string }
+	resp := c.do(http.MethodPost, "/alice/big.bin?uploads", "", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	decodeXML(t, resp, &initiated)
+	upload := "/alice/big.bin?uploadId=" + initiated.UploadId
+
+	parts := []string{strings.Repeat("a", 1000), strings.Repeat("b", 10), "c"}
+	etags := make([]string, len(parts))
+	for i, data := range parts {
+		resp := c.do(http.MethodPut, upload+"&partNumber="+strconv.Itoa(i+1), data, nil)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		etags[i] = resp.Header.Get("ETag")
+	}
+	// друга частина завантажена повторно
+	resp = c.do(http.MethodPut, upload+"&partNumber=2", "BB", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	complete := func(etags ...string) string {
+		var b strings.Builder
+		b.WriteString("<CompleteMultipartUpload>")
+		for i, etag := range etags {
+			b.WriteString("<Part><PartNumber>" + strconv.Itoa(i+1) + "</PartNumber><ETag>" + etag + "</ETag></Part>")
+		}
+		b.WriteString("</CompleteMultipartUpload>")
+		return b.String()
+	}
+	resp = c.do(http.MethodPost, upload, complete(etags...), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	etags[1] = `"` + sha256Hex([]byte("BB")) + `"`
+	resp = c.do(http.MethodPost, upload, complete(etags...), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var result struct{ ETag string }
+	decodeXML(t, resp, &result)
+	want := parts[0] + "BB" + parts[2]
+	assert.Equal(t, `"`+sha256Hex([]byte(want))+`"`, result.ETag)
+
+	resp = c.do(http.MethodGet, "/alice/big.bin", "", nil)
+	assert.Equal(t, want, body(t, resp))
+
+	// завершене завантаження зникає
+	resp = c.do(http.MethodPut, upload+"&partNumber=1", "x", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = c.do(http.MethodPost, "/alice/aborted?uploads", "", nil)
+	decodeXML(t, resp, &initiated)
+	resp = c.do(http.MethodDelete, "/alice/aborted?uploadId="+initiated.UploadId, "", nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = c.do(http.MethodDelete, "/alice/aborted?uploadId="+initiated.UploadId, "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// Розмір частин обмежений, а вже завантажені частини враховуються у квоті
+func TestS3MultipartLimits(t *testing.T) {
+	c := newS3Server(t)
+	c.s3.SetReceiveLimits(packet.ReceiveOptions{MaxDecompressedSize: 100})
+	c.store.SetQuotas(storage.Quotas{Default: storage.Quota{Bytes: 150}})
+	unsigned := map[string]string{"X-Amz-Content-Sha256": unsignedPayload}
+	first, second := c.initiate("first.bin"), c.initiate("second.bin")
+
+	resp := c.do(http.MethodPut, first+"&partNumber=1", strings.Repeat("a", 101), nil)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "EntityTooLarge", responseCode(t, resp))
+	// без Content-Length частина обривається на межі
+	resp = c.do(http.MethodPut, first+"&partNumber=1", strings.Repeat("a", 101), unsigned)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "EntityTooLarge", responseCode(t, resp))
+
+	resp = c.do(http.MethodPut, first+"&partNumber=1", strings.Repeat("a", 100), nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = c.do(http.MethodPut, second+"&partNumber=1", strings.Repeat("b", 60), nil)
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+	assert.Equal(t, "QuotaExceeded", responseCode(t, resp))
+	resp = c.do(http.MethodPut, second+"&partNumber=1", strings.Repeat("b", 60), unsigned)
+	assert.Equal(t, http.StatusInsufficientStorage, resp.StatusCode)
+
+	// повторна частина замінює попередню, а не додається до неї
+	resp = c.do(http.MethodPut, first+"&partNumber=1", strings.Repeat("c", 100), unsigned)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp = c.do(http.MethodDelete, first, "", nil)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp = c.do(http.MethodPut, second+"&partNumber=1", strings.Repeat("b", 60), unsigned)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = c.do(http.MethodPut, "/alice/object.bin", strings.Repeat("d", 101), unsigned)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	assert.Equal(t, "EntityTooLarge", responseCode(t, resp))
+	resp = c.do(http.MethodGet, "/alice/object.bin", "", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// Покинуті завантаження видаляються і під час роботи сервера
+func TestS3UploadCleanup(t *testing.T) {
+	c := newS3Server(t)
+	abandoned, fresh := c.initiate("abandoned.bin"), c.initiate("fresh.bin")
+	resp := c.do(http.MethodPut, abandoned+"&partNumber=1", "old data", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	id := abandoned[strings.LastIndex(abandoned, "=")+1:]
+	old := time.Now().Add(-maxUploadAge - time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(c.s3.uploads.dir, id), old, old))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.s3.RunCleanup(ctx, 10*time.Millisecond)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(filepath.Join(c.s3.uploads.dir, id))
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+	resp = c.do(http.MethodPut, abandoned+"&partNumber=2", "more", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = c.do(http.MethodPut, fresh+"&partNumber=1", "new data", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -0,0 +1,456 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, the only authentication S3 clients still use:
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html
+
+const (
+	sigAlgorithm  = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+
+	unsignedPayload          = "UNSIGNED-PAYLOAD"
+	streamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	emptySHA256              = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	maxClockSkew = 15 * time.Minute
+	maxPresign   = 7 * 24 * time.Hour
+	// maxChunk - signed chunks are kept in memory until they are verified
+	maxChunk = 16 << 20
+)
+
+// signature - verified signature of a request, chunks of a streaming
+// upload are chained to it
+type signature struct {
+	accessKey string
+	amzDate   string
+	scope     string
+	key       []byte
+	value     string
+	payload   string
+}
+
+// verifySigV4 checks the Authorization header or the presigned URL query
+// of r, secretKey looks up the secret of an access key
+func verifySigV4(r *http.Request, secretKey func(accessKey string) (string, bool), now time.Time) (*signature, error) {
+	var (
+		credential, signedHeaders, value, payload string
+		query                                     = r.URL.Query()
+		presigned                                 = query.Get("X-Amz-Algorithm") != ""
+		amzDate                                   string
+	)
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fields, ok := strings.CutPrefix(auth, sigAlgorithm+" ")
+		if !ok {
+			return nil, s3Err(http.StatusBadRequest, "InvalidArgument", "only "+sigAlgorithm+" authorization is supported")
+		}
+		for _, field := range strings.Split(fields, ",") {
+			name, val, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch name {
+			case "Credential":
+				credential = val
+			case "SignedHeaders":
+				signedHeaders = val
+			case "Signature":
+				value = val
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payload = r.Header.Get("X-Amz-Content-Sha256")
+		if payload == "" {
+			return nil, s3Err(http.StatusBadRequest, "InvalidRequest", "missing x-amz-content-sha256")
+		}
+	} else if presigned {
+		if query.Get("X-Amz-Algorithm") != sigAlgorithm {
+			return nil, s3Err(http.StatusBadRequest, "InvalidArgument", "only "+sigAlgorithm+" presigned URLs are supported")
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		value = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payload = query.Get("X-Amz-Content-Sha256")
+		if payload == "" {
+			payload = unsignedPayload
+		}
+	} else {
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "request is not signed")
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || signedHeaders == "" || value == "" {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "malformed credential or signature")
+	}
+	signed, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil || parts[1] != amzDate[:8] {
+		return nil, s3Err(http.StatusForbidden, "AccessDenied", "missing or invalid X-Amz-Date")
+	}
+	if presigned {
+		expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		if err != nil || expires <= 0 || time.Duration(expires)*time.Second > maxPresign {
+			return nil, s3Err(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be 1 to 604800 seconds")
+		}
+		if now.After(signed.Add(time.Duration(expires)*time.Second)) || signed.After(now.Add(maxClockSkew)) {
+			return nil, s3Err(http.StatusForbidden, "AccessDenied", "request has expired")
+		}
+	} else if now.Sub(signed) > maxClockSkew || signed.Sub(now) > maxClockSkew {
+		return nil, s3Err(http.StatusForbidden, "RequestTimeTooSkewed", "the difference between the request time and the server's time is too large")
+	}
+
+	secret, ok := secretKey(parts[0])
+	if !ok {
+		return nil, s3Err(http.StatusForbidden, "InvalidAccessKeyId", "unknown access key "+parts[0])
+	}
+	headers := strings.Split(signedHeaders, ";")
+	if !sort.StringsAreSorted(headers) || !contains(headers, "host") {
+		return nil, s3Err(http.StatusBadRequest, "AuthorizationHeaderMalformed", "signed headers must be sorted and include host")
+	}
+
+	sig := &signature{
+		accessKey: parts[0],
+		amzDate:   amzDate,
+		scope:     strings.Join(parts[1:], "/"),
+		key:       signingKey(secret, parts[1], parts[2]),
+		payload:   payload,
+	}
+	request := canonicalRequest(r, headers, payload, presigned)
+	sig.value = sig.sign(sigAlgorithm, sha256Hex([]byte(request)))
+	if !hmac.Equal([]byte(sig.value), []byte(value)) {
+		return nil, s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match")
+	}
+	return sig, nil
+}
+
+func (s *signature) sign(algorithm string, lines ...string) string {
+	toSign := algorithm + "\n" + s.amzDate + "\n" + s.scope + "\n" + strings.Join(lines, "\n")
+	return hex.EncodeToString(hmacSHA256(s.key, toSign))
+}
+
+func signingKey(secret, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+func canonicalRequest(r *http.Request, headers []string, payload string, presigned bool) string {
+	values, _ := url.ParseQuery(r.URL.RawQuery)
+	var query []string
+	for name, list := range values {
+		if presigned && name == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range list {
+			query = append(query, uriEncode(name, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(query)
+
+	var canonical strings.Builder
+	for _, name := range headers {
+		canonical.WriteString(name + ":" + headerValue(r, name) + "\n")
+	}
+
+	uri := r.URL.Path
+	if uri == "" {
+		uri = "/"
+	}
+	return strings.Join([]string{
+		r.Method,
+		uriEncode(uri, false),
+		strings.Join(query, "&"),
+		canonical.String(),
+		strings.Join(headers, ";"),
+		payload,
+	}, "\n")
+}
+
+// headerValue - trimmed values with spaces collapsed, joined with commas.
+// net/http moves Host and Content-Length out of the header map.
+func headerValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		values = []string{r.Host}
+	case "content-length":
+		values = r.Header.Values(name)
+		if len(values) == 0 && r.ContentLength >= 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+	default:
+		values = r.Header.Values(name)
+	}
+	for i, v := range values {
+		values[i] = strings.Join(strings.Fields(v), " ")
+	}
+	return strings.Join(values, ",")
+}
+
+// uriEncode encodes everything but unreserved characters (RFC 3986),
+// slashes are kept in paths
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && !encodeSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// payloadReader returns the body of r as signed by sig: the payload hash
+// and checksums are verified when the body is read to the end, aws-chunked
+// bodies are decoded. The second result is the size of the decoded body,
+// -1 if unknown.
+func payloadReader(r *http.Request, sig *signature) (io.Reader, int64, error) {
+	var checks []bodyCheck
+	if md5sum := r.Header.Get("Content-MD5"); md5sum != "" {
+		want, err := base64.StdEncoding.DecodeString(md5sum)
+		if err != nil {
+			return nil, 0, s3Err(http.StatusBadRequest, "InvalidDigest", "invalid Content-MD5")
+		}
+		checks = append(checks, bodyCheck{hash: md5.New(), want: want, code: "BadDigest"})
+	}
+	for name := range r.Header {
+		algorithm, ok := strings.CutPrefix(strings.ToLower(name), "x-amz-checksum-")
+		if h := checksumHash(algorithm); ok && h != nil {
+			want, err := base64.StdEncoding.DecodeString(r.Header.Get(name))
+			if err != nil {
+				return nil, 0, s3Err(http.StatusBadRequest, "InvalidDigest", "invalid "+name)
+			}
+			checks = append(checks, bodyCheck{hash: h, want: want, code: "BadDigest"})
+		}
+	}
+
+	switch sig.payload {
+	case unsignedPayload:
+		return checkedReader(r.Body, checks), r.ContentLength, nil
+	case streamingPayload, streamingUnsignedTrailer:
+		size, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || size < 0 {
+			return nil, 0, s3Err(http.StatusLengthRequired, "MissingContentLength", "missing x-amz-decoded-content-length")
+		}
+		chunks := &chunkedReader{r: bufio.NewReader(r.Body), prev: sig.value}
+		if sig.payload == streamingPayload {
+			chunks.sig = sig
+		} else {
+			trailer := strings.ToLower(r.Header.Get("X-Amz-Trailer"))
+			algorithm, _ := strings.CutPrefix(trailer, "x-amz-checksum-")
+			chunks.trailer, chunks.sum = trailer, checksumHash(algorithm)
+		}
+		return checkedReader(io.LimitReader(chunks, size+1), append(checks, bodyCheck{size: size})), size, nil
+	}
+
+	if strings.HasPrefix(sig.payload, "STREAMING-") {
+		return nil, 0, s3Err(http.StatusNotImplemented, "NotImplemented", sig.payload+" is not supported")
+	}
+	want, err := hex.DecodeString(sig.payload)
+	if err != nil || len(want) != sha256.Size {
+		return nil, 0, s3Err(http.StatusBadRequest, "InvalidArgument", "invalid x-amz-content-sha256")
+	}
+	return checkedReader(r.Body, append(checks, bodyCheck{hash: sha256.New(), want: want, code: "XAmzContentSHA256Mismatch"})), r.ContentLength, nil
+}
+
+func checksumHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "crc32":
+		return crc32.NewIEEE()
+	case "crc32c":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// bodyCheck - hash the body must have, or its exact size if hash is nil
+type bodyCheck struct {
+	hash hash.Hash
+	want []byte
+	code string
+	size int64
+}
+
+type verifiedReader struct {
+	r      io.Reader
+	checks []bodyCheck
+	read   int64
+}
+
+func checkedReader(r io.Reader, checks []bodyCheck) io.Reader {
+	if len(checks) == 0 {
+		return r
+	}
+	return &verifiedReader{r: r, checks: checks}
+}
+
+func (v *verifiedReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.read += int64(n)
+	for _, check := range v.checks {
+		if check.hash != nil {
+			check.hash.Write(p[:n])
+		} else if v.read > check.size {
+			return n, s3Err(http.StatusBadRequest, "IncompleteBody", "body is longer than x-amz-decoded-content-length")
+		}
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	for _, check := range v.checks {
+		if check.hash == nil && v.read != check.size {
+			return n, s3Err(http.StatusBadRequest, "IncompleteBody", "body is shorter than x-amz-decoded-content-length")
+		}
+		if check.hash != nil && !bytes.Equal(check.hash.Sum(nil), check.want) {
+			return n, s3Err(http.StatusBadRequest, check.code, "body doesn't match its checksum")
+		}
+	}
+	return n, io.EOF
+}
+
+// chunkedReader decodes aws-chunked bodies:
+//
+//	<hex size>[;chunk-signature=<signature>]\r\n<data>\r\n ... 0...\r\n[trailers]\r\n
+//
+// Signed chunks are released only after their signature, chained to the
+// previous one, is verified.
+type chunkedReader struct {
+	r    *bufio.Reader
+	sig  *signature
+	prev string
+	// trailer - checksum header sent after the last chunk, sum computes it
+	trailer string
+	sum     hash.Hash
+
+	buf  []byte
+	done bool
+}
+
+var errChunk = s3Err(http.StatusBadRequest, "IncompleteBody", "malformed aws-chunked body")
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.buf) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) next() error {
+	line, err := c.line()
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 || size > maxChunk {
+		return errChunk
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errChunk
+	}
+	if size > 0 || c.sig != nil {
+		if crlf, err := c.line(); err != nil || crlf != "" {
+			return errChunk
+		}
+	}
+
+	if c.sig != nil {
+		value, ok := strings.CutPrefix(ext, "chunk-signature=")
+		expected := c.sig.sign(sigAlgorithm+"-PAYLOAD", c.prev, emptySHA256, sha256Hex(data))
+		if !ok || !hmac.Equal([]byte(value), []byte(expected)) {
+			return s3Err(http.StatusForbidden, "SignatureDoesNotMatch", "chunk signature does not match")
+		}
+		c.prev = expected
+	}
+	if c.sum != nil {
+		c.sum.Write(data)
+	}
+	c.buf = data
+	if size > 0 {
+		return nil
+	}
+
+	c.done = true
+	if c.sig != nil {
+		return nil
+	}
+	// trailers up to an empty line
+	for {
+		line, err := c.line()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if c.sum != nil && strings.ToLower(name) == c.trailer {
+			want, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+			if err != nil || !bytes.Equal(want, c.sum.Sum(nil)) {
+				return s3Err(http.StatusBadRequest, "BadDigest", "body doesn't match "+c.trailer)
+			}
+		}
+	}
+}
+
+func (c *chunkedReader) line() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || err != nil && len(line) == 0 {
+		return "", errChunk
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
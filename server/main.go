@@ -0,0 +1,238 @@
+package main
+
+import (
+	packet "EternalPacket"
+	"bufio"
+	"context"
+	"errors"
+	"eternalStorageServer/gateway"
+	"eternalStorageServer/replica"
+	"eternalStorageServer/storage"
+	"eternalStorageServer/tcp"
+	"flag"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// run server
+// go run . -addr localhost:8080 -dir storage -users users.json
+// add user, token or password is read from stdin
+// echo "secret" | go run . -users users.json -adduser alice
+
+func main() {
+	addr := flag.String("addr", "localhost:8080", "service address")
+	dir := flag.String("dir", "storage", "storage directory")
+	users := flag.String("users", "users.json", "credentials file")
+	quotas := flag.String("quotas", "", "per user and global quotas file (JSON), unlimited if empty")
+	versions := flag.Int("versions", storage.DefaultKeepVersions, "previous versions kept per file, 0 - overwrite, -1 - keep all")
+	retention := flag.String("retention", "", "retention rules file (JSON), namespace -> [{prefix, max_age}]")
+	shards := flag.String("shards", "", "comma separated directories (one per disk) blobs are erasure coded across")
+	parity := flag.Int("parity", 1, "parity shards of -shards, that many directories may be lost")
+	peers := flag.String("peers", "", "peer servers uploads are replicated to (JSON file), none if empty")
+	replicas := flag.Int("replicas", 0, "peers that must confirm an upload before the client is answered, 0 - replicate asynchronously")
+	replicaTimeout := flag.Duration("replica-timeout", replica.DefaultTimeout, "how long an upload waits for -replicas confirmations")
+	replicaIOTimeout := flag.Duration("replica-io-timeout", replica.DefaultIOTimeout, "a peer that doesn't read or answer for this long is reconnected")
+	replicators := flag.String("replicators", "", "comma separated users (peer servers) allowed to store replicas")
+	sweep := flag.Duration("sweep", time.Minute, "how often expired files are removed, 0 - never")
+	httpAddr := flag.String("http", "", "address of the HTTPS gateway (GET/PUT/DELETE/HEAD under "+gateway.Prefix+"), off if empty")
+	s3Addr := flag.String("s3", "", "address of the S3 compatible HTTPS endpoint, off if empty")
+	metricsAddr := flag.String("metrics", "", "address of the Prometheus /metrics endpoint (plain HTTP), off if empty")
+	maxFileSize := flag.Int64("max-file-size", 0, "largest upload as sent (compressed) in bytes, held in memory while received, 0 - 4 GiB")
+	maxDecompressed := flag.Int64("max-decompressed-size", 0, "largest upload after decompression (or HTTP and S3 object) in bytes, 0 - 16 GiB")
+	verbose := flag.Bool("v", false, "log packet transfers and chunks to stdout")
+	addUser := flag.String("adduser", "", "add or update user and exit, secret is read from stdin")
+	flag.Parse()
+	if *verbose {
+		packet.SetLogger(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	}
+
+	if *addUser != "" {
+		if err := addCredentials(*users, *addUser); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("user saved:", *addUser)
+		return
+	}
+
+	creds, err := packet.LoadCredentials(*users)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := storage.Open(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store.SetKeepVersions(*versions)
+
+	if *shards != "" {
+		if err := store.SetShards(strings.Split(*shards, ","), *parity); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *quotas != "" {
+		q, err := storage.LoadQuotas(*quotas)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store.SetQuotas(q)
+	}
+
+	if *retention != "" {
+		rules, err := storage.LoadRetention(*retention)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store.SetRetention(rules)
+	}
+	if *sweep < 0 {
+		log.Fatalf("-sweep must not be negative, got %s", *sweep)
+	}
+	go store.RunSweeper(context.Background(), *sweep, func(removed []storage.Expired, err error) {
+		if err != nil {
+			log.Println("sweep failed:", err)
+		}
+		for _, file := range removed {
+			log.Printf("expired %s/%s version %d (%d bytes, expired %s)",
+				file.Namespace, file.Path, file.Version, file.Size, file.Expires.Format(time.RFC3339))
+		}
+	})
+
+	listener, err := tcp.NewListenerTCP(*addr, store, creds)
+	if err != nil {
+		log.Fatal(err)
+	}
+	limits := packet.ReceiveOptions{MaxFileSize: *maxFileSize, MaxDecompressedSize: *maxDecompressed}
+	listener.SetReceiveLimits(limits)
+	if *replicators != "" {
+		listener.AllowReplication(strings.Split(*replicators, ",")...)
+	}
+	var replicator *replica.Replicator
+	if *peers != "" {
+		list, err := replica.LoadPeers(*peers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r, err := replica.New(store, list, replica.Options{
+			Journal:   filepath.Join(*dir, replica.JournalFile),
+			Wait:      *replicas,
+			Timeout:   *replicaTimeout,
+			IOTimeout: *replicaIOTimeout,
+			Logger:    log.New(os.Stdout, "[REPLICA]: ", log.Ldate|log.Ltime),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener.SetReplicator(r)
+		replicator = r
+		go r.Run(context.Background())
+	}
+
+	if *httpAddr != "" {
+		logger := log.New(os.Stdout, "[HTTP]: ", log.Ldate|log.Ltime)
+		g := gateway.New(store, creds, replicator, logger)
+		g.SetReceiveLimits(limits)
+		go func() {
+			log.Fatal(gateway.ListenAndServeTLS(*httpAddr, g, logger))
+		}()
+	}
+	if *s3Addr != "" {
+		logger := log.New(os.Stdout, "[S3]: ", log.Ldate|log.Ltime)
+		s3, err := gateway.NewS3(store, creds, replicator, logger)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s3.SetReceiveLimits(limits)
+		go s3.RunCleanup(context.Background(), time.Hour)
+		go func() {
+			log.Fatal(gateway.ListenAndServeTLS(*s3Addr, s3, logger))
+		}()
+	}
+	if *metricsAddr != "" {
+		reg := newRegistry(store, replicator)
+		go func() {
+			log.Fatal(packet.ServeMetrics(*metricsAddr, reg))
+		}()
+	}
+	log.Fatal(listener.Serve())
+}
+
+// storageCollector - storage usage and the replication backlog, both are
+// read on every scrape. Namespaces that hold nothing have no series, so
+// the series of a namespace whose files were all removed go away.
+type storageCollector struct {
+	store      *storage.Store
+	replicator *replica.Replicator
+}
+
+var (
+	usedBytesDesc = prometheus.NewDesc("eternal_storage_used_bytes",
+		"Stored bytes per namespace, previous versions included.", []string{"namespace"}, nil)
+	filesDesc = prometheus.NewDesc("eternal_storage_files",
+		"Current files per namespace.", []string{"namespace"}, nil)
+	pendingDesc = prometheus.NewDesc("eternal_replication_pending",
+		"Uploads waiting to be replicated per peer.", []string{"peer"}, nil)
+)
+
+func (c storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- usedBytesDesc
+	ch <- filesDesc
+	ch <- pendingDesc
+}
+
+func (c storageCollector) Collect(ch chan<- prometheus.Metric) {
+	for ns, usage := range c.store.Usages() {
+		if usage == (storage.Usage{}) {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(usedBytesDesc, prometheus.GaugeValue, float64(usage.Bytes), ns)
+		ch <- prometheus.MustNewConstMetric(filesDesc, prometheus.GaugeValue, float64(usage.Files), ns)
+	}
+	if c.replicator != nil {
+		for peer, n := range c.replicator.Pending() {
+			ch <- prometheus.MustNewConstMetric(pendingDesc, prometheus.GaugeValue, float64(n), peer)
+		}
+	}
+}
+
+// newRegistry - metrics of the server: transfers, connections, storage
+// and the Go runtime of the process
+func newRegistry(store *storage.Store, replicator *replica.Replicator) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(packet.Collectors()...)
+	reg.MustRegister(tcp.Collectors()...)
+	reg.MustRegister(
+		storageCollector{store: store, replicator: replicator},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
+
+// addCredentials stores the key of user derived from the secret on stdin
+func addCredentials(path, user string) error {
+	creds, err := packet.LoadCredentials(path)
+	if errors.Is(err, os.ErrNotExist) {
+		creds = packet.Credentials{}
+	} else if err != nil {
+		return err
+	}
+
+	secret, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && secret == "" {
+		return fmt.Errorf("failed to read secret: %w", err)
+	}
+	if err := creds.Add(user, strings.TrimSpace(secret)); err != nil {
+		return err
+	}
+	return creds.Save(path)
+}
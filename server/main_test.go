@@ -0,0 +1,46 @@
+package main
+
+import (
+	"eternalStorageServer/storage"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Серії простору імен, з якого все видалено, зникають з метрик
+func TestStorageCollector(t *testing.T) {
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	_, err = store.Put("alice", "alice", "a.txt", strings.NewReader("12345"), storage.PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+	_, err = store.Put("bob", "bob", "b.txt", strings.NewReader("123"), storage.PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+
+	reg := newRegistry(store, nil)
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP eternal_storage_files Current files per namespace.
+# TYPE eternal_storage_files gauge
+eternal_storage_files{namespace="alice"} 1
+eternal_storage_files{namespace="bob"} 1
+# HELP eternal_storage_used_bytes Stored bytes per namespace, previous versions included.
+# TYPE eternal_storage_used_bytes gauge
+eternal_storage_used_bytes{namespace="alice"} 5
+eternal_storage_used_bytes{namespace="bob"} 3
+`), "eternal_storage_files", "eternal_storage_used_bytes"))
+
+	require.NoError(t, store.Delete("bob", "bob", "b.txt"))
+	require.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP eternal_storage_files Current files per namespace.
+# TYPE eternal_storage_files gauge
+eternal_storage_files{namespace="alice"} 1
+# HELP eternal_storage_used_bytes Stored bytes per namespace, previous versions included.
+# TYPE eternal_storage_used_bytes gauge
+eternal_storage_used_bytes{namespace="alice"} 5
+`), "eternal_storage_files", "eternal_storage_used_bytes"))
+
+	// два реєстри в одному процесі не конфліктують
+	assert.NotPanics(t, func() { newRegistry(store, nil) })
+}
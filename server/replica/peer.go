@@ -0,0 +1,119 @@
+package replica
+
+import (
+	packet "EternalPacket"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// peerConn - connection to one peer, opened on first use
+// and again after it failed
+type peerConn struct {
+	peer    Peer
+	tls     *tls.Config
+	timeout time.Duration
+	conn    net.Conn
+	nextID  uint64
+	wake    chan struct{}
+}
+
+func newPeerConn(peer Peer, timeout time.Duration) (*peerConn, error) {
+	config, err := packet.LoadClientTLS(peer.Cert)
+	if err != nil {
+		return nil, err
+	}
+	return &peerConn{peer: peer, tls: config, timeout: timeout, wake: make(chan struct{}, 1)}, nil
+}
+
+func (p *peerConn) wakeUp() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *peerConn) dial() error {
+	if p.conn != nil {
+		return nil
+	}
+	tlsConn, err := tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, "tcp", p.peer.Addr, p.tls)
+	if err != nil {
+		return err
+	}
+	conn := &deadlineConn{Conn: tlsConn, timeout: p.timeout}
+	if err := packet.ClientAuth(conn, p.peer.User, p.peer.Secret); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	p.conn = conn
+	return nil
+}
+
+// put sends data as entry.Path of entry.Namespace: Request, packet, Response
+func (p *peerConn) put(entry Entry, data io.Reader, ttl int64) error {
+	tp, err := packet.NewTCPPacketFromReader(data, entry.Path, entry.Mode, "snappy")
+	if err != nil {
+		return err
+	}
+	tp.MetaData.TTL = ttl
+	if err := p.dial(); err != nil {
+		return err
+	}
+
+	p.nextID++
+	req := &packet.Request{ID: p.nextID, Op: packet.OpReplicate, Namespace: entry.Namespace, Path: entry.Path}
+	err = req.Send(p.conn)
+	if err == nil {
+		err = tp.SendOverTCP(p.conn)
+	}
+	var reject *packet.RejectError
+	if err != nil && !errors.As(err, &reject) {
+		p.close()
+		return err
+	}
+	// a refused packet is still answered with a response
+	_, respErr := packet.ReadResponse(p.conn, req)
+	var failed *packet.ResponseError
+	if respErr != nil && !errors.As(respErr, &failed) {
+		p.close()
+		return respErr
+	}
+	if reject != nil {
+		return reject
+	}
+	return respErr
+}
+
+func (p *peerConn) close() {
+	if p.conn != nil {
+		_ = p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// deadlineConn moves the deadline forward before every read and write,
+// so a peer that stops reading or answering fails the request instead of
+// blocking its worker, while a long transfer that keeps going is not cut
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
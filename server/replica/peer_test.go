@@ -0,0 +1,148 @@
+package replica_test
+
+import (
+	packet "EternalPacket"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"eternalStorageServer/replica"
+	"eternalStorageServer/storage"
+	"eternalStorageServer/tcp"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// сертифікат піра на 127.0.0.1 і файл, за яким йому довіряють
+func peerCert(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "peer"},
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "peer.crt")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func localListener(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener
+}
+
+// Живий пір: синхронна реплікація підтверджується, копія лежить
+// у сховищі піра, журнал порожній
+func TestReplicateLivePeer(t *testing.T) {
+	cert, certFile := peerCert(t)
+	creds := packet.Credentials{}
+	require.NoError(t, creds.Add("node1", "s"))
+	peerStore, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	server, err := tcp.NewListenerTCP("", peerStore, creds)
+	require.NoError(t, err)
+	server.SetCertificate(cert)
+	server.AllowReplication("node1")
+	listener := localListener(t)
+	go func() { _ = server.ServeListener(listener) }()
+
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	file, err := store.Put("alice", "alice", "a.txt", strings.NewReader("replicated"), storage.PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+
+	peer := replica.Peer{Addr: listener.Addr().String(), User: "node1", Secret: "s", Cert: certFile}
+	r, err := replica.New(store, []replica.Peer{peer}, replica.Options{
+		Journal: filepath.Join(t.TempDir(), replica.JournalFile),
+		Wait:    1,
+		Timeout: 10 * time.Second,
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	require.NoError(t, r.Replicate("alice", file))
+	assert.Equal(t, map[string]int{peer.Addr: 0}, r.Pending())
+
+	copied, data, err := peerStore.Open("alice", "alice", "a.txt")
+	require.NoError(t, err)
+	defer data.Close()
+	content, err := io.ReadAll(data)
+	require.NoError(t, err)
+	assert.Equal(t, "replicated", string(content))
+	assert.Equal(t, file.Hash, copied.Hash)
+}
+
+// Пір, що пройшов автентифікацію і замовк, не тримає з'єднання
+// довше за IOTimeout
+func TestReplicateStalledPeer(t *testing.T) {
+	cert, certFile := peerCert(t)
+	creds := packet.Credentials{}
+	require.NoError(t, creds.Add("node1", "s"))
+	listener := localListener(t)
+	closed := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			closed <- err
+			return
+		}
+		defer conn.Close()
+		conn = tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if _, err := packet.ServerAuth(conn, creds); err != nil {
+			closed <- err
+			return
+		}
+		// запит не читається і не отримує відповіді, поки клієнт не закриє з'єднання
+		time.Sleep(500 * time.Millisecond)
+		_, err = io.Copy(io.Discard, conn)
+		closed <- err
+	}()
+
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	file, err := store.Put("alice", "alice", "a.txt", strings.NewReader("stalled"), storage.PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+
+	peer := replica.Peer{Addr: listener.Addr().String(), User: "node1", Secret: "s", Cert: certFile}
+	r, err := replica.New(store, []replica.Peer{peer}, replica.Options{
+		Wait:      1,
+		Timeout:   5 * time.Second,
+		IOTimeout: 200 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Run(ctx)
+
+	go func() { _ = r.Replicate("alice", file) }()
+	select {
+	case err := <-closed:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled peer connection was not dropped")
+	}
+	assert.Equal(t, map[string]int{peer.Addr: 1}, r.Pending())
+}
@@ -0,0 +1,427 @@
+// Package replica copies uploads to peer servers over the packet protocol.
+// Every upload is queued for every peer in a journal that survives
+// restarts, so a peer that was offline catches up once it is back.
+package replica
+
+import (
+	packet "EternalPacket"
+	"context"
+	"encoding/json"
+	"errors"
+	"eternalStorageServer/storage"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultTimeout = 30 * time.Second
+	// DefaultIOTimeout - default Options.IOTimeout
+	DefaultIOTimeout = time.Minute
+	// JournalFile - default journal name in the storage directory
+	JournalFile = "replication.json"
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+	// journalFlush - how often replicated entries are removed from the
+	// journal file, a crash before that only sends them again
+	journalFlush = time.Second
+)
+
+// ErrNotReplicated - fewer peers than required confirmed an upload in time,
+// the upload is stored locally and still replicated in the background
+var ErrNotReplicated = errors.New("not enough replicas confirmed")
+
+// Peer - server uploads are replicated to
+type Peer struct {
+	Addr string `json:"addr"`
+	// User the peer knows this server as, it must be one of its -replicators
+	User string `json:"user"`
+	// Secret of User, ETERNAL_PEER_SECRET if empty
+	Secret string `json:"secret,omitempty"`
+	// Cert - certificate of the peer (PEM)
+	Cert string `json:"cert"`
+}
+
+// LoadPeers reads a JSON list of peers
+func LoadPeers(path string) ([]Peer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	if err := json.Unmarshal(data, &peers); err != nil {
+		return nil, fmt.Errorf("error parsing peers: %w", err)
+	}
+	for i := range peers {
+		if peers[i].Addr == "" || peers[i].User == "" {
+			return nil, fmt.Errorf("peer %d: addr and user are required", i)
+		}
+		if peers[i].Secret == "" {
+			peers[i].Secret = os.Getenv("ETERNAL_PEER_SECRET")
+		}
+	}
+	return peers, nil
+}
+
+type Options struct {
+	// Journal - where pending replications are kept
+	Journal string
+	// Wait - peers that have to confirm an upload before the client
+	// gets an answer, 0 - the client doesn't wait for replication
+	Wait int
+	// Timeout of waiting for Wait confirmations
+	Timeout time.Duration
+	// IOTimeout - a peer that doesn't read or answer for this long is
+	// dropped and the upload retried on a new connection
+	IOTimeout time.Duration
+	Logger    *log.Logger
+}
+
+// Entry - stored file waiting to be copied to a peer
+type Entry struct {
+	Namespace string      `json:"namespace"`
+	Path      string      `json:"path"`
+	Hash      string      `json:"hash"`
+	Mode      os.FileMode `json:"mode"`
+	Expires   time.Time   `json:"expires,omitempty"`
+	Queued    time.Time   `json:"queued"`
+}
+
+func (e Entry) key() string {
+	return e.Namespace + "/" + e.Path
+}
+
+// queued - place of a journal entry in the queue of a peer
+type queued struct {
+	key    string
+	queued time.Time
+}
+
+type Replicator struct {
+	store *storage.Store
+	peers []*peerConn
+	opts  Options
+
+	mu sync.Mutex
+	// journal - peer address -> namespace/path -> latest version to send
+	journal map[string]map[string]Entry
+	// queue - peer address -> entries in the order they were queued, a
+	// place whose entry was queued again or removed is skipped
+	queue map[string][]queued
+	// dirty - entries were removed since the journal was saved
+	dirty bool
+	// waiters - namespace/path + hash -> uploads waiting for confirmations
+	waiters map[string][]chan string
+}
+
+func New(store *storage.Store, peers []Peer, opts Options) (*Replicator, error) {
+	if opts.Wait > len(peers) {
+		return nil, fmt.Errorf("can't wait for %d replicas with %d peers", opts.Wait, len(peers))
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.IOTimeout <= 0 {
+		opts.IOTimeout = DefaultIOTimeout
+	}
+	if opts.Logger == nil {
+		opts.Logger = log.New(io.Discard, "", 0)
+	}
+
+	r := &Replicator{
+		store:   store,
+		opts:    opts,
+		journal: make(map[string]map[string]Entry),
+		queue:   make(map[string][]queued),
+		waiters: make(map[string][]chan string),
+	}
+	data, err := os.ReadFile(opts.Journal)
+	if err == nil {
+		if err := json.Unmarshal(data, &r.journal); err != nil {
+			return nil, fmt.Errorf("error parsing replication journal: %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, peer := range peers {
+		p, err := newPeerConn(peer, opts.IOTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("peer %s: %w", peer.Addr, err)
+		}
+		r.peers = append(r.peers, p)
+		if r.journal[peer.Addr] == nil {
+			r.journal[peer.Addr] = make(map[string]Entry)
+		}
+	}
+	for addr, entries := range r.journal {
+		for _, entry := range entries {
+			r.queue[addr] = append(r.queue[addr], queued{key: entry.key(), queued: entry.Queued})
+		}
+		sort.Slice(r.queue[addr], func(i, j int) bool {
+			a, b := r.queue[addr][i], r.queue[addr][j]
+			if !a.queued.Equal(b.queued) {
+				return a.queued.Before(b.queued)
+			}
+			return a.key < b.key
+		})
+	}
+	return r, nil
+}
+
+// Run sends queued uploads to the peers until ctx is done,
+// starting with what was left in the journal
+func (r *Replicator) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, p := range r.peers {
+		wg.Add(1)
+		go func(p *peerConn) {
+			defer wg.Done()
+			r.worker(ctx, p)
+		}(p)
+	}
+
+	ticker := time.NewTicker(journalFlush)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.flush()
+		case <-ctx.Done():
+			wg.Wait()
+			r.flush()
+			return
+		}
+	}
+}
+
+// Replicate queues the current version of file in ns for every peer and
+// waits for Options.Wait of them to confirm
+func (r *Replicator) Replicate(ns string, file *storage.File) error {
+	entry := Entry{
+		Namespace: ns,
+		Path:      file.Path,
+		Hash:      file.Hash,
+		Mode:      file.Mode,
+		Expires:   file.Expires,
+		Queued:    time.Now(),
+	}
+
+	acks := make(chan string, len(r.peers))
+	waitKey := entry.key() + "@" + entry.Hash
+	r.mu.Lock()
+	for _, p := range r.peers {
+		r.journal[p.peer.Addr][entry.key()] = entry
+		r.enqueue(p.peer.Addr, entry)
+	}
+	if r.opts.Wait > 0 {
+		r.waiters[waitKey] = append(r.waiters[waitKey], acks)
+	}
+	err := r.save()
+	r.mu.Unlock()
+	for _, p := range r.peers {
+		p.wakeUp()
+	}
+	if err != nil || r.opts.Wait == 0 {
+		return err
+	}
+	defer r.unwait(waitKey, acks)
+
+	timeout := time.NewTimer(r.opts.Timeout)
+	defer timeout.Stop()
+	confirmed := make(map[string]bool)
+	for len(confirmed) < r.opts.Wait {
+		select {
+		case addr := <-acks:
+			confirmed[addr] = true
+		case <-timeout.C:
+			return fmt.Errorf("%w: %d of %d in %s, %s/%s is stored and will be replicated later",
+				ErrNotReplicated, len(confirmed), r.opts.Wait, r.opts.Timeout, ns, file.Path)
+		}
+	}
+	return nil
+}
+
+// Pending - number of queued uploads per peer address
+func (r *Replicator) Pending() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	pending := make(map[string]int, len(r.journal))
+	for _, p := range r.peers {
+		pending[p.peer.Addr] = len(r.journal[p.peer.Addr])
+	}
+	return pending
+}
+
+func (r *Replicator) worker(ctx context.Context, p *peerConn) {
+	defer p.close()
+	backoff := minBackoff
+	for {
+		entry, ok := r.next(p.peer.Addr)
+		if !ok {
+			select {
+			case <-ctx.Done():
+				return
+			case <-p.wake:
+			}
+			continue
+		}
+
+		err := r.send(p, entry)
+		if err != nil && !permanent(err) {
+			r.opts.Logger.Printf("replication of %s to %s failed, retrying in %s: %v", entry.key(), p.peer.Addr, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(2*backoff, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+		if err != nil {
+			r.opts.Logger.Printf("replication of %s to %s dropped: %v", entry.key(), p.peer.Addr, err)
+		} else {
+			r.opts.Logger.Printf("replicated %s version %s to %s", entry.key(), entry.Hash[:12], p.peer.Addr)
+		}
+		r.done(p.peer.Addr, entry, err == nil)
+	}
+}
+
+// enqueue puts entry at the end of the queue of peer, places skipped by
+// next are dropped once they outnumber the queued entries
+func (r *Replicator) enqueue(addr string, entry Entry) {
+	queue := append(r.queue[addr], queued{key: entry.key(), queued: entry.Queued})
+	if len(queue) > 2*len(r.journal[addr])+64 {
+		live := queue[:0]
+		for _, q := range queue {
+			if current, ok := r.journal[addr][q.key]; ok && current.Queued.Equal(q.queued) {
+				live = append(live, q)
+			}
+		}
+		queue = live
+	}
+	r.queue[addr] = queue
+}
+
+// next - the oldest queued entry of peer, it stays at the head of the
+// queue until done removes it from the journal
+func (r *Replicator) next(addr string) (Entry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	queue := r.queue[addr]
+	for len(queue) > 0 {
+		entry, ok := r.journal[addr][queue[0].key]
+		if ok && entry.Queued.Equal(queue[0].queued) {
+			r.queue[addr] = queue
+			return entry, true
+		}
+		queue = queue[1:]
+	}
+	r.queue[addr] = nil
+	return Entry{}, false
+}
+
+func (r *Replicator) send(p *peerConn, entry Entry) error {
+	var ttl int64
+	if !entry.Expires.IsZero() {
+		ttl = int64(time.Until(entry.Expires).Seconds())
+		if ttl <= 0 {
+			return fmt.Errorf("%w: expired", errSkipped)
+		}
+	}
+	// the owner of the namespace may always read it
+	_, data, err := r.store.OpenHash(entry.Namespace, entry.Namespace, entry.Hash)
+	if errors.Is(err, storage.ErrNotFound) {
+		return fmt.Errorf("%w: %v", errSkipped, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	return p.put(entry, data, ttl)
+}
+
+// done removes entry from the journal unless a newer version
+// was queued meanwhile
+func (r *Replicator) done(addr string, entry Entry, replicated bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if current, ok := r.journal[addr][entry.key()]; ok && current.Hash == entry.Hash {
+		delete(r.journal[addr], entry.key())
+		r.dirty = true
+	}
+	if replicated {
+		for _, acks := range r.waiters[entry.key()+"@"+entry.Hash] {
+			select {
+			case acks <- addr:
+			default:
+			}
+		}
+	}
+}
+
+func (r *Replicator) unwait(key string, acks chan string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	waiters := r.waiters[key]
+	for i := range waiters {
+		if waiters[i] == acks {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(r.waiters, key)
+	} else {
+		r.waiters[key] = waiters
+	}
+}
+
+// flush saves the journal if entries were removed since the last save
+func (r *Replicator) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.dirty {
+		return
+	}
+	if err := r.save(); err != nil {
+		r.opts.Logger.Println("saving replication journal failed:", err)
+	}
+}
+
+// save writes the journal, must be called with mu locked. Uploads are
+// saved before they are answered, removals are batched by flush.
+func (r *Replicator) save() error {
+	if r.opts.Journal == "" {
+		return nil
+	}
+	data, err := json.Marshal(r.journal)
+	if err != nil {
+		return err
+	}
+	if err := packet.WriteFileAtomic(r.opts.Journal, data, 0o600); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// errSkipped - the entry can't be replicated anymore
+var errSkipped = errors.New("nothing to replicate")
+
+// permanent - retrying won't help: the content is gone or the peer
+// refused it (not a replicator, quota...)
+func permanent(err error) bool {
+	var respErr *packet.ResponseError
+	if errors.As(err, &respErr) {
+		return respErr.Status < packet.StatusInternalError
+	}
+	var reject *packet.RejectError
+	return errors.Is(err, errSkipped) || errors.As(err, &reject)
+}
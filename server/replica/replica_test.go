@@ -0,0 +1,145 @@
+package replica
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"eternalStorageServer/storage"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// сертифікат, якому довіряє з'єднання з піром
+func writeCert(t *testing.T) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "peer"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "peer.crt")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644))
+	return path
+}
+
+// адреса, на якій ніхто не слухає
+func offlineAddr(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	return addr
+}
+
+// Пір недоступний: синхронна реплікація не підтверджується,
+// а завантаження лишається в журналі до наступного запуску
+func TestReplicateOfflinePeer(t *testing.T) {
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	file, err := store.Put("alice", "alice", "a.txt", strings.NewReader("v1"), storage.PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+
+	peer := Peer{Addr: offlineAddr(t), User: "node1", Secret: "s", Cert: writeCert(t)}
+	opts := Options{Journal: filepath.Join(t.TempDir(), JournalFile), Wait: 1, Timeout: 100 * time.Millisecond}
+	r, err := New(store, []Peer{peer}, opts)
+	require.NoError(t, err)
+
+	err = r.Replicate("alice", file)
+	assert.ErrorIs(t, err, ErrNotReplicated)
+
+	// новіша версія замінює ще не відправлену
+	file, err = store.Put("alice", "alice", "a.txt", strings.NewReader("v2"), storage.PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+	opts.Wait = 0
+	r, err = New(store, []Peer{peer}, opts)
+	require.NoError(t, err)
+	require.NoError(t, r.Replicate("alice", file))
+
+	r, err = New(store, []Peer{peer}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{peer.Addr: 1}, r.Pending())
+	entry, ok := r.next(peer.Addr)
+	require.True(t, ok)
+	assert.Equal(t, file.Hash, entry.Hash)
+
+	_, err = New(store, []Peer{peer}, Options{Wait: 2})
+	assert.Error(t, err)
+}
+
+// Черга журналу: порядок постановки, повторно поставлений файл іде в
+// кінець, видалення зберігаються пакетом
+func TestJournalQueue(t *testing.T) {
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	peer := Peer{Addr: offlineAddr(t), User: "node1", Secret: "s", Cert: writeCert(t)}
+	opts := Options{Journal: filepath.Join(t.TempDir(), JournalFile)}
+	r, err := New(store, []Peer{peer}, opts)
+	require.NoError(t, err)
+
+	put := func(name, data string) *storage.File {
+		t.Helper()
+		file, err := store.Put("alice", "alice", name, strings.NewReader(data), storage.PutOptions{Mode: 0o644})
+		require.NoError(t, err)
+		require.NoError(t, r.Replicate("alice", file))
+		return file
+	}
+	put("a.txt", "a1")
+	put("b.txt", "b1")
+	put("c.txt", "c1")
+	a2 := put("a.txt", "a2")
+	for range 200 {
+		put("hot.txt", "h")
+	}
+	assert.LessOrEqual(t, len(r.queue[peer.Addr]), 2*4+64+1)
+
+	order := func(r *Replicator) []string {
+		var paths []string
+		for {
+			entry, ok := r.next(peer.Addr)
+			if !ok {
+				return paths
+			}
+			paths = append(paths, entry.Path)
+			r.done(peer.Addr, entry, true)
+		}
+	}
+	// журнал з диска дає той самий порядок
+	loaded, err := New(store, []Peer{peer}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b.txt", "c.txt", "a.txt", "hot.txt"}, order(loaded))
+
+	entry, ok := r.next(peer.Addr)
+	require.True(t, ok)
+	assert.Equal(t, "b.txt", entry.Path)
+	r.done(peer.Addr, entry, true)
+	entry, _ = r.next(peer.Addr)
+	assert.Equal(t, "c.txt", entry.Path)
+	r.done(peer.Addr, entry, true)
+	entry, _ = r.next(peer.Addr)
+	assert.Equal(t, a2.Hash, entry.Hash)
+
+	// видалене потрапляє у файл тільки під час flush
+	loaded, err = New(store, []Peer{peer}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{peer.Addr: 4}, loaded.Pending())
+	r.flush()
+	loaded, err = New(store, []Peer{peer}, opts)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{peer.Addr: 2}, loaded.Pending())
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Perm - what a user may do with a path
+type Perm uint8
+
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+	PermDelete
+	PermShare
+
+	PermNone Perm = 0
+	PermAll       = PermRead | PermWrite | PermDelete | PermShare
+)
+
+var permLetters = []struct {
+	perm   Perm
+	letter byte
+}{
+	{PermRead, 'r'},
+	{PermWrite, 'w'},
+	{PermDelete, 'd'},
+	{PermShare, 's'},
+}
+
+// ParsePerm parses letters "rwds", e.g. "rw" - read and write.
+// "-" or empty string means no permissions (revoke).
+func ParsePerm(s string) (Perm, error) {
+	var perm Perm
+	if s == "-" {
+		return PermNone, nil
+	}
+	for i := 0; i < len(s); i++ {
+		found := false
+		for _, p := range permLetters {
+			if s[i] == p.letter {
+				perm |= p.perm
+				found = true
+			}
+		}
+		if !found {
+			return PermNone, fmt.Errorf("unknown permission %q, use r/w/d/s", s[i])
+		}
+	}
+	return perm, nil
+}
+
+func (p Perm) String() string {
+	if p == PermNone {
+		return "-"
+	}
+	var b strings.Builder
+	for _, l := range permLetters {
+		if p&l.perm != 0 {
+			b.WriteByte(l.letter)
+		}
+	}
+	return b.String()
+}
+
+// ACL - path prefix -> user -> permissions granted by the namespace owner.
+// Entry on a directory covers everything below it; "" covers the whole namespace.
+type ACL map[string]map[string]Perm
+
+// perm - union of all entries on path and its parent directories
+func (acl ACL) perm(user, filePath string) Perm {
+	var perm Perm
+	for prefix := filePath; ; prefix = parentDir(prefix) {
+		perm |= acl[prefix][user]
+		if prefix == "" {
+			return perm
+		}
+	}
+}
+
+func (acl ACL) set(user, filePath string, perm Perm) {
+	if perm == PermNone {
+		delete(acl[filePath], user)
+		if len(acl[filePath]) == 0 {
+			delete(acl, filePath)
+		}
+		return
+	}
+	if acl[filePath] == nil {
+		acl[filePath] = make(map[string]Perm)
+	}
+	acl[filePath][user] = perm
+}
+
+func parentDir(filePath string) string {
+	i := strings.LastIndexByte(filePath, '/')
+	if i < 0 {
+		return ""
+	}
+	return filePath[:i]
+}
+
+func (p Perm) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *Perm) UnmarshalText(text []byte) error {
+	perm, err := ParsePerm(string(text))
+	if err != nil {
+		return err
+	}
+	*p = perm
+	return nil
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Reed-Solomon over GF(2^8): k data shards and m parity shards, any k of
+// the k+m are enough to get the data back. The encoding matrix is
+// a Vandermonde matrix turned systematic, so data shards are the data
+// itself and only parity has to be computed.
+
+const gfPoly = 0x11d
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= gfPoly
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+type gfMatrix [][]byte
+
+func newGFMatrix(rows, cols int) gfMatrix {
+	m := make(gfMatrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+func (a gfMatrix) mul(b gfMatrix) gfMatrix {
+	out := newGFMatrix(len(a), len(b[0]))
+	for i := range a {
+		for j := range b[0] {
+			var v byte
+			for k := range b {
+				v ^= gfMul[a[i][k]][b[k][j]]
+			}
+			out[i][j] = v
+		}
+	}
+	return out
+}
+
+// invert - Gauss-Jordan elimination of a square matrix
+func (a gfMatrix) invert() (gfMatrix, error) {
+	n := len(a)
+	work := newGFMatrix(n, 2*n)
+	for i := range a {
+		copy(work[i], a[i])
+		work[i][n+i] = 1
+	}
+	for col := 0; col < n; col++ {
+		pivot := col
+		for pivot < n && work[pivot][col] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular matrix")
+		}
+		work[col], work[pivot] = work[pivot], work[col]
+
+		scale := gfInv(work[col][col])
+		for j := range work[col] {
+			work[col][j] = gfMul[scale][work[col][j]]
+		}
+		for row := 0; row < n; row++ {
+			if row == col || work[row][col] == 0 {
+				continue
+			}
+			factor := work[row][col]
+			for j := range work[row] {
+				work[row][j] ^= gfMul[factor][work[col][j]]
+			}
+		}
+	}
+	out := newGFMatrix(n, n)
+	for i := range out {
+		copy(out[i], work[i][n:])
+	}
+	return out, nil
+}
+
+type reedSolomon struct {
+	data, parity int
+	// matrix - (data+parity) x data, the top is the identity
+	matrix gfMatrix
+}
+
+func newReedSolomon(data, parity int) (*reedSolomon, error) {
+	if data < 1 || parity < 1 || data+parity > 256 {
+		return nil, fmt.Errorf("invalid erasure coding %d+%d, need at least 1+1 and at most 256 shards", data, parity)
+	}
+	vandermonde := newGFMatrix(data+parity, data)
+	for r := range vandermonde {
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := vandermonde[:data].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{data: data, parity: parity, matrix: vandermonde.mul(top)}, nil
+}
+
+// encode fills parity shards from data shards, all shards have the same size
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for p := 0; p < rs.parity; p++ {
+		row := rs.matrix[rs.data+p]
+		out := shards[rs.data+p]
+		clear(out)
+		for d := 0; d < rs.data; d++ {
+			mulAdd(out, shards[d], row[d])
+		}
+	}
+}
+
+// reconstruct fills nil data shards, at least data shards must be present,
+// size - size of every shard
+func (rs *reedSolomon) reconstruct(shards [][]byte, size int) error {
+	missing := false
+	for d := 0; d < rs.data; d++ {
+		missing = missing || shards[d] == nil
+	}
+	if !missing {
+		return nil
+	}
+
+	rows := make([]int, 0, rs.data)
+	for i := range shards {
+		if shards[i] != nil && len(rows) < rs.data {
+			rows = append(rows, i)
+		}
+	}
+	if len(rows) < rs.data {
+		return fmt.Errorf("%d of %d shards left, need %d", len(rows), len(shards), rs.data)
+	}
+
+	sub := newGFMatrix(rs.data, rs.data)
+	for i, row := range rows {
+		copy(sub[i], rs.matrix[row])
+	}
+	decode, err := sub.invert()
+	if err != nil {
+		return err
+	}
+	for d := 0; d < rs.data; d++ {
+		if shards[d] != nil {
+			continue
+		}
+		out := make([]byte, size)
+		for i, row := range rows {
+			mulAdd(out, shards[row], decode[d][i])
+		}
+		shards[d] = out
+	}
+	return nil
+}
+
+// mulAdd: out ^= c * in
+func mulAdd(out, in []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	table := &gfMul[c]
+	for i, v := range in {
+		out[i] ^= table[v]
+	}
+}
@@ -0,0 +1,156 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Дані відновлюються з будь-яких data шардів з data+parity
+func TestReedSolomonReconstruct(t *testing.T) {
+	rs, err := newReedSolomon(4, 2)
+	require.NoError(t, err)
+
+	shards := make([][]byte, 6)
+	for i := range shards {
+		shards[i] = make([]byte, 100)
+		if i < 4 {
+			_, err := rand.Read(shards[i])
+			require.NoError(t, err)
+		}
+	}
+	rs.encode(shards)
+
+	for a := 0; a < 6; a++ {
+		for b := a; b < 6; b++ {
+			damaged := append([][]byte(nil), shards...)
+			damaged[a], damaged[b] = nil, nil
+			require.NoError(t, rs.reconstruct(damaged, 100))
+			for d := 0; d < 4; d++ {
+				assert.Equal(t, shards[d], damaged[d], "lost %d and %d", a, b)
+			}
+		}
+	}
+
+	damaged := append([][]byte(nil), shards...)
+	damaged[0], damaged[1], damaged[5] = nil, nil, nil
+	assert.Error(t, rs.reconstruct(damaged, 100))
+}
+
+func shardStore(t *testing.T, disks, parity int) (*Store, []string) {
+	t.Helper()
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	dirs := make([]string, disks)
+	for i := range dirs {
+		dirs[i] = t.TempDir()
+	}
+	require.NoError(t, s.SetShards(dirs, parity))
+	return s, dirs
+}
+
+func readAll(t *testing.T, s *Store, path string) ([]byte, error) {
+	t.Helper()
+	_, r, err := s.Open("alice", "alice", path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// Файл читається, поки втрачено не більше parity дисків або шардів
+func TestStoreShards(t *testing.T) {
+	s, dirs := shardStore(t, 5, 2)
+
+	big := make([]byte, 3*3*shardUnit+12345)
+	_, err := rand.Read(big)
+	require.NoError(t, err)
+	files := map[string][]byte{"empty": nil, "small": []byte("small file"), "big": big}
+	for name, data := range files {
+		_, err := s.Put("alice", "alice", name, bytes.NewReader(data), PutOptions{Mode: 0o644})
+		require.NoError(t, err)
+	}
+
+	// один диск втрачено, на іншому шард пошкоджено
+	require.NoError(t, os.RemoveAll(filepath.Join(dirs[1], "shards")))
+	file, err := s.Stat("alice", "alice", "big")
+	require.NoError(t, err)
+	shard := filepath.Join(dirs[3], "shards", file.Hash[:2], file.Hash)
+	raw, err := os.ReadFile(shard)
+	require.NoError(t, err)
+	raw[shardHeaderSize+shardUnit+4+10] ^= 1
+	require.NoError(t, os.WriteFile(shard, raw, 0o640))
+
+	for name, data := range files {
+		got, err := readAll(t, s, name)
+		require.NoError(t, err, name)
+		assert.Equal(t, len(data), len(got), name)
+		assert.True(t, bytes.Equal(data, got), name)
+	}
+
+	// довільне читання, як у дельт
+	_, r, err := s.Open("alice", "alice", "big")
+	require.NoError(t, err)
+	part := make([]byte, 1000)
+	n, err := r.(io.ReaderAt).ReadAt(part, int64(shardUnit)*4-500)
+	require.NoError(t, err)
+	assert.Equal(t, big[shardUnit*4-500:shardUnit*4+500], part[:n])
+	require.NoError(t, r.Close())
+
+	// третій диск - забагато
+	require.NoError(t, os.RemoveAll(filepath.Join(dirs[4], "shards")))
+	_, err = readAll(t, s, "big")
+	assert.Error(t, err)
+
+	// повторне завантаження відновлює шарди
+	_, err = s.Put("alice", "alice", "big-again", bytes.NewReader(big), PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+	got, err := readAll(t, s, "big")
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(big, got))
+
+	// видалення прибирає всі шарди
+	require.NoError(t, s.Delete("alice", "alice", "big"))
+	require.NoError(t, s.Delete("alice", "alice", "big-again"))
+	for _, dir := range dirs {
+		_, err := os.Stat(filepath.Join(dir, "shards", file.Hash[:2], file.Hash))
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
+
+// Файли, збережені до шардування, лишаються доступними
+func TestStoreShardsLegacyBlobs(t *testing.T) {
+	root := t.TempDir()
+	s, err := Open(root)
+	require.NoError(t, err)
+	put(t, s, "alice", "alice", "old.txt", "stored before")
+
+	require.NoError(t, s.SetShards([]string{t.TempDir(), t.TempDir(), t.TempDir()}, 1))
+	put(t, s, "alice", "alice", "new.txt", "stored after")
+	assert.Equal(t, "stored before", read(t, s, "alice", "alice", "old.txt"))
+	assert.Equal(t, "stored after", read(t, s, "alice", "alice", "new.txt"))
+	assert.Error(t, s.SetShards([]string{t.TempDir(), t.TempDir()}, 1))
+}
+
+// Два шарди в одному каталозі перезаписували б один одного
+func TestStoreShardsDuplicateDirs(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	a, b := t.TempDir(), t.TempDir()
+
+	err = s.SetShards([]string{a, b, a + "/"}, 1)
+	assert.ErrorContains(t, err, "are the same")
+
+	link := filepath.Join(t.TempDir(), "link")
+	require.NoError(t, os.Symlink(b, link))
+	assert.Error(t, s.SetShards([]string{a, b, link}, 1))
+
+	require.NoError(t, s.SetShards([]string{a, b, t.TempDir()}, 1))
+}
@@ -0,0 +1,151 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota - limits of one namespace or of the whole store, 0 - unlimited
+type Quota struct {
+	Bytes int64 `json:"bytes,omitempty"`
+	Files int   `json:"files,omitempty"`
+}
+
+// Quotas - Default applies to every namespace without own entry in Users
+type Quotas struct {
+	Default Quota            `json:"default"`
+	Users   map[string]Quota `json:"users,omitempty"`
+	Total   Quota            `json:"total"`
+}
+
+// Usage - what is counted against quotas, sizes are before compression.
+// Previous versions take space, so they count in Bytes, but not in Files.
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int   `json:"files"`
+}
+
+func LoadQuotas(path string) (Quotas, error) {
+	var quotas Quotas
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return quotas, err
+	}
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return quotas, fmt.Errorf("error parsing quotas %s: %w", path, err)
+	}
+	return quotas, nil
+}
+
+func (q Quotas) user(ns string) Quota {
+	if quota, ok := q.Users[ns]; ok {
+		return quota
+	}
+	return q.Default
+}
+
+func (s *Store) SetQuotas(quotas Quotas) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.quotas = quotas
+}
+
+// Usage of namespace ns, "" - the whole store
+func (s *Store) Usage(ns string) Usage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.usage(ns)
+}
+
+// CheckPut tells if user may store size bytes as filePath in ns,
+// it's meant to be called before the upload data is accepted
+func (s *Store) CheckPut(user, ns, filePath string, size int64) error {
+	filePath, err := s.check(user, ns, filePath, PermWrite)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkQuota(ns, filePath, size)
+}
+
+// checkQuota - both quotas of ns and of the store. Must be called with mu locked.
+func (s *Store) checkQuota(ns, filePath string, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("%w: negative size", ErrBadPath)
+	}
+
+	// the current version goes to history, so replacing a file
+	// needs space for the whole new one unless history is off
+	grow := Usage{Bytes: size}
+	if old := s.namespaces[ns].lookup(filePath); old == nil {
+		grow.Files = 1
+	} else if s.keep == 0 {
+		grow.Bytes -= old.Size
+	}
+
+	if err := exceeds(ns, s.quotas.user(ns), s.usage(ns), grow); err != nil {
+		return err
+	}
+	return exceeds("storage", s.quotas.Total, s.usage(""), grow)
+}
+
+func exceeds(owner string, quota Quota, used, grow Usage) error {
+	if quota.Bytes > 0 && grow.Bytes > 0 && used.Bytes+grow.Bytes > quota.Bytes {
+		return fmt.Errorf("%w: %s uses %s of %s, upload needs %s more",
+			ErrQuotaExceeded, owner, formatBytes(used.Bytes), formatBytes(quota.Bytes), formatBytes(grow.Bytes))
+	}
+	if quota.Files > 0 && grow.Files > 0 && used.Files+grow.Files > quota.Files {
+		return fmt.Errorf("%w: %s has %d of %d files", ErrQuotaExceeded, owner, used.Files, quota.Files)
+	}
+	return nil
+}
+
+// Usages - Usage of every namespace
+func (s *Store) Usages() map[string]Usage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usages := make(map[string]Usage, len(s.namespaces))
+	for ns := range s.namespaces {
+		usages[ns] = s.usage(ns)
+	}
+	return usages
+}
+
+// usage must be called with mu locked
+func (s *Store) usage(ns string) Usage {
+	var usage Usage
+	for name, namespace := range s.namespaces {
+		if ns != "" && name != ns {
+			continue
+		}
+		for _, file := range namespace.Files {
+			usage.Bytes += file.Size
+			usage.Files++
+		}
+		for _, versions := range namespace.Versions {
+			for _, version := range versions {
+				usage.Bytes += version.Size
+			}
+		}
+	}
+	return usage
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rule - files under Prefix (slash separated, "" - whole namespace)
+// are removed MaxAge after their upload
+type Rule struct {
+	Prefix string   `json:"prefix"`
+	MaxAge Duration `json:"max_age"`
+}
+
+// Retention - namespace -> rules. A TTL given on upload wins over rules,
+// when several rules match the longest prefix is used.
+type Retention map[string][]Rule
+
+// Duration - time.Duration written as "336h" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	parsed, err := time.ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Expired - what the sweeper removed
+type Expired struct {
+	Namespace string    `json:"namespace"`
+	Path      string    `json:"path"`
+	Version   int       `json:"version"`
+	Size      int64     `json:"size"`
+	Expires   time.Time `json:"expires"`
+}
+
+func LoadRetention(path string) (Retention, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var retention Retention
+	if err := json.Unmarshal(data, &retention); err != nil {
+		return nil, fmt.Errorf("error parsing retention rules %s: %w", path, err)
+	}
+	return retention, nil
+}
+
+func (s *Store) SetRetention(retention Retention) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retention = retention
+}
+
+// Sweep removes every file and previous version expired at now.
+// When the current version expires the path is removed with its history.
+func (s *Store) Sweep(now time.Time) ([]Expired, error) {
+	s.mu.Lock()
+
+	var (
+		removed []Expired
+		garbage []string
+	)
+	for ns, namespace := range s.namespaces {
+		for filePath, file := range namespace.Files {
+			if expires, ok := s.expires(ns, filePath, file.version()); ok && !now.Before(expires) {
+				removed = append(removed, expired(ns, filePath, file.version(), expires))
+				garbage = append(garbage, file.Hash)
+				for _, version := range namespace.Versions[filePath] {
+					removed = append(removed, expired(ns, filePath, version, expires))
+					garbage = append(garbage, version.Hash)
+				}
+				delete(namespace.Files, filePath)
+				delete(namespace.Versions, filePath)
+				continue
+			}
+
+			var kept []Version
+			for _, version := range namespace.Versions[filePath] {
+				if expires, ok := s.expires(ns, filePath, version); ok && !now.Before(expires) {
+					removed = append(removed, expired(ns, filePath, version, expires))
+					garbage = append(garbage, version.Hash)
+					continue
+				}
+				kept = append(kept, version)
+			}
+			if len(kept) != len(namespace.Versions[filePath]) {
+				if len(kept) == 0 {
+					delete(namespace.Versions, filePath)
+				} else {
+					namespace.Versions[filePath] = kept
+				}
+			}
+		}
+	}
+
+	var err error
+	if len(removed) > 0 {
+		err = s.save()
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+	s.gc(garbage...)
+
+	sort.Slice(removed, func(i, j int) bool {
+		if removed[i].Namespace != removed[j].Namespace {
+			return removed[i].Namespace < removed[j].Namespace
+		}
+		if removed[i].Path != removed[j].Path {
+			return removed[i].Path < removed[j].Path
+		}
+		return removed[i].Version > removed[j].Version
+	})
+	return removed, nil
+}
+
+// RunSweeper calls Sweep every interval until ctx is done,
+// report gets what was removed (and errors) after every run.
+// A non-positive interval disables the sweeper, it returns at once.
+func (s *Store) RunSweeper(ctx context.Context, interval time.Duration, report func([]Expired, error)) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		removed, err := s.Sweep(time.Now())
+		if report != nil && (err != nil || len(removed) > 0) {
+			report(removed, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// expires - when the version at filePath expires, must be called with mu locked
+func (s *Store) expires(ns, filePath string, version Version) (time.Time, bool) {
+	if !version.Expires.IsZero() {
+		return version.Expires, true
+	}
+
+	var (
+		match  *Rule
+		prefix = -1
+	)
+	for i, rule := range s.retention[ns] {
+		if !underPrefix(filePath, rule.Prefix) || len(rule.Prefix) <= prefix {
+			continue
+		}
+		match, prefix = &s.retention[ns][i], len(rule.Prefix)
+	}
+	if match == nil || match.MaxAge <= 0 {
+		return time.Time{}, false
+	}
+	return version.Modified.Add(time.Duration(match.MaxAge)), true
+}
+
+func expired(ns, filePath string, version Version, expires time.Time) Expired {
+	if !version.Expires.IsZero() {
+		expires = version.Expires
+	}
+	return Expired{
+		Namespace: ns,
+		Path:      filePath,
+		Version:   version.ID,
+		Size:      version.Size,
+		Expires:   expires,
+	}
+}
+
+func underPrefix(filePath, prefix string) bool {
+	prefix = strings.Trim(prefix, "/")
+	return prefix == "" || filePath == prefix || strings.HasPrefix(filePath, prefix+"/")
+}
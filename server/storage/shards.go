@@ -0,0 +1,352 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// shardBlobs - every blob is split into data+parity shards, one per
+// directory, <dir>/shards/<hash[:2]>/<hash>. Directories are meant to be
+// on different disks: a blob is read back while at most parity shards are
+// missing or corrupted.
+//
+// A shard file is a header and then one block per stripe: unit bytes of
+// the shard and CRC32C of them. A stripe is data*unit bytes of the blob,
+// the last one is padded with zeros.
+type shardBlobs struct {
+	dirs []string
+	rs   *reedSolomon
+	// legacy - blobs stored before sharding was turned on, still readable
+	legacy *dirBlobs
+}
+
+const (
+	shardMagic      = "ESHD"
+	shardHeaderSize = 24
+	// shardUnit - bytes of one shard in a stripe, smaller for small blobs
+	shardUnit = 64 * 1024
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type shardHeader struct {
+	data, parity, index int
+	unit                int
+	size                int64
+}
+
+func (h shardHeader) encode() []byte {
+	buf := make([]byte, shardHeaderSize)
+	copy(buf, shardMagic)
+	buf[4], buf[5], buf[6] = byte(h.data), byte(h.parity), byte(h.index)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(h.unit))
+	binary.LittleEndian.PutUint64(buf[12:], uint64(h.size))
+	binary.LittleEndian.PutUint32(buf[20:], crc32.Checksum(buf[:20], castagnoli))
+	return buf
+}
+
+func decodeShardHeader(buf []byte) (shardHeader, bool) {
+	if len(buf) != shardHeaderSize || string(buf[:4]) != shardMagic ||
+		binary.LittleEndian.Uint32(buf[20:]) != crc32.Checksum(buf[:20], castagnoli) {
+		return shardHeader{}, false
+	}
+	h := shardHeader{
+		data:   int(buf[4]),
+		parity: int(buf[5]),
+		index:  int(buf[6]),
+		unit:   int(binary.LittleEndian.Uint32(buf[8:])),
+		size:   int64(binary.LittleEndian.Uint64(buf[12:])),
+	}
+	return h, h.data > 0 && h.unit > 0 && h.size >= 0
+}
+
+func newShardBlobs(dirs []string, parity int, legacy *dirBlobs) (*shardBlobs, error) {
+	rs, err := newReedSolomon(len(dirs)-parity, parity)
+	if err != nil {
+		return nil, err
+	}
+	// two shards in one directory would overwrite each other on every put
+	dirs = slices.Clone(dirs)
+	infos := make([]os.FileInfo, len(dirs))
+	for i, dir := range dirs {
+		dirs[i] = filepath.Clean(dir)
+		for _, sub := range []string{"shards", "tmp"} {
+			if err := os.MkdirAll(filepath.Join(dirs[i], sub), 0o750); err != nil {
+				return nil, err
+			}
+		}
+		info, err := os.Stat(dirs[i])
+		if err != nil {
+			return nil, err
+		}
+		for j, seen := range infos[:i] {
+			if os.SameFile(seen, info) {
+				return nil, fmt.Errorf("shard directories %s and %s are the same", dirs[j], dirs[i])
+			}
+		}
+		infos[i] = info
+	}
+	return &shardBlobs{dirs: dirs, rs: rs, legacy: legacy}, nil
+}
+
+// put splits r into shards and returns its sha256 and size. Shards of
+// a blob that is already stored are written again, which repairs them.
+func (b *shardBlobs) put(r io.Reader) (string, int64, error) {
+	tmps := make([]*os.File, len(b.dirs))
+	defer func() {
+		for _, tmp := range tmps {
+			if tmp != nil {
+				_ = tmp.Close()
+				_ = os.Remove(tmp.Name())
+			}
+		}
+	}()
+	for i, dir := range b.dirs {
+		tmp, err := os.CreateTemp(filepath.Join(dir, "tmp"), "shard-*")
+		if err != nil {
+			return "", 0, err
+		}
+		tmps[i] = tmp
+		// the header is written when the size is known
+		if _, err := tmp.Write(make([]byte, shardHeaderSize)); err != nil {
+			return "", 0, err
+		}
+	}
+
+	hash := sha256.New()
+	r = io.TeeReader(r, hash)
+	stripe := make([]byte, b.rs.data*shardUnit)
+	n, err := io.ReadFull(r, stripe)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", 0, err
+	}
+	unit := shardUnit
+	if n < len(stripe) {
+		// everything fits one stripe, no need for full units
+		unit = max(1, (n+b.rs.data-1)/b.rs.data)
+	}
+
+	shards := make([][]byte, len(b.dirs))
+	for i := range shards {
+		shards[i] = make([]byte, unit)
+	}
+	block := make([]byte, unit+4)
+	var size int64
+	for n > 0 {
+		size += int64(n)
+		clear(stripe[n:])
+		for d := 0; d < b.rs.data; d++ {
+			copy(shards[d], stripe[d*unit:(d+1)*unit])
+		}
+		b.rs.encode(shards)
+		for i, shard := range shards {
+			copy(block, shard)
+			binary.LittleEndian.PutUint32(block[unit:], crc32.Checksum(shard, castagnoli))
+			if _, err := tmps[i].Write(block); err != nil {
+				return "", 0, err
+			}
+		}
+
+		n, err = io.ReadFull(r, stripe[:b.rs.data*unit])
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", 0, err
+		}
+	}
+
+	sum := fmt.Sprintf("%x", hash.Sum(nil))
+	for i, tmp := range tmps {
+		header := shardHeader{data: b.rs.data, parity: b.rs.parity, index: i, unit: unit, size: size}
+		if _, err := tmp.WriteAt(header.encode(), 0); err != nil {
+			return "", 0, err
+		}
+		if err := tmp.Sync(); err != nil {
+			return "", 0, err
+		}
+		if err := tmp.Close(); err != nil {
+			return "", 0, err
+		}
+	}
+	for i, tmp := range tmps {
+		path := b.path(i, sum)
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			return "", 0, err
+		}
+		if err := os.Rename(tmp.Name(), path); err != nil {
+			return "", 0, err
+		}
+		tmps[i] = nil
+	}
+	return sum, size, nil
+}
+
+func (b *shardBlobs) open(hash string) (blob, error) {
+	if !validHash(hash) {
+		return nil, fmt.Errorf("blob %q: %w", hash, ErrNotFound)
+	}
+
+	files := make([]*os.File, len(b.dirs))
+	var header shardHeader
+	found := false
+	for i := range b.dirs {
+		file, err := os.Open(b.path(i, hash))
+		if err != nil {
+			continue
+		}
+		buf := make([]byte, shardHeaderSize)
+		h, ok := shardHeader{}, false
+		if _, err := io.ReadFull(file, buf); err == nil {
+			h, ok = decodeShardHeader(buf)
+		}
+		// a shard of another layout (or a broken header) is as good as missing
+		if !ok || h.index != i || (found && h != withIndex(header, i)) {
+			_ = file.Close()
+			continue
+		}
+		if !found {
+			header, found = h, true
+		}
+		files[i] = file
+	}
+
+	if !found {
+		if b.legacy != nil {
+			return b.legacy.open(hash)
+		}
+		return nil, fmt.Errorf("blob %s: %w", hash, ErrNotFound)
+	}
+	if header.data != b.rs.data || header.parity != b.rs.parity {
+		// written with other settings, decode with those
+		rs, err := newReedSolomon(header.data, header.parity)
+		if err != nil || header.data+header.parity != len(b.dirs) {
+			closeShards(files)
+			return nil, fmt.Errorf("blob %s: shards of %d+%d don't fit %d directories", hash, header.data, header.parity, len(b.dirs))
+		}
+		return &shardReader{hash: hash, files: files, header: header, rs: rs, stripe: -1}, nil
+	}
+	return &shardReader{hash: hash, files: files, header: header, rs: b.rs, stripe: -1}, nil
+}
+
+func withIndex(h shardHeader, index int) shardHeader {
+	h.index = index
+	return h
+}
+
+func (b *shardBlobs) remove(hash string) error {
+	var failed []error
+	for i := range b.dirs {
+		if err := os.Remove(b.path(i, hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			failed = append(failed, err)
+		}
+	}
+	if b.legacy != nil {
+		failed = append(failed, b.legacy.remove(hash))
+	}
+	return errors.Join(failed...)
+}
+
+func (b *shardBlobs) path(index int, hash string) string {
+	return filepath.Join(b.dirs[index], "shards", hash[:2], hash)
+}
+
+func closeShards(files []*os.File) {
+	for _, file := range files {
+		if file != nil {
+			_ = file.Close()
+		}
+	}
+}
+
+// shardReader decodes a blob stripe by stripe, missing and corrupted
+// shards are rebuilt from parity
+type shardReader struct {
+	hash   string
+	files  []*os.File
+	header shardHeader
+	rs     *reedSolomon
+	pos    int64
+
+	mu     sync.Mutex
+	stripe int64
+	data   []byte
+}
+
+func (r *shardReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *shardReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	stripeSize := int64(r.header.data * r.header.unit)
+	read := 0
+	for read < len(p) && off < r.header.size {
+		data, err := r.decode(off / stripeSize)
+		if err != nil {
+			return read, err
+		}
+		n := copy(p[read:], data[off%stripeSize:min(stripeSize, r.header.size-off/stripeSize*stripeSize)])
+		read += n
+		off += int64(n)
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// decode returns data of stripe n, the last decoded stripe is kept
+func (r *shardReader) decode(n int64) ([]byte, error) {
+	if r.stripe == n {
+		return r.data, nil
+	}
+
+	unit := r.header.unit
+	shards := make([][]byte, len(r.files))
+	for i, file := range r.files {
+		if file == nil {
+			continue
+		}
+		block := make([]byte, unit+4)
+		if _, err := file.ReadAt(block, shardHeaderSize+n*int64(unit+4)); err != nil {
+			continue
+		}
+		if crc32.Checksum(block[:unit], castagnoli) != binary.LittleEndian.Uint32(block[unit:]) {
+			continue
+		}
+		shards[i] = block[:unit]
+	}
+	if err := r.rs.reconstruct(shards, unit); err != nil {
+		return nil, fmt.Errorf("blob %s stripe %d: %w", r.hash, n, err)
+	}
+
+	if r.data == nil {
+		r.data = make([]byte, r.header.data*unit)
+	}
+	for d := 0; d < r.header.data; d++ {
+		copy(r.data[d*unit:], shards[d])
+	}
+	r.stripe = n
+	return r.data, nil
+}
+
+func (r *shardReader) Close() error {
+	closeShards(r.files)
+	return nil
+}
@@ -0,0 +1,547 @@
+package storage
+
+import (
+	packet "EternalPacket"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound  = errors.New("file not found")
+	ErrForbidden = errors.New("permission denied")
+	ErrBadPath   = errors.New("invalid path")
+	ErrConflict  = errors.New("file was changed")
+)
+
+var namespacePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+const indexFile = "index.json"
+
+// File - current version of a stored path,
+// Mode has os.ModeDir for directories in List results
+type File struct {
+	Path     string      `json:"path"`
+	Hash     string      `json:"hash,omitempty"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	Modified time.Time   `json:"modified"`
+	Version  int         `json:"version,omitempty"`
+	Expires  time.Time   `json:"expires,omitempty"`
+}
+
+// MatchNone - IfMatch of a path that must not exist yet
+const MatchNone = "none"
+
+// PutOptions - optional attributes of an upload
+type PutOptions struct {
+	Mode os.FileMode
+	// TTL removes the file after this time, 0 - retention rules decide
+	TTL time.Duration
+	// IfMatch - hash the current version must have, MatchNone - there must
+	// be no file, otherwise ErrConflict. Empty - no condition.
+	IfMatch string
+}
+
+// Namespace - files of one user, their previous versions
+// and what the user shared with others
+type Namespace struct {
+	Files    map[string]*File     `json:"files"`
+	Versions map[string][]Version `json:"versions,omitempty"`
+	ACL      ACL                  `json:"acl,omitempty"`
+}
+
+// Store - server storage, every user owns the namespace named after
+// them and sees other namespaces only through their ACLs.
+// Contents live in blobs, the index (index.json) maps paths to hashes.
+type Store struct {
+	mu         sync.RWMutex
+	blobMu     sync.RWMutex // put (shared) vs gc (exclusive)
+	root       string
+	blobs      blobStore
+	tmp        string
+	namespaces map[string]*Namespace
+	quotas     Quotas
+	keep       int
+	retention  Retention
+}
+
+func Open(root string) (*Store, error) {
+	if err := os.MkdirAll(root, 0o750); err != nil {
+		return nil, err
+	}
+	blobs, err := newDirBlobs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Store{
+		root:       root,
+		blobs:      blobs,
+		tmp:        blobs.tmp,
+		namespaces: make(map[string]*Namespace),
+		keep:       DefaultKeepVersions,
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, indexFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.namespaces); err != nil {
+		return nil, fmt.Errorf("error parsing storage index: %w", err)
+	}
+	for _, namespace := range s.namespaces {
+		if namespace.Files == nil {
+			namespace.Files = make(map[string]*File)
+		}
+	}
+	return s, nil
+}
+
+// TempDir - place for uploads that are not complete yet,
+// on the same file system as the blobs
+func (s *Store) TempDir() string {
+	return s.tmp
+}
+
+// SetShards stores new blobs as data+parity Reed-Solomon shards, one per
+// directory (len(dirs)-parity data shards). Blobs are read back while at
+// most parity directories are lost or their shards corrupted. Blobs
+// stored before are still read from the storage directory.
+func (s *Store) SetShards(dirs []string, parity int) error {
+	legacy, ok := s.blobs.(*dirBlobs)
+	if !ok {
+		return errors.New("shards are already set")
+	}
+	blobs, err := newShardBlobs(dirs, parity, legacy)
+	if err != nil {
+		return err
+	}
+	s.blobMu.Lock()
+	s.blobs = blobs
+	s.blobMu.Unlock()
+	return nil
+}
+
+// Put stores r as filePath in namespace ns on behalf of user
+func (s *Store) Put(user, ns, filePath string, r io.Reader, opts PutOptions) (*File, error) {
+	filePath, err := s.check(user, ns, filePath, PermWrite)
+	if err != nil {
+		return nil, err
+	}
+
+	file, garbage, err := s.put(user, ns, filePath, r, opts)
+	s.gc(garbage...)
+	return file, err
+}
+
+// put returns hashes of blobs that may be unused after the call
+func (s *Store) put(user, ns, filePath string, r io.Reader, opts PutOptions) (*File, []string, error) {
+	// blob can't be collected before the index refers to it
+	s.blobMu.RLock()
+	defer s.blobMu.RUnlock()
+
+	hash, size, err := s.blobs.put(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// permissions could be revoked and other uploads could take
+	// the quota while the data was written
+	if !s.allowed(user, ns, filePath, PermWrite) {
+		return nil, []string{hash}, fmt.Errorf("%w: write %s/%s", ErrForbidden, ns, filePath)
+	}
+	if err := s.checkQuota(ns, filePath, size); err != nil {
+		return nil, []string{hash}, err
+	}
+	if err := s.match(ns, filePath, opts.IfMatch); err != nil {
+		return nil, []string{hash}, err
+	}
+
+	file := &File{
+		Path:     filePath,
+		Hash:     hash,
+		Size:     size,
+		Mode:     opts.Mode.Perm(),
+		Modified: time.Now().UTC(),
+	}
+	if opts.TTL > 0 {
+		file.Expires = file.Modified.Add(opts.TTL)
+	}
+	garbage := s.namespace(ns).replace(file, s.keep)
+
+	if err := s.save(); err != nil {
+		return nil, nil, err
+	}
+
+	copied := *file
+	return &copied, garbage, nil
+}
+
+// Open returns the file info and its contents
+func (s *Store) Open(user, ns, filePath string) (*File, io.ReadCloser, error) {
+	return s.OpenVersion(user, ns, filePath, 0)
+}
+
+func (s *Store) Stat(user, ns, filePath string) (*File, error) {
+	filePath, err := s.check(user, ns, filePath, PermRead)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file := s.namespaces[ns].lookup(filePath)
+	if file == nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotFound, ns, filePath)
+	}
+	copied := *file
+	return &copied, nil
+}
+
+// List returns files and subdirectories directly under dir that user can read
+func (s *Store) List(user, ns, dir string) ([]File, error) {
+	dir, err := cleanPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !namespacePattern.MatchString(ns) {
+		return nil, fmt.Errorf("%w: namespace %q", ErrBadPath, ns)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	namespace := s.namespaces[ns]
+	if namespace == nil {
+		if user == ns {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ns)
+	}
+
+	prefix := dir
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	dirs := make(map[string]*File)
+	var list []File
+	for filePath, file := range namespace.Files {
+		rest, ok := strings.CutPrefix(filePath, prefix)
+		if !ok || !s.allowed(user, ns, filePath, PermRead) {
+			continue
+		}
+
+		name, _, nested := strings.Cut(rest, "/")
+		if !nested {
+			list = append(list, *file)
+			continue
+		}
+
+		// directories are implicit, size and time are taken from their contents
+		sub := dirs[name]
+		if sub == nil {
+			sub = &File{Path: prefix + name, Mode: os.ModeDir | 0o755}
+			dirs[name] = sub
+		}
+		sub.Size += file.Size
+		if file.Modified.After(sub.Modified) {
+			sub.Modified = file.Modified
+		}
+	}
+	for _, sub := range dirs {
+		list = append(list, *sub)
+	}
+
+	if len(list) == 0 && dir != "" {
+		if !s.allowed(user, ns, dir, PermRead) {
+			return nil, fmt.Errorf("%w: list %s/%s", ErrForbidden, ns, dir)
+		}
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotFound, ns, dir)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list, nil
+}
+
+// Walk returns all files in ns that user can read and whose path starts
+// with prefix (not necessarily at a directory boundary), sorted by path
+func (s *Store) Walk(user, ns, prefix string) ([]File, error) {
+	if !namespacePattern.MatchString(ns) {
+		return nil, fmt.Errorf("%w: namespace %q", ErrBadPath, ns)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	namespace := s.namespaces[ns]
+	if namespace == nil {
+		if user == ns {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, ns)
+	}
+
+	var list []File
+	for filePath, file := range namespace.Files {
+		if strings.HasPrefix(filePath, prefix) && s.allowed(user, ns, filePath, PermRead) {
+			list = append(list, *file)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list, nil
+}
+
+// Namespaces - the own namespace of user and those shared with them, sorted
+func (s *Store) Namespaces(user string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	names := []string{user}
+	for ns, namespace := range s.namespaces {
+		if ns == user {
+			continue
+		}
+		for _, users := range namespace.ACL {
+			if users[user] != PermNone {
+				names = append(names, ns)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Delete removes filePath together with its previous versions
+func (s *Store) Delete(user, ns, filePath string) error {
+	return s.DeleteIf(user, ns, filePath, "")
+}
+
+// DeleteIf - Delete only if the current version has hash ifMatch
+// (see PutOptions.IfMatch), empty - no condition
+func (s *Store) DeleteIf(user, ns, filePath, ifMatch string) error {
+	filePath, err := s.check(user, ns, filePath, PermDelete)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	file := s.namespaces[ns].lookup(filePath)
+	if file == nil {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: %s/%s", ErrNotFound, ns, filePath)
+	}
+	if err := s.match(ns, filePath, ifMatch); err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	garbage := []string{file.Hash}
+	for _, version := range s.namespaces[ns].Versions[filePath] {
+		garbage = append(garbage, version.Hash)
+	}
+	delete(s.namespaces[ns].Files, filePath)
+	delete(s.namespaces[ns].Versions, filePath)
+	err = s.save()
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	s.gc(garbage...)
+	return nil
+}
+
+// Share grants grantee perm on filePath (file or directory, "" - whole
+// namespace), PermNone revokes. Only the owner or users with PermShare
+// may share, and nobody can grant more than they have. Users with
+// PermShare only add to a grant, lowering or revoking it is up to the
+// owner.
+func (s *Store) Share(user, ns, filePath, grantee string, perm Perm) error {
+	filePath, err := cleanPath(filePath)
+	if err != nil {
+		return err
+	}
+	if !namespacePattern.MatchString(ns) || !namespacePattern.MatchString(grantee) {
+		return fmt.Errorf("%w: bad namespace or user name", ErrBadPath)
+	}
+	if grantee == ns {
+		return fmt.Errorf("%w: owner always has full access", ErrBadPath)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	own := s.perm(user, ns, filePath)
+	if own&PermShare == 0 {
+		return fmt.Errorf("%w: share %s/%s", ErrForbidden, ns, filePath)
+	}
+
+	namespace := s.namespace(ns)
+	if namespace.ACL == nil {
+		namespace.ACL = make(ACL)
+	}
+	if user != ns {
+		granted := namespace.ACL[filePath][grantee]
+		if perm&granted != granted {
+			return fmt.Errorf("%w: only the owner can lower the grant of %s on %s/%s", ErrForbidden, grantee, ns, filePath)
+		}
+		own |= granted
+	}
+	namespace.ACL.set(grantee, filePath, perm&own)
+
+	return s.save()
+}
+
+// ACL returns entries of namespace ns, only for its owner
+func (s *Store) ACL(user, ns string) (ACL, error) {
+	if user != ns {
+		return nil, fmt.Errorf("%w: acl of %s", ErrForbidden, ns)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	acl := make(ACL)
+	if namespace := s.namespaces[ns]; namespace != nil {
+		for filePath, users := range namespace.ACL {
+			for grantee, perm := range users {
+				acl.set(grantee, filePath, perm)
+			}
+		}
+	}
+	return acl, nil
+}
+
+// check validates names and permissions before any data is touched
+func (s *Store) check(user, ns, filePath string, perm Perm) (string, error) {
+	filePath, err := cleanPath(filePath)
+	if err != nil {
+		return "", err
+	}
+	if filePath == "" {
+		return "", fmt.Errorf("%w: empty file path", ErrBadPath)
+	}
+	if !namespacePattern.MatchString(ns) {
+		return "", fmt.Errorf("%w: namespace %q", ErrBadPath, ns)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.allowed(user, ns, filePath, perm) {
+		return "", fmt.Errorf("%w: %s %s/%s", ErrForbidden, perm, ns, filePath)
+	}
+	return filePath, nil
+}
+
+// match checks the IfMatch condition, must be called with mu locked
+func (s *Store) match(ns, filePath, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	file := s.namespaces[ns].lookup(filePath)
+	switch {
+	case file == nil && ifMatch == MatchNone:
+		return nil
+	case file == nil:
+		return fmt.Errorf("%w: %s/%s was deleted", ErrConflict, ns, filePath)
+	case file.Hash != ifMatch:
+		return fmt.Errorf("%w: %s/%s is at version %d", ErrConflict, ns, filePath, file.Version)
+	}
+	return nil
+}
+
+func (s *Store) allowed(user, ns, filePath string, perm Perm) bool {
+	return s.perm(user, ns, filePath)&perm == perm
+}
+
+func (s *Store) perm(user, ns, filePath string) Perm {
+	if user == ns {
+		return PermAll
+	}
+	namespace := s.namespaces[ns]
+	if namespace == nil {
+		return PermNone
+	}
+	return namespace.ACL.perm(user, filePath)
+}
+
+// namespace returns ns, creating it if needed, must be called with mu locked
+func (s *Store) namespace(ns string) *Namespace {
+	namespace := s.namespaces[ns]
+	if namespace == nil {
+		namespace = &Namespace{Files: make(map[string]*File)}
+		s.namespaces[ns] = namespace
+	}
+	return namespace
+}
+
+// gc removes blobs nothing refers to anymore
+func (s *Store) gc(hashes ...string) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	unused := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		unused[hash] = true
+	}
+	for _, namespace := range s.namespaces {
+		for _, file := range namespace.Files {
+			delete(unused, file.Hash)
+		}
+		for _, versions := range namespace.Versions {
+			for _, version := range versions {
+				delete(unused, version.Hash)
+			}
+		}
+	}
+	for hash := range unused {
+		_ = s.blobs.remove(hash)
+	}
+}
+
+// save writes the index, must be called with mu locked
+func (s *Store) save() error {
+	data, err := json.Marshal(s.namespaces)
+	if err != nil {
+		return err
+	}
+	return packet.WriteFileAtomic(filepath.Join(s.root, indexFile), data, 0o600)
+}
+
+func (n *Namespace) lookup(filePath string) *File {
+	if n == nil {
+		return nil
+	}
+	return n.Files[filePath]
+}
+
+// cleanPath - slash separated path relative to the namespace root,
+// ".." can't go above it
+func cleanPath(filePath string) (string, error) {
+	if strings.ContainsRune(filePath, 0) {
+		return "", fmt.Errorf("%w: %q", ErrBadPath, filePath)
+	}
+	filePath = strings.ReplaceAll(filePath, "\\", "/")
+	return strings.TrimPrefix(path.Clean("/"+filePath), "/"), nil
+}
@@ -0,0 +1,356 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func put(t *testing.T, s *Store, user, ns, path, data string) *File {
+	t.Helper()
+	file, err := s.Put(user, ns, path, strings.NewReader(data), PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+	return file
+}
+
+func read(t *testing.T, s *Store, user, ns, path string) string {
+	t.Helper()
+	_, r, err := s.Open(user, ns, path)
+	require.NoError(t, err)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// Кожен користувач бачить тільки свій простір імен
+func TestStoreNamespaces(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	put(t, s, "alice", "alice", "docs/a.txt", "alice data")
+	put(t, s, "bob", "bob", "docs/a.txt", "bob data")
+
+	assert.Equal(t, "alice data", read(t, s, "alice", "alice", "docs/a.txt"))
+	assert.Equal(t, "bob data", read(t, s, "bob", "bob", "/docs/../docs/a.txt"))
+
+	_, _, err = s.Open("bob", "alice", "docs/a.txt")
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = s.Put("bob", "alice", "x.txt", strings.NewReader("x"), PutOptions{Mode: 0o644})
+	assert.ErrorIs(t, err, ErrForbidden)
+	_, err = s.List("bob", "alice", "docs")
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.ErrorIs(t, s.Delete("bob", "alice", "docs/a.txt"), ErrForbidden)
+
+	// шлях не може вийти за межі простору імен
+	put(t, s, "alice", "alice", "../../bob/docs/a.txt", "escape")
+	assert.Equal(t, "bob data", read(t, s, "bob", "bob", "docs/a.txt"))
+	assert.Equal(t, "escape", read(t, s, "alice", "alice", "bob/docs/a.txt"))
+}
+
+func TestStoreShare(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	require.NoError(t, err)
+
+	put(t, s, "alice", "alice", "shared/a.txt", "a")
+	put(t, s, "alice", "alice", "shared/sub/b.txt", "b")
+	put(t, s, "alice", "alice", "private.txt", "p")
+
+	require.NoError(t, s.Share("alice", "alice", "shared", "bob", PermRead|PermWrite))
+
+	// Bob не може роздати далі без права share
+	assert.ErrorIs(t, s.Share("bob", "alice", "shared", "carol", PermRead), ErrForbidden)
+
+	assert.Equal(t, "b", read(t, s, "bob", "alice", "shared/sub/b.txt"))
+	put(t, s, "bob", "alice", "shared/c.txt", "c")
+	assert.ErrorIs(t, s.Delete("bob", "alice", "shared/c.txt"), ErrForbidden)
+	_, err = s.Stat("bob", "alice", "private.txt")
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	// в корені Bob бачить тільки спільну директорію
+	list, err := s.List("bob", "alice", "")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "shared", list[0].Path)
+	assert.True(t, list[0].Mode.IsDir())
+
+	list, err = s.List("bob", "alice", "shared")
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	assert.Equal(t, "shared/a.txt", list[0].Path)
+	assert.Equal(t, "shared/c.txt", list[1].Path)
+	assert.Equal(t, "shared/sub", list[2].Path)
+
+	// рекурсивно за префіксом, як ListObjectsV2
+	list, err = s.Walk("bob", "alice", "sh")
+	require.NoError(t, err)
+	require.Len(t, list, 3)
+	assert.Equal(t, "shared/sub/b.txt", list[2].Path)
+	list, err = s.Walk("bob", "alice", "")
+	require.NoError(t, err)
+	assert.Len(t, list, 3)
+	assert.Equal(t, []string{"alice", "bob"}, s.Namespaces("bob"))
+	assert.Equal(t, []string{"carol"}, s.Namespaces("carol"))
+
+	// ACL зберігаються між перезапусками
+	s, err = Open(dir)
+	require.NoError(t, err)
+	assert.Equal(t, "a", read(t, s, "bob", "alice", "shared/a.txt"))
+
+	require.NoError(t, s.Share("alice", "alice", "shared", "bob", PermNone))
+	_, err = s.Stat("bob", "alice", "shared/a.txt")
+	assert.ErrorIs(t, err, ErrForbidden)
+
+}
+
+// Користувач з правом share тільки додає права, знижувати їх може лише власник
+func TestStoreShareByGrantee(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	put(t, s, "alice", "alice", "shared/a.txt", "a")
+	require.NoError(t, s.Share("alice", "alice", "shared", "bob", PermRead|PermShare))
+	require.NoError(t, s.Share("alice", "alice", "shared", "carol", PermRead|PermWrite))
+
+	// більше, ніж має сам, Bob не роздає
+	require.NoError(t, s.Share("bob", "alice", "shared", "dave", PermAll))
+	acl, err := s.ACL("alice", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, PermRead|PermShare, acl["shared"]["dave"])
+
+	// чужий дозвіл не знижується і не відкликається
+	assert.ErrorIs(t, s.Share("bob", "alice", "shared", "carol", PermRead), ErrForbidden)
+	assert.ErrorIs(t, s.Share("bob", "alice", "shared", "carol", PermNone), ErrForbidden)
+	// додати можна, у межах своїх прав
+	require.NoError(t, s.Share("bob", "alice", "shared", "carol", PermRead|PermWrite|PermShare))
+	acl, err = s.ACL("alice", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, PermRead|PermWrite|PermShare, acl["shared"]["carol"])
+
+	// власник знижує будь-який дозвіл
+	require.NoError(t, s.Share("alice", "alice", "shared", "carol", PermRead))
+	require.NoError(t, s.Share("alice", "alice", "shared", "dave", PermNone))
+	acl, err = s.ACL("alice", "alice")
+	require.NoError(t, err)
+	assert.Equal(t, PermRead, acl["shared"]["carol"])
+	assert.NotContains(t, acl["shared"], "dave")
+}
+
+func TestStoreDeleteCollectsBlobs(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	a := put(t, s, "alice", "alice", "a.txt", "same")
+	put(t, s, "alice", "alice", "b.txt", "same")
+
+	require.NoError(t, s.Delete("alice", "alice", "a.txt"))
+	assert.Equal(t, "same", read(t, s, "alice", "alice", "b.txt"))
+
+	require.NoError(t, s.Delete("alice", "alice", "b.txt"))
+	_, err = s.blobs.open(a.Hash)
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestStoreQuotas(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	s.SetQuotas(Quotas{
+		Default: Quota{Bytes: 10, Files: 2},
+		Users:   map[string]Quota{"bob": {Bytes: 100}},
+		Total:   Quota{Bytes: 30},
+	})
+
+	put(t, s, "alice", "alice", "a.txt", "12345")
+	assert.ErrorIs(t, s.CheckPut("alice", "alice", "b.txt", 6), ErrQuotaExceeded)
+	assert.NoError(t, s.CheckPut("alice", "alice", "b.txt", 5))
+
+	// попередня версія лишається в історії, тому заміна потребує місця під весь файл
+	assert.ErrorIs(t, s.CheckPut("alice", "alice", "a.txt", 10), ErrQuotaExceeded)
+	assert.NoError(t, s.CheckPut("alice", "alice", "a.txt", 5))
+
+	put(t, s, "alice", "alice", "b.txt", "1")
+	assert.ErrorIs(t, s.CheckPut("alice", "alice", "c.txt", 1), ErrQuotaExceeded)
+
+	// перевірка повторюється при збереженні, розмір з метаданих може брехати
+	_, err = s.Put("alice", "alice", "b.txt", strings.NewReader("12345678901"), PutOptions{Mode: 0o644})
+	assert.ErrorIs(t, err, ErrQuotaExceeded)
+
+	// у bob власна квота, але загальна спільна для всіх
+	put(t, s, "bob", "bob", "big.txt", strings.Repeat("x", 20))
+	assert.ErrorIs(t, s.CheckPut("bob", "bob", "more.txt", 5), ErrQuotaExceeded)
+	assert.Equal(t, Usage{Bytes: 26, Files: 3}, s.Usage(""))
+}
+
+func TestStoreVersions(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	s.SetKeepVersions(2)
+
+	put(t, s, "alice", "alice", "a.txt", "v1")
+	put(t, s, "alice", "alice", "a.txt", "v2")
+	put(t, s, "alice", "alice", "a.txt", "v2") // той самий вміст - не нова версія
+	file := put(t, s, "alice", "alice", "a.txt", "v3")
+	assert.Equal(t, 3, file.Version)
+
+	versions, err := s.Versions("alice", "alice", "a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, []int{3, 2, 1}, []int{versions[0].ID, versions[1].ID, versions[2].ID})
+	assert.True(t, versions[0].Current)
+
+	_, r, err := s.OpenVersion("alice", "alice", "a.txt", 1)
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, "v1", string(data))
+
+	// відновлена версія стає поточною з новим номером
+	file, err = s.Restore("alice", "alice", "a.txt", 1)
+	require.NoError(t, err)
+	assert.Equal(t, 4, file.Version)
+	assert.Equal(t, "v1", read(t, s, "alice", "alice", "a.txt"))
+
+	// зберігаються тільки 2 попередні версії
+	versions, err = s.Versions("alice", "alice", "a.txt")
+	require.NoError(t, err)
+	require.Len(t, versions, 3)
+	assert.Equal(t, []int{4, 3, 2}, []int{versions[0].ID, versions[1].ID, versions[2].ID})
+	_, _, err = s.OpenVersion("alice", "alice", "a.txt", 1)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	// без права запису відновити не можна
+	require.NoError(t, s.Share("alice", "alice", "", "bob", PermRead))
+	_, err = s.Versions("bob", "alice", "a.txt")
+	assert.NoError(t, err)
+	_, err = s.Restore("bob", "alice", "a.txt", 2)
+	assert.ErrorIs(t, err, ErrForbidden)
+
+	require.NoError(t, s.Delete("alice", "alice", "a.txt"))
+	assert.Equal(t, Usage{}, s.Usage("alice"))
+}
+
+func TestStoreSweep(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+	s.SetRetention(Retention{
+		"ci": {
+			{Prefix: "builds", MaxAge: Duration(14 * 24 * time.Hour)},
+			{Prefix: "builds/release", MaxAge: 0},
+		},
+	})
+
+	put(t, s, "ci", "ci", "builds/1.tar", "old build")
+	put(t, s, "ci", "ci", "builds/release/1.0.tar", "release")
+	put(t, s, "ci", "ci", "notes.txt", "keep")
+	_, err = s.Put("ci", "ci", "tmp/log.txt", strings.NewReader("log"), PutOptions{TTL: time.Hour})
+	require.NoError(t, err)
+
+	removed, err := s.Sweep(time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	removed, err = s.Sweep(time.Now().Add(2 * time.Hour))
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "tmp/log.txt", removed[0].Path)
+
+	removed, err = s.Sweep(time.Now().Add(15 * 24 * time.Hour))
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, Expired{Namespace: "ci", Path: "builds/1.tar", Version: 1, Size: 9, Expires: removed[0].Expires}, removed[0])
+
+	list, err := s.List("ci", "ci", "")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "builds", list[0].Path)
+	assert.Equal(t, "notes.txt", list[1].Path)
+	assert.Equal(t, Usage{Bytes: 11, Files: 2}, s.Usage("ci"))
+
+	// нульовий інтервал вимикає прибирання, а не панікує
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.RunSweeper(context.Background(), 0, nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("RunSweeper with zero interval didn't return")
+	}
+}
+
+// Файл можна знайти за хешем, але тільки серед того, що користувач може читати
+func TestStoreOpenHash(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	v1 := put(t, s, "alice", "alice", "docs/a.txt", "first")
+	v2 := put(t, s, "alice", "alice", "docs/a.txt", "second")
+	put(t, s, "alice", "alice", "private/b.txt", "secret")
+
+	file, r, err := s.OpenHash("alice", "alice", v2.Hash)
+	require.NoError(t, err)
+	data, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "second", string(data))
+	assert.Equal(t, "docs/a.txt", file.Path)
+	assert.Equal(t, v2.Version, file.Version)
+
+	// старі версії теж
+	file, r, err = s.OpenHash("alice", "alice", v1.Hash)
+	require.NoError(t, err)
+	r.Close()
+	assert.Equal(t, v1.Version, file.Version)
+
+	// bob бачить тільки docs, чужий хеш виглядає як відсутній
+	require.NoError(t, s.Share("alice", "alice", "docs", "bob", PermRead))
+	_, r, err = s.OpenHash("bob", "alice", v2.Hash)
+	require.NoError(t, err)
+	r.Close()
+	secret := sha(t, "secret")
+	_, _, err = s.OpenHash("bob", "alice", secret)
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, _, err = s.OpenHash("alice", "alice", "../../index.json")
+	assert.ErrorIs(t, err, ErrBadPath)
+}
+
+func sha(t *testing.T, data string) string {
+	t.Helper()
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// Умовні зміни: файл змінився після того, як клієнт його бачив - конфлікт
+func TestStoreIfMatch(t *testing.T) {
+	s, err := Open(t.TempDir())
+	require.NoError(t, err)
+
+	putIf := func(data, ifMatch string) (*File, error) {
+		return s.Put("alice", "alice", "a.txt", strings.NewReader(data), PutOptions{Mode: 0o644, IfMatch: ifMatch})
+	}
+
+	v1, err := putIf("one", MatchNone)
+	require.NoError(t, err)
+	_, err = putIf("again", MatchNone)
+	assert.ErrorIs(t, err, ErrConflict)
+
+	v2, err := putIf("two", v1.Hash)
+	require.NoError(t, err)
+	_, err = putIf("three", v1.Hash)
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Equal(t, "two", read(t, s, "alice", "alice", "a.txt"))
+
+	assert.ErrorIs(t, s.DeleteIf("alice", "alice", "a.txt", v1.Hash), ErrConflict)
+	require.NoError(t, s.DeleteIf("alice", "alice", "a.txt", v2.Hash))
+	_, err = putIf("four", v2.Hash)
+	assert.ErrorIs(t, err, ErrConflict)
+}
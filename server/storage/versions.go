@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultKeepVersions - previous versions kept for every path
+const DefaultKeepVersions = 10
+
+// Version - one revision of a path, IDs grow with every change
+// and the current version always has the largest one
+type Version struct {
+	ID       int         `json:"id"`
+	Hash     string      `json:"hash"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	Modified time.Time   `json:"modified"`
+	Expires  time.Time   `json:"expires,omitempty"`
+	Current  bool        `json:"current,omitempty"`
+}
+
+// SetKeepVersions - how many previous versions of a path are kept,
+// 0 turns history off (uploads overwrite), negative keeps everything
+func (s *Store) SetKeepVersions(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keep = n
+}
+
+// Versions returns all versions of filePath, newest (current) first
+func (s *Store) Versions(user, ns, filePath string) ([]Version, error) {
+	filePath, err := s.check(user, ns, filePath, PermRead)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file := s.namespaces[ns].lookup(filePath)
+	if file == nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotFound, ns, filePath)
+	}
+
+	current := file.version()
+	current.Current = true
+	versions := append([]Version{current}, s.namespaces[ns].Versions[filePath]...)
+	sort.SliceStable(versions[1:], func(i, j int) bool { return versions[1+i].ID > versions[1+j].ID })
+	return versions, nil
+}
+
+// OpenVersion - Open for any version listed by Versions, 0 - the current one.
+// Returned File describes that version.
+func (s *Store) OpenVersion(user, ns, filePath string, id int) (*File, io.ReadCloser, error) {
+	version, err := s.findVersion(user, ns, filePath, id, PermRead)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob, err := s.blobs.open(version.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &File{
+		Path:     version.path,
+		Hash:     version.Hash,
+		Size:     version.Size,
+		Mode:     version.Mode,
+		Modified: version.Modified,
+		Version:  version.ID,
+		Expires:  version.Expires,
+	}, blob, nil
+}
+
+// OpenHash - Open by content, the first file or version in ns with this
+// hash that user may read. Files user can't read are reported as not found,
+// so hashes don't tell what others stored.
+func (s *Store) OpenHash(user, ns, hash string) (*File, io.ReadCloser, error) {
+	if !validHash(hash) {
+		return nil, nil, fmt.Errorf("%w: hash %q", ErrBadPath, hash)
+	}
+	if !namespacePattern.MatchString(ns) {
+		return nil, nil, fmt.Errorf("%w: namespace %q", ErrBadPath, ns)
+	}
+
+	version := s.findHash(user, ns, hash)
+	if version == nil {
+		return nil, nil, fmt.Errorf("%w: %s/%s", ErrNotFound, ns, hash)
+	}
+	return s.OpenVersion(user, ns, version.path, version.ID)
+}
+
+func (s *Store) findHash(user, ns, hash string) *foundVersion {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := s.namespaces[ns]
+	if n == nil {
+		return nil
+	}
+	paths := make([]string, 0, len(n.Files))
+	for filePath := range n.Files {
+		paths = append(paths, filePath)
+	}
+	sort.Strings(paths)
+
+	// current files win over history
+	for _, filePath := range paths {
+		if file := n.Files[filePath]; file.Hash == hash && s.allowed(user, ns, filePath, PermRead) {
+			return &foundVersion{Version: file.version(), path: filePath}
+		}
+	}
+	for _, filePath := range paths {
+		if !s.allowed(user, ns, filePath, PermRead) {
+			continue
+		}
+		for _, version := range n.Versions[filePath] {
+			if version.Hash == hash {
+				return &foundVersion{Version: version, path: filePath}
+			}
+		}
+	}
+	return nil
+}
+
+// Restore makes version id current again, the replaced current version
+// is kept in history like after an upload
+func (s *Store) Restore(user, ns, filePath string, id int) (*File, error) {
+	version, err := s.findVersion(user, ns, filePath, id, PermWrite)
+	if err != nil {
+		return nil, err
+	}
+	if version.Current {
+		return s.Stat(user, ns, filePath)
+	}
+
+	s.blobMu.RLock()
+	s.mu.Lock()
+	file, garbage, err := s.restore(user, ns, version)
+	s.mu.Unlock()
+	s.blobMu.RUnlock()
+
+	s.gc(garbage...)
+	return file, err
+}
+
+// restore must be called with mu and blobMu locked
+func (s *Store) restore(user, ns string, version *foundVersion) (*File, []string, error) {
+	filePath := version.path
+	if !s.allowed(user, ns, filePath, PermWrite) {
+		return nil, nil, fmt.Errorf("%w: write %s/%s", ErrForbidden, ns, filePath)
+	}
+	if err := s.checkQuota(ns, filePath, version.Size); err != nil {
+		return nil, nil, err
+	}
+
+	file := &File{
+		Path:     filePath,
+		Hash:     version.Hash,
+		Size:     version.Size,
+		Mode:     version.Mode,
+		Modified: time.Now().UTC(),
+		Expires:  version.Expires,
+	}
+	garbage := s.namespace(ns).replace(file, s.keep)
+	if err := s.save(); err != nil {
+		return nil, nil, err
+	}
+
+	copied := *file
+	return &copied, garbage, nil
+}
+
+type foundVersion struct {
+	Version
+	path string
+}
+
+func (s *Store) findVersion(user, ns, filePath string, id int, perm Perm) (*foundVersion, error) {
+	filePath, err := s.check(user, ns, filePath, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file := s.namespaces[ns].lookup(filePath)
+	if file == nil {
+		return nil, fmt.Errorf("%w: %s/%s", ErrNotFound, ns, filePath)
+	}
+	if id == 0 || file.version().ID == id {
+		current := file.version()
+		current.Current = true
+		return &foundVersion{Version: current, path: filePath}, nil
+	}
+	for _, version := range s.namespaces[ns].Versions[filePath] {
+		if version.ID == id {
+			return &foundVersion{Version: version, path: filePath}, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s/%s version %d", ErrNotFound, ns, filePath, id)
+}
+
+// replace makes file current and moves the previous one to history.
+// Returns hashes of versions that were dropped.
+func (n *Namespace) replace(file *File, keep int) []string {
+	old := n.Files[file.Path]
+	n.Files[file.Path] = file
+
+	file.Version = 1
+	if old == nil {
+		return nil
+	}
+	if old.Hash == file.Hash {
+		// same content again is not a new version
+		file.Version = old.Version
+		return nil
+	}
+	file.Version = max(old.Version, 1) + 1
+
+	if keep == 0 {
+		return []string{old.Hash}
+	}
+	if n.Versions == nil {
+		n.Versions = make(map[string][]Version)
+	}
+	versions := append(n.Versions[file.Path], old.version())
+
+	var garbage []string
+	if keep > 0 && len(versions) > keep {
+		for _, version := range versions[:len(versions)-keep] {
+			garbage = append(garbage, version.Hash)
+		}
+		versions = append([]Version(nil), versions[len(versions)-keep:]...)
+	}
+	n.Versions[file.Path] = versions
+	return garbage
+}
+
+func (f *File) version() Version {
+	return Version{
+		ID:       max(f.Version, 1),
+		Hash:     f.Hash,
+		Size:     f.Size,
+		Mode:     f.Mode,
+		Modified: f.Modified,
+		Expires:  f.Expires,
+	}
+}
@@ -0,0 +1,153 @@
+package tcp
+
+import (
+	packet "EternalPacket"
+	"crypto/tls"
+	"eternalStorageServer/replica"
+	"eternalStorageServer/storage"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// time a client has for TLS + authentication
+const handshakeTimeout = 30 * time.Second
+
+var (
+	activeConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "eternal_active_connections",
+		Help: "Open client connections, authenticated or not.",
+	})
+	tlsHandshakeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "eternal_tls_handshake_failures_total",
+		Help: "TLS handshakes with clients that failed.",
+	})
+	authFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "eternal_auth_failures_total",
+		Help: "Clients that failed authentication after the TLS handshake.",
+	})
+)
+
+// Collectors - connection metrics of the listener
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{activeConnections, tlsHandshakeFailures, authFailures}
+}
+
+type ListenerTCP struct {
+	Addr      string
+	store     *storage.Store
+	creds     packet.CredentialStore
+	tlsConfig *tls.Config
+	logger    *log.Logger
+	// replicas - where uploads are copied to, nil - nowhere
+	replicas *replica.Replicator
+	// replicators - users (peer servers) allowed to REPLICATE
+	replicators map[string]bool
+	// limits of received uploads, Check is set per upload
+	limits packet.ReceiveOptions
+}
+
+func NewListenerTCP(addr string, store *storage.Store, creds packet.CredentialStore) (*ListenerTCP, error) {
+	return &ListenerTCP{
+		Addr:      addr,
+		store:     store,
+		creds:     creds,
+		tlsConfig: &tls.Config{},
+		logger:    log.New(os.Stdout, "[SERVER]: ", log.Ldate|log.Ltime),
+	}, nil
+}
+
+// SetCertificate - certificate presented to clients, without it Serve
+// loads server.crt and server.key or generates them
+func (l *ListenerTCP) SetCertificate(cert tls.Certificate) {
+	l.tlsConfig.Certificates = []tls.Certificate{cert}
+}
+
+// SetReplicator replicates every upload and restore with r
+func (l *ListenerTCP) SetReplicator(r *replica.Replicator) {
+	l.replicas = r
+}
+
+// SetReceiveLimits - limits of uploads and replicas, zero fields
+// keep the packet defaults
+func (l *ListenerTCP) SetReceiveLimits(opts packet.ReceiveOptions) {
+	opts.Check = nil
+	l.limits = opts
+}
+
+// AllowReplication lets users store replicas into any namespace
+func (l *ListenerTCP) AllowReplication(users ...string) {
+	l.replicators = make(map[string]bool, len(users))
+	for _, user := range users {
+		l.replicators[user] = true
+	}
+}
+
+func (l *ListenerTCP) Serve() error {
+	listener, err := net.Listen("tcp", l.Addr)
+	if err != nil {
+		return err
+	}
+	return l.ServeListener(listener)
+}
+
+// ServeListener - Serve on a listener that is already open, Addr is
+// ignored. TLS is added on top of it.
+func (l *ListenerTCP) ServeListener(inner net.Listener) error {
+	if len(l.tlsConfig.Certificates) == 0 {
+		l.SetCertificate(packet.LoadTLSCert())
+	}
+	listener := tls.NewListener(inner, l.tlsConfig)
+	defer listener.Close()
+	l.logger.Println("listening on", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go l.handleConn(conn)
+	}
+}
+
+func (l *ListenerTCP) handleConn(conn net.Conn) {
+	defer conn.Close()
+	activeConnections.Inc()
+	defer activeConnections.Dec()
+	remote := conn.RemoteAddr().String()
+
+	user, err := l.handshake(conn)
+	if err != nil {
+		l.logger.Println(remote, err)
+		return
+	}
+	l.logger.Println(remote, "authenticated as", user)
+
+	if err := l.serve(conn, user); err != nil {
+		l.logger.Println(remote, "session closed:", err)
+	}
+}
+
+// handshake - TLS and authentication, nothing else is read from
+// the connection until both succeeded
+func (l *ListenerTCP) handshake(conn net.Conn) (string, error) {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return "", err
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			tlsHandshakeFailures.Inc()
+			return "", fmt.Errorf("TLS handshake failed: %w", err)
+		}
+	}
+
+	user, err := packet.ServerAuth(conn, l.creds)
+	if err != nil {
+		authFailures.Inc()
+		return "", err
+	}
+	return user, conn.SetDeadline(time.Time{})
+}
@@ -0,0 +1,516 @@
+package tcp
+
+import (
+	packet "EternalPacket"
+	"encoding/json"
+	"errors"
+	"eternalStorageServer/replica"
+	"eternalStorageServer/storage"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// session - commands of one authenticated connection
+type session struct {
+	store    *storage.Store
+	replicas *replica.Replicator
+	conn     net.Conn
+	user     string
+	// replicator - user is a peer server
+	replicator bool
+	limits     packet.ReceiveOptions
+	// tree - Merkle tree of the content with hash treeHash, kept for the
+	// following RANGE requests of a download
+	tree     *packet.MerkleTree
+	treeHash string
+}
+
+// serve handles requests until the client disconnects,
+// returned error means the connection can't be used anymore
+func (l *ListenerTCP) serve(conn net.Conn, user string) error {
+	s := &session{store: l.store, replicas: l.replicas, conn: conn, user: user, replicator: l.replicators[user], limits: l.limits}
+
+	for {
+		req, err := packet.ReadRequest(conn)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := s.handle(req); err != nil {
+			return err
+		}
+		l.logger.Println(conn.RemoteAddr(), user, req.Op, req.Namespace, req.Path, req.Hash)
+	}
+}
+
+func (s *session) handle(req *packet.Request) error {
+	ns := req.Namespace
+	if ns == "" {
+		ns = s.user
+	}
+
+	switch req.Op {
+	case packet.OpPut:
+		return s.put(req, ns)
+	case packet.OpDelta:
+		return s.putDelta(req, ns)
+	case packet.OpGet:
+		return s.get(req, ns)
+	case packet.OpRange:
+		return s.getRange(req, ns)
+	case packet.OpList:
+		return s.list(req, ns)
+	case packet.OpStat:
+		file, err := s.store.Stat(s.user, ns, req.Path)
+		return s.respond(req, &packet.Response{File: fileInfo(file)}, err)
+	case packet.OpDelete:
+		return s.respond(req, &packet.Response{}, s.store.DeleteIf(s.user, ns, req.Path, req.IfMatch))
+	case packet.OpVersions:
+		return s.versions(req, ns)
+	case packet.OpRestore:
+		file, err := s.store.Restore(s.user, ns, req.Path, req.Version)
+		if err == nil {
+			err = s.replicate(ns, file)
+		}
+		return s.respond(req, &packet.Response{File: fileInfo(file)}, err)
+	case packet.OpReplicate:
+		return s.putReplica(req, ns)
+	case packet.OpShare:
+		perm, err := storage.ParsePerm(req.Perm)
+		if err == nil {
+			err = s.store.Share(s.user, ns, req.Path, req.User, perm)
+		}
+		return s.respond(req, &packet.Response{}, err)
+	default:
+		return s.respond(req, &packet.Response{
+			Status: packet.StatusNotImplemented,
+			Error:  "unknown operation " + req.Op,
+		}, nil)
+	}
+}
+
+// put - packet is decompressed into a temp file first and gets
+// into the namespace only when it was fully received
+func (s *session) put(req *packet.Request, ns string) error {
+	tmp, err := os.CreateTemp(s.store.TempDir(), "upload-*")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	var name string
+	tp, err := packet.ReceiveOverTCPWith(s.conn, tmp.Name(), s.receiveOptions(s.checkPut(req, ns, &name)))
+	if err != nil {
+		return s.receiveFailed(req, err)
+	}
+	return s.save(req, ns, name, tmp.Name(), tp.MetaData)
+}
+
+// putDelta - upload of a changed file as a delta against its current version
+func (s *session) putDelta(req *packet.Request, ns string) error {
+	file, data, err := s.store.OpenVersion(s.user, ns, req.Path, 0)
+	if err != nil {
+		return s.respond(req, &packet.Response{}, err)
+	}
+	defer data.Close()
+	if req.IfMatch != "" && req.IfMatch != file.Hash {
+		// don't make the client send a delta that can't be stored
+		return s.respond(req, &packet.Response{}, fmt.Errorf("%w: %s/%s is at version %d",
+			storage.ErrConflict, ns, file.Path, file.Version))
+	}
+	base, ok := data.(io.ReaderAt)
+	if !ok {
+		// client falls back to a full upload
+		return s.respond(req, &packet.Response{
+			Status: packet.StatusNotImplemented,
+			Error:  "delta isn't supported by this storage",
+		}, nil)
+	}
+
+	if err := s.respond(req, &packet.Response{File: fileInfo(file)}, nil); err != nil {
+		return err
+	}
+	blockSize := packet.DeltaBlockSize(file.Size)
+	if err := packet.WriteSignature(s.conn, io.NewSectionReader(base, 0, file.Size), blockSize); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.store.TempDir(), "delta-*")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	name := req.Path
+	meta, err := packet.ReceiveDeltaOverTCP(s.conn, tmp.Name(), base, file.Size, blockSize, s.receiveOptions(s.checkPut(req, ns, &name)))
+	if err != nil {
+		return s.receiveFailed(req, err)
+	}
+	return s.save(req, ns, name, tmp.Name(), meta)
+}
+
+// checkPut - MetaDataCheck of uploads, name gets the path the file is stored as
+func (s *session) checkPut(req *packet.Request, ns string, name *string) packet.MetaDataCheck {
+	return func(meta *packet.TCPPacketMetaData) error {
+		*name = req.Path
+		if *name == "" {
+			// without a path the sender's file name is stored in the root
+			if err := packet.CheckFileName(meta.FileName); err != nil {
+				return &packet.RejectError{Status: packet.StatusBadRequest, Code: packet.ErrorCode(err), Message: err.Error()}
+			}
+			*name = meta.FileName
+		}
+		err := s.store.CheckPut(s.user, ns, *name, meta.Size)
+		if err != nil {
+			return &packet.RejectError{Status: statusFor(err), Code: codeFor(err), Message: err.Error()}
+		}
+		return nil
+	}
+}
+
+// receiveOptions - limits of the server with check of one upload
+func (s *session) receiveOptions(check packet.MetaDataCheck) packet.ReceiveOptions {
+	opts := s.limits
+	opts.Check = check
+	return opts
+}
+
+// receiveFailed answers an upload that wasn't received
+func (s *session) receiveFailed(req *packet.Request, err error) error {
+	var reject *packet.RejectError
+	if errors.As(err, &reject) {
+		return s.respond(req, &packet.Response{Status: reject.Status, Code: reject.Code, Error: reject.Message}, nil)
+	}
+	// the rest of the upload may still be on the wire, the session
+	// can't go on after telling the client why
+	_ = s.respond(req, &packet.Response{Status: packet.StatusBadRequest, Code: codeFor(err), Error: err.Error()}, nil)
+	return err
+}
+
+// save moves a received upload into the namespace
+func (s *session) save(req *packet.Request, ns, name, tmpName string, meta *packet.TCPPacketMetaData) error {
+	data, err := os.Open(tmpName)
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	file, err := s.store.Put(s.user, ns, name, data, storage.PutOptions{
+		Mode:    meta.FileMode,
+		TTL:     time.Duration(meta.TTL) * time.Second,
+		IfMatch: req.IfMatch,
+	})
+	if err == nil {
+		err = s.replicate(ns, file)
+	}
+	return s.respond(req, &packet.Response{File: fileInfo(file)}, err)
+}
+
+// replicate copies a new current version to the peers, with synchronous
+// replication the client is answered only after enough peers confirmed
+func (s *session) replicate(ns string, file *storage.File) error {
+	if s.replicas == nil {
+		return nil
+	}
+	return s.replicas.Replicate(ns, file)
+}
+
+// putReplica - upload from a peer server, stored as the namespace owner
+// and not replicated further
+func (s *session) putReplica(req *packet.Request, ns string) error {
+	tmp, err := os.CreateTemp(s.store.TempDir(), "replica-*")
+	if err != nil {
+		return err
+	}
+	_ = tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	tp, err := packet.ReceiveOverTCPWith(s.conn, tmp.Name(), s.receiveOptions(func(meta *packet.TCPPacketMetaData) error {
+		if !s.replicator {
+			return &packet.RejectError{Status: packet.StatusForbidden, Message: s.user + " may not replicate"}
+		}
+		if err := s.store.CheckPut(ns, ns, req.Path, meta.Size); err != nil {
+			return &packet.RejectError{Status: statusFor(err), Code: codeFor(err), Message: err.Error()}
+		}
+		return nil
+	}))
+	if err != nil {
+		return s.receiveFailed(req, err)
+	}
+
+	data, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+	file, err := s.store.Put(ns, ns, req.Path, data, storage.PutOptions{
+		Mode: tp.MetaData.FileMode,
+		TTL:  time.Duration(tp.MetaData.TTL) * time.Second,
+	})
+	return s.respond(req, &packet.Response{File: fileInfo(file)}, err)
+}
+
+// open - file of GET or RANGE, by hash or by path and version
+func (s *session) open(req *packet.Request, ns string) (*storage.File, io.ReadCloser, error) {
+	if req.Hash != "" {
+		return s.store.OpenHash(s.user, ns, req.Hash)
+	}
+	return s.store.OpenVersion(s.user, ns, req.Path, req.Version)
+}
+
+// get sends a stored file, found by path (and version) or by hash
+func (s *session) get(req *packet.Request, ns string) error {
+	file, data, err := s.open(req, ns)
+	if err != nil {
+		return s.respond(req, &packet.Response{}, err)
+	}
+	defer data.Close()
+
+	tp, err := packet.NewTCPPacketFromReader(data, file.Path, file.Mode, req.CompressType)
+	if err != nil {
+		return s.respond(req, &packet.Response{}, err)
+	}
+
+	if err := s.respond(req, &packet.Response{File: fileInfo(file)}, nil); err != nil {
+		return err
+	}
+
+	err = tp.SendOverTCP(s.conn)
+	var reject *packet.RejectError
+	if errors.As(err, &reject) {
+		// client refused the packet, nothing else was sent
+		return nil
+	}
+	return err
+}
+
+// getRange - leaves of the file with their Merkle proofs, the tree is
+// built once for all ranges of the same content
+func (s *session) getRange(req *packet.Request, ns string) error {
+	file, data, err := s.open(req, ns)
+	if err != nil {
+		return s.respond(req, &packet.Response{}, err)
+	}
+	defer data.Close()
+	base, ok := data.(io.ReaderAt)
+	if !ok {
+		return s.respond(req, &packet.Response{
+			Status: packet.StatusNotImplemented,
+			Error:  "ranges aren't supported by this storage",
+		}, nil)
+	}
+	if req.Offset < 0 || req.Offset%packet.MerkleLeafSize != 0 || req.Offset > 0 && req.Offset >= file.Size {
+		return s.respond(req, &packet.Response{
+			Status: packet.StatusBadRequest,
+			Error:  fmt.Sprintf("range offset %d must be a multiple of %d below the size %d", req.Offset, packet.MerkleLeafSize, file.Size),
+		}, nil)
+	}
+
+	if s.tree == nil || s.treeHash != file.Hash {
+		tree, err := packet.BuildMerkleTree(io.NewSectionReader(base, 0, file.Size))
+		if err != nil {
+			return s.respond(req, &packet.Response{}, err)
+		}
+		s.tree, s.treeHash = tree, file.Hash
+	}
+	if req.Root != "" && req.Root != s.tree.Root() {
+		// the leaves the client has are of other content
+		return s.respond(req, &packet.Response{}, fmt.Errorf("%w: %s/%s has another merkle root now",
+			storage.ErrConflict, ns, file.Path))
+	}
+	length := req.Length
+	if length <= 0 || length > packet.MaxRangeLength {
+		length = packet.MaxRangeLength
+	}
+	// whole leaves, only the last one of the file can be shorter
+	length = max(packet.MerkleLeafSize, length-length%packet.MerkleLeafSize)
+	buf := make([]byte, min(length, file.Size-req.Offset))
+	if _, err := io.ReadFull(io.NewSectionReader(base, req.Offset, int64(len(buf))), buf); err != nil {
+		return s.respond(req, &packet.Response{}, err)
+	}
+	rng, err := s.tree.Range(req.Offset, buf)
+	if err != nil {
+		return s.respond(req, &packet.Response{}, err)
+	}
+	info := fileInfo(file)
+	info.MerkleRoot = s.tree.Root()
+	return s.respond(req, &packet.Response{File: info, Range: rng}, nil)
+}
+
+// list - entries sorted by path, a page starts after the path in Cursor
+func (s *session) list(req *packet.Request, ns string) error {
+	files, err := s.store.List(s.user, ns, req.Path)
+	if err != nil {
+		return s.respond(req, &packet.Response{}, err)
+	}
+	infos := fileInfos(files)
+	start := 0
+	if req.Cursor != "" {
+		start = sort.Search(len(infos), func(i int) bool { return infos[i].Path > req.Cursor })
+	}
+	resp := &packet.Response{}
+	resp.Files, resp.Next = page(infos[start:], req.Limit, func(info packet.FileInfo) string { return info.Path })
+	return s.respond(req, resp, nil)
+}
+
+// versions - newest first, a page starts below the version in Cursor
+func (s *session) versions(req *packet.Request, ns string) error {
+	versions, err := s.store.Versions(s.user, ns, req.Path)
+	if err != nil {
+		return s.respond(req, &packet.Response{}, err)
+	}
+	infos := versionInfos(req.Path, versions)
+	start := 0
+	if req.Cursor != "" {
+		below, err := strconv.Atoi(req.Cursor)
+		if err != nil {
+			return s.respond(req, &packet.Response{
+				Status: packet.StatusBadRequest,
+				Error:  fmt.Sprintf("bad VERSIONS cursor %q", req.Cursor),
+			}, nil)
+		}
+		for start < len(infos) && infos[start].Version >= below {
+			start++
+		}
+	}
+	resp := &packet.Response{}
+	resp.Files, resp.Next = page(infos[start:], req.Limit, func(info packet.FileInfo) string { return strconv.Itoa(info.Version) })
+	return s.respond(req, resp, nil)
+}
+
+// page cuts the first page out of files: up to limit entries (0 - all of
+// them) and packet.PageBytes of JSON. next is the cursor of the last
+// entry, empty if nothing is left.
+func page(files []packet.FileInfo, limit int, cursor func(packet.FileInfo) string) ([]packet.FileInfo, string) {
+	if limit <= 0 {
+		return files, ""
+	}
+	limit = min(limit, packet.MaxPage)
+	size := 0
+	for i := range files {
+		if i == limit {
+			return files[:i], cursor(files[i-1])
+		}
+		data, err := json.Marshal(files[i])
+		if err != nil {
+			continue
+		}
+		size += len(data) + 1
+		if i > 0 && size > packet.PageBytes {
+			return files[:i], cursor(files[i-1])
+		}
+	}
+	return files, ""
+}
+
+// respond sends resp for req, status and message are taken from err
+func (s *session) respond(req *packet.Request, resp *packet.Response, err error) error {
+	resp.ID = req.ID
+	if err != nil {
+		resp.Status = statusFor(err)
+		resp.Code = codeFor(err)
+		resp.Error = err.Error()
+		resp.File, resp.Files, resp.Range = nil, nil, nil
+	}
+	if resp.Status == 0 {
+		resp.Status = packet.StatusOK
+	}
+	return resp.Send(s.conn)
+}
+
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		return packet.StatusInsufficientStorage
+	case errors.Is(err, storage.ErrForbidden):
+		return packet.StatusForbidden
+	case errors.Is(err, storage.ErrNotFound):
+		return packet.StatusNotFound
+	case errors.Is(err, storage.ErrBadPath):
+		return packet.StatusBadRequest
+	case errors.Is(err, storage.ErrConflict):
+		return packet.StatusConflict
+	case errors.Is(err, replica.ErrNotReplicated):
+		return packet.StatusServiceUnavailable
+	default:
+		return packet.StatusInternalError
+	}
+}
+
+// codeFor - code of the packet error the client gets for err
+func codeFor(err error) string {
+	switch {
+	case errors.Is(err, storage.ErrQuotaExceeded):
+		err = packet.ErrQuotaExceeded
+	case errors.Is(err, storage.ErrForbidden):
+		err = packet.ErrForbidden
+	case errors.Is(err, storage.ErrNotFound):
+		err = packet.ErrNotFound
+	case errors.Is(err, storage.ErrBadPath):
+		err = packet.ErrBadPath
+	case errors.Is(err, storage.ErrConflict):
+		err = packet.ErrConflict
+	case errors.Is(err, replica.ErrNotReplicated):
+		err = packet.ErrNotReplicated
+	}
+	return packet.ErrorCode(err)
+}
+
+func fileInfo(file *storage.File) *packet.FileInfo {
+	if file == nil {
+		return nil
+	}
+	info := &packet.FileInfo{
+		Path:     file.Path,
+		Hash:     file.Hash,
+		Size:     file.Size,
+		Mode:     file.Mode,
+		IsDir:    file.Mode.IsDir(),
+		Modified: file.Modified,
+		Version:  file.Version,
+	}
+	if !file.Expires.IsZero() {
+		expires := file.Expires
+		info.Expires = &expires
+	}
+	return info
+}
+
+func fileInfos(files []storage.File) []packet.FileInfo {
+	infos := make([]packet.FileInfo, 0, len(files))
+	for i := range files {
+		infos = append(infos, *fileInfo(&files[i]))
+	}
+	return infos
+}
+
+func versionInfos(filePath string, versions []storage.Version) []packet.FileInfo {
+	infos := make([]packet.FileInfo, 0, len(versions))
+	for _, version := range versions {
+		info := packet.FileInfo{
+			Path:     filePath,
+			Hash:     version.Hash,
+			Size:     version.Size,
+			Mode:     version.Mode,
+			Modified: version.Modified,
+			Version:  version.ID,
+			Current:  version.Current,
+		}
+		if !version.Expires.IsZero() {
+			expires := version.Expires
+			info.Expires = &expires
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
@@ -0,0 +1,222 @@
+package tcp
+
+import (
+	packet "EternalPacket"
+	"bytes"
+	"crypto/rand"
+	"eternalStorageServer/storage"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// сесія користувача user на локальному TCP з'єднанні, без TLS і
+// автентифікації, які перевіряються в packet
+func startSession(t *testing.T, l *ListenerTCP, user string) net.Conn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = l.serve(conn, user)
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = client.Close()
+		<-done
+	})
+	return client
+}
+
+func newTestListener(t *testing.T) (*ListenerTCP, *storage.Store) {
+	t.Helper()
+	store, err := storage.Open(t.TempDir())
+	require.NoError(t, err)
+	l, err := NewListenerTCP("", store, packet.Credentials{})
+	require.NoError(t, err)
+	l.logger.SetOutput(io.Discard)
+	return l, store
+}
+
+func dataPacket(name, data string) *packet.TCPPacket {
+	return &packet.TCPPacket{
+		MetaData: &packet.TCPPacketMetaData{FileName: name, Size: int64(len(data)), FileMode: 0o644},
+		Bytes:    []byte(data),
+	}
+}
+
+// Невідома операція отримує 501, а сесія продовжується
+func TestSessionUnknownOp(t *testing.T) {
+	l, _ := newTestListener(t)
+	conn := startSession(t, l, "alice")
+
+	req := &packet.Request{ID: 1, Op: "COPY", Path: "a.txt"}
+	require.NoError(t, req.Send(conn))
+	_, err := packet.ReadResponse(conn, req)
+	var respErr *packet.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	assert.Equal(t, packet.StatusNotImplemented, respErr.Status)
+
+	req = &packet.Request{ID: 2, Op: packet.OpList}
+	require.NoError(t, req.Send(conn))
+	resp, err := packet.ReadResponse(conn, req)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Files)
+}
+
+// Ім'я файлу від клієнта без шляху перевіряється до даних
+func TestSessionPutUnsafeName(t *testing.T) {
+	l, _ := newTestListener(t)
+	conn := startSession(t, l, "alice")
+
+	req := &packet.Request{ID: 1, Op: packet.OpPut}
+	require.NoError(t, req.Send(conn))
+	err := dataPacket("../escape.txt", "x").SendOverTCP(conn)
+	assert.ErrorIs(t, err, packet.ErrUnsafeName)
+	_, err = packet.ReadResponse(conn, req)
+	var respErr *packet.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	assert.Equal(t, packet.StatusBadRequest, respErr.Status)
+	assert.ErrorIs(t, err, packet.ErrUnsafeName)
+}
+
+// REPLICATE дозволено тільки користувачам з AllowReplication
+func TestSessionReplicate(t *testing.T) {
+	l, store := newTestListener(t)
+	l.AllowReplication("node1")
+
+	conn := startSession(t, l, "alice")
+	req := &packet.Request{ID: 1, Op: packet.OpReplicate, Namespace: "bob", Path: "a.txt"}
+	require.NoError(t, req.Send(conn))
+	var reject *packet.RejectError
+	require.ErrorAs(t, dataPacket("a.txt", "copy").SendOverTCP(conn), &reject)
+	assert.Equal(t, packet.StatusForbidden, reject.Status)
+	_, err := packet.ReadResponse(conn, req)
+	assert.ErrorIs(t, err, packet.ErrForbidden)
+
+	conn = startSession(t, l, "node1")
+	require.NoError(t, req.Send(conn))
+	require.NoError(t, dataPacket("a.txt", "copy").SendOverTCP(conn))
+	resp, err := packet.ReadResponse(conn, req)
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", resp.File.Path)
+
+	// репліка лежить у просторі bob, ніби її завантажив він сам
+	file, err := store.Stat("bob", "bob", "a.txt")
+	require.NoError(t, err)
+	assert.Equal(t, resp.File.Hash, file.Hash)
+}
+
+// RANGE повертає листи з доказами, які перевіряються коренем усього файлу
+func TestSessionRange(t *testing.T) {
+	l, store := newTestListener(t)
+	data := make([]byte, 3*packet.MerkleLeafSize+100)
+	_, err := rand.Read(data)
+	require.NoError(t, err)
+	_, err = store.Put("alice", "alice", "a.bin", bytes.NewReader(data), storage.PutOptions{Mode: 0o644})
+	require.NoError(t, err)
+	tree, err := packet.BuildMerkleTree(bytes.NewReader(data))
+	require.NoError(t, err)
+	conn := startSession(t, l, "alice")
+
+	// довжина округлюється до цілих листів
+	req := &packet.Request{ID: 1, Op: packet.OpRange, Path: "a.bin", Offset: packet.MerkleLeafSize, Length: packet.MerkleLeafSize + 10}
+	require.NoError(t, req.Send(conn))
+	resp, err := packet.ReadResponse(conn, req)
+	require.NoError(t, err)
+	assert.Equal(t, tree.Root(), resp.File.MerkleRoot)
+	assert.Equal(t, data[packet.MerkleLeafSize:2*packet.MerkleLeafSize], resp.Range.Data)
+	assert.NoError(t, packet.VerifyRange(tree.Root(), resp.Range))
+
+	req = &packet.Request{ID: 2, Op: packet.OpRange, Path: "a.bin", Offset: 2 * packet.MerkleLeafSize}
+	require.NoError(t, req.Send(conn))
+	resp, err = packet.ReadResponse(conn, req)
+	require.NoError(t, err)
+	assert.Equal(t, data[2*packet.MerkleLeafSize:], resp.Range.Data)
+	assert.NoError(t, packet.VerifyRange(tree.Root(), resp.Range))
+
+	// продовження з коренем іншого вмісту
+	req = &packet.Request{ID: 3, Op: packet.OpRange, Path: "a.bin", Offset: packet.MerkleLeafSize, Root: packet.NewMerkleTree(nil).Root()}
+	require.NoError(t, req.Send(conn))
+	_, err = packet.ReadResponse(conn, req)
+	assert.ErrorIs(t, err, packet.ErrConflict)
+
+	for i, offset := range []int64{10, 4 * packet.MerkleLeafSize} {
+		req = &packet.Request{ID: uint64(4 + i), Op: packet.OpRange, Path: "a.bin", Offset: offset}
+		require.NoError(t, req.Send(conn))
+		_, err = packet.ReadResponse(conn, req)
+		var respErr *packet.ResponseError
+		require.ErrorAs(t, err, &respErr)
+		assert.Equal(t, packet.StatusBadRequest, respErr.Status)
+	}
+}
+
+// LIST і VERSIONS сторінками: курсор продовжує з наступного запису
+func TestSessionPages(t *testing.T) {
+	l, store := newTestListener(t)
+	conn := startSession(t, l, "alice")
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		_, err := store.Put("alice", "alice", name, bytes.NewReader([]byte(name)), storage.PutOptions{Mode: 0o644})
+		require.NoError(t, err)
+	}
+	for i := range 3 {
+		_, err := store.Put("alice", "alice", "a.txt", bytes.NewReader([]byte{byte(i)}), storage.PutOptions{Mode: 0o644})
+		require.NoError(t, err)
+	}
+
+	var id uint64
+	pages := func(op, path string) [][]string {
+		t.Helper()
+		var got [][]string
+		req := &packet.Request{Op: op, Path: path, Limit: 2}
+		for {
+			id++
+			req.ID = id
+			require.NoError(t, req.Send(conn))
+			resp, err := packet.ReadResponse(conn, req)
+			require.NoError(t, err)
+			var page []string
+			for _, file := range resp.Files {
+				if op == packet.OpVersions {
+					page = append(page, fmt.Sprint(file.Version))
+				} else {
+					page = append(page, file.Path)
+				}
+			}
+			got = append(got, page)
+			if resp.Next == "" {
+				return got
+			}
+			req.Cursor = resp.Next
+		}
+	}
+	assert.Equal(t, [][]string{{"a.txt", "b.txt"}, {"c.txt"}}, pages(packet.OpList, ""))
+	assert.Equal(t, [][]string{{"4", "3"}, {"2", "1"}}, pages(packet.OpVersions, "a.txt"))
+
+	// без Limit - усе однією відповіддю, як чекають старі клієнти
+	req := &packet.Request{ID: 100, Op: packet.OpList}
+	require.NoError(t, req.Send(conn))
+	resp, err := packet.ReadResponse(conn, req)
+	require.NoError(t, err)
+	assert.Len(t, resp.Files, 3)
+	assert.Empty(t, resp.Next)
+
+	req = &packet.Request{ID: 101, Op: packet.OpVersions, Path: "a.txt", Cursor: "x", Limit: 2}
+	require.NoError(t, req.Send(conn))
+	_, err = packet.ReadResponse(conn, req)
+	var respErr *packet.ResponseError
+	require.ErrorAs(t, err, &respErr)
+	assert.Equal(t, packet.StatusBadRequest, respErr.Status)
+}